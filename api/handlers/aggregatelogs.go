@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+const (
+	// maxAggregateContainers bounds how many containers one aggregated log
+	// stream reads from
+	maxAggregateContainers = 50
+
+	// logReorderWindow is how long followed lines are held so lines from
+	// other containers with earlier timestamps can be sent before them
+	logReorderWindow = 500 * time.Millisecond
+)
+
+// AggregateLogs streams the logs of several containers, given as
+// containers (names or IDs, repeatable or comma separated) or as a compose
+// project, as server-sent "log" events carrying LogFrames. The last tail
+// lines (default 100) of every container are sent first, merged by
+// timestamp, followed by a "backlog_end" event; with follow (the default)
+// new lines keep coming, interleaved by timestamp within a short window.
+// since, until, stream, q, regex and level pick the lines as for a single
+// container's logs.
+func (h *ContainerHandler) AggregateLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tail, since, until, err := parseLogRange(query, "100")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	follow := query.Get("follow") != "false"
+
+	var refs []string
+	for _, v := range query["containers"] {
+		for _, ref := range strings.Split(v, ",") {
+			if ref = strings.TrimSpace(ref); ref != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	project := query.Get("project")
+	if (len(refs) == 0) == (project == "") {
+		http.Error(w, "Either containers or project is required", http.StatusBadRequest)
+		return
+	}
+
+	var slots map[string]logSlot
+	var ok bool
+	if project != "" {
+		slots, ok = h.projectLogSlots(w, r, project)
+	} else {
+		slots, ok = h.containerLogSlots(w, r, refs)
+	}
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	send := func(event string, data any) error {
+		payload, _ := json.Marshal(data)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return r.Context().Err()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	options := container.LogsOptions{
+		ShowStdout: filter.stdout,
+		ShowStderr: filter.stderr,
+		Timestamps: true,
+		Tail:       tail,
+		Since:      since,
+		Until:      until,
+	}
+	collect := func(slot logSlot, add func(apitypes.LogFrame)) func(stream, message string, ts time.Time) {
+		return func(stream, message string, ts time.Time) {
+			level, ok := filter.match(stream, message)
+			if !ok && stream != "error" {
+				return
+			}
+			frame := slot.frame(stream, message, ts)
+			frame.Level = level
+			add(frame)
+		}
+	}
+
+	// The backlog of every container is read in full, then merged
+	started := time.Now()
+	var (
+		mu      sync.Mutex
+		backlog []apitypes.LogFrame
+		wg      sync.WaitGroup
+	)
+	last := make(map[string]time.Time, len(slots))
+	for id, slot := range slots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts := readContainerLogs(ctx, h.client, id, options, time.Time{}, collect(slot, func(frame apitypes.LogFrame) {
+				mu.Lock()
+				backlog = append(backlog, frame)
+				mu.Unlock()
+			}))
+			mu.Lock()
+			last[id] = ts
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	sortLogFrames(backlog)
+	for _, frame := range backlog {
+		if send("log", frame) != nil {
+			return
+		}
+	}
+	if send("backlog_end", map[string]int{"containers": len(slots), "lines": len(backlog)}) != nil || !follow || until != "" {
+		return
+	}
+
+	// Followed lines are held for the reorder window and sent in timestamp
+	// order
+	lines := make(chan apitypes.LogFrame, 256)
+	options.Follow = true
+	for id, slot := range slots {
+		after := last[id]
+		if after.IsZero() {
+			after = started
+		}
+		go readContainerLogs(ctx, h.client, id, options, after, collect(slot, func(frame apitypes.LogFrame) {
+			select {
+			case lines <- frame:
+			case <-ctx.Done():
+			}
+		}))
+	}
+
+	tick := time.NewTicker(logReorderWindow / 5)
+	defer tick.Stop()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	var pending []apitypes.LogFrame
+	for {
+		select {
+		case frame := <-lines:
+			if frame.Timestamp.IsZero() {
+				frame.Timestamp = time.Now().UTC()
+			}
+			pending = append(pending, frame)
+		case <-tick.C:
+			sortLogFrames(pending)
+			cutoff := time.Now().Add(-logReorderWindow)
+			n := sort.Search(len(pending), func(i int) bool { return pending[i].Timestamp.After(cutoff) })
+			for _, frame := range pending[:n] {
+				if send("log", frame) != nil {
+					return
+				}
+			}
+			pending = append(pending[:0], pending[n:]...)
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// containerLogSlots resolves the named containers and gives each a color
+// index from its position among the sorted names. It answers the request
+// and reports false if one can't be used.
+func (h *ContainerHandler) containerLogSlots(w http.ResponseWriter, r *http.Request, refs []string) (map[string]logSlot, bool) {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	prefix := h.config.Get().NamePrefix
+	found := make(map[string]types.ContainerJSON)
+	for _, ref := range refs {
+		inspect, err := h.client.ContainerInspect(ctx, ref)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+				return nil, false
+			}
+			http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+			return nil, false
+		}
+		if !hasNamePrefix(inspect.Name, prefix) {
+			http.Error(w, fmt.Sprintf("Container %s is outside the %q name prefix", ref, prefix), http.StatusForbidden)
+			return nil, false
+		}
+		found[inspect.ID] = inspect
+	}
+	if len(found) > maxAggregateContainers {
+		http.Error(w, fmt.Sprintf("Too many containers: at most %d can be aggregated", maxAggregateContainers), http.StatusBadRequest)
+		return nil, false
+	}
+
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	name := func(id string) string { return strings.TrimPrefix(found[id].Name, "/") }
+	sort.Slice(ids, func(i, j int) bool { return name(ids[i]) < name(ids[j]) })
+
+	slots := make(map[string]logSlot, len(ids))
+	for color, id := range ids {
+		var labels map[string]string
+		if found[id].Config != nil {
+			labels = found[id].Config.Labels
+		}
+		index, ok := replicaNumber(labels)
+		if !ok {
+			index = 1
+		}
+		slots[id] = logSlot{service: labels["com.docker.compose.service"], container: name(id), index: index, colorIndex: color}
+	}
+	return slots, true
+}
+
+// projectLogSlots finds a compose project's containers and colors them by
+// service, as the project log stream does. It answers the request and
+// reports false if there are none.
+func (h *ContainerHandler) projectLogSlots(w http.ResponseWriter, r *http.Request, project string) (map[string]logSlot, bool) {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", project))
+	listed, err := h.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), failureStatus(err))
+		return nil, false
+	}
+	prefix := h.config.Get().NamePrefix
+	containers := listed[:0]
+	for _, c := range listed {
+		if listedWithPrefix(c, prefix) {
+			containers = append(containers, c)
+		}
+	}
+	if len(containers) == 0 {
+		http.Error(w, fmt.Sprintf("Project %s has no containers", project), http.StatusNotFound)
+		return nil, false
+	}
+	if len(containers) > maxAggregateContainers {
+		http.Error(w, fmt.Sprintf("Too many containers: at most %d can be aggregated", maxAggregateContainers), http.StatusBadRequest)
+		return nil, false
+	}
+	return assignLogSlots(containers, nil), true
+}
+
+// sortLogFrames orders frames by timestamp, keeping the order of lines with
+// the same timestamp
+func sortLogFrames(frames []apitypes.LogFrame) {
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Timestamp.Before(frames[j].Timestamp) })
+}
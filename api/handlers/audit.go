@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/audit"
+	"kibutsu/config"
+	"kibutsu/logging"
+)
+
+// auditErrorSize is how much of an error response is kept in the audit log
+const auditErrorSize = 512
+
+// auditCollectionActions are the second path segments that name an action
+// on a whole collection, as in /images/pull, rather than an object
+var auditCollectionActions = map[string]bool{
+	"prune": true, "pull": true, "build": true, "batch": true, "import": true,
+	"raw": true, "login": true, "logout": true, "reload": true, "check": true,
+	"batch-delete": true, "import-git": true, "test": true,
+}
+
+// AuditHandler records every state-changing API call in the audit store and
+// serves the record back
+type AuditHandler struct {
+	store *audit.Store
+}
+
+func NewAuditHandler(store *audit.Store) *AuditHandler {
+	return &AuditHandler{store: store}
+}
+
+// auditKey holds the flag recordAudit sets on a GET
+type auditKey struct{}
+
+// recordAudit keeps a GET in the audit store, which otherwise only records
+// requests that change state. Reads that reveal secrets or open a shell
+// call it.
+func recordAudit(r *http.Request) {
+	if flag, ok := r.Context().Value(auditKey{}).(*atomic.Bool); ok {
+		flag.Store(true)
+	}
+}
+
+// Record wraps the API router, appending an entry for each request that
+// isn't a GET, HEAD or OPTIONS once it has been served. A GET is recorded
+// only if its handler calls recordAudit.
+func (h *AuditHandler) Record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var flag *atomic.Bool
+		switch r.Method {
+		case http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		case http.MethodGet:
+			flag = new(atomic.Bool)
+			r = r.WithContext(context.WithValue(r.Context(), auditKey{}, flag))
+		}
+
+		start := time.Now()
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if flag != nil && !flag.Load() {
+			return
+		}
+
+		endpoint, resource, target, action := describeAuditTarget(r)
+		entry := apitypes.AuditEntry{
+			Time:       start.UTC(),
+			User:       requestUser(r),
+			Endpoint:   endpoint,
+			Resource:   resource,
+			Target:     target,
+			Action:     action,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+			Status:     rec.status,
+			Success:    rec.status < http.StatusBadRequest,
+			DurationMS: time.Since(start).Milliseconds(),
+			RequestID:  logging.RequestID(r.Context()),
+		}
+		if !entry.Success {
+			entry.Error = strings.TrimSpace(rec.body.String())
+		}
+		if err := h.store.Append(entry); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write audit entry", "error", err)
+		}
+	})
+}
+
+// ListAudit returns the audit entries, newest first. since and until take
+// an RFC 3339 time or a duration ago (24h); user, resource, target (a
+// prefix, so short container ids match), action and success narrow them.
+func (h *AuditHandler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{
+		User:     query.Get("user"),
+		Resource: query.Get("resource"),
+		Target:   query.Get("target"),
+		Action:   query.Get("action"),
+	}
+	for _, param := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(param.name); v != "" {
+			t, err := parseAuditTime(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: %v", param.name, err), http.StatusBadRequest)
+				return
+			}
+			*param.dst = t
+		}
+	}
+	if v := query.Get("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid success: must be true or false", http.StatusBadRequest)
+			return
+		}
+		filter.Success = &success
+	}
+
+	entries, err := h.store.Query(filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read audit log: %v", err), failureStatus(err))
+		return
+	}
+	writeList(w, params, entries)
+}
+
+// parseAuditTime reads an RFC 3339 time, or a duration counted back from now
+func parseAuditTime(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time or a duration")
+	}
+	return t, nil
+}
+
+// describeAuditTarget works out from an API path which endpoint, resource
+// and object a request acted on, and how. Image references may contain
+// slashes, so for images everything before a trailing tag or push is the
+// target.
+func describeAuditTarget(r *http.Request) (endpoint, resource, target, action string) {
+	path := strings.Trim(r.URL.Path, "/")
+	endpoint = r.URL.Query().Get("endpoint")
+	if rest, ok := strings.CutPrefix(path, "endpoints/"); ok {
+		endpoint, path, _ = strings.Cut(rest, "/")
+	}
+	if endpoint == "" {
+		endpoint = config.LocalEndpoint
+	}
+
+	parts := strings.Split(path, "/")
+	resource = parts[0]
+	if resource == "compose" && len(parts) > 1 && parts[1] == "projects" {
+		parts = parts[1:]
+	}
+
+	switch {
+	case len(parts) == 1:
+	case len(parts) == 2 && auditCollectionActions[parts[1]]:
+		action = parts[1]
+	case resource == "images":
+		parts = parts[1:]
+		if last := parts[len(parts)-1]; len(parts) > 1 && (last == "tag" || last == "push") {
+			action = last
+			parts = parts[:len(parts)-1]
+		}
+		target = strings.Join(parts, "/")
+	default:
+		target = parts[1]
+		action = strings.Join(parts[2:], "/")
+	}
+
+	if action == "" {
+		switch r.Method {
+		case http.MethodPost:
+			action = "create"
+		case http.MethodPut, http.MethodPatch:
+			action = "update"
+		case http.MethodDelete:
+			action = "remove"
+		default:
+			action = strings.ToLower(r.Method)
+		}
+	}
+	return endpoint, resource, target, action
+}
+
+// auditRecorder captures the status and the start of an error response.
+// Flush and Hijack pass through so streams and WebSocket upgrades work.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   strings.Builder
+}
+
+func (a *auditRecorder) WriteHeader(code int) {
+	a.status = code
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if a.status >= http.StatusBadRequest && a.body.Len() < auditErrorSize {
+		a.body.Write(p[:min(len(p), auditErrorSize-a.body.Len())])
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+func (a *auditRecorder) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *auditRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	a.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (a *auditRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"kibutsu/audit"
+)
+
+// GETs are kept in the audit store only when their handler asks
+func TestRecordKeepsAuditedGets(t *testing.T) {
+	store, err := audit.NewStore(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	handler := NewAuditHandler(store).Record(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("reveal") == "true" {
+			recordAudit(r)
+		}
+	}))
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/containers/abc/env", nil),
+		httptest.NewRequest(http.MethodGet, "/containers/abc/env?reveal=true", nil),
+		httptest.NewRequest(http.MethodPost, "/containers/abc/start", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries, err := store.Query(audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %+v", len(entries), entries)
+	}
+	actions := map[string]bool{}
+	for _, e := range entries {
+		actions[e.Method+" "+e.Action] = true
+	}
+	if !actions["GET env"] || !actions["POST start"] {
+		t.Errorf("recorded %v, want GET env and POST start", actions)
+	}
+}
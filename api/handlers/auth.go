@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/auth"
+)
+
+// AuthHandler serves login, logout and the current session. A nil
+// authenticator means authentication is disabled.
+type AuthHandler struct {
+	auth *auth.Authenticator
+}
+
+func NewAuthHandler(authenticator *auth.Authenticator) *AuthHandler {
+	return &AuthHandler{auth: authenticator}
+}
+
+// Login checks the posted credentials, sets the session cookie and returns
+// the session, including its token.
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.auth == nil {
+		http.Error(w, "Authentication is disabled; set KIBUTSU_USERS_FILE to enable it", http.StatusForbidden)
+		return
+	}
+
+	var req apitypes.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.auth.Login(req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			auditLog(r, "Login failed", "username", req.Username)
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to log in: %v", err), failureStatus(err))
+		return
+	}
+	auditLog(r, "Login succeeded", "username", session.Username)
+
+	auth.SetCookie(w, r, session)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apitypes.AuthSession{
+		Enabled:   true,
+		Username:  session.Username,
+		ExpiresAt: &session.ExpiresAt,
+		Token:     session.Token,
+	})
+}
+
+// Logout ends the caller's session and clears the cookie
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.auth != nil {
+		h.auth.Logout(r)
+	}
+	auth.ClearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSession reports whether authentication is enabled and who the caller
+// is logged in as. It is reachable without a session so the UI can decide
+// whether to show the login form.
+func (h *AuthHandler) GetSession(w http.ResponseWriter, r *http.Request) {
+	response := apitypes.AuthSession{Enabled: h.auth != nil}
+	if h.auth != nil {
+		if session, ok := h.auth.Authenticate(r); ok {
+			response.Username = session.Username
+			response.ExpiresAt = &session.ExpiresAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/backups"
+	"kibutsu/config"
+	"kibutsu/docker"
+	"kibutsu/objectstore"
+)
+
+// BackupHandler keeps backups of one endpoint's volumes and compose
+// projects in the object storage bucket or the backup directory, under the
+// endpoint's name
+type BackupHandler struct {
+	client   *client.Client
+	config   *config.Store
+	endpoint string
+	compose  *ComposeHandler
+}
+
+func NewBackupHandler(client *client.Client, cfg *config.Store, endpoint string, compose *ComposeHandler) *BackupHandler {
+	return &BackupHandler{client: client, config: cfg, endpoint: endpoint, compose: compose}
+}
+
+// store returns the endpoint's backups, or nil when neither a bucket nor a
+// backup directory is configured. The bucket takes precedence.
+func (h *BackupHandler) store() *backups.Store {
+	cfg := h.config.Get()
+	if cfg.ObjectStorage != nil {
+		return backups.NewBucketStore(objectstore.New(cfg.ObjectStorage), "backups/"+h.endpoint)
+	}
+	if cfg.BackupDir == "" {
+		return nil
+	}
+	return backups.NewStore(filepath.Join(cfg.BackupDir, h.endpoint))
+}
+
+// enabledStore returns the endpoint's backups, writing a 403 when no
+// storage is configured
+func (h *BackupHandler) enabledStore(w http.ResponseWriter) (*backups.Store, bool) {
+	store := h.store()
+	if store == nil {
+		http.Error(w, "Backups are disabled; set KIBUTSU_S3_BUCKET or KIBUTSU_BACKUP_DIR to enable them", http.StatusForbidden)
+	}
+	return store, store != nil
+}
+
+// create takes a backup of a volume or a compose project
+func (h *BackupHandler) create(ctx context.Context, kind, name string) (apitypes.Backup, error) {
+	store := h.store()
+	if store == nil {
+		return apitypes.Backup{}, errors.New("backups are disabled; set KIBUTSU_S3_BUCKET or KIBUTSU_BACKUP_DIR to enable them")
+	}
+	helperImage := h.config.Get().VolumeHelperImage
+
+	if kind == backups.KindVolume {
+		return store.Create(ctx, kind, name, func(w io.Writer) error {
+			return docker.BackupVolume(ctx, h.client, name, helperImage, w)
+		})
+	}
+
+	if !docker.ValidProjectName(name) {
+		return apitypes.Backup{}, fmt.Errorf("invalid project name %q", name)
+	}
+	composeConfig, err := h.compose.loadComposeFile(name)
+	if err != nil {
+		return apitypes.Backup{}, fmt.Errorf("failed to load compose file: %w", err)
+	}
+	dir := h.compose.projectDir(name)
+	files, err := docker.BundleFiles(dir, composeConfig)
+	if err != nil {
+		return apitypes.Backup{}, fmt.Errorf("failed to collect project files: %w", err)
+	}
+	return store.Create(ctx, kind, name, func(w io.Writer) error {
+		return docker.BackupProject(ctx, h.client, helperImage, w, dir, name, files, docker.ProjectVolumes(composeConfig))
+	})
+}
+
+// prune removes the oldest backups of kind and name beyond keep
+func (h *BackupHandler) prune(ctx context.Context, kind, name string, keep int) ([]apitypes.Backup, error) {
+	store := h.store()
+	if store == nil {
+		return nil, nil
+	}
+	return store.Prune(ctx, kind, name, keep)
+}
+
+// backupID returns the backup ID in the path, below /backups/ and before
+// any /restore
+func backupID(r *http.Request) string {
+	return strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/backups/"), "/restore")
+}
+
+// ListBackups returns the kept backups, newest first, narrowed by kind
+// (volume or compose) and name
+func (h *BackupHandler) ListBackups(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, ok := h.enabledStore(w)
+	if !ok {
+		return
+	}
+	kind, name := r.URL.Query().Get("kind"), r.URL.Query().Get("name")
+	if kind != "" && !backups.ValidKind(kind) {
+		http.Error(w, "Invalid kind: must be volume or compose", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+	list, err := store.List(ctx, kind, name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list backups: %v", err), failureStatus(err))
+		return
+	}
+	writeList(w, params, list)
+}
+
+// CreateBackup takes a backup of a volume or a compose project now. A
+// compose backup holds the project's files and every named volume its
+// services mount.
+func (h *BackupHandler) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.BackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := backups.Validate(req.Kind, req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.enabledStore(w); !ok {
+		return
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	backup, err := h.create(ctx, req.Kind, req.Name)
+	if err != nil {
+		if client.IsErrNotFound(err) || errors.Is(err, os.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("No %s named %s: %v", req.Kind, req.Name, err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to back up %s: %v", req.Kind, err), http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "Backup taken", "backup", backup.ID, "size", backup.Size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backup)
+}
+
+// DownloadBackup streams a kept backup
+func (h *BackupHandler) DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	store, ok := h.enabledStore(w)
+	if !ok {
+		return
+	}
+	rc, backup, err := store.Open(r.Context(), backupID(r))
+	if err != nil {
+		writeBackupError(w, "open", err)
+		return
+	}
+	defer rc.Close()
+
+	// A large backup takes longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	name := fmt.Sprintf("%s-%s-%s", backup.Kind, backup.Name, backup.Created.Format(backupTimeFormat))
+	if backup.Kind == backups.KindVolume {
+		w.Header().Set("Content-Type", "application/gzip")
+		name += ".tar.gz"
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		name += ".tar"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	copyDownload(w, r, rc, "Failed to download backup", "backup", backup.ID)
+}
+
+// DeleteBackup removes a kept backup
+func (h *BackupHandler) DeleteBackup(w http.ResponseWriter, r *http.Request) {
+	store, ok := h.enabledStore(w)
+	if !ok {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+	id := backupID(r)
+	if err := store.Delete(ctx, id); err != nil {
+		writeBackupError(w, "remove", err)
+		return
+	}
+	auditLog(r, "Backup removed", "backup", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RestoreBackup puts a kept backup back. A volume backup empties and
+// refills the volume, or the one named by volume=. A compose backup does
+// the same for each of the project's volumes, and registers the project's
+// files again if the project no longer exists. Containers using the
+// volumes keep running, so stop them first for a consistent restore.
+func (h *BackupHandler) RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	store, ok := h.enabledStore(w)
+	if !ok {
+		return
+	}
+	cfg := h.config.Get()
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	rc, backup, err := store.Open(ctx, backupID(r))
+	if err != nil {
+		writeBackupError(w, "open", err)
+		return
+	}
+	defer rc.Close()
+
+	var result *apitypes.BackupRestoreResult
+	if backup.Kind == backups.KindVolume {
+		volume := backup.Name
+		if v := r.URL.Query().Get("volume"); v != "" {
+			volume = v
+		}
+		err = docker.RestoreVolume(ctx, h.client, volume, cfg.VolumeHelperImage, rc, true)
+		result = &apitypes.BackupRestoreResult{Volumes: []string{volume}}
+	} else {
+		result, err = docker.RestoreProject(ctx, h.client, cfg.VolumeHelperImage, rc, cfg.ComposeDir, backup.Name)
+	}
+	if err != nil {
+		auditLog(r, "Backup restore failed", "backup", backup.ID, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to restore backup: %v", err), failureStatus(err))
+		return
+	}
+	result.Backup = backup.ID
+	auditLog(r, "Backup restored", "backup", backup.ID, "volumes", strings.Join(result.Volumes, ","), "files", result.Files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeBackupError reports a failure to reach a kept backup
+func writeBackupError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, backups.ErrNotFound) {
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to %s backup: %v", action, err), http.StatusInternalServerError)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// linuxCapabilities are the capability names the kernel defines, without
+// the CAP_ prefix
+var linuxCapabilities = map[string]bool{
+	"CHOWN": true, "DAC_OVERRIDE": true, "DAC_READ_SEARCH": true, "FOWNER": true,
+	"FSETID": true, "KILL": true, "SETGID": true, "SETUID": true,
+	"SETPCAP": true, "LINUX_IMMUTABLE": true, "NET_BIND_SERVICE": true, "NET_BROADCAST": true,
+	"NET_ADMIN": true, "NET_RAW": true, "IPC_LOCK": true, "IPC_OWNER": true,
+	"SYS_MODULE": true, "SYS_RAWIO": true, "SYS_CHROOT": true, "SYS_PTRACE": true,
+	"SYS_PACCT": true, "SYS_ADMIN": true, "SYS_BOOT": true, "SYS_NICE": true,
+	"SYS_RESOURCE": true, "SYS_TIME": true, "SYS_TTY_CONFIG": true, "MKNOD": true,
+	"LEASE": true, "AUDIT_WRITE": true, "AUDIT_CONTROL": true, "SETFCAP": true,
+	"MAC_OVERRIDE": true, "MAC_ADMIN": true, "SYSLOG": true, "WAKE_ALARM": true,
+	"BLOCK_SUSPEND": true, "AUDIT_READ": true, "PERFMON": true, "BPF": true,
+	"CHECKPOINT_RESTORE": true,
+}
+
+// normalizeCapabilities validates capability names, accepted in any case
+// with or without the CAP_ prefix, and returns them in the CAP_NAME form
+// the daemon reports. ALL is accepted as well.
+func normalizeCapabilities(caps []string) ([]string, error) {
+	result := make([]string, 0, len(caps))
+	for _, c := range caps {
+		name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+		if name == "ALL" {
+			result = append(result, name)
+			continue
+		}
+		if !linuxCapabilities[name] {
+			return nil, fmt.Errorf("unknown capability %q", c)
+		}
+		result = append(result, "CAP_"+name)
+	}
+	return result, nil
+}
@@ -2,54 +2,80 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"gopkg.in/yaml.v3"
 
 	apitypes "kibutsu/api/types"
+	"kibutsu/config"
 	"kibutsu/docker"
 )
 
 type ComposeHandler struct {
-	client *client.Client
+	client  *client.Client
+	config  *config.Store
+	history *deploymentHistory
+
+	// registryAuth holds registry logins for image pulls; nil if none are
+	// set up
+	registryAuth docker.RegistryAuth
 }
 
-func NewComposeHandler(client *client.Client) *ComposeHandler {
-	return &ComposeHandler{client: client}
+func NewComposeHandler(client *client.Client, cfg *config.Store, registryAuth docker.RegistryAuth) *ComposeHandler {
+	return &ComposeHandler{client: client, config: cfg, history: newDeploymentHistory(), registryAuth: registryAuth}
 }
 
+// ListProjects lists compose projects sorted by name, each with its
+// containers. With envelope=false the page is returned as the older map of
+// project name to containers.
 func (h *ComposeHandler) ListProjects(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
 	// Filter containers with compose label
 	f := filters.NewArgs()
 	f.Add("label", "com.docker.compose.project")
 
-	containers, err := h.client.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: f,
+	containers, err := retryRead(ctx, h.config, func(ctx context.Context) ([]types.Container, error) {
+		return h.client.ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: f,
+		})
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list compose projects: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list compose projects: %v", err), failureStatus(err))
 		return
 	}
 
 	// Group containers by project
+	prefix := h.config.Get().NamePrefix
 	projects := make(map[string][]apitypes.ContainerResponse)
 	for _, c := range containers {
 		projectName := c.Labels["com.docker.compose.project"]
-		if projectName == "" {
+		if projectName == "" || !listedWithPrefix(c, prefix) {
 			continue
 		}
 
@@ -68,13 +94,30 @@ func (h *ComposeHandler) ListProjects(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(projects)
+	names := sortedKeys(projects)
+	if !params.envelope {
+		legacy := make(map[string][]apitypes.ContainerResponse)
+		for _, name := range page(names, params) {
+			legacy[name] = projects[name]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(names)))
+		json.NewEncoder(w).Encode(legacy)
+		return
+	}
+
+	items := make([]apitypes.ProjectContainers, 0, len(names))
+	for _, name := range names {
+		items = append(items, apitypes.ProjectContainers{Name: name, Containers: projects[name]})
+	}
+	writeList(w, params, items)
 }
 
 func (h *ComposeHandler) GetProject(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
 
 	config, err := h.loadComposeFile(name)
 	if err != nil {
@@ -87,8 +130,10 @@ func (h *ComposeHandler) GetProject(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *ComposeHandler) ProjectUp(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
 
 	config, err := h.loadComposeFile(name)
 	if err != nil {
@@ -96,24 +141,248 @@ func (h *ComposeHandler) ProjectUp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	ctx, cancel := longContext(w, r, h.config)
 	defer cancel()
 
-	if err := h.startProject(ctx, name, config); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to start project: %v", err), http.StatusInternalServerError)
+	images := make(map[string]string, len(config.Services))
+	for service, spec := range config.Services {
+		images[service] = spec.Image
+	}
+	record := func(err error) {
+		rec := apitypes.DeploymentRecord{Action: "up", Success: err == nil, Images: images}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		h.recordDeployment(r, name, rec)
+	}
+
+	if WantsProgress(r) {
+		send := progressWriter(w)
+		result, err := h.startProject(ctx, name, config, send)
+		record(err)
+		if result == nil {
+			result = &apitypes.ComposeResult{Operation: "up", Succeeded: []string{}, Failed: []string{}, Skipped: []string{}}
+		}
+		done := apitypes.ComposeProgress{Status: "done", Result: result}
+		if err != nil {
+			done.Error = err.Error()
+		}
+		send(done)
+		return
+	}
+
+	_, err = h.startProject(ctx, name, config, nil)
+	record(err)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start project: %v", err), failureStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// WantsProgress reports whether the client asked for NDJSON progress instead
+// of a single response, via ?stream=true or the Accept header.
+func WantsProgress(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "true" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// progressWriter starts an NDJSON response and returns a func that writes
+// and flushes one progress line.
+func progressWriter(w http.ResponseWriter) func(apitypes.ComposeProgress) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	return func(msg apitypes.ComposeProgress) {
+		encoder.Encode(msg)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
 func (h *ComposeHandler) ProjectDown(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	timeout, source, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	send := func(apitypes.ComposeProgress) {}
+	if WantsProgress(r) {
+		send = progressWriter(w)
+	}
+
+	slog.InfoContext(r.Context(), "Stopping project containers", "project", name, "timeout", timeout, "source", source)
+	result, images, err := h.stopProject(ctx, name, timeout, send)
+	if err != nil {
+		if WantsProgress(r) {
+			send(apitypes.ComposeProgress{Status: "error", Error: err.Error()})
+			return
+		}
+		var outside *outsidePrefixError
+		if errors.As(err, &outside) {
+			http.Error(w, fmt.Sprintf("Cannot stop project %s: %v", name, err), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), failureStatus(err))
+		return
+	}
+
+	rec := apitypes.DeploymentRecord{Action: "down", Success: result.Success, Images: images}
+	if !result.Success {
+		rec.Error = fmt.Sprintf("failed to stop services: %s", strings.Join(result.Failed, ", "))
+	}
+	h.recordDeployment(r, name, rec)
+
+	if WantsProgress(r) {
+		send(apitypes.ComposeProgress{Status: "done", Result: result})
+		return
+	}
+	if !result.Success {
+		http.Error(w, fmt.Sprintf("Failed to stop services: %s", strings.Join(result.Failed, ", ")), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ProjectPull pulls the images of a project's services, like docker
+// compose pull. ?services= (comma-separated or repeated) limits it to
+// some services.
+func (h *ComposeHandler) ProjectPull(w http.ResponseWriter, r *http.Request) {
+	h.projectAction(w, r, "pull")
+}
+
+// ProjectRestart restarts a project's containers without recreating them,
+// like docker compose restart. ?services= limits it to some services and
+// timeout overrides the graceful stop timeout.
+func (h *ComposeHandler) ProjectRestart(w http.ResponseWriter, r *http.Request) {
+	h.projectAction(w, r, "restart")
+}
+
+// ServiceAction starts, stops or restarts the containers of one service,
+// at /compose/projects/{project}/services/{service}/{action}, leaving the
+// rest of the project alone. Stopped containers are kept; start creates
+// them if the service has none.
+func (h *ComposeHandler) ServiceAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/projects/"), "/")
+	if len(parts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	h.projectAction(w, r, parts[3])
+}
+
+// projectAction runs pull, start, stop or restart on the selected services
+// of a project, streaming progress with stream=true and recording it in the
+// history. The services are the one named in the path, if any, or else
+// those given with ?services=.
+func (h *ComposeHandler) projectAction(w http.ResponseWriter, r *http.Request, action string) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/projects/"), "/")
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	config, err := h.loadComposeFile(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		return
+	}
+	var services []string
+	if len(parts) > 2 && parts[1] == "services" {
+		if _, ok := config.Services[parts[2]]; !ok {
+			http.Error(w, fmt.Sprintf("Service %s not found in project %s", parts[2], name), http.StatusNotFound)
+			return
+		}
+		services = []string{parts[2]}
+	}
+	for _, v := range r.URL.Query()["services"] {
+		for _, service := range strings.Split(v, ",") {
+			if service = strings.TrimSpace(service); service == "" {
+				continue
+			}
+			if _, ok := config.Services[service]; !ok {
+				http.Error(w, fmt.Sprintf("Unknown service %q in project %s", service, name), http.StatusBadRequest)
+				return
+			}
+			services = append(services, service)
+		}
+	}
+	timeout, _, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	composeProject, err := docker.NewComposeProject(h.client, name, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), failureStatus(err))
+		return
+	}
+	composeProject.StopTimeout = timeout
+	composeProject.RegistryMirror = h.config.Get().RegistryMirror
+	composeProject.RegistryAuth = h.registryAuth
+	if WantsProgress(r) {
+		composeProject.Progress = progressWriter(w)
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
 	defer cancel()
 
+	var result *apitypes.ComposeResult
+	switch action {
+	case "pull":
+		result, err = composeProject.Pull(ctx, services...)
+	case "start":
+		result, err = composeProject.Start(ctx, services...)
+	case "stop":
+		result, err = composeProject.Stop(ctx, services...)
+	default:
+		result, err = composeProject.Restart(ctx, services...)
+	}
+
+	rec := apitypes.DeploymentRecord{Action: action, Services: services, Success: err == nil, Images: map[string]string{}}
+	for _, service := range result.Succeeded {
+		rec.Images[service] = config.Services[service].Image
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.recordDeployment(r, name, rec)
+
+	if WantsProgress(r) {
+		done := apitypes.ComposeProgress{Status: "done", Result: result}
+		if err != nil {
+			done.Error = err.Error()
+		}
+		composeProject.Progress(done)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s project: %v", action, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// stopProject stops and removes every container of a project, reporting
+// progress to send. It returns the per-service result and each service's
+// image; the error is only set if the containers could not be listed or
+// one of them is outside the name prefix, in which case none are touched.
+func (h *ComposeHandler) stopProject(ctx context.Context, name string, timeout int, send func(apitypes.ComposeProgress)) (*apitypes.ComposeResult, map[string]string, error) {
 	f := filters.NewArgs()
 	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", name))
 
@@ -122,26 +391,85 @@ func (h *ComposeHandler) ProjectDown(w http.ResponseWriter, r *http.Request) {
 		Filters: f,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), http.StatusInternalServerError)
-		return
+		return nil, nil, err
+	}
+	if err := checkPrefix(containers, h.config.Get().NamePrefix); err != nil {
+		return nil, nil, err
 	}
 
+	// A service counts as failed if any of its containers could not be
+	// stopped and removed; the rest are still attempted.
+	failed := make(map[string]bool)
+	seen := make(map[string]bool)
+	images := make(map[string]string)
+	var services []string
 	for _, c := range containers {
-		timeout := 30
+		service := c.Labels["com.docker.compose.service"]
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+			images[service] = c.Image
+		}
+		containerName := c.ID[:12]
+		if len(c.Names) > 0 {
+			containerName = strings.TrimPrefix(c.Names[0], "/")
+		}
+
+		send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "stopping"})
 		if err := h.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: &timeout}); err != nil {
+			failed[service] = true
+			send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "error", Error: fmt.Sprintf("Failed to stop: %v", err)})
 			continue
 		}
+		send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "stopped"})
+
+		send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "removing"})
 		if err := h.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			failed[service] = true
+			send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "error", Error: fmt.Sprintf("Failed to remove: %v", err)})
 			continue
 		}
+		send(apitypes.ComposeProgress{Service: service, Container: containerName, Status: "removed"})
 	}
 
-	w.WriteHeader(http.StatusOK)
+	result := &apitypes.ComposeResult{Operation: "down", Succeeded: []string{}, Failed: []string{}, Skipped: []string{}}
+	for _, service := range services {
+		if failed[service] {
+			result.Failed = append(result.Failed, service)
+		} else {
+			result.Succeeded = append(result.Succeeded, service)
+		}
+	}
+	result.Success = len(result.Failed) == 0
+	return result, images, nil
 }
 
 func (h *ComposeHandler) ListServices(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config, err := h.loadComposeFile(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		return
+	}
+
+	writeList(w, params, sortedKeys(config.Services))
+}
+
+func (h *ComposeHandler) GetProjectGraph(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
 
 	config, err := h.loadComposeFile(name)
 	if err != nil {
@@ -149,20 +477,35 @@ func (h *ComposeHandler) ListServices(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	services := make([]string, 0, len(config.Services))
-	for service := range config.Services {
-		services = append(services, service)
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	composeProject, err := docker.NewComposeProject(h.client, name, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), failureStatus(err))
+		return
+	}
+
+	graph, err := composeProject.Graph(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to build service graph: %v", err), failureStatus(err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(services)
+	json.NewEncoder(w).Encode(graph)
 }
 
+// GetProjectLogs returns the recent logs of every container in a project as
+// plain text, or as NDJSON LogFrames with stream=true (or an ndjson Accept
+// header), where follow=true keeps the stream open.
 func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
 	f := filters.NewArgs()
@@ -173,7 +516,16 @@ func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request)
 		Filters: f,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), failureStatus(err))
+		return
+	}
+	if err := checkPrefix(containers, h.config.Get().NamePrefix); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read project %s logs: %v", name, err), http.StatusForbidden)
+		return
+	}
+
+	if WantsProgress(r) {
+		h.streamProjectLogs(w, r, name, containers)
 		return
 	}
 
@@ -190,8 +542,12 @@ func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request)
 			Timestamps: true,
 		}
 
-		logs, err := h.client.ContainerLogs(ctx, c.ID, options)
+		logs, err := openContainerLogs(ctx, h.client, c.ID, options)
 		if err != nil {
+			var unavailable *logsUnavailableError
+			if errors.As(err, &unavailable) {
+				fmt.Fprintf(w, "%s\n\n", logsUnavailableMessage(err))
+			}
 			continue
 		}
 		io.Copy(w, logs)
@@ -201,13 +557,16 @@ func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ComposeHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/compose/projects/"), "/")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/projects/"), "/")
 	if len(parts) < 4 {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	projectName := parts[0]
+	projectName, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
 	serviceName := parts[2]
 
 	var scaleReq struct {
@@ -218,19 +577,379 @@ func (h *ComposeHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	ctx, cancel := longContext(w, r, h.config)
 	defer cancel()
 
-	if err := h.scaleService(ctx, projectName, serviceName, scaleReq.Replicas); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to scale service: %v", err), http.StatusInternalServerError)
+	err := h.scaleService(ctx, projectName, serviceName, scaleReq.Replicas)
+
+	rec := apitypes.DeploymentRecord{Action: "scale", Service: serviceName, Replicas: scaleReq.Replicas, Success: err == nil}
+	if config, loadErr := h.loadComposeFile(projectName); loadErr == nil {
+		if spec, ok := config.Services[serviceName]; ok {
+			rec.Images = map[string]string{serviceName: spec.Image}
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.recordDeployment(r, projectName, rec)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to scale service: %v", err), failureStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// RunService starts a one-off container from a service definition. Detached
+// runs return the container at once; attached runs stream its output as
+// NDJSON and finish with the exit code.
+func (h *ComposeHandler) RunService(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/projects/"), "/")
+	if len(parts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	projectName, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+	serviceName := parts[2]
+
+	var runReq apitypes.ComposeRunRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&runReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	config, err := h.loadComposeFile(projectName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		return
+	}
+	if _, ok := config.Services[serviceName]; !ok {
+		http.Error(w, fmt.Sprintf("Service %s not found in project %s", serviceName, projectName), http.StatusNotFound)
+		return
+	}
+
+	project, err := docker.NewComposeProject(h.client, projectName, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), failureStatus(err))
+		return
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	id, name, err := project.CreateOneOff(ctx, serviceName, runReq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run service: %v", err), failureStatus(err))
+		return
+	}
+
+	if runReq.Detach {
+		if err := h.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+			h.client.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+			http.Error(w, fmt.Sprintf("Failed to start container: %v", err), failureStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(apitypes.ComposeRunResponse{ID: id, Name: name})
+		return
+	}
+
+	if runReq.Remove {
+		defer func() {
+			// The request context may already be done if the client left.
+			rmCtx, rmCancel := context.WithTimeout(context.Background(), h.config.Get().DockerWriteTimeout)
+			defer rmCancel()
+			if err := h.client.ContainerRemove(rmCtx, id, container.RemoveOptions{Force: true}); err != nil {
+				slog.WarnContext(r.Context(), "Failed to remove one-off container", "container", name, "error", err)
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(msg apitypes.RunOutput) {
+		encoder.Encode(msg)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send(apitypes.RunOutput{ID: id})
+
+	// Attach and wait before starting so no output or exit is missed.
+	attach, err := h.client.ContainerAttach(ctx, id, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		send(apitypes.RunOutput{Error: fmt.Sprintf("Failed to attach to container: %v", err)})
+		return
+	}
+	defer attach.Close()
+	waitCh, errCh := h.client.ContainerWait(ctx, id, container.WaitConditionNextExit)
+
+	if err := h.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		send(apitypes.RunOutput{Error: fmt.Sprintf("Failed to start container: %v", err)})
+		return
+	}
+
+	stdcopy.StdCopy(
+		runOutputWriter{stream: "stdout", send: send},
+		runOutputWriter{stream: "stderr", send: send},
+		attach.Reader,
+	)
+
+	select {
+	case result := <-waitCh:
+		exitCode := result.StatusCode
+		msg := apitypes.RunOutput{ExitCode: &exitCode}
+		if result.Error != nil {
+			msg.Error = result.Error.Message
+		}
+		send(msg)
+	case err := <-errCh:
+		send(apitypes.RunOutput{Error: fmt.Sprintf("Failed to wait for container: %v", err)})
+	}
+}
+
+// runOutputWriter turns demultiplexed container output into RunOutput lines
+type runOutputWriter struct {
+	stream string
+	send   func(apitypes.RunOutput)
+}
+
+func (w runOutputWriter) Write(p []byte) (int, error) {
+	w.send(apitypes.RunOutput{Stream: w.stream, Data: string(p)})
+	return len(p), nil
+}
+
+// ExportProject streams the project's compose file, .env and bind-mounted
+// local files as a tar.gz bundle that ImportProject accepts.
+func (h *ComposeHandler) ExportProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	config, err := h.loadComposeFile(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		return
+	}
+
+	dir := h.projectDir(name)
+	files, err := docker.BundleFiles(dir, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to collect project files: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	if err := docker.WriteBundle(w, dir, name, files); err != nil {
+		downloadFailed(r, err, "Failed to export project", "project", name)
+	}
+}
+
+// ImportProject registers a project from a tar.gz bundle sent as the request
+// body. The project takes the bundle's name unless ?name= is given.
+func (h *ComposeHandler) ImportProject(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, docker.MaxBundleSize)
+
+	result, err := docker.ImportBundle(body, h.config.Get().ComposeDir, r.URL.Query().Get("name"))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, docker.ErrProjectExists):
+			http.Error(w, fmt.Sprintf("Failed to import project: %v", err), http.StatusConflict)
+		case errors.Is(err, docker.ErrInvalidBundle), errors.As(err, &maxErr):
+			http.Error(w, fmt.Sprintf("Failed to import project: %v", err), http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to import project: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// CreateProject registers a new project from a compose file, sent either
+// as JSON ({"name", "compose"}) or as a multipart form with a name field and
+// a file field. The file is validated before anything is written.
+func (h *ComposeHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, docker.MaxComposeFileSize+64<<10)
+
+	var req apitypes.ComposeProjectCreateRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(docker.MaxComposeFileSize); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form: %v", err), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Missing compose file: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, docker.MaxComposeFileSize+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read compose file: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Name = r.FormValue("name")
+		req.Compose = string(data)
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Compose) > docker.MaxComposeFileSize {
+		http.Error(w, fmt.Sprintf("Compose file exceeds %d bytes", docker.MaxComposeFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	config, err := docker.CreateProject(h.config.Get().ComposeDir, req.Name, []byte(req.Compose))
+	if err != nil {
+		switch {
+		case errors.Is(err, docker.ErrProjectExists):
+			http.Error(w, fmt.Sprintf("Failed to create project: %v", err), http.StatusConflict)
+		case errors.Is(err, docker.ErrInvalidComposeFile):
+			http.Error(w, fmt.Sprintf("Failed to create project: %v", err), http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to create project: %v", err), failureStatus(err))
+		}
+		return
+	}
+	auditLog(r, "Compose project created", "project", req.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apitypes.ComposeProjectCreated{Project: req.Name, Services: sortedKeys(config.Services)})
+}
+
+// GetComposeFile returns a project's compose file as it is on disk. The
+// ETag header carries its checksum for PutComposeFile's If-Match.
+func (h *ComposeHandler) GetComposeFile(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(h.projectDir(name), "docker-compose.yml"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read compose file: %v", err), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("ETag", strconv.Quote(composeChecksum(data)))
+	w.Write(data)
+}
+
+// PutComposeFile replaces a project's compose file with the YAML in the
+// request body and reports which services were added, removed or changed.
+// The file must pass the same validation as a new project. With
+// ?dryRun=true nothing is saved. An If-Match header must match the current
+// file's ETag, so concurrent edits aren't lost.
+func (h *ComposeHandler) PutComposeFile(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	dir := h.projectDir(name)
+	current, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read compose file: %v", err), http.StatusNotFound)
+		return
+	}
+	// A sync would overwrite the edit; change the repository instead
+	if _, err := docker.LoadGitSource(h.config.Get().ComposeDir, name); err == nil {
+		http.Error(w, fmt.Sprintf("Project %s is synced from git; commit the change to its repository and sync", name), http.StatusConflict)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != strconv.Quote(composeChecksum(current)) {
+		http.Error(w, "Compose file was changed since it was read", http.StatusPreconditionFailed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, docker.MaxComposeFileSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Compose file exceeds %d bytes", docker.MaxComposeFileSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	next, err := docker.ParseComposeFile(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update compose file: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The current file may not pass today's validation; diff against
+	// whatever services it does define
+	var old apitypes.ComposeConfig
+	yaml.Unmarshal(current, &old)
+	added, removed, changed := docker.DiffServices(&old, next)
+	change := apitypes.ComposeFileChange{
+		Project:  name,
+		Added:    added,
+		Removed:  removed,
+		Changed:  changed,
+		Checksum: composeChecksum(data),
+	}
+
+	if r.URL.Query().Get("dryRun") != "true" {
+		if err := docker.WriteComposeFile(dir, data); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save compose file: %v", err), failureStatus(err))
+			return
+		}
+		change.Saved = true
+		auditLog(r, "Compose file updated", "project", name, "added", added, "removed", removed, "changed", len(changed))
+		w.Header().Set("ETag", strconv.Quote(change.Checksum))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+func composeChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pathProject returns the project named in the request's path, answering
+// 400 unless it is a valid project name, so a name such as .. can't reach
+// outside the compose directory
+func pathProject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/projects/"), "/")[0]
+	if !docker.ValidProjectName(name) {
+		http.Error(w, fmt.Sprintf("Invalid project name %q", name), http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// projectDir is the directory holding a project's compose file
+func (h *ComposeHandler) projectDir(project string) string {
+	return filepath.Join(h.config.Get().ComposeDir, project)
+}
+
 func (h *ComposeHandler) loadComposeFile(project string) (*apitypes.ComposeConfig, error) {
-	path := filepath.Join("compose", project, "docker-compose.yml")
+	if !docker.ValidProjectName(project) {
+		return nil, fmt.Errorf("invalid project name %q", project)
+	}
+	path := filepath.Join(h.projectDir(project), "docker-compose.yml")
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -244,17 +963,21 @@ func (h *ComposeHandler) loadComposeFile(project string) (*apitypes.ComposeConfi
 	return &config, nil
 }
 
-func (h *ComposeHandler) startProject(ctx context.Context, project string, config *apitypes.ComposeConfig) error {
+func (h *ComposeHandler) startProject(ctx context.Context, project string, config *apitypes.ComposeConfig, progress func(apitypes.ComposeProgress)) (*apitypes.ComposeResult, error) {
 	composeProject, err := docker.NewComposeProject(h.client, project, config)
 	if err != nil {
-		return fmt.Errorf("failed to create compose project: %w", err)
+		return nil, fmt.Errorf("failed to create compose project: %w", err)
 	}
+	composeProject.Progress = progress
+	composeProject.RegistryMirror = h.config.Get().RegistryMirror
+	composeProject.RegistryAuth = h.registryAuth
 
-	if err := composeProject.Up(ctx); err != nil {
-		return fmt.Errorf("failed to start project: %w", err)
+	result, err := composeProject.Up(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to start project: %w", err)
 	}
 
-	return nil
+	return result, nil
 }
 
 func (h *ComposeHandler) scaleService(ctx context.Context, project, service string, replicas int) error {
@@ -267,6 +990,7 @@ func (h *ComposeHandler) scaleService(ctx context.Context, project, service stri
 	if err != nil {
 		return fmt.Errorf("failed to create compose project: %w", err)
 	}
+	composeProject.StopTimeout = int(h.config.Get().StopTimeout.Seconds())
 
 	if err := composeProject.Scale(ctx, service, replicas); err != nil {
 		return fmt.Errorf("failed to scale service: %w", err)
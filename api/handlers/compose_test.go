@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kibutsu/config"
+)
+
+// newTestComposeHandler returns a handler whose compose directory sits in a
+// temporary directory that also holds a compose file of its own, as a
+// target for requests that escape the compose directory
+func newTestComposeHandler(t *testing.T) (*ComposeHandler, string) {
+	t.Helper()
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "docker-compose.yml")
+	if err := os.WriteFile(outside, []byte("services:\n  web:\n    image: nginx\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	composeDir := filepath.Join(parent, "projects")
+	if err := os.Mkdir(composeDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewStore(&config.Config{ComposeDir: composeDir}, config.Options{})
+	return NewComposeHandler(nil, cfg, nil), outside
+}
+
+func TestComposeFileRejectsParentProject(t *testing.T) {
+	h, outside := newTestComposeHandler(t)
+
+	w := httptest.NewRecorder()
+	h.GetComposeFile(w, httptest.NewRequest(http.MethodGet, "/compose/projects/%2E%2E/file", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+
+	body := "services:\n  evil:\n    image: busybox\n"
+	w = httptest.NewRecorder()
+	h.PutComposeFile(w, httptest.NewRequest(http.MethodPut, "/compose/projects/%2E%2E/file", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if data, _ := os.ReadFile(outside); strings.Contains(string(data), "evil") {
+		t.Error("PUT overwrote the compose file outside the compose directory")
+	}
+}
+
+func TestExportProjectRejectsParentProject(t *testing.T) {
+	h, _ := newTestComposeHandler(t)
+
+	w := httptest.NewRecorder()
+	h.ExportProject(w, httptest.NewRequest(http.MethodGet, "/compose/projects/%2E%2E/export", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// The batch endpoint takes the same project names as the per-project routes
+func TestBatchProjectsRejectsInvalidNames(t *testing.T) {
+	h, _ := newTestComposeHandler(t)
+
+	for _, name := range []string{"..", "Web", "my app", ".hidden", "a/b"} {
+		body := `{"action":"down","projects":["` + name + `"]}`
+		w := httptest.NewRecorder()
+		h.BatchProjects(w, httptest.NewRequest(http.MethodPost, "/compose/batch", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid project name") {
+			t.Errorf("%q: status = %d, want %d: %s", name, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
+
+func TestComposeProjectsHonorNamePrefix(t *testing.T) {
+	cfg := config.NewStore(&config.Config{NamePrefix: "t", DockerReadTimeout: 5 * time.Second, DockerWriteTimeout: 5 * time.Second, DockerLongTimeout: 5 * time.Second}, config.Options{})
+	h := NewComposeHandler(listDaemon(t), cfg, nil)
+
+	w := httptest.NewRecorder()
+	h.ListProjects(w, httptest.NewRequest(http.MethodGet, "/compose/projects", nil))
+	var env struct {
+		Items []struct{ Name string } `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	var names []string
+	for _, p := range env.Items {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "beta,gamma" {
+		t.Errorf("projects = %v, want beta and gamma, whose containers are within the prefix", names)
+	}
+
+	// listDaemon answers every project's listing with all its containers,
+	// including one outside the prefix
+	for _, tt := range []struct {
+		method, path string
+		handle       http.HandlerFunc
+	}{
+		{http.MethodGet, "/compose/projects/beta/logs", h.GetProjectLogs},
+		{http.MethodPost, "/compose/projects/beta/down", h.ProjectDown},
+	} {
+		w := httptest.NewRecorder()
+		tt.handle(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d: %s", tt.method, tt.path, w.Code, http.StatusForbidden, w.Body)
+		}
+	}
+}
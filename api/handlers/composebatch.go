@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+const (
+	defaultBatchConcurrency = 4
+	maxBatchConcurrency     = 16
+)
+
+// BatchProjects applies up, down or pull to several projects at once, a
+// bounded number at a time. A failing project does not stop the others;
+// the response reports each one. With stream=true progress lines carry the
+// project name and the last line holds the batch result.
+func (h *ComposeHandler) BatchProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apitypes.ComposeBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case "up", "down", "pull":
+	default:
+		http.Error(w, fmt.Sprintf("Invalid action %q: must be up, down or pull", req.Action), http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency < 0 || req.Concurrency > maxBatchConcurrency {
+		http.Error(w, fmt.Sprintf("Invalid concurrency %d: must be between 1 and %d", req.Concurrency, maxBatchConcurrency), http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = defaultBatchConcurrency
+	}
+	timeout, _, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	projects := req.Projects.Names
+	if req.Projects.All {
+		ctx, cancel := readContext(r, h.config)
+		projects, err = h.batchTargets(ctx, req.Action)
+		cancel()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list compose projects: %v", err), failureStatus(err))
+			return
+		}
+	} else {
+		if len(projects) == 0 {
+			http.Error(w, `No projects given: pass a list of names or "all"`, http.StatusBadRequest)
+			return
+		}
+		for _, name := range projects {
+			if !docker.ValidProjectName(name) {
+				http.Error(w, fmt.Sprintf("Invalid project name %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// progressWriter is not safe for concurrent use
+	var mu sync.Mutex
+	send := func(apitypes.ComposeProgress) {}
+	if WantsProgress(r) {
+		write := progressWriter(w)
+		send = func(msg apitypes.ComposeProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			write(msg)
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Running compose batch", "action", req.Action, "projects", len(projects), "concurrency", req.Concurrency)
+	batch := &apitypes.ComposeBatchResult{
+		Action:   req.Action,
+		Success:  true,
+		Projects: make([]apitypes.ComposeBatchProjectResult, len(projects)),
+	}
+	sem := make(chan struct{}, req.Concurrency)
+	var wg sync.WaitGroup
+	for i, name := range projects {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			projectSend := func(msg apitypes.ComposeProgress) {
+				msg.Project = name
+				send(msg)
+			}
+			result := h.batchProject(w, r, req.Action, name, timeout, projectSend)
+			done := apitypes.ComposeProgress{Status: "done", Result: result.Result, Error: result.Error}
+			projectSend(done)
+			batch.Projects[i] = result
+		}(i, name)
+	}
+	wg.Wait()
+
+	for _, result := range batch.Projects {
+		batch.Success = batch.Success && result.Success
+	}
+
+	if WantsProgress(r) {
+		send(apitypes.ComposeProgress{Status: "done", Batch: batch})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// batchProject runs one project's part of a batch and records it in the
+// project's deployment history.
+func (h *ComposeHandler) batchProject(w http.ResponseWriter, r *http.Request, action, name string, timeout int, send func(apitypes.ComposeProgress)) apitypes.ComposeBatchProjectResult {
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	rec := apitypes.DeploymentRecord{Action: action}
+	var result *apitypes.ComposeResult
+	var err error
+	switch action {
+	case "down":
+		result, rec.Images, err = h.stopProject(ctx, name, timeout, send)
+		if err == nil && !result.Success {
+			err = fmt.Errorf("failed to stop services: %s", strings.Join(result.Failed, ", "))
+		}
+	default:
+		var config *apitypes.ComposeConfig
+		config, err = h.loadComposeFile(name)
+		if err != nil {
+			err = fmt.Errorf("failed to load compose file: %w", err)
+			break
+		}
+		rec.Images = make(map[string]string, len(config.Services))
+		for service, spec := range config.Services {
+			rec.Images[service] = spec.Image
+		}
+		if action == "up" {
+			result, err = h.startProject(ctx, name, config, send)
+		} else {
+			result, err = h.pullProject(ctx, name, config, send)
+		}
+	}
+
+	rec.Success = err == nil
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.recordDeployment(r, name, rec)
+
+	return apitypes.ComposeBatchProjectResult{Project: name, Success: rec.Success, Error: rec.Error, Result: result}
+}
+
+// batchTargets resolves "all" for a batch action: projects with a compose
+// file for up and pull, and projects with containers for down.
+func (h *ComposeHandler) batchTargets(ctx context.Context, action string) ([]string, error) {
+	if action != "down" {
+		root := h.config.Get().ComposeDir
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return []string{}, nil
+			}
+			return nil, err
+		}
+		var names []string
+		for _, entry := range entries {
+			// Projects imported from git are symlinks into their clone
+			if !entry.IsDir() && entry.Type()&fs.ModeSymlink == 0 {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(root, entry.Name(), "docker-compose.yml")); err == nil {
+				names = append(names, entry.Name())
+			}
+		}
+		return names, nil
+	}
+
+	f := filters.NewArgs()
+	f.Add("label", "com.docker.compose.project")
+	containers, err := retryRead(ctx, h.config, func(ctx context.Context) ([]types.Container, error) {
+		return h.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, c := range containers {
+		if name := c.Labels["com.docker.compose.project"]; name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pullProject pulls the images of every service in a project
+func (h *ComposeHandler) pullProject(ctx context.Context, project string, config *apitypes.ComposeConfig, progress func(apitypes.ComposeProgress)) (*apitypes.ComposeResult, error) {
+	composeProject, err := docker.NewComposeProject(h.client, project, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compose project: %w", err)
+	}
+	composeProject.Progress = progress
+	composeProject.RegistryMirror = h.config.Get().RegistryMirror
+	composeProject.RegistryAuth = h.registryAuth
+
+	return composeProject.Pull(ctx)
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// ImportGitProject registers a project from a Git repository. The
+// repository is cloned into the compose directory and the compose file at
+// the given path is validated before the project is created; nothing is
+// deployed until the project is brought up or synced.
+func (h *ComposeHandler) ImportGitProject(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.ComposeGitImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cfg := h.config.Get()
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+	source, config, err := docker.ImportGitProject(ctx, cfg.ComposeDir, cfg.SecretKey, req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to import project: %v", err), gitErrorStatus(err))
+		return
+	}
+	auditLog(r, "Compose project imported from git", "project", req.Name, "url", req.URL, "branch", req.Branch, "commit", source.Commit)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apitypes.ComposeProjectCreated{Project: req.Name, Services: sortedKeys(config.Services), Git: source})
+}
+
+// GetGitSource returns the repository, branch and commit a Git-backed
+// project is synced from
+func (h *ComposeHandler) GetGitSource(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	source, err := docker.LoadGitSource(h.config.Get().ComposeDir, name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load git source: %v", err), gitErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(source)
+}
+
+// SyncProject pulls the latest commit of a Git-backed project and, if it
+// changed, takes the project down and up again with the new compose file.
+// ?force=true redeploys even when the commit is unchanged; ?deploy=false
+// only updates the checkout. Local edits to tracked files are overwritten.
+func (h *ComposeHandler) SyncProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	deploy, force := query.Get("deploy") != "false", query.Get("force") == "true"
+	timeout, _, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg := h.config.Get()
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+	source, previous, config, err := docker.SyncGitProject(ctx, cfg.ComposeDir, name, cfg.SecretKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to sync project: %v", err), gitErrorStatus(err))
+		return
+	}
+
+	sync := apitypes.ComposeSyncResult{
+		Project:        name,
+		PreviousCommit: previous,
+		Commit:         source.Commit,
+		Changed:        source.Commit != previous,
+	}
+	auditLog(r, "Compose project synced from git", "project", name, "previous", previous, "commit", source.Commit)
+
+	if deploy && (sync.Changed || force) {
+		sync.Deployed = true
+		var send func(apitypes.ComposeProgress)
+		if WantsProgress(r) {
+			send = progressWriter(w)
+		} else {
+			send = func(apitypes.ComposeProgress) {}
+		}
+
+		rec := apitypes.DeploymentRecord{Action: "sync"}
+		if _, _, err = h.stopProject(ctx, name, timeout, send); err == nil {
+			sync.Result, err = h.startProject(ctx, name, config, send)
+		}
+		if sync.Result != nil {
+			rec.Images = make(map[string]string, len(sync.Result.Succeeded))
+			for _, service := range sync.Result.Succeeded {
+				rec.Images[service] = config.Services[service].Image
+			}
+		}
+		rec.Success = err == nil
+		if err != nil {
+			sync.Error = err.Error()
+			rec.Error = err.Error()
+			slog.ErrorContext(r.Context(), "Failed to redeploy synced project", "project", name, "commit", source.Commit, "error", err)
+		}
+		h.recordDeployment(r, name, rec)
+
+		if WantsProgress(r) {
+			send(apitypes.ComposeProgress{Status: "done", Result: sync.Result, Error: sync.Error})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if sync.Error != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(sync)
+}
+
+// gitErrorStatus maps errors from importing or syncing a Git-backed project
+// to a response status
+func gitErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, docker.ErrProjectExists):
+		return http.StatusConflict
+	case errors.Is(err, docker.ErrNotGitProject):
+		return http.StatusNotFound
+	case errors.Is(err, docker.ErrInvalidGitSource), errors.Is(err, docker.ErrInvalidComposeFile):
+		return http.StatusBadRequest
+	case errors.Is(err, docker.ErrGitFailed):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// confirmTokenTTL is how long a destructive-operation token stays valid.
+const confirmTokenTTL = 60 * time.Second
+
+type confirmToken struct {
+	target    string
+	expiresAt time.Time
+}
+
+// confirmStore issues short-lived, single-use tokens that must be presented
+// to confirm a destructive operation against a specific target.
+type confirmStore struct {
+	mu     sync.Mutex
+	tokens map[string]confirmToken
+}
+
+func newConfirmStore() *confirmStore {
+	return &confirmStore{tokens: make(map[string]confirmToken)}
+}
+
+// Issue creates a token bound to target and returns it with its expiry.
+func (s *confirmStore) Issue(target string) (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for token, t := range s.tokens {
+		if now.After(t.expiresAt) {
+			delete(s.tokens, token)
+		}
+	}
+
+	token := uuid.New().String()
+	expiresAt := now.Add(confirmTokenTTL)
+	s.tokens[token] = confirmToken{target: target, expiresAt: expiresAt}
+	return token, expiresAt
+}
+
+// Consume reports whether token is valid for target. A token can only be
+// consumed once, whether or not it matched.
+func (s *confirmStore) Consume(token, target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(s.tokens, token)
+
+	return t.target == target && time.Now().Before(t.expiresAt)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxBatchContainers caps the containers one batch request may name
+const maxBatchContainers = 500
+
+// BatchContainers applies start, stop, restart or remove to several
+// containers at once, a bounded number at a time. A failing container does
+// not stop the others; each gets its own result with the status the
+// single-container endpoint would have answered, so containers outside the
+// name prefix or without a confirmation token fail on their own.
+func (h *ContainerHandler) BatchContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apitypes.ContainerBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case "start", "stop", "restart", "remove":
+	default:
+		http.Error(w, fmt.Sprintf("Invalid action %q: must be start, stop, restart or remove", req.Action), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "No containers given", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBatchContainers {
+		http.Error(w, fmt.Sprintf("Too many containers: at most %d per batch", maxBatchContainers), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id == "" || seen[id] {
+			http.Error(w, fmt.Sprintf("Invalid container id %q: ids must be non-empty and unique", id), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+	if req.Concurrency < 0 || req.Concurrency > maxBatchConcurrency {
+		http.Error(w, fmt.Sprintf("Invalid concurrency %d: must be between 1 and %d", req.Concurrency, maxBatchConcurrency), http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = defaultBatchConcurrency
+	}
+	timeout, _, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Running container batch", "action", req.Action, "containers", len(req.IDs), "concurrency", req.Concurrency)
+	batch := &apitypes.ContainerBatchResult{
+		Action:     req.Action,
+		Containers: make([]apitypes.ContainerBatchItemResult, len(req.IDs)),
+	}
+	sem := make(chan struct{}, req.Concurrency)
+	var wg sync.WaitGroup
+	for i, id := range req.IDs {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			batch.Containers[i] = h.batchContainer(w, r, req, id, timeout)
+		}(i, id)
+	}
+	wg.Wait()
+
+	for _, result := range batch.Containers {
+		if result.Success {
+			batch.Succeeded++
+		} else {
+			batch.Failed++
+		}
+	}
+	batch.Success = batch.Failed == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// batchContainer runs one container's part of a batch, with the same checks
+// as the single-container endpoint
+func (h *ContainerHandler) batchContainer(w http.ResponseWriter, r *http.Request, req apitypes.ContainerBatchRequest, id string, timeout int) apitypes.ContainerBatchItemResult {
+	result := apitypes.ContainerBatchItemResult{ID: id}
+	fail := func(status int, format string, args ...any) apitypes.ContainerBatchItemResult {
+		result.Status, result.Error = status, fmt.Sprintf(format, args...)
+		return result
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	cancel()
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return fail(http.StatusNotFound, "Container not found: %v", err)
+		}
+		return fail(http.StatusInternalServerError, "Failed to inspect container: %v", err)
+	}
+	result.Name = strings.TrimPrefix(inspect.Name, "/")
+	if prefix := h.config.Get().NamePrefix; prefix != "" && !hasNamePrefix(inspect.Name, prefix) {
+		return fail(http.StatusForbidden, "Container %s is outside the %q name prefix", id, prefix)
+	}
+
+	switch req.Action {
+	case "start":
+		ctx, cancel := writeContext(w, r, h.config)
+		defer cancel()
+		if conflict := h.findPortConflict(ctx, inspect.ID); conflict != "" {
+			return fail(http.StatusConflict, "%s", conflict)
+		}
+		err = h.client.ContainerStart(ctx, inspect.ID, container.StartOptions{})
+
+	case "stop", "restart":
+		ctx, cancel := stopContext(w, r, h.config, timeout)
+		defer cancel()
+		options := container.StopOptions{Timeout: &timeout}
+		if req.Action == "stop" {
+			err = h.client.ContainerStop(ctx, inspect.ID, options)
+		} else {
+			err = h.client.ContainerRestart(ctx, inspect.ID, options)
+		}
+
+	case "remove":
+		if h.confirmRemove {
+			token := req.Tokens[id]
+			if token == "" {
+				token = req.Tokens[inspect.ID]
+			}
+			if !h.confirmations.Consume(token, inspect.ID) {
+				return fail(http.StatusPreconditionRequired, "Missing, expired or invalid confirmation token; request one from /remove-preview")
+			}
+		}
+		ctx, cancel := writeContext(w, r, h.config)
+		defer cancel()
+		err = h.client.ContainerRemove(ctx, inspect.ID, container.RemoveOptions{Force: req.Force, RemoveVolumes: req.Volumes})
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case client.IsErrNotFound(err):
+			status = http.StatusNotFound
+		case errdefs.IsConflict(err):
+			status = http.StatusConflict
+		}
+		return fail(status, "Failed to %s container: %v", req.Action, err)
+	}
+
+	result.Success, result.Status = true, http.StatusOK
+	return result
+}
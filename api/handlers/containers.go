@@ -1,20 +1,44 @@
 package handlers
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	timetypes "github.com/docker/docker/api/types/time"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
 
 	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
 )
 
 type ContainerResponse struct {
@@ -28,29 +52,152 @@ type ContainerResponse struct {
 	Mounts   []apitypes.MountInfo   `json:"mounts"`
 }
 
+// Limits for commands run through RunExec
+const (
+	defaultExecTimeout = 30 * time.Second
+	maxExecTimeout     = 5 * time.Minute
+	maxExecOutput      = 1 << 20 // bytes of output kept
+	maxExecStdin       = 1 << 20 // bytes of stdin accepted
+)
+
+// containerSizeTTL is how long a computed container size is served from cache
+const containerSizeTTL = 60 * time.Second
+
+// maxBindMountEntries caps the files and directories walked to measure one
+// bind mount, so a mount of / or a huge tree can't tie up the request
+const maxBindMountEntries = 100000
+
+// errWalkLimit stops a walk that reached maxBindMountEntries
+var errWalkLimit = errors.New("too many entries")
+
 type ContainerHandler struct {
-	client *client.Client
+	client        *client.Client
+	config        *config.Store
+	confirmRemove bool
+	confirmations *confirmStore
+
+	// registryAuth holds registry logins for the pulls of a recreate; nil
+	// if none are set up
+	registryAuth docker.RegistryAuth
+
+	sizeMu sync.Mutex
+	sizes  map[string]apitypes.ContainerSize
+}
+
+func NewContainerHandler(client *client.Client, cfg *config.Store) *ContainerHandler {
+	return &ContainerHandler{
+		client:        client,
+		config:        cfg,
+		confirmations: newConfirmStore(),
+		sizes:         make(map[string]apitypes.ContainerSize),
+	}
+}
+
+// UseRegistryAuth sets the registry logins used to pull images when
+// recreating containers
+func (h *ContainerHandler) UseRegistryAuth(auth docker.RegistryAuth) {
+	h.registryAuth = auth
 }
 
-func NewContainerHandler(client *client.Client) *ContainerHandler {
-	return &ContainerHandler{client: client}
+// RequireRemoveConfirmation makes RemoveContainer reject requests that don't
+// carry a token obtained from RemoveContainerPreview.
+func (h *ContainerHandler) RequireRemoveConfirmation(required bool) {
+	h.confirmRemove = required
 }
 
+// ListContainers lists all containers. The optional status, name and label
+// query parameters are passed to Docker as filters; health (healthy,
+// unhealthy, starting or none) is applied afterwards from each container's
+// inspect data, since older daemons cannot filter on it. sort (name, image,
+// state or created) and order (asc or desc) arrange the list before it is
+// paged, and only the containers on the page are inspected unless health
+// needs them all.
 func (h *ContainerHandler) ListContainers(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	f := filters.NewArgs()
+	if status := query.Get("status"); status != "" {
+		if !validContainerStatuses[status] {
+			http.Error(w, fmt.Sprintf("Invalid status %q: must be one of created, restarting, running, removing, paused, exited or dead", status), http.StatusBadRequest)
+			return
+		}
+		f.Add("status", status)
+	}
+	if name := query.Get("name"); name != "" {
+		f.Add("name", name)
+	}
+	for _, label := range query["label"] {
+		if key, _, _ := strings.Cut(label, "="); key == "" {
+			http.Error(w, fmt.Sprintf("Invalid label %q: must be key or key=value", label), http.StatusBadRequest)
+			return
+		}
+		f.Add("label", label)
+	}
+	health := query.Get("health")
+	if health != "" && !validHealthStates[health] {
+		http.Error(w, fmt.Sprintf("Invalid health %q: must be one of healthy, unhealthy, starting or none", health), http.StatusBadRequest)
+		return
+	}
+	sortBy := query.Get("sort")
+	if _, ok := containerSortFields[sortBy]; sortBy != "" && !ok {
+		http.Error(w, fmt.Sprintf("Invalid sort %q: must be one of name, image, state or created", sortBy), http.StatusBadRequest)
+		return
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		http.Error(w, fmt.Sprintf("Invalid order %q: must be asc or desc", order), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true})
+	containers, err := retryRead(ctx, h.config, func(ctx context.Context) ([]types.Container, error) {
+		return h.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), failureStatus(err))
 		return
 	}
 
-	response := make([]apitypes.ContainerResponse, 0, len(containers))
+	prefix := h.config.Get().NamePrefix
+	listed := make([]types.Container, 0, len(containers))
 	for _, c := range containers {
-		inspect, err := h.client.ContainerInspect(ctx, c.ID)
-		if err != nil {
-			continue
+		if listedWithPrefix(c, prefix) {
+			listed = append(listed, c)
+		}
+	}
+	if sortBy != "" {
+		sortContainers(listed, sortBy, order == "desc")
+	}
+
+	inspected := make(map[string]types.ContainerJSON)
+	if health != "" {
+		matched := listed[:0]
+		for _, c := range listed {
+			inspect, err := h.client.ContainerInspect(ctx, c.ID)
+			if err != nil || healthStatus(inspect) != health {
+				continue
+			}
+			inspected[c.ID] = inspect
+			matched = append(matched, c)
+		}
+		listed = matched
+	}
+
+	pageItems := page(listed, params)
+	response := make([]apitypes.ContainerResponse, 0, len(pageItems))
+	for _, c := range pageItems {
+		inspect, ok := inspected[c.ID]
+		if !ok {
+			if inspect, err = h.client.ContainerInspect(ctx, c.ID); err != nil {
+				continue
+			}
 		}
 
 		created, err := time.Parse(time.RFC3339Nano, inspect.Created)
@@ -63,10 +210,230 @@ func (h *ContainerHandler) ListContainers(w http.ResponseWriter, r *http.Request
 			Name:     strings.TrimPrefix(inspect.Name, "/"),
 			Image:    c.Image,
 			Status:   c.Status,
+			State:    c.State,
+			Health:   healthStatus(inspect),
 			Created:  created,
 			Ports:    convertPorts(c.Ports),
 			Networks: convertNetworks(inspect.NetworkSettings.Networks),
 			Mounts:   convertMounts(inspect.Mounts),
+
+			FailingStreak: failingStreak(inspect),
+		})
+	}
+
+	writeListPage(w, params, response, len(listed))
+}
+
+// containerSortFields compare listed containers by each field ListContainers
+// can sort on, in ascending order
+var containerSortFields = map[string]func(a, b types.Container) int{
+	"name":    func(a, b types.Container) int { return strings.Compare(listedName(a), listedName(b)) },
+	"image":   func(a, b types.Container) int { return strings.Compare(a.Image, b.Image) },
+	"state":   func(a, b types.Container) int { return strings.Compare(a.State, b.State) },
+	"created": func(a, b types.Container) int { return cmp.Compare(a.Created, b.Created) },
+}
+
+// sortContainers orders containers by field, breaking ties by name
+func sortContainers(containers []types.Container, field string, desc bool) {
+	compare := containerSortFields[field]
+	slices.SortStableFunc(containers, func(a, b types.Container) int {
+		c := compare(a, b)
+		if c == 0 {
+			c = strings.Compare(listedName(a), listedName(b))
+		}
+		if desc {
+			return -c
+		}
+		return c
+	})
+}
+
+func (h *ContainerHandler) CreateContainer(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.CreateContainerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			http.Error(w, fmt.Sprintf("Invalid request body: %s must be a %s", typeErr.Field, typeErr.Type), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	h.createContainer(w, r, req)
+}
+
+// createContainer validates a create request, then creates and optionally
+// starts the container, answering 201 with its ID
+func (h *ContainerHandler) createContainer(w http.ResponseWriter, r *http.Request, req apitypes.CreateContainerRequest) {
+	if req.Image == "" {
+		http.Error(w, "Image is required", http.StatusBadRequest)
+		return
+	}
+	if prefix := h.config.Get().NamePrefix; prefix != "" {
+		if req.Name == "" {
+			req.Name = prefix + uuid.New().String()[:8]
+		} else if !hasNamePrefix(req.Name, prefix) {
+			req.Name = prefix + strings.TrimPrefix(req.Name, "/")
+		}
+	}
+	if req.CPUs < 0 || req.Memory < 0 {
+		http.Error(w, "cpus and memory must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var limits config.ResourcePreset
+	if req.Preset != "" {
+		presets := h.config.Get().ResourcePresets
+		preset, ok := presets[req.Preset]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown preset %q: available presets are %s", req.Preset, strings.Join(sortedKeys(presets), ", ")), http.StatusBadRequest)
+			return
+		}
+		limits = preset
+	}
+	if req.CPUs > 0 {
+		limits.CPUs = req.CPUs
+	}
+	if req.Memory > 0 {
+		limits.Memory = req.Memory
+	}
+
+	deviceRequests, err := convertDeviceRequests(req.DeviceRequests)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid device request: %v", err), http.StatusBadRequest)
+		return
+	}
+	devices, err := convertDeviceMappings(req.Devices)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid device mapping: %v", err), http.StatusBadRequest)
+		return
+	}
+	ulimits, err := convertUlimits(req.Ulimits)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ulimit: %v", err), http.StatusBadRequest)
+		return
+	}
+	capAdd, err := normalizeCapabilities(req.CapAdd)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid capAdd: %v", err), http.StatusBadRequest)
+		return
+	}
+	capDrop, err := normalizeCapabilities(req.CapDrop)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid capDrop: %v", err), http.StatusBadRequest)
+		return
+	}
+	exposedPorts, portBindings, err := convertPortBindings(req.Ports)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid port: %v", err), http.StatusBadRequest)
+		return
+	}
+	mounts, err := convertMountRequests(req.Mounts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid mount: %v", err), http.StatusBadRequest)
+		return
+	}
+	var restartPolicy container.RestartPolicy
+	if req.RestartPolicy != nil {
+		restartPolicy = container.RestartPolicy{
+			Name:              container.RestartPolicyMode(req.RestartPolicy.Name),
+			MaximumRetryCount: req.RestartPolicy.MaximumRetryCount,
+		}
+		if err := container.ValidateRestartPolicy(restartPolicy); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid restart policy: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	for key := range req.Sysctls {
+		if key == "" || strings.ContainsAny(key, " =") {
+			http.Error(w, fmt.Sprintf("Invalid sysctl name %q", key), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	deviceWarning, err := h.checkDeviceDrivers(ctx, deviceRequests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := &container.Config{
+		Image:        req.Image,
+		Cmd:          req.Cmd,
+		Entrypoint:   req.Entrypoint,
+		Env:          req.Env,
+		Labels:       req.Labels,
+		ExposedPorts: exposedPorts,
+		WorkingDir:   req.WorkingDir,
+		User:         req.User,
+		Hostname:     req.Hostname,
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode:   container.NetworkMode(req.Network),
+		Init:          req.Init,
+		Sysctls:       req.Sysctls,
+		CapAdd:        capAdd,
+		CapDrop:       capDrop,
+		PortBindings:  portBindings,
+		Mounts:        mounts,
+		RestartPolicy: restartPolicy,
+		Resources: container.Resources{
+			NanoCPUs:       int64(limits.CPUs * 1e9),
+			Memory:         limits.Memory,
+			DeviceRequests: deviceRequests,
+			Devices:        devices,
+			Ulimits:        ulimits,
+		},
+	}
+
+	created, err := h.client.ContainerCreate(ctx, config, hostConfig, nil, nil, req.Name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Image not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to create container: %v", err), failureStatus(err))
+		return
+	}
+
+	response := apitypes.CreateContainerResponse{
+		ID:       created.ID,
+		Warnings: created.Warnings,
+	}
+	if deviceWarning != "" {
+		response.Warnings = append(response.Warnings, deviceWarning)
+	}
+
+	if req.Start {
+		if conflict := h.findPortConflict(ctx, created.ID); conflict != "" {
+			http.Error(w, fmt.Sprintf("Container %s created but not started: %s", created.ID, conflict), http.StatusConflict)
+			return
+		}
+		if err := h.client.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			http.Error(w, fmt.Sprintf("Container %s created but failed to start: %v", created.ID, err), http.StatusInternalServerError)
+			return
+		}
+		response.Started = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListResourcePresets returns the resource presets containers can be
+// created with, sorted by name
+func (h *ContainerHandler) ListResourcePresets(w http.ResponseWriter, r *http.Request) {
+	presets := h.config.Get().ResourcePresets
+	response := make([]apitypes.ResourcePreset, 0, len(presets))
+	for _, name := range sortedKeys(presets) {
+		response = append(response, apitypes.ResourcePreset{
+			Name:   name,
+			CPUs:   presets[name].CPUs,
+			Memory: presets[name].Memory,
 		})
 	}
 
@@ -74,14 +441,133 @@ func (h *ContainerHandler) ListContainers(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(response)
 }
 
+// findPortConflict checks the host ports a container binds against the ports
+// already published by running containers and describes the first clash.
+// It returns an empty string when there is no conflict or it can't tell, in
+// which case the daemon's own error is left to report the problem.
+func (h *ContainerHandler) findPortConflict(ctx context.Context, id string) string {
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil || inspect.HostConfig == nil || inspect.State.Running {
+		return ""
+	}
+	if len(inspect.HostConfig.PortBindings) == 0 {
+		return ""
+	}
+
+	running, err := h.client.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return ""
+	}
+
+	for port, bindings := range inspect.HostConfig.PortBindings {
+		for _, binding := range bindings {
+			if binding.HostPort == "" {
+				continue // ephemeral port chosen by the daemon
+			}
+			hostPort, err := strconv.Atoi(binding.HostPort)
+			if err != nil {
+				continue // port ranges are left to the daemon
+			}
+
+			for _, other := range running {
+				if other.ID == inspect.ID {
+					continue
+				}
+				for _, p := range other.Ports {
+					if int(p.PublicPort) != hostPort || p.Type != port.Proto() || !hostIPsOverlap(binding.HostIP, p.IP) {
+						continue
+					}
+					name := other.ID[:12]
+					if len(other.Names) > 0 {
+						name = strings.TrimPrefix(other.Names[0], "/")
+					}
+					return fmt.Sprintf("Host port %d/%s is already in use by container %s (%s)", hostPort, port.Proto(), name, other.ID[:12])
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// hostIPsOverlap reports whether two host bind addresses can clash. An empty
+// or wildcard address binds every interface and so overlaps with anything.
+func hostIPsOverlap(a, b string) bool {
+	isWildcard := func(ip string) bool { return ip == "" || ip == "0.0.0.0" || ip == "::" }
+	return isWildcard(a) || isWildcard(b) || a == b
+}
+
+// checkDeviceDrivers checks GPU and CDI device requests against the devices
+// the daemon reports discovering, so a request it can't satisfy is reported
+// before ContainerCreate. Daemons that don't report devices, or only expose
+// GPUs through the nvidia container hook rather than CDI, can't be checked;
+// the returned warning says so and the daemon decides when the container
+// starts.
+func (h *ContainerHandler) checkDeviceDrivers(ctx context.Context, requests []container.DeviceRequest) (string, error) {
+	checked := false
+	for _, req := range requests {
+		checked = checked || req.Driver == "nvidia" || req.Driver == "cdi"
+	}
+	if !checked {
+		return "", nil
+	}
+
+	devices, ok, err := docker.DiscoveredDevices(ctx, h.client)
+	if err != nil {
+		return "", fmt.Errorf("failed to query Docker daemon for devices: %w", err)
+	}
+	if !ok {
+		return "Device availability was not checked: the Docker daemon doesn't report discovered devices (Docker 28.3 or later does)", nil
+	}
+
+	gpus := docker.NvidiaGPUs(devices)
+	// CDI specs may name each GPU by index and by UUID; the indexes count them
+	gpuCount := 0
+	for _, name := range gpus {
+		if _, err := strconv.Atoi(name); err == nil {
+			gpuCount++
+		}
+	}
+	if gpuCount == 0 {
+		gpuCount = len(gpus)
+	}
+
+	warning := ""
+	for _, req := range requests {
+		switch req.Driver {
+		case "nvidia":
+			if len(gpus) == 0 {
+				warning = "GPU availability was not checked: the Docker daemon reports no nvidia.com/gpu CDI devices, so GPUs, if any, come through the nvidia runtime"
+				continue
+			}
+			if req.Count > gpuCount {
+				return "", fmt.Errorf("%d GPUs requested but the Docker daemon reports %d (%s)", req.Count, gpuCount, strings.Join(gpus, ", "))
+			}
+			for _, id := range req.DeviceIDs {
+				if !slices.Contains(gpus, id) {
+					return "", fmt.Errorf("GPU %q is not among the GPUs the Docker daemon reports (%s)", id, strings.Join(gpus, ", "))
+				}
+			}
+		case "cdi":
+			for _, id := range req.DeviceIDs {
+				if !slices.ContainsFunc(devices, func(d docker.DiscoveredDevice) bool { return d.ID == id }) {
+					return "", fmt.Errorf("CDI device %q is not among the devices the Docker daemon reports", id)
+				}
+			}
+		}
+	}
+	return warning, nil
+}
+
 func (h *ContainerHandler) GetContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	inspect, err := h.client.ContainerInspect(ctx, id)
+	inspect, err := retryRead(ctx, h.config, func(ctx context.Context) (types.ContainerJSON, error) {
+		return h.client.ContainerInspect(ctx, id)
+	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
 		return
@@ -97,24 +583,194 @@ func (h *ContainerHandler) GetContainer(w http.ResponseWriter, r *http.Request)
 		Name:     strings.TrimPrefix(inspect.Name, "/"),
 		Image:    inspect.Config.Image,
 		Status:   inspect.State.Status,
+		Health:   healthStatus(inspect),
 		Created:  created,
 		Networks: convertNetworks(inspect.NetworkSettings.Networks),
 		Mounts:   convertMounts(inspect.Mounts),
+		Env:      h.envSanitizer(w, r, inspect.ID).env(inspect.Config.Env),
+
+		FailingStreak: failingStreak(inspect),
+	}
+	if inspect.HostConfig != nil {
+		response.Init = inspect.HostConfig.Init != nil && *inspect.HostConfig.Init
+		response.DeviceRequests = convertDeviceRequestsToAPI(inspect.HostConfig.DeviceRequests)
+		response.Devices = convertDeviceMappingsToAPI(inspect.HostConfig.Devices)
+		response.Sysctls = inspect.HostConfig.Sysctls
+		response.Ulimits = convertUlimitsToAPI(inspect.HostConfig.Ulimits)
+		response.CapAdd = inspect.HostConfig.CapAdd
+		response.CapDrop = inspect.HostConfig.CapDrop
+		response.RestartPolicy = apitypes.RestartPolicy{
+			Name:              string(inspect.HostConfig.RestartPolicy.Name),
+			MaximumRetryCount: inspect.HostConfig.RestartPolicy.MaximumRetryCount,
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// GetContainerEnv returns a container's environment variables. Values whose
+// names look secret are redacted unless reveal=true is passed.
+func (h *ContainerHandler) GetContainerEnv(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := retryRead(ctx, h.config, func(ctx context.Context) (types.ContainerJSON, error) {
+		return h.client.ContainerInspect(ctx, id)
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	var env []string
+	if inspect.Config != nil {
+		env = inspect.Config.Env
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.envSanitizer(w, r, inspect.ID).vars(env))
+}
+
+// RunExec runs a command in a running container, optionally with stdin,
+// and returns its combined output and exit code once it finishes. A command
+// that exits non-zero still returns 200; callers check exitCode.
+//
+// A JSON body is an ExecRunRequest. Any other body is the command's stdin,
+// with the rest of the request in the query: cmd and env repeated, user,
+// workingDir and timeout.
+func (h *ContainerHandler) RunExec(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	req, err := execRunRequest(w, r)
+	if err == nil && len(req.Stdin) > maxExecStdin {
+		err = errExecStdinTooLarge
+	}
+	if errors.Is(err, errExecStdinTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Cmd) == 0 {
+		http.Error(w, "cmd is required", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultExecTimeout
+	if req.Timeout != 0 {
+		if req.Timeout < 0 || time.Duration(req.Timeout)*time.Second > maxExecTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be between 1 and %d seconds", int(maxExecTimeout.Seconds())), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	config := docker.ExecConfig{Cmd: req.Cmd, User: req.User, WorkingDir: req.WorkingDir, Env: req.Env}
+	if err := docker.ValidateExecConfig(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := callContext(w, r, h.config.Get(), timeout)
+	defer cancel()
+
+	var stdin io.Reader
+	if req.Stdin != "" {
+		stdin = strings.NewReader(req.Stdin)
+	}
+
+	start := time.Now()
+	result, err := docker.NewExecManager(h.client).Run(ctx, id, config, stdin, maxExecOutput)
+	if err != nil {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			http.Error(w, fmt.Sprintf("Command did not finish within %s", timeout), http.StatusGatewayTimeout)
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+		case errdefs.IsConflict(err):
+			http.Error(w, fmt.Sprintf("Container is not running: %v", err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to run command: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apitypes.ExecRunResponse{
+		ExitCode:   result.ExitCode,
+		Output:     string(result.Output),
+		Truncated:  result.Truncated,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+}
+
+// errExecStdinTooLarge is returned by execRunRequest for a body too large
+// to hold stdin within maxExecStdin
+var errExecStdinTooLarge = fmt.Errorf("stdin must be at most %d bytes", maxExecStdin)
+
+// execRunRequest reads RunExec's request from a JSON body, or from the
+// query with the body as stdin. A JSON body may take up to six bytes per
+// byte of stdin for escapes; stdin that still fits is checked by RunExec.
+func execRunRequest(w http.ResponseWriter, r *http.Request) (apitypes.ExecRunRequest, error) {
+	var req apitypes.ExecRunRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 6*maxExecStdin+64<<10)).Decode(&req); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return req, errExecStdinTooLarge
+			}
+			return req, fmt.Errorf("invalid JSON body")
+		}
+		return req, nil
+	}
+
+	query := r.URL.Query()
+	req.Cmd = query["cmd"]
+	req.Env = query["env"]
+	req.User = query.Get("user")
+	req.WorkingDir = query.Get("workingDir")
+	if v := query.Get("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return req, fmt.Errorf("invalid timeout: must be a number of seconds")
+		}
+		req.Timeout = n
+	}
+	stdin, err := io.ReadAll(io.LimitReader(r.Body, maxExecStdin+1))
+	if err != nil {
+		return req, fmt.Errorf("failed to read stdin: %v", err)
+	}
+	if len(stdin) > maxExecStdin {
+		return req, errExecStdinTooLarge
+	}
+	req.Stdin = string(stdin)
+	return req, nil
+}
+
 func (h *ContainerHandler) StartContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
+	if conflict := h.findPortConflict(ctx, id); conflict != "" {
+		http.Error(w, conflict, http.StatusConflict)
+		return
+	}
+
 	if err := h.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to start container: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to start container: %v", err), failureStatus(err))
 		return
 	}
 
@@ -122,16 +778,21 @@ func (h *ContainerHandler) StartContainer(w http.ResponseWriter, r *http.Request
 }
 
 func (h *ContainerHandler) StopContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	timeoutSeconds, source, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := stopContext(w, r, h.config, timeoutSeconds)
 	defer cancel()
 
-	timeout := 30 * time.Second
-	timeoutSeconds := int(timeout.Seconds())
+	slog.InfoContext(r.Context(), "Stopping container", "container", id, "timeout", timeoutSeconds, "source", source)
 	if err := h.client.ContainerStop(ctx, id, container.StopOptions{Timeout: &timeoutSeconds}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to stop container: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to stop container: %v", err), failureStatus(err))
 		return
 	}
 
@@ -139,69 +800,1528 @@ func (h *ContainerHandler) StopContainer(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ContainerHandler) RestartContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	timeoutSeconds, source, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := stopContext(w, r, h.config, timeoutSeconds)
 	defer cancel()
 
-	timeout := 30 * time.Second
-	timeoutSeconds := int(timeout.Seconds())
+	// Checking for a newer image never blocks the restart; the result is
+	// only reported so the caller can offer to recreate instead.
+	var imageCheck *apitypes.ImageUpdateCheck
+	if r.URL.Query().Get("checkImage") == "true" {
+		imageCheck = h.checkImageUpdate(r, id)
+	}
+
+	slog.InfoContext(r.Context(), "Restarting container", "container", id, "timeout", timeoutSeconds, "source", source)
 	if err := h.client.ContainerRestart(ctx, id, container.StopOptions{Timeout: &timeoutSeconds}); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to restart container: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to restart container: %v", err), failureStatus(err))
+		return
+	}
+
+	if imageCheck != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(apitypes.RestartResponse{Restarted: true, ImageCheck: imageCheck})
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *ContainerHandler) GetContainerLogs(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+// containerActionError writes the error of a pause, unpause, kill, rename,
+// update or commit. The daemon reports a container in the wrong state, such as
+// pausing one that isn't running, as a conflict.
+func containerActionError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case client.IsErrNotFound(err):
+		http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+	case errdefs.IsConflict(err):
+		http.Error(w, fmt.Sprintf("Failed to %s container: %v", action, err), http.StatusConflict)
+	case errdefs.IsInvalidParameter(err):
+		http.Error(w, fmt.Sprintf("Failed to %s container: %v", action, err), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to %s container: %v", action, err), http.StatusInternalServerError)
+	}
+}
+
+func (h *ContainerHandler) PauseContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
-	options := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Tail:       "100",
-		Timestamps: true,
+	if err := h.client.ContainerPause(ctx, id); err != nil {
+		containerActionError(w, "pause", err)
+		return
 	}
 
-	logs, err := h.client.ContainerLogs(ctx, id, options)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get logs: %v", err), http.StatusInternalServerError)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ContainerHandler) UnpauseContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.ContainerUnpause(ctx, id); err != nil {
+		containerActionError(w, "unpause", err)
 		return
 	}
-	defer logs.Close()
 
-	w.Header().Set("Content-Type", "text/plain")
-	io.Copy(w, logs)
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *ContainerHandler) GetContainerStats(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+// KillContainer sends the signal query parameter, SIGKILL by default, to the
+// container's main process. Signals are given by name (SIGHUP, HUP) or
+// number, as docker kill takes them.
+func (h *ContainerHandler) KillContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	signal := r.URL.Query().Get("signal")
+	if signal == "" {
+		signal = "SIGKILL"
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
-	stats, err := h.client.ContainerStats(ctx, id, false)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get stats: %v", err), http.StatusInternalServerError)
+	slog.InfoContext(r.Context(), "Killing container", "container", id, "signal", signal)
+	if err := h.client.ContainerKill(ctx, id, signal); err != nil {
+		containerActionError(w, "kill", err)
 		return
 	}
-	defer stats.Body.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, stats.Body)
+	w.WriteHeader(http.StatusOK)
 }
 
-// Helper functions to convert Docker SDK types to our API types
-func convertPorts(ports []types.Port) []apitypes.PortMapping {
-	result := make([]apitypes.PortMapping, len(ports))
-	for i, p := range ports {
+// RenameContainer renames a container to the name query parameter. Under a
+// name prefix the new name is prefixed as on create, so the container stays
+// visible.
+func (h *ContainerHandler) RenameContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	name := strings.TrimPrefix(r.URL.Query().Get("name"), "/")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if prefix := h.config.Get().NamePrefix; prefix != "" && !hasNamePrefix(name, prefix) {
+		name = prefix + name
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.ContainerRename(ctx, id, name); err != nil {
+		containerActionError(w, "rename", err)
+		return
+	}
+	auditLog(r, "Container renamed", "container", id, "name", name)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// UpdateContainer changes the CPU and memory limits and the restart policy
+// of a container in place, running or not. The daemon can raise or lower a
+// limit but not remove one.
+func (h *ContainerHandler) UpdateContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	var req apitypes.UpdateContainerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.CPUs < 0 || req.Memory < 0 || req.MemorySwap < -1 {
+		http.Error(w, "cpus and memory must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var limits config.ResourcePreset
+	if req.Preset != "" {
+		presets := h.config.Get().ResourcePresets
+		preset, ok := presets[req.Preset]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown preset %q: available presets are %s", req.Preset, strings.Join(sortedKeys(presets), ", ")), http.StatusBadRequest)
+			return
+		}
+		limits = preset
+	}
+	if req.CPUs > 0 {
+		limits.CPUs = req.CPUs
+	}
+	if req.Memory > 0 {
+		limits.Memory = req.Memory
+	}
+
+	update := container.UpdateConfig{
+		Resources: container.Resources{
+			NanoCPUs:   int64(limits.CPUs * 1e9),
+			Memory:     limits.Memory,
+			MemorySwap: req.MemorySwap,
+		},
+	}
+	if req.RestartPolicy != nil {
+		update.RestartPolicy = container.RestartPolicy{
+			Name:              container.RestartPolicyMode(req.RestartPolicy.Name),
+			MaximumRetryCount: req.RestartPolicy.MaximumRetryCount,
+		}
+		if err := container.ValidateRestartPolicy(update.RestartPolicy); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid restart policy: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if update.NanoCPUs == 0 && update.Memory == 0 && update.MemorySwap == 0 && req.RestartPolicy == nil {
+		http.Error(w, "Nothing to update: set cpus, memory, memorySwap, preset or restartPolicy", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	result, err := h.client.ContainerUpdate(ctx, id, update)
+	if err != nil {
+		containerActionError(w, "update", err)
+		return
+	}
+	auditLog(r, "Container updated", "container", id, "cpus", limits.CPUs, "memory", limits.Memory, "memory_swap", req.MemorySwap, "restart_policy", string(update.RestartPolicy.Name))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apitypes.UpdateContainerResponse{Warnings: result.Warnings})
+}
+
+// errNoPullReference is returned by recreate for containers created from an
+// image ID, which has no registry reference to pull again
+var errNoPullReference = errors.New("container was created from an image ID, which has no reference to pull")
+
+// errPullFailed wraps the failure of the pull before a recreate
+var errPullFailed = errors.New("failed to pull image")
+
+// RecreateContainer pulls the container's image reference again and, if
+// that brought a different image, replaces the container with one created
+// from it with the same configuration, ports, mounts and networks. The
+// replacement is started if the old container was running. force=true
+// recreates even when the image is unchanged, and pull=false skips the
+// pull to pick up an image already pulled or built locally.
+func (h *ContainerHandler) RecreateContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	query := r.URL.Query()
+	force := query.Get("force") == "true"
+	pull := query.Get("pull") != "false"
+	timeoutSeconds, _, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	result, err := h.recreate(ctx, id, force, pull, timeoutSeconds)
+	if err != nil {
+		switch {
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+		case errors.Is(err, errNoPullReference):
+			http.Error(w, fmt.Sprintf("Failed to recreate container: %v", err), http.StatusBadRequest)
+		case errors.Is(err, errPullFailed):
+			http.Error(w, fmt.Sprintf("Failed to recreate container: %v", err), http.StatusBadGateway)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to recreate container: %v", err), failureStatus(err))
+		}
+		return
+	}
+	if result.Recreated {
+		auditLog(r, "Container recreated", "container", result.OldID, "replacement", result.ID, "image", result.Image, "image_id", result.ImageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// recreate pulls the image of container id and replaces the container if
+// the image changed or force is set. Failures after the old container was
+// stopped are rolled back, so an error leaves the old container in place.
+func (h *ContainerHandler) recreate(ctx context.Context, id string, force, pull bool, stopTimeout int) (apitypes.RecreateResult, error) {
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return apitypes.RecreateResult{}, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if inspect.Config == nil || inspect.HostConfig == nil {
+		return apitypes.RecreateResult{}, errors.New("failed to inspect container: no configuration returned")
+	}
+	ref := inspect.Config.Image
+	if _, err := reference.ParseNormalizedNamed(ref); err != nil || strings.HasPrefix(ref, "sha256:") {
+		return apitypes.RecreateResult{}, errNoPullReference
+	}
+
+	if pull {
+		manager := docker.NewImageManager(h.client)
+		manager.RegistryAuth = h.registryAuth
+		policy := docker.RetryPolicy{Attempts: h.config.Get().PullRetries, Backoff: pullRetryBackoff}
+		if err := manager.PullThroughMirror(ctx, ref, h.config.Get().RegistryMirror, policy, func(apitypes.PullProgress) {}); err != nil {
+			return apitypes.RecreateResult{}, fmt.Errorf("%w: %v", errPullFailed, err)
+		}
+	}
+	image, _, err := h.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return apitypes.RecreateResult{}, fmt.Errorf("failed to inspect image: %w", err)
+	}
+
+	result := apitypes.RecreateResult{
+		OldID:           inspect.ID,
+		ID:              inspect.ID,
+		Name:            strings.TrimPrefix(inspect.Name, "/"),
+		Image:           ref,
+		PreviousImageID: inspect.Image,
+		ImageID:         image.ID,
+	}
+	if image.ID == inspect.Image && !force {
+		return result, nil
+	}
+
+	// Settings the container only inherited from its old image are left to
+	// the new one; the old image may be gone already
+	var imageConfig *container.Config
+	if previous, _, err := h.client.ImageInspectWithRaw(ctx, inspect.Image); err == nil {
+		imageConfig = previous.Config
+	}
+
+	slog.InfoContext(ctx, "Recreating container", "container", inspect.ID, "image", ref, "previous_image", inspect.Image, "new_image", image.ID)
+	recreated, err := docker.RecreateContainer(ctx, h.client, inspect, imageConfig, stopTimeout)
+	if err != nil {
+		return apitypes.RecreateResult{}, fmt.Errorf("%w; the old container was restored", err)
+	}
+	result.ID, result.Started, result.Warnings = recreated.ID, recreated.Started, recreated.Warnings
+	result.Recreated = true
+	return result, nil
+}
+
+// CommitContainer creates an image from the container's current state,
+// tagged repo:tag when a repo is given.
+func (h *ContainerHandler) CommitContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	var req apitypes.ContainerCommitRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	target := ""
+	if req.Repo != "" {
+		target = req.Repo
+		if req.Tag != "" {
+			target += ":" + req.Tag
+		}
+		if _, err := reference.ParseNormalizedNamed(target); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid tag %q", target), http.StatusBadRequest)
+			return
+		}
+	} else if req.Tag != "" {
+		http.Error(w, "repo is required with tag", http.StatusBadRequest)
+		return
+	}
+	pause := req.Pause == nil || *req.Pause
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	result, err := h.client.ContainerCommit(ctx, id, container.CommitOptions{
+		Reference: target,
+		Comment:   req.Comment,
+		Author:    req.Author,
+		Pause:     pause,
+	})
+	if err != nil {
+		containerActionError(w, "commit", err)
+		return
+	}
+	auditLog(r, "Container committed", "container", id, "image", result.ID, "reference", target)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apitypes.ContainerCommitResponse{ID: result.ID, Reference: target})
+}
+
+func (h *ContainerHandler) checkImageUpdate(r *http.Request, id string) *apitypes.ImageUpdateCheck {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return &apitypes.ImageUpdateCheck{LocalDigests: []string{}, Warning: fmt.Sprintf("Failed to inspect container: %v", err)}
+	}
+	ref := inspect.Image
+	if inspect.Config != nil && inspect.Config.Image != "" {
+		ref = inspect.Config.Image
+	}
+
+	manager := docker.NewImageManager(h.client)
+	manager.RegistryAuth = h.registryAuth
+	check := manager.CheckUpdate(ctx, ref, inspect.Image)
+	if check.Warning != "" {
+		slog.WarnContext(ctx, "Image update check skipped", "container", id, "reason", check.Warning)
+	}
+	return &check
+}
+
+func (h *ContainerHandler) RemoveContainerPreview(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	volumes := make([]string, 0)
+	for _, m := range inspect.Mounts {
+		if m.Type == mount.TypeVolume && isAnonymousVolume(m.Name) {
+			volumes = append(volumes, m.Name)
+		}
+	}
+
+	token, expiresAt := h.confirmations.Issue(inspect.ID)
+	response := apitypes.RemovePreview{
+		ID:        inspect.ID,
+		Name:      strings.TrimPrefix(inspect.Name, "/"),
+		Running:   inspect.State.Running,
+		Volumes:   volumes,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *ContainerHandler) RemoveContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	force := r.URL.Query().Get("force") == "true"
+	removeVolumes := r.URL.Query().Get("volumes") == "true"
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if h.confirmRemove {
+		inspect, err := h.client.ContainerInspect(ctx, id)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+			return
+		}
+		if !h.consumeConfirmation(w, r, inspect.ID) {
+			return
+		}
+		id = inspect.ID
+	}
+
+	if err := h.client.ContainerRemove(ctx, id, container.RemoveOptions{
+		Force:         force,
+		RemoveVolumes: removeVolumes,
+	}); err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		if errdefs.IsConflict(err) {
+			http.Error(w, fmt.Sprintf("Failed to remove container: %v", err), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to remove container: %v", err), failureStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PruneContainers removes stopped containers. until and label narrow the
+// prune the same way they do for docker container prune. With a name
+// prefix configured only containers within it are removed, one at a time,
+// since the daemon's prune can't be limited by name.
+func (h *ContainerHandler) PruneContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pruneFilters := filters.NewArgs()
+	if until := r.URL.Query().Get("until"); until != "" {
+		if _, err := timetypes.GetTimestamp(until, time.Now()); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid until %q: %v", until, err), http.StatusBadRequest)
+			return
+		}
+		pruneFilters.Add("until", until)
+	}
+	for _, label := range r.URL.Query()["label"] {
+		pruneFilters.Add("label", label)
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	var result *apitypes.ContainerPruneResult
+	var err error
+	if prefix := h.config.Get().NamePrefix; prefix != "" {
+		result, err = h.pruneWithPrefix(ctx, pruneFilters, prefix)
+	} else {
+		var report container.PruneReport
+		report, err = h.client.ContainersPrune(ctx, pruneFilters)
+		result = &apitypes.ContainerPruneResult{
+			ContainersDeleted: report.ContainersDeleted,
+			SpaceReclaimed:    report.SpaceReclaimed,
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prune containers: %v", err), failureStatus(err))
+		return
+	}
+	if result.ContainersDeleted == nil {
+		result.ContainersDeleted = []string{}
+	}
+	auditLog(r, "Containers pruned", "count", len(result.ContainersDeleted), "reclaimed_bytes", result.SpaceReclaimed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// pruneWithPrefix removes the stopped containers within prefix that match
+// the prune filters. Containers that fail to be removed are skipped.
+func (h *ContainerHandler) pruneWithPrefix(ctx context.Context, pruneFilters filters.Args, prefix string) (*apitypes.ContainerPruneResult, error) {
+	listFilters := filters.NewArgs()
+	for _, status := range []string{"created", "exited", "dead"} {
+		listFilters.Add("status", status)
+	}
+	for _, label := range pruneFilters.Get("label") {
+		listFilters.Add("label", label)
+	}
+	var until int64
+	if values := pruneFilters.Get("until"); len(values) > 0 {
+		ts, _ := timetypes.GetTimestamp(values[0], time.Now())
+		until, _, _ = timetypes.ParseTimestamps(ts, 0)
+	}
+
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true, Size: true, Filters: listFilters})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &apitypes.ContainerPruneResult{}
+	for _, c := range containers {
+		if !listedWithPrefix(c, prefix) || (until != 0 && c.Created >= until) {
+			continue
+		}
+		if err := h.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{}); err != nil {
+			slog.WarnContext(ctx, "Failed to prune container", "container", c.ID, "error", err)
+			continue
+		}
+		result.ContainersDeleted = append(result.ContainersDeleted, c.ID)
+		result.SpaceReclaimed += uint64(c.SizeRw)
+	}
+	return result, nil
+}
+
+// consumeConfirmation checks the removal confirmation token sent with the
+// request, writing a 428 if it is missing or invalid.
+func (h *ContainerHandler) consumeConfirmation(w http.ResponseWriter, r *http.Request, id string) bool {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.Header.Get("X-Confirm-Token")
+	}
+	if !h.confirmations.Consume(token, id) {
+		http.Error(w, "Missing, expired or invalid confirmation token; request one from /remove-preview", http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
+
+// StopAndRemove stops a container, if it is running, and removes it in one
+// request. If the stop fails the container is left alone unless force=true,
+// in which case it is killed and removed anyway.
+func (h *ContainerHandler) StopAndRemove(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	query := r.URL.Query()
+	force := query.Get("force") == "true"
+	removeVolumes := query.Get("volumes") == "true" || query.Get("removeVolumes") == "true"
+	timeoutSeconds, source, err := stopTimeout(r, h.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := stopContext(w, r, h.config, timeoutSeconds)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+	if h.confirmRemove && !h.consumeConfirmation(w, r, inspect.ID) {
+		return
+	}
+
+	result := apitypes.StopAndRemoveResult{ID: inspect.ID, Name: strings.TrimPrefix(inspect.Name, "/")}
+	if inspect.State != nil && (inspect.State.Running || inspect.State.Restarting) {
+		slog.InfoContext(r.Context(), "Stopping container before removal", "container", inspect.ID, "timeout", timeoutSeconds, "source", source)
+		if err := h.client.ContainerStop(ctx, inspect.ID, container.StopOptions{Timeout: &timeoutSeconds}); err != nil {
+			if !force {
+				http.Error(w, fmt.Sprintf("Failed to stop container, not removing it (pass force=true to remove anyway): %v", err), failureStatus(err))
+				return
+			}
+			result.StopError = err.Error()
+		} else {
+			result.Stopped = true
+		}
+	}
+
+	if err := h.client.ContainerRemove(ctx, inspect.ID, container.RemoveOptions{
+		Force:         force,
+		RemoveVolumes: removeVolumes,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to remove container: %v", err), failureStatus(err))
+		return
+	}
+	result.Removed = true
+	result.VolumesRemoved = removeVolumes
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *ContainerHandler) GetLogConfig(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	var logConfig container.LogConfig
+	if inspect.HostConfig != nil {
+		logConfig = inspect.HostConfig.LogConfig
+	}
+
+	cfg := describeLogConfig(logConfig, journalReadable(h.client))
+	cfg.Hint = logHint(cfg, inspect.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// GetContainerHealth returns a container's health check configuration, its
+// status and the output of its most recent probes
+func (h *ContainerHandler) GetContainerHealth(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := retryRead(ctx, h.config, func(ctx context.Context) (types.ContainerJSON, error) {
+		return h.client.ContainerInspect(ctx, id)
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(containerHealth(inspect))
+}
+
+// GetContainerCommand reports the resolved entrypoint, command and working
+// directory, and which of them differ from the image defaults.
+func (h *ContainerHandler) GetContainerCommand(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	result := apitypes.ContainerCommand{
+		Entrypoint: []string{},
+		Cmd:        []string{},
+	}
+	if inspect.Config != nil {
+		result.Entrypoint = nonNil(inspect.Config.Entrypoint)
+		result.Cmd = nonNil(inspect.Config.Cmd)
+		result.WorkingDir = inspect.Config.WorkingDir
+	}
+	result.Display = shellJoin(append(append([]string{}, result.Entrypoint...), result.Cmd...))
+
+	// The image may have been removed since the container was created, in
+	// which case there is nothing to compare against.
+	if image, _, err := h.client.ImageInspectWithRaw(ctx, inspect.Image); err == nil && image.Config != nil {
+		defaults := &apitypes.CommandDefaults{
+			Entrypoint: nonNil(image.Config.Entrypoint),
+			Cmd:        nonNil(image.Config.Cmd),
+			WorkingDir: image.Config.WorkingDir,
+		}
+		result.ImageDefaults = defaults
+		result.EntrypointOverridden = !slices.Equal(result.Entrypoint, defaults.Entrypoint)
+		result.CmdOverridden = !slices.Equal(result.Cmd, defaults.Cmd)
+		result.WorkingDirOverridden = result.WorkingDir != defaults.WorkingDir
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetConfigDrift compares the container's runtime config with its image and,
+// for compose containers, with the service declared in the compose file.
+func (h *ContainerHandler) GetConfigDrift(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	image, _, err := h.client.ImageInspectWithRaw(ctx, inspect.Image)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to inspect image: %v", err), failureStatus(err))
+		return
+	}
+
+	report := apitypes.ConfigDrift{
+		ID:          inspect.ID,
+		Name:        strings.TrimPrefix(inspect.Name, "/"),
+		Differences: imageDrift(inspect, image),
+	}
+	if inspect.Config != nil {
+		report.Image = inspect.Config.Image
+		report.ComposeProject = inspect.Config.Labels["com.docker.compose.project"]
+		report.ComposeService = inspect.Config.Labels["com.docker.compose.service"]
+	}
+
+	if report.ComposeProject != "" {
+		if diffs, err := h.composeDrift(report.ComposeProject, report.ComposeService, inspect, image); err != nil {
+			report.ComposeMessage = err.Error()
+		} else {
+			report.ComposeChecked = true
+			report.Differences = append(report.Differences, diffs...)
+		}
+	}
+	report.Drifted = len(report.Differences) > 0
+	h.envSanitizer(w, r, inspect.ID).differences(report.Differences)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *ContainerHandler) composeDrift(project, service string, inspect types.ContainerJSON, image types.ImageInspect) ([]apitypes.ConfigDifference, error) {
+	config, err := docker.LoadProjectConfig(h.config.Get().ComposeDir, project)
+	if err != nil {
+		return nil, fmt.Errorf("Compose file for project %s is not available: %v", project, err)
+	}
+	svc, ok := config.Services[service]
+	if !ok {
+		return nil, fmt.Errorf("Service %s is no longer declared in project %s", service, project)
+	}
+	return composeDrift(inspect, image, svc)
+}
+
+// GetContainerSize reports the size of the container's writable layer and
+// root filesystem. Sizes are expensive to compute, so results are cached
+// briefly; pass refresh=true to bypass the cache.
+func (h *ContainerHandler) GetContainerSize(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+	refresh := r.URL.Query().Get("refresh") == "true"
+
+	h.sizeMu.Lock()
+	cached, ok := h.sizes[id]
+	h.sizeMu.Unlock()
+	if !refresh && ok && time.Since(cached.GeneratedAt) < containerSizeTTL {
+		cached.Cached = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cached)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	inspect, _, err := h.client.ContainerInspectWithRaw(ctx, id, true)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	size := apitypes.ContainerSize{
+		ID:          inspect.ID,
+		GeneratedAt: time.Now().UTC(),
+	}
+	if inspect.SizeRw != nil {
+		size.SizeRw = *inspect.SizeRw
+	}
+	if inspect.SizeRootFs != nil {
+		size.SizeRootFs = *inspect.SizeRootFs
+	}
+
+	h.sizeMu.Lock()
+	for key, entry := range h.sizes {
+		if time.Since(entry.GeneratedAt) >= containerSizeTTL {
+			delete(h.sizes, key)
+		}
+	}
+	// Cache under both the requested reference and the full ID so lookups
+	// by name or short ID hit as well.
+	h.sizes[id] = size
+	h.sizes[inspect.ID] = size
+	h.sizeMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(size)
+}
+
+// GetContainerLogs returns a container's raw log stream. tail (default 100,
+// or "all"), since and until (timestamps or durations such as 10m) and
+// stream (stdout or stderr) pick the lines. A search with q, regex or level,
+// or format=json, is matched here instead of in the browser: it reads the
+// whole range (tail defaults to all) and returns the newest limit matches
+// as JSON.
+func (h *ContainerHandler) GetContainerLogs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	search := filter.searching() || query.Get("format") == "json"
+	defaultTail := "100"
+	if search {
+		defaultTail = "all"
+	}
+	tail, since, until, err := parseLogRange(query, defaultTail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultLogMatches
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLogMatches {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: must be between 1 and %d", v, maxLogMatches), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	options := container.LogsOptions{
+		ShowStdout: filter.stdout,
+		ShowStderr: filter.stderr,
+		Tail:       tail,
+		Since:      since,
+		Until:      until,
+		Timestamps: true,
+	}
+	if !search {
+		ctx, cancel := readContext(r, h.config)
+		defer cancel()
+
+		logs, err := openContainerLogs(ctx, h.client, id, options)
+		if err != nil {
+			writeLogsError(w, err)
+			return
+		}
+		defer logs.Close()
+
+		w.Header().Set("Content-Type", "text/plain")
+		io.Copy(w, logs)
+		return
+	}
+
+	// Searching reads the whole range, which may be gigabytes
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+	logs, err := openContainerLogs(ctx, h.client, inspect.ID, options)
+	if err != nil {
+		writeLogsError(w, err)
+		return
+	}
+	defer logs.Close()
+
+	matches := &logMatches{limit: limit}
+	lines := func(stream string) *logLineWriter {
+		return &logLineWriter{emit: func(line string) {
+			matches.scanned++
+			ts, message := splitLogTimestamp(line)
+			if level, ok := filter.match(stream, message); ok {
+				matches.add(apitypes.LogEntry{Timestamp: ts, Stream: stream, Level: level, Message: message})
+			}
+		}}
+	}
+	stdout, stderr := lines("stdout"), lines("stderr")
+	if hasTTY(inspect) {
+		_, err = io.Copy(stdout, logs)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read logs: %v", err), failureStatus(err))
+		return
+	}
+	stdout.flush()
+	stderr.flush()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches.result(strings.TrimPrefix(inspect.Name, "/")))
+}
+
+// writeLogsError answers 422 with the log config when the logs live outside
+// the daemon, and 500 otherwise
+func writeLogsError(w http.ResponseWriter, err error) {
+	var unavailable *logsUnavailableError
+	if errors.As(err, &unavailable) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(unavailable.config)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to get logs: %v", err), failureStatus(err))
+}
+
+// StreamContainerLogs streams a container's logs over a WebSocket as JSON
+// LogFrame messages, one per line, tagged stdout or stderr and with the
+// detected level. tail (default 100, or "all") and since (a timestamp or a
+// duration such as 10m) pick where to start and until where to stop;
+// follow=false closes the socket once the existing logs are sent. stream, q,
+// regex and level filter the lines as for GetContainerLogs; tail counts
+// lines before filtering.
+func (h *ContainerHandler) StreamContainerLogs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tail, since, until, err := parseLogRange(query, "100")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	follow := query.Get("follow") != "false"
+
+	inspect, err := h.client.ContainerInspect(r.Context(), id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+	name := strings.TrimPrefix(inspect.Name, "/")
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// Pings share the connection with frames, so writes are serialized.
+		var mu sync.Mutex
+		send := func(frame apitypes.LogFrame) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return websocket.JSON.Send(ws, frame)
+		}
+
+		// The client never sends anything; reading detects disconnects and
+		// consumes pongs.
+		go func() {
+			io.Copy(io.Discard, ws)
+			cancel()
+		}()
+		go pingWebSocket(ctx, ws, &mu, cancel)
+
+		options := container.LogsOptions{
+			ShowStdout: filter.stdout,
+			ShowStderr: filter.stderr,
+			Timestamps: true,
+			Follow:     follow,
+			Tail:       tail,
+			Since:      since,
+			Until:      until,
+		}
+		logs, err := openContainerLogs(ctx, h.client, inspect.ID, options)
+		if err != nil {
+			send(apitypes.LogFrame{Container: name, Stream: "error", Timestamp: time.Now().UTC(), Message: logsUnavailableMessage(err)})
+			return
+		}
+		defer logs.Close()
+
+		lines := func(stream string) *logLineWriter {
+			return &logLineWriter{emit: func(line string) {
+				ts, message := splitLogTimestamp(line)
+				level, ok := filter.match(stream, message)
+				if !ok {
+					return
+				}
+				if send(apitypes.LogFrame{Container: name, Stream: stream, Timestamp: ts, Level: level, Message: message}) != nil {
+					cancel()
+				}
+			}}
+		}
+		stdout, stderr := lines("stdout"), lines("stderr")
+		if hasTTY(inspect) {
+			io.Copy(stdout, logs)
+		} else {
+			stdcopy.StdCopy(stdout, stderr, logs)
+		}
+		stdout.flush()
+		stderr.flush()
+	}).ServeHTTP(w, r)
+}
+
+// defaultStatsInterval is how often streamed container stats are sent
+// unless the client asks otherwise
+const defaultStatsInterval = 2 * time.Second
+
+// GetContainerStats returns one raw Docker stats reading, or with
+// stream=true sends decoded ContainerStats samples as server-sent "stats"
+// events every interval (2s by default) until the container stops, which
+// ends the stream with an "end" event. WebSocket clients always get the
+// stream, as JSON messages.
+func (h *ContainerHandler) GetContainerStats(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	isWebSocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	if isWebSocket || r.URL.Query().Get("stream") == "true" {
+		interval := defaultStatsInterval
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < minUsageInterval {
+				http.Error(w, fmt.Sprintf("Invalid interval: must be a duration of at least %s", minUsageInterval), http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+		if isWebSocket {
+			h.streamStatsWebSocket(w, r, id, interval)
+		} else {
+			h.streamStatsSSE(w, r, id, interval)
+		}
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	stats, err := h.client.ContainerStats(ctx, id, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get stats: %v", err), failureStatus(err))
+		return
+	}
+	defer stats.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, stats.Body)
+}
+
+func (h *ContainerHandler) streamStatsSSE(w http.ResponseWriter, r *http.Request, id string, interval time.Duration) {
+	// Check the container first so a bad id is a plain 404
+	ctx, cancel := readContext(r, h.config)
+	_, err := h.client.ContainerInspect(ctx, id)
+	cancel()
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	send := func(event string, data any) error {
+		payload, _ := json.Marshal(data)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	fmt.Fprintf(w, "retry: %d\n\n", interval.Milliseconds())
+
+	err = docker.StreamStats(r.Context(), h.client, id, interval, func(stats apitypes.ContainerStats) error {
+		return send("stats", stats)
+	})
+	if r.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		send("error", map[string]string{"error": err.Error()})
+		return
+	}
+	send("end", map[string]string{"reason": "container stopped"})
+}
+
+func (h *ContainerHandler) streamStatsWebSocket(w http.ResponseWriter, r *http.Request, id string, interval time.Duration) {
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		var mu sync.Mutex
+		go func() {
+			io.Copy(io.Discard, ws)
+			cancel()
+		}()
+		go pingWebSocket(ctx, ws, &mu, cancel)
+
+		err := docker.StreamStats(ctx, h.client, id, interval, func(stats apitypes.ContainerStats) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return websocket.JSON.Send(ws, stats)
+		})
+		if err != nil && ctx.Err() == nil {
+			mu.Lock()
+			websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+			mu.Unlock()
+		}
+	}).ServeHTTP(w, r)
+}
+
+func (h *ContainerHandler) GetContainerMounts(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	withSize := r.URL.Query().Get("withSize") == "true"
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	mounts := convertMounts(inspect.Mounts)
+	if withSize {
+		h.fillMountSizes(ctx, mounts)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mounts)
+}
+
+// fillMountSizes sets Size on volume and bind mounts where it can be
+// determined. Volume sizes come from the daemon; bind mounts are measured on
+// the local filesystem and left unset if the path isn't visible to us. A
+// bind mount too large to measure before ctx ends or the entry cap is hit is
+// marked partial.
+func (h *ContainerHandler) fillMountSizes(ctx context.Context, mounts []apitypes.MountInfo) {
+	var volumeSizes map[string]int64
+	for i := range mounts {
+		switch mount.Type(mounts[i].Type) {
+		case mount.TypeVolume:
+			if volumeSizes == nil {
+				volumeSizes = make(map[string]int64)
+				usage, err := h.client.DiskUsage(ctx, types.DiskUsageOptions{
+					Types: []types.DiskUsageObject{types.VolumeObject},
+				})
+				if err == nil {
+					for _, v := range usage.Volumes {
+						if v.UsageData != nil && v.UsageData.Size >= 0 {
+							volumeSizes[v.Name] = v.UsageData.Size
+						}
+					}
+				}
+			}
+			if size, ok := volumeSizes[mounts[i].Name]; ok {
+				mounts[i].Size = &size
+			}
+		case mount.TypeBind:
+			if size, partial, err := pathSize(ctx, mounts[i].Source, maxBindMountEntries); err == nil {
+				mounts[i].Size = &size
+				mounts[i].SizePartial = partial
+			}
+		}
+	}
+}
+
+// TopContainers samples every running container and returns the heaviest
+// consumers of the requested resource.
+func (h *ContainerHandler) TopContainers(w http.ResponseWriter, r *http.Request) {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "cpu"
+	}
+	metric, ok := topMetrics[by]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invalid by value %q: must be one of cpu, memory, netio, blockio", by), http.StatusBadRequest)
+		return
+	}
+
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	samples, err := docker.SampleRunning(ctx, h.client, 8)
+	if err != nil && len(samples) == 0 {
+		http.Error(w, fmt.Sprintf("Failed to sample container stats: %v", err), failureStatus(err))
+		return
+	}
+	if prefix := h.config.Get().NamePrefix; prefix != "" {
+		visible := samples[:0]
+		for _, s := range samples {
+			if hasNamePrefix(s.Name, prefix) {
+				visible = append(visible, s)
+			}
+		}
+		samples = visible
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return metric(samples[i].Stats) > metric(samples[j].Stats)
+	})
+	if len(samples) > limit {
+		samples = samples[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
+
+// ListCrashLooping returns containers that have restarted at least
+// minRestarts times (default 3) and are restarting now or last started within
+// window (default 10m), with their last exit code and a log tail.
+func (h *ContainerHandler) ListCrashLooping(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	minRestarts := 3
+	if v := r.URL.Query().Get("minRestarts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid minRestarts: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		minRestarts = n
+	}
+	window := 10 * time.Minute
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid window: must be a positive duration such as 10m", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), failureStatus(err))
+		return
+	}
+
+	now := time.Now()
+	prefix := h.config.Get().NamePrefix
+	response := make([]apitypes.CrashLoopInfo, 0)
+	for _, c := range containers {
+		if c.State != "running" && c.State != "restarting" && c.State != "exited" {
+			continue
+		}
+		if !listedWithPrefix(c, prefix) {
+			continue
+		}
+
+		inspect, err := h.client.ContainerInspect(ctx, c.ID)
+		if err != nil || inspect.State == nil || inspect.RestartCount < minRestarts {
+			continue
+		}
+
+		startedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+		finishedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+		if !inspect.State.Restarting && now.Sub(startedAt) > window {
+			continue
+		}
+
+		var perHour float64
+		if created, err := time.Parse(time.RFC3339Nano, inspect.Created); err == nil {
+			if age := now.Sub(created).Hours(); age > 0 {
+				perHour = float64(inspect.RestartCount) / age
+			}
+		}
+
+		response = append(response, apitypes.CrashLoopInfo{
+			ID:              inspect.ID,
+			Name:            strings.TrimPrefix(inspect.Name, "/"),
+			Image:           inspect.Config.Image,
+			RestartCount:    inspect.RestartCount,
+			RestartsPerHour: perHour,
+			Restarting:      inspect.State.Restarting,
+			LastExitCode:    inspect.State.ExitCode,
+			OOMKilled:       inspect.State.OOMKilled,
+			Error:           inspect.State.Error,
+			StartedAt:       startedAt,
+			FinishedAt:      finishedAt,
+			LogTail:         h.logTail(ctx, inspect.ID, 20),
+		})
+	}
+
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].RestartsPerHour > response[j].RestartsPerHour
+	})
+
+	writeList(w, params, response)
+}
+
+// BreakRestartLoop disables a container's restart policy and stops it, so a
+// crash-looping container stays down until someone starts it again.
+func (h *ContainerHandler) BreakRestartLoop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if _, err := h.client.ContainerUpdate(ctx, id, container.UpdateConfig{
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyDisabled},
+	}); err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to disable restart policy: %v", err), failureStatus(err))
+		return
+	}
+
+	timeoutSeconds := 10
+	if err := h.client.ContainerStop(ctx, id, container.StopOptions{Timeout: &timeoutSeconds}); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to stop container: %v", err), failureStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// logTail returns the last n log lines of a container, or nil if they can't
+// be read.
+func (h *ContainerHandler) logTail(ctx context.Context, id string, n int) []string {
+	logs, err := h.client.ContainerLogs(ctx, id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(n),
+	})
+	if err != nil {
+		return nil
+	}
+	defer logs.Close()
+
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, logs); err != nil {
+		return nil
+	}
+	text := strings.TrimRight(buf.String(), "\n")
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+// topMetrics maps the ?by= values accepted by TopContainers to sort keys.
+var topMetrics = map[string]func(apitypes.ContainerStats) float64{
+	"cpu":     func(s apitypes.ContainerStats) float64 { return s.CPU.UsagePercent },
+	"memory":  func(s apitypes.ContainerStats) float64 { return float64(s.Memory.Usage) },
+	"netio":   func(s apitypes.ContainerStats) float64 { return float64(s.Network.RxBytes + s.Network.TxBytes) },
+	"blockio": func(s apitypes.ContainerStats) float64 { return float64(s.BlockIO.Read + s.BlockIO.Write) },
+}
+
+// Helper functions to convert Docker SDK types to our API types
+var validContainerStatuses = map[string]bool{
+	"created": true, "restarting": true, "running": true, "removing": true,
+	"paused": true, "exited": true, "dead": true,
+}
+
+var validHealthStates = map[string]bool{"healthy": true, "unhealthy": true, "starting": true, "none": true}
+
+// healthStatus returns the container's health check status, or "none" if it
+// has no health check.
+func healthStatus(inspect types.ContainerJSON) string {
+	if inspect.State == nil || inspect.State.Health == nil || inspect.State.Health.Status == "" {
+		return "none"
+	}
+	return inspect.State.Health.Status
+}
+
+func failingStreak(inspect types.ContainerJSON) int {
+	if inspect.State == nil || inspect.State.Health == nil {
+		return 0
+	}
+	return inspect.State.Health.FailingStreak
+}
+
+// containerHealth describes the container's health check and its recent
+// probes. A HEALTHCHECK NONE in the image or container disables the check.
+func containerHealth(inspect types.ContainerJSON) apitypes.ContainerHealth {
+	health := apitypes.ContainerHealth{
+		Status:        healthStatus(inspect),
+		FailingStreak: failingStreak(inspect),
+		Log:           []apitypes.HealthProbe{},
+	}
+	if inspect.Config != nil && inspect.Config.Healthcheck != nil {
+		if hc := inspect.Config.Healthcheck; len(hc.Test) > 0 && hc.Test[0] != "NONE" {
+			health.Check = &apitypes.HealthCheck{
+				Test:          hc.Test,
+				Interval:      durationString(hc.Interval),
+				Timeout:       durationString(hc.Timeout),
+				StartPeriod:   durationString(hc.StartPeriod),
+				StartInterval: durationString(hc.StartInterval),
+				Retries:       hc.Retries,
+			}
+		}
+	}
+	if inspect.State != nil && inspect.State.Health != nil {
+		for _, probe := range inspect.State.Health.Log {
+			if probe == nil {
+				continue
+			}
+			health.Log = append(health.Log, apitypes.HealthProbe{
+				Start:    probe.Start,
+				End:      probe.End,
+				ExitCode: probe.ExitCode,
+				Output:   probe.Output,
+			})
+		}
+	}
+	return health
+}
+
+// durationString formats d, or returns "" for zero (the daemon default)
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func convertPorts(ports []types.Port) []apitypes.PortMapping {
+	result := make([]apitypes.PortMapping, len(ports))
+	for i, p := range ports {
 		result[i] = apitypes.PortMapping{
 			HostIP:        p.IP,
 			HostPort:      p.PublicPort,
@@ -230,6 +2350,7 @@ func convertMounts(mounts []types.MountPoint) []apitypes.MountInfo {
 	for i, m := range mounts {
 		result[i] = apitypes.MountInfo{
 			Type:        string(m.Type),
+			Name:        m.Name,
 			Source:      m.Source,
 			Destination: m.Destination,
 			Mode:        m.Mode,
@@ -238,3 +2359,260 @@ func convertMounts(mounts []types.MountPoint) []apitypes.MountInfo {
 	}
 	return result
 }
+
+// convertDeviceRequests validates API device requests and applies the GPU
+// defaults used by `docker run --gpus`.
+func convertDeviceRequests(requests []apitypes.DeviceRequest) ([]container.DeviceRequest, error) {
+	result := make([]container.DeviceRequest, 0, len(requests))
+	for _, req := range requests {
+		if req.Count < -1 {
+			return nil, fmt.Errorf("count must be -1 (all) or a positive number, got %d", req.Count)
+		}
+		if req.Count != 0 && len(req.DeviceIDs) > 0 {
+			return nil, fmt.Errorf("count and deviceIds are mutually exclusive")
+		}
+		seen := make(map[string]bool, len(req.DeviceIDs))
+		for _, id := range req.DeviceIDs {
+			if id == "" || strings.ContainsAny(id, ", \t\n") {
+				return nil, fmt.Errorf("invalid device ID %q: must be a device index or UUID", id)
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("device ID %q is listed more than once", id)
+			}
+			seen[id] = true
+		}
+		for _, set := range req.Capabilities {
+			if len(set) == 0 || slices.Contains(set, "") {
+				return nil, fmt.Errorf("capabilities must be non-empty lists of names, such as [[\"gpu\"]]")
+			}
+		}
+
+		driver := req.Driver
+		if driver == "" {
+			driver = "nvidia"
+		}
+		capabilities := req.Capabilities
+		if len(capabilities) == 0 && driver == "nvidia" {
+			capabilities = [][]string{{"gpu"}}
+		}
+		count := req.Count
+		if count == 0 && len(req.DeviceIDs) == 0 {
+			count = -1
+		}
+
+		result = append(result, container.DeviceRequest{
+			Driver:       driver,
+			Count:        count,
+			DeviceIDs:    req.DeviceIDs,
+			Capabilities: capabilities,
+			Options:      req.Options,
+		})
+	}
+	return result, nil
+}
+
+func convertDeviceMappings(devices []apitypes.DeviceMapping) ([]container.DeviceMapping, error) {
+	result := make([]container.DeviceMapping, 0, len(devices))
+	for _, d := range devices {
+		if !strings.HasPrefix(d.PathOnHost, "/") {
+			return nil, fmt.Errorf("pathOnHost must be an absolute path, got %q", d.PathOnHost)
+		}
+		pathInContainer := d.PathInContainer
+		if pathInContainer == "" {
+			pathInContainer = d.PathOnHost
+		}
+		permissions := d.CgroupPermissions
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		if strings.Trim(permissions, "rwm") != "" {
+			return nil, fmt.Errorf("cgroupPermissions may only contain r, w and m, got %q", permissions)
+		}
+
+		result = append(result, container.DeviceMapping{
+			PathOnHost:        d.PathOnHost,
+			PathInContainer:   pathInContainer,
+			CgroupPermissions: permissions,
+		})
+	}
+	return result, nil
+}
+
+// convertPortBindings turns requested port mappings into the exposed ports
+// and bindings of a new container.
+func convertPortBindings(ports []apitypes.PortMapping) (nat.PortSet, nat.PortMap, error) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, p := range ports {
+		if p.ContainerPort == 0 {
+			return nil, nil, fmt.Errorf("containerPort is required")
+		}
+		protocol := strings.ToLower(p.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+			return nil, nil, fmt.Errorf("protocol must be tcp, udp or sctp, got %q", p.Protocol)
+		}
+		if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+			return nil, nil, fmt.Errorf("hostIp must be an IP address, got %q", p.HostIP)
+		}
+
+		port, err := nat.NewPort(protocol, strconv.Itoa(int(p.ContainerPort)))
+		if err != nil {
+			return nil, nil, err
+		}
+		exposed[port] = struct{}{}
+		binding := nat.PortBinding{HostIP: p.HostIP}
+		if p.HostPort != 0 {
+			binding.HostPort = strconv.Itoa(int(p.HostPort))
+		}
+		bindings[port] = append(bindings[port], binding)
+	}
+	return exposed, bindings, nil
+}
+
+func convertMountRequests(requests []apitypes.MountRequest) ([]mount.Mount, error) {
+	result := make([]mount.Mount, 0, len(requests))
+	for _, m := range requests {
+		if !strings.HasPrefix(m.Target, "/") {
+			return nil, fmt.Errorf("target must be an absolute path, got %q", m.Target)
+		}
+		switch mount.Type(m.Type) {
+		case mount.TypeBind:
+			if !strings.HasPrefix(m.Source, "/") {
+				return nil, fmt.Errorf("source of a bind mount must be an absolute host path, got %q", m.Source)
+			}
+		case mount.TypeVolume:
+		case mount.TypeTmpfs:
+			if m.Source != "" {
+				return nil, fmt.Errorf("tmpfs mounts take no source")
+			}
+		default:
+			return nil, fmt.Errorf("type must be bind, volume or tmpfs, got %q", m.Type)
+		}
+		result = append(result, mount.Mount{
+			Type:     mount.Type(m.Type),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	return result, nil
+}
+
+// convertUlimits validates ulimits by name and requires non-negative limits
+// with soft no greater than hard.
+func convertUlimits(ulimits []apitypes.Ulimit) ([]*container.Ulimit, error) {
+	result := make([]*container.Ulimit, 0, len(ulimits))
+	for _, u := range ulimits {
+		hard := u.Soft
+		if u.Hard != nil {
+			hard = *u.Hard
+		}
+		if u.Soft < 0 || hard < 0 {
+			return nil, fmt.Errorf("%s limits must not be negative", u.Name)
+		}
+		// ParseUlimit knows the valid names and checks soft <= hard
+		parsed, err := units.ParseUlimit(fmt.Sprintf("%s=%d:%d", u.Name, u.Soft, hard))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsed)
+	}
+	return result, nil
+}
+
+func convertUlimitsToAPI(ulimits []*container.Ulimit) []apitypes.Ulimit {
+	result := make([]apitypes.Ulimit, 0, len(ulimits))
+	for _, u := range ulimits {
+		hard := u.Hard
+		result = append(result, apitypes.Ulimit{Name: u.Name, Soft: u.Soft, Hard: &hard})
+	}
+	return result
+}
+
+func convertDeviceRequestsToAPI(requests []container.DeviceRequest) []apitypes.DeviceRequest {
+	result := make([]apitypes.DeviceRequest, len(requests))
+	for i, req := range requests {
+		result[i] = apitypes.DeviceRequest{
+			Driver:       req.Driver,
+			Count:        req.Count,
+			DeviceIDs:    req.DeviceIDs,
+			Capabilities: req.Capabilities,
+			Options:      req.Options,
+		}
+	}
+	return result
+}
+
+func convertDeviceMappingsToAPI(devices []container.DeviceMapping) []apitypes.DeviceMapping {
+	result := make([]apitypes.DeviceMapping, len(devices))
+	for i, d := range devices {
+		result[i] = apitypes.DeviceMapping{
+			PathOnHost:        d.PathOnHost,
+			PathInContainer:   d.PathInContainer,
+			CgroupPermissions: d.CgroupPermissions,
+		}
+	}
+	return result
+}
+
+// isAnonymousVolume reports whether a volume name looks daemon-generated,
+// i.e. a volume that is removed together with its container.
+func isAnonymousVolume(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathSize returns the total size of the regular files at or below path,
+// visiting at most limit entries. When the limit or ctx stops the walk
+// early, the size so far is returned as partial.
+func pathSize(ctx context.Context, path string, limit int) (size int64, partial bool, err error) {
+	entries := 0
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entries++; entries > limit {
+			return errWalkLimit
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if errors.Is(err, errWalkLimit) || (err != nil && ctx.Err() != nil) {
+		return size, true, nil
+	}
+	return size, false, err
+}
+
+// shellJoin quotes args so the result can be pasted into a POSIX shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, func(c rune) bool {
+			return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("@%+=:,./_-", c))
+		}) < 0 {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
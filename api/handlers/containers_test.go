@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+func TestConvertDeviceRequests(t *testing.T) {
+	valid := []apitypes.DeviceRequest{
+		{},
+		{Count: -1},
+		{Count: 2},
+		{DeviceIDs: []string{"0", "GPU-3a2b"}},
+		{Driver: "cdi", Capabilities: [][]string{{"gpu", "compute"}}},
+	}
+	for _, req := range valid {
+		if _, err := convertDeviceRequests([]apitypes.DeviceRequest{req}); err != nil {
+			t.Errorf("%+v: unexpected error: %v", req, err)
+		}
+	}
+
+	invalid := []apitypes.DeviceRequest{
+		{Count: -2},
+		{Count: 1, DeviceIDs: []string{"0"}},
+		{DeviceIDs: []string{""}},
+		{DeviceIDs: []string{"0,1"}},
+		{DeviceIDs: []string{"0 "}},
+		{DeviceIDs: []string{"0", "0"}},
+		{Capabilities: [][]string{{}}},
+		{Capabilities: [][]string{{""}}},
+	}
+	for _, req := range invalid {
+		if _, err := convertDeviceRequests([]apitypes.DeviceRequest{req}); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+}
+
+func TestExecRunRequestRawBody(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/containers/abc/exec/run?cmd=sh&cmd=-c&cmd=cat&env=A=1&timeout=5", strings.NewReader("hello\n"))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	req, err := execRunRequest(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(req.Cmd, []string{"sh", "-c", "cat"}) || !slices.Equal(req.Env, []string{"A=1"}) || req.Timeout != 5 || req.Stdin != "hello\n" {
+		t.Errorf("got %+v", req)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/containers/abc/exec/run", strings.NewReader(`{"cmd":["cat"],"stdin":"hi"}`))
+	r.Header.Set("Content-Type", "application/json")
+	req, err = execRunRequest(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(req.Cmd, []string{"cat"}) || req.Stdin != "hi" {
+		t.Errorf("got %+v", req)
+	}
+}
+
+// A command that runs past the server's write timeout still gets its
+// response to the client
+func TestRunExecOutlivesServerWriteTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:     50 * time.Millisecond,
+		ServerWriteTimeout: 50 * time.Millisecond,
+	}, config.Options{})
+	h := NewContainerHandler(hungDaemon(t), cfg)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := WithRequestTimeout(r.Context(), cfg.Get().RequestTimeout)
+		defer cancel()
+		h.RunExec(w, r.WithContext(ctx))
+	}))
+	srv.Config.WriteTimeout = cfg.Get().ServerWriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/containers/abc/exec/run", "application/json", strings.NewReader(`{"cmd":["sleep","60"],"timeout":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+// Stdin over the cap is refused with 413 whether it comes in a JSON body or
+// as the raw body, even when the JSON body is too large to read whole
+func TestRunExecRejectsLargeStdin(t *testing.T) {
+	h := NewContainerHandler(nil, config.NewStore(&config.Config{}, config.Options{}))
+	stdin := strings.Repeat("a", maxExecStdin+1)
+	escaped := strings.Repeat(`\u0000`, maxExecStdin+16<<10)
+
+	for name, body := range map[string]struct{ contentType, body string }{
+		"raw":          {"application/octet-stream", stdin},
+		"json":         {"application/json", `{"cmd":["cat"],"stdin":"` + stdin + `"}`},
+		"json escaped": {"application/json", `{"cmd":["cat"],"stdin":"` + escaped + `"}`},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/containers/abc/exec/run?cmd=cat", strings.NewReader(body.body))
+		r.Header.Set("Content-Type", body.contentType)
+		w := httptest.NewRecorder()
+		h.RunExec(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "stdin must be at most") {
+			t.Errorf("%s: status = %d, want %d: %.100s", name, w.Code, http.StatusRequestEntityTooLarge, w.Body)
+		}
+	}
+}
+
+// infoDaemon is a Docker daemon whose info is the given JSON
+func infoDaemon(t *testing.T, info string) *client.Client {
+	t.Helper()
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(info))
+	}))
+	t.Cleanup(daemon.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCheckDeviceDrivers(t *testing.T) {
+	const twoGPUs = `{"DiscoveredDevices":[
+		{"Source":"cdi","ID":"nvidia.com/gpu=0"},
+		{"Source":"cdi","ID":"nvidia.com/gpu=1"},
+		{"Source":"cdi","ID":"nvidia.com/gpu=GPU-abc"},
+		{"Source":"cdi","ID":"nvidia.com/gpu=all"}]}`
+	tests := []struct {
+		name    string
+		info    string
+		request container.DeviceRequest
+		wantErr bool
+		warns   bool
+	}{
+		{"all GPUs", twoGPUs, container.DeviceRequest{Driver: "nvidia", Count: -1}, false, false},
+		{"two GPUs", twoGPUs, container.DeviceRequest{Driver: "nvidia", Count: 2}, false, false},
+		{"too many GPUs", twoGPUs, container.DeviceRequest{Driver: "nvidia", Count: 3}, true, false},
+		{"GPU by UUID", twoGPUs, container.DeviceRequest{Driver: "nvidia", DeviceIDs: []string{"GPU-abc"}}, false, false},
+		{"unknown GPU", twoGPUs, container.DeviceRequest{Driver: "nvidia", DeviceIDs: []string{"2"}}, true, false},
+		{"CDI device", twoGPUs, container.DeviceRequest{Driver: "cdi", DeviceIDs: []string{"nvidia.com/gpu=all"}}, false, false},
+		{"unknown CDI device", twoGPUs, container.DeviceRequest{Driver: "cdi", DeviceIDs: []string{"vendor.com/fpga=0"}}, true, false},
+		{"no CDI GPUs", `{"DiscoveredDevices":[]}`, container.DeviceRequest{Driver: "nvidia", Count: 8}, false, true},
+		{"older daemon", `{"CDISpecDirs":["/etc/cdi"]}`, container.DeviceRequest{Driver: "nvidia", Count: 8}, false, true},
+	}
+	cfg := config.NewStore(&config.Config{}, config.Options{})
+	for _, tt := range tests {
+		h := NewContainerHandler(infoDaemon(t, tt.info), cfg)
+		warning, err := h.checkDeviceDrivers(context.Background(), []container.DeviceRequest{tt.request})
+		if (err != nil) != tt.wantErr || (warning != "") != tt.warns {
+			t.Errorf("%s: warning %q, err %v; want error %v, warning %v", tt.name, warning, err, tt.wantErr, tt.warns)
+		}
+	}
+}
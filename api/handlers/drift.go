@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+
+	apitypes "kibutsu/api/types"
+)
+
+// imageDrift reports where the container departs from its image defaults.
+func imageDrift(inspect types.ContainerJSON, image types.ImageInspect) []apitypes.ConfigDifference {
+	diffs := make([]apitypes.ConfigDifference, 0)
+	if inspect.Config == nil || image.Config == nil {
+		return diffs
+	}
+	add := func(field, expected, actual string) {
+		diffs = append(diffs, apitypes.ConfigDifference{Source: "image", Field: field, Expected: expected, Actual: actual})
+	}
+
+	diffs = append(diffs, envDrift("image", envMap(image.Config.Env), envMap(inspect.Config.Env))...)
+
+	if got, want := shellJoin(inspect.Config.Entrypoint), shellJoin(image.Config.Entrypoint); got != want {
+		add("entrypoint", want, got)
+	}
+	if got, want := shellJoin(inspect.Config.Cmd), shellJoin(image.Config.Cmd); got != want {
+		add("command", want, got)
+	}
+
+	for _, port := range sortedPorts(inspect.Config.ExposedPorts) {
+		if _, ok := image.Config.ExposedPorts[nat.Port(port)]; !ok {
+			add("ports", "", port)
+		}
+	}
+
+	mounted := make(map[string]bool)
+	for _, m := range inspect.Mounts {
+		mounted[m.Destination] = true
+	}
+	for _, path := range sortedKeys(image.Config.Volumes) {
+		if !mounted[path] {
+			add("mounts", path, "")
+		}
+	}
+
+	return diffs
+}
+
+// composeDrift reports where the container departs from its service in the
+// compose file. Environment is compared against the image defaults overlaid
+// with the service's environment, since that is what compose would produce.
+func composeDrift(inspect types.ContainerJSON, image types.ImageInspect, svc apitypes.ServiceSpec) ([]apitypes.ConfigDifference, error) {
+	diffs := make([]apitypes.ConfigDifference, 0)
+	if inspect.Config == nil || inspect.HostConfig == nil {
+		return diffs, nil
+	}
+	add := func(field, expected, actual string) {
+		diffs = append(diffs, apitypes.ConfigDifference{Source: "compose", Field: field, Expected: expected, Actual: actual})
+	}
+
+	if svc.Image != inspect.Config.Image {
+		add("image", svc.Image, inspect.Config.Image)
+	}
+
+	expectedEnv := make(map[string]string)
+	if image.Config != nil {
+		expectedEnv = envMap(image.Config.Env)
+	}
+	for k, v := range svc.Environment {
+		expectedEnv[k] = v
+	}
+	diffs = append(diffs, envDrift("compose", expectedEnv, envMap(inspect.Config.Env))...)
+
+	if len(svc.Command) > 0 {
+		if got, want := shellJoin(inspect.Config.Cmd), shellJoin(svc.Command); got != want {
+			add("command", want, got)
+		}
+	}
+
+	expectedPorts := make(map[string]bool)
+	for _, spec := range svc.Ports {
+		mappings, err := nat.ParsePortSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %s: %w", spec, err)
+		}
+		for _, pm := range mappings {
+			expectedPorts[formatBinding(pm.Port, pm.Binding)] = true
+		}
+	}
+	actualPorts := make(map[string]bool)
+	for port, bindings := range inspect.HostConfig.PortBindings {
+		for _, b := range bindings {
+			actualPorts[formatBinding(port, b)] = true
+		}
+	}
+	diffs = append(diffs, setDrift("compose", "ports", expectedPorts, actualPorts)...)
+
+	expectedBinds := make(map[string]bool)
+	for _, v := range svc.Volumes {
+		expectedBinds[v] = true
+	}
+	actualBinds := make(map[string]bool)
+	for _, v := range inspect.HostConfig.Binds {
+		actualBinds[v] = true
+	}
+	diffs = append(diffs, setDrift("compose", "mounts", expectedBinds, actualBinds)...)
+
+	return diffs, nil
+}
+
+// envDrift reports variables whose runtime value differs from the expected
+// one, including variables set at runtime that were never declared.
+func envDrift(source string, expected, actual map[string]string) []apitypes.ConfigDifference {
+	keys := make(map[string]struct{})
+	for k := range expected {
+		keys[k] = struct{}{}
+	}
+	for k := range actual {
+		keys[k] = struct{}{}
+	}
+
+	diffs := make([]apitypes.ConfigDifference, 0)
+	for _, k := range sortedKeys(keys) {
+		if expected[k] != actual[k] {
+			diffs = append(diffs, apitypes.ConfigDifference{Source: source, Field: "env." + k, Expected: expected[k], Actual: actual[k]})
+		}
+	}
+	return diffs
+}
+
+// setDrift reports values declared but missing at runtime, then values
+// present at runtime but never declared.
+func setDrift(source, field string, expected, actual map[string]bool) []apitypes.ConfigDifference {
+	diffs := make([]apitypes.ConfigDifference, 0)
+	for _, v := range sortedKeys(expected) {
+		if !actual[v] {
+			diffs = append(diffs, apitypes.ConfigDifference{Source: source, Field: field, Expected: v})
+		}
+	}
+	for _, v := range sortedKeys(actual) {
+		if !expected[v] {
+			diffs = append(diffs, apitypes.ConfigDifference{Source: source, Field: field, Actual: v})
+		}
+	}
+	return diffs
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		m[k] = v
+	}
+	return m
+}
+
+// formatBinding renders a port binding as [ip:]hostPort:port/proto
+func formatBinding(port nat.Port, b nat.PortBinding) string {
+	s := fmt.Sprintf("%s:%s", b.HostPort, port)
+	if b.HostIP != "" && b.HostIP != "0.0.0.0" {
+		s = b.HostIP + ":" + s
+	}
+	return s
+}
+
+func sortedPorts(ports nat.PortSet) []string {
+	list := make([]string, 0, len(ports))
+	for p := range ports {
+		list = append(list, string(p))
+	}
+	sort.Strings(list)
+	return list
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
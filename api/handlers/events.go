@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/websocket"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/notify"
+)
+
+// eventClientBuffer is how many events may queue for a client before it is
+// considered too slow and disconnected. It reconnects with ?since= and
+// catches up from the replay buffer.
+const eventClientBuffer = 64
+
+// maxProbeOutput bounds the health probe output quoted in a notification
+const maxProbeOutput = 500
+
+// EventHub relays Docker events to WebSocket clients. It keeps the most
+// recent events so clients that connect late, or reconnect, can catch up.
+type EventHub struct {
+	client *client.Client
+	config *config.Store
+
+	// notifier, if set, is told about containers exiting with an error and
+	// failing health checks on the named endpoint
+	notifier *notify.Notifier
+	endpoint string
+	killed   map[string]bool // containers sent a signal, whose exit was asked for
+
+	// epoch tells this process's sequence numbers from those of an earlier
+	// run, which restart at 1 and would otherwise look like old events
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	buffer  []apitypes.Event // oldest first
+	clients map[chan apitypes.Event]struct{}
+}
+
+func NewEventHub(client *client.Client, cfg *config.Store) *EventHub {
+	return &EventHub{
+		client:  client,
+		config:  cfg,
+		killed:  make(map[string]bool),
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		clients: make(map[chan apitypes.Event]struct{}),
+	}
+}
+
+// UseNotifier sends notifications for the endpoint's container events
+func (h *EventHub) UseNotifier(notifier *notify.Notifier, endpoint string) {
+	h.notifier = notifier
+	h.endpoint = endpoint
+}
+
+// Run subscribes to the Docker event stream until ctx is cancelled,
+// resubscribing if the daemon connection drops.
+func (h *EventHub) Run(ctx context.Context) {
+	for {
+		msgs, errs := h.client.Events(ctx, events.ListOptions{})
+	stream:
+		for {
+			select {
+			case msg := <-msgs:
+				h.publish(toEvent(msg))
+				h.notify(msg)
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				slog.WarnContext(ctx, "Docker event stream interrupted", "error", err)
+				break stream
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func toEvent(msg events.Message) apitypes.Event {
+	eventType := string(msg.Type)
+	if msg.Type == events.DaemonEventType {
+		eventType = "system"
+	}
+	return apitypes.Event{
+		Type:    eventType,
+		Action:  string(msg.Action),
+		ID:      msg.Actor.ID,
+		Name:    msg.Actor.Attributes["name"],
+		Project: msg.Actor.Attributes["com.docker.compose.project"],
+		Time:    time.Unix(0, msg.TimeNano).UTC(),
+	}
+}
+
+// notify reports containers that exit with a non-zero code or turn
+// unhealthy. Stopping or killing a container sends it a signal first, so
+// exits that follow a kill event were asked for and aren't reported. Only
+// Run calls it, so killed needs no lock.
+func (h *EventHub) notify(msg events.Message) {
+	if h.notifier == nil || msg.Type != events.ContainerEventType {
+		return
+	}
+	name := msg.Actor.Attributes["name"]
+	if !hasNamePrefix(name, h.config.Get().NamePrefix) {
+		return
+	}
+	n := apitypes.Notification{
+		Endpoint:    h.endpoint,
+		Container:   name,
+		ContainerID: msg.Actor.ID,
+		Project:     msg.Actor.Attributes["com.docker.compose.project"],
+		Time:        time.Unix(0, msg.TimeNano).UTC(),
+	}
+	image := msg.Actor.Attributes["image"]
+
+	switch msg.Action {
+	case events.ActionKill:
+		h.killed[msg.Actor.ID] = true
+		return
+	case events.ActionStart, events.ActionDestroy:
+		delete(h.killed, msg.Actor.ID)
+		return
+	case events.ActionDie:
+		killed := h.killed[msg.Actor.ID]
+		delete(h.killed, msg.Actor.ID)
+		code := msg.Actor.Attributes["exitCode"]
+		if killed || code == "" || code == "0" {
+			return
+		}
+		n.Event = "container-exited"
+		n.Title = fmt.Sprintf("Container %s exited with code %s", name, code)
+		n.Message = fmt.Sprintf("Container %s (%s) exited unexpectedly with code %s.", name, image, code)
+	case events.ActionHealthStatusUnhealthy:
+		n.Event = "health-failing"
+		n.Title = fmt.Sprintf("Container %s is unhealthy", name)
+		n.Message = fmt.Sprintf("The health check of container %s (%s) is failing.", name, image)
+		go h.notifyUnhealthy(n)
+		return
+	default:
+		return
+	}
+	h.notifier.Notify(n)
+}
+
+// notifyUnhealthy adds the failing streak and the output of the last probe
+// to an unhealthy notification. It inspects the container, so it runs apart
+// from the event stream.
+func (h *EventHub) notifyUnhealthy(n apitypes.Notification) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Get().DockerReadTimeout)
+	defer cancel()
+
+	if inspect, err := h.client.ContainerInspect(ctx, n.ContainerID); err == nil {
+		health := containerHealth(inspect)
+		if health.FailingStreak > 0 {
+			n.Message += fmt.Sprintf(" %d probes in a row have failed.", health.FailingStreak)
+		}
+		if len(health.Log) > 0 {
+			last := health.Log[len(health.Log)-1]
+			if output := strings.TrimSpace(last.Output); output != "" {
+				if len(output) > maxProbeOutput {
+					output = strings.ToValidUTF8(output[:maxProbeOutput], "") + "..."
+				}
+				n.Message += fmt.Sprintf("\nLast probe (exit code %d): %s", last.ExitCode, output)
+			}
+		}
+	}
+	h.notifier.Notify(n)
+}
+
+func (h *EventHub) publish(e apitypes.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e.Epoch = h.epoch
+	e.Seq = h.seq
+
+	h.buffer = append(h.buffer, e)
+	if size := h.config.Get().EventReplaySize; len(h.buffer) > size {
+		h.buffer = append(h.buffer[:0], h.buffer[len(h.buffer)-size:]...)
+	}
+
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client and returns the buffered events after since.
+// Both happen under the lock so no event falls between replay and live.
+func (h *EventHub) subscribe(epoch string, since uint64) ([]apitypes.Event, apitypes.ReplayEnd, chan apitypes.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Another epoch means the server restarted since the client last
+	// connected, and so does a sequence from the future from clients that
+	// don't send one; the old numbering no longer applies.
+	reset := since > 0 && ((epoch != "" && epoch != h.epoch) || since > h.seq)
+	if reset {
+		since = 0
+	}
+
+	replay := make([]apitypes.Event, 0)
+	for _, e := range h.buffer {
+		if e.Seq > since {
+			e.Replay = true
+			replay = append(replay, e)
+		}
+	}
+	end := apitypes.ReplayEnd{
+		Type:      "replay_end",
+		Epoch:     h.epoch,
+		Reset:     reset,
+		Replayed:  len(replay),
+		Seq:       h.seq,
+		Truncated: since > 0 && len(h.buffer) > 0 && h.buffer[0].Seq > since+1,
+	}
+
+	ch := make(chan apitypes.Event, eventClientBuffer)
+	h.clients[ch] = struct{}{}
+	return replay, end, ch
+}
+
+func (h *EventHub) unsubscribe(ch chan apitypes.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// parseEventID parses an event ID as sent to SSE clients, {epoch}-{seq}, or
+// a bare sequence number
+func parseEventID(v string) (string, uint64, bool) {
+	epoch, seq, ok := strings.Cut(v, "-")
+	if !ok {
+		epoch, seq = "", v
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || (ok && epoch == "") {
+		return "", 0, false
+	}
+	return epoch, n, true
+}
+
+// HandleWebSocket streams events to a WebSocket client. Buffered events newer
+// than ?since= are sent first with replay set, followed by a replay_end
+// message, then live events. since takes {epoch}-{seq}, or a sequence with
+// the epoch in ?epoch=; every buffered event is replayed if the epoch is
+// from an earlier server process.
+func (h *EventHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var epoch string
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var ok bool
+		epoch, since, ok = parseEventID(v)
+		if !ok {
+			http.Error(w, "Invalid since: must be an event ID or sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	if epoch == "" {
+		epoch = r.URL.Query().Get("epoch")
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		replay, end, ch := h.subscribe(epoch, since)
+		defer h.unsubscribe(ch)
+
+		for _, e := range replay {
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		}
+		if err := websocket.JSON.Send(ws, end); err != nil {
+			return
+		}
+
+		// The client never sends anything; reading only detects disconnects
+		// and consumes the pongs answering our pings, which show the client
+		// is still there while no events arrive.
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ping.C:
+				ws.PayloadType = websocket.PingFrame
+				_, err := ws.Write(nil)
+				ws.PayloadType = websocket.TextFrame
+				if err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
+
+// sseEventTypes are the event types HandleSSE forwards when no type filter
+// is given
+var sseEventTypes = []string{"container", "image", "network", "volume"}
+
+// eventFilter matches events against the filter query parameters of
+// HandleSSE. Each parameter may be repeated or comma separated; an event
+// must match one value of every parameter given.
+type eventFilter struct {
+	types    map[string]bool
+	actions  map[string]bool
+	names    map[string]bool
+	projects map[string]bool
+}
+
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	values := func(key string) map[string]bool {
+		var set map[string]bool
+		for _, v := range r.URL.Query()[key] {
+			for _, part := range strings.Split(v, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					if set == nil {
+						set = make(map[string]bool)
+					}
+					set[part] = true
+				}
+			}
+		}
+		return set
+	}
+
+	f := eventFilter{
+		types:    values("type"),
+		actions:  values("action"),
+		names:    values("name"),
+		projects: values("project"),
+	}
+	if f.types == nil {
+		f.types = make(map[string]bool)
+		for _, t := range sseEventTypes {
+			f.types[t] = true
+		}
+	}
+	for t := range f.types {
+		switch t {
+		case "container", "image", "network", "volume", "system":
+		default:
+			return eventFilter{}, fmt.Errorf("invalid type %q: must be container, image, network, volume or system", t)
+		}
+	}
+	return f, nil
+}
+
+func (f eventFilter) match(e apitypes.Event) bool {
+	// Actions such as "exec_start: sh" carry details after the colon
+	action, _, _ := strings.Cut(e.Action, ":")
+	return f.types[e.Type] &&
+		(f.actions == nil || f.actions[action]) &&
+		(f.names == nil || f.names[e.Name] || f.names[e.ID]) &&
+		(f.projects == nil || f.projects[e.Project])
+}
+
+// HandleSSE streams events as server-sent events, each with its epoch and
+// sequence number as the event id, so a reconnecting EventSource resumes from
+// Last-Event-ID (or ?since=) out of the replay buffer, or replays all of it
+// after a server restart. Only container,
+// image, network and volume events are sent unless type says otherwise;
+// action, name and project narrow the stream further.
+func (h *EventHub) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var epoch string
+	var since uint64
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("since")
+	}
+	if v != "" {
+		var ok bool
+		epoch, since, ok = parseEventID(v)
+		if !ok {
+			http.Error(w, "Invalid since: must be an event ID or sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	replay, end, ch := h.subscribe(epoch, since)
+	defer h.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	flush := func() error {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return r.Context().Err()
+	}
+	send := func(e apitypes.Event) error {
+		if !filter.match(e) {
+			return nil
+		}
+		payload, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", e.Epoch, e.Seq, e.Type, payload); err != nil {
+			return err
+		}
+		return flush()
+	}
+
+	for _, e := range replay {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	payload, _ := json.Marshal(end)
+	fmt.Fprintf(w, "id: %s-%d\nevent: replay_end\ndata: %s\n\n", end.Epoch, end.Seq, payload)
+	if flush() != nil {
+		return
+	}
+
+	// Comments keep proxies from closing the connection while no events
+	// arrive, and notice clients that went away.
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil || flush() != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
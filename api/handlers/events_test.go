@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"testing"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+func TestSubscribeEpoch(t *testing.T) {
+	h := NewEventHub(nil, config.NewStore(&config.Config{EventReplaySize: 10}, config.Options{}))
+	for range 3 {
+		h.publish(apitypes.Event{Type: "container"})
+	}
+
+	tests := []struct {
+		name   string
+		epoch  string
+		since  uint64
+		replay int
+		reset  bool
+	}{
+		{"same epoch", h.epoch, 2, 1, false},
+		{"bare sequence", "", 2, 1, false},
+		{"bare sequence from the future", "", 9, 3, true},
+		{"earlier epoch", "old", 2, 3, true},
+		{"earlier epoch from the start", "old", 0, 3, false},
+	}
+	for _, tt := range tests {
+		replay, end, ch := h.subscribe(tt.epoch, tt.since)
+		h.unsubscribe(ch)
+		if len(replay) != tt.replay || end.Reset != tt.reset || end.Epoch != h.epoch || end.Seq != 3 {
+			t.Errorf("%s: replayed %d, %+v; want %d replayed, reset %v", tt.name, len(replay), end, tt.replay, tt.reset)
+		}
+		for _, e := range replay {
+			if e.Epoch != h.epoch {
+				t.Errorf("%s: event epoch = %q, want %q", tt.name, e.Epoch, h.epoch)
+			}
+		}
+	}
+}
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		id    string
+		epoch string
+		seq   uint64
+		ok    bool
+	}{
+		{"12", "", 12, true},
+		{"abc-12", "abc", 12, true},
+		{"-12", "", 0, false},
+		{"abc-", "", 0, false},
+		{"abc", "", 0, false},
+	}
+	for _, tt := range tests {
+		epoch, seq, ok := parseEventID(tt.id)
+		if epoch != tt.epoch || seq != tt.seq || ok != tt.ok {
+			t.Errorf("parseEventID(%q) = %q, %d, %v; want %q, %d, %v", tt.id, epoch, seq, ok, tt.epoch, tt.seq, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// maxFileEntries bounds how many entries a listing returns, and
+// maxFileListBytes how much of the directory's archive it reads. Listing /
+// has the daemon send the whole filesystem, so a listing behind a large
+// subdirectory is cut short rather than tying up the daemon.
+const (
+	maxFileEntries   = 10000
+	maxFileListBytes = 64 << 20
+)
+
+// containerFilePath reads the path query parameter, defaulting to the root.
+// Paths must be absolute; they are cleaned so .. can't confuse the archive
+// name.
+func containerFilePath(r *http.Request) (string, error) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		return "/", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("path must be absolute")
+	}
+	return path.Clean(p), nil
+}
+
+// ListContainerFiles lists a directory in a container's filesystem. A path
+// naming a file returns just that entry. Works on stopped containers too.
+func (h *ContainerHandler) ListContainerFiles(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	dir, err := containerFilePath(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	stat, err := docker.StatContainerPath(ctx, h.client, id, dir)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Path not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to stat path: %v", err), failureStatus(err))
+		return
+	}
+
+	list := apitypes.ContainerFileList{Path: dir, Entries: []apitypes.ContainerFile{stat}}
+	if stat.Type == "dir" {
+		list.Entries, list.Truncated, err = docker.ListContainerDir(ctx, h.client, id, dir, maxFileEntries, maxFileListBytes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list path: %v", err), failureStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// DownloadContainerArchive streams a file or directory from a container as
+// an uncompressed tar, as the daemon produces it.
+func (h *ContainerHandler) DownloadContainerArchive(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	src, err := containerFilePath(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	rc, _, err := h.client.CopyFromContainer(ctx, id, src)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Path not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to copy from container: %v", err), failureStatus(err))
+		return
+	}
+	defer rc.Close()
+
+	name := path.Base(src)
+	if name == "/" {
+		name = "rootfs"
+	}
+	auditLog(r, "Container files downloaded", "container", id, "path", src)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+	copyDownload(w, r, rc, "Failed to download container files", "container", id, "path", src)
+}
+
+// ExportContainer streams a container's whole filesystem as a flat tar, as
+// docker export makes it. Volumes aren't included, and neither is the
+// image's history: importing it gives a single-layer image. A POST with
+// target=s3 stores the tar under exports/containers/ in the bucket instead.
+func (h *ContainerHandler) ExportContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+	bucket, ok := exportTarget(w, r, h.config)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	cancel()
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+
+	rc, err := h.client.ContainerExport(r.Context(), inspect.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to export container: %v", err), failureStatus(err))
+		return
+	}
+	defer rc.Close()
+
+	name := strings.TrimPrefix(inspect.Name, "/")
+
+	// A large filesystem takes longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if bucket != nil {
+		key := fmt.Sprintf("exports/containers/%s-%s.tar", name, time.Now().UTC().Format(storageStampFormat))
+		if exportObject(w, r, bucket, key, "application/x-tar", rc) {
+			auditLog(r, "Container exported", "container", name, "id", inspect.ID, "key", key)
+		}
+		return
+	}
+	auditLog(r, "Container exported", "container", name, "id", inspect.ID)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+	copyDownload(w, r, rc, "Failed to export container", "container", name)
+}
+
+// changeKinds names the daemon's change types
+var changeKinds = map[container.ChangeType]string{
+	container.ChangeAdd:    "added",
+	container.ChangeModify: "modified",
+	container.ChangeDelete: "deleted",
+}
+
+// GetContainerChanges lists the paths the container has added, modified or
+// deleted relative to its image, sorted by path. kind narrows them to one
+// kind of change.
+func (h *ContainerHandler) GetContainerChanges(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case "", "added", "modified", "deleted":
+	default:
+		http.Error(w, "Invalid kind: must be added, modified or deleted", http.StatusBadRequest)
+		return
+	}
+
+	// Diffing walks the container's writable layer, so allow it a write
+	// timeout
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	diff, err := h.client.ContainerDiff(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to get container changes: %v", err), failureStatus(err))
+		return
+	}
+
+	changes := make([]apitypes.ContainerChange, 0, len(diff))
+	for _, change := range diff {
+		if kind != "" && changeKinds[change.Kind] != kind {
+			continue
+		}
+		changes = append(changes, apitypes.ContainerChange{Path: change.Path, Kind: changeKinds[change.Kind]})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	writeList(w, params, changes)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// filesDaemon is a container whose root holds bin, a usr tree with more
+// entries than a listing returns and a large file, and var after it
+func filesDaemon(t *testing.T) *client.Client {
+	t.Helper()
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stat, _ := json.Marshal(map[string]any{"name": "/", "mode": uint32(fs.ModeDir | 0o755), "mtime": time.Now()})
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+		if r.Method == http.MethodHead {
+			return
+		}
+		tw := tar.NewWriter(w)
+		dir := func(name string) {
+			tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0o755})
+		}
+		dir("bin")
+		dir("usr")
+		for i := 0; i < maxFileEntries+10; i++ {
+			tw.WriteHeader(&tar.Header{Name: "usr/lib/f" + strconv.Itoa(i), Typeflag: tar.TypeReg, Mode: 0o644})
+		}
+		big := strings.Repeat("x", 1<<20)
+		tw.WriteHeader(&tar.Header{Name: "usr/big", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(big))})
+		tw.Write([]byte(big))
+		dir("var")
+		tw.Close()
+	}))
+	t.Cleanup(daemon.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Only direct children count toward the entry cap, so a large subdirectory
+// doesn't hide the entries after it
+func TestListContainerFilesCountsDirectChildren(t *testing.T) {
+	cfg := config.NewStore(&config.Config{DockerWriteTimeout: 5 * time.Second}, config.Options{})
+	h := NewContainerHandler(filesDaemon(t), cfg)
+
+	w := httptest.NewRecorder()
+	h.ListContainerFiles(w, httptest.NewRequest(http.MethodGet, "/containers/abc/files?path=/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var list apitypes.ContainerFileList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range list.Entries {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, ",") != "bin,usr,var" || list.Truncated {
+		t.Errorf("entries = %v, truncated %v; want bin, usr and var in full", names, list.Truncated)
+	}
+}
+
+// Reading stops once the byte budget is spent, and the list says so
+func TestListContainerDirByteBudget(t *testing.T) {
+	entries, truncated, err := docker.ListContainerDir(context.Background(), filesDaemon(t), "abc", "/", maxFileEntries, 512<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || len(entries) != 2 {
+		t.Errorf("got %d entries, truncated %v; want bin and usr, truncated", len(entries), truncated)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/auth"
+)
+
+// deploymentHistorySize is how many records are kept per project
+const deploymentHistorySize = 100
+
+// deploymentHistory keeps the most recent up, down and scale actions of each
+// compose project in memory. It is lost on restart.
+type deploymentHistory struct {
+	mu       sync.Mutex
+	projects map[string][]apitypes.DeploymentRecord
+}
+
+func newDeploymentHistory() *deploymentHistory {
+	return &deploymentHistory{projects: make(map[string][]apitypes.DeploymentRecord)}
+}
+
+func (d *deploymentHistory) add(project string, record apitypes.DeploymentRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	records := append(d.projects[project], record)
+	if len(records) > deploymentHistorySize {
+		records = records[len(records)-deploymentHistorySize:]
+	}
+	d.projects[project] = records
+}
+
+// list returns a project's records, newest first.
+func (d *deploymentHistory) list(project string) []apitypes.DeploymentRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	records := d.projects[project]
+	result := make([]apitypes.DeploymentRecord, len(records))
+	for i, record := range records {
+		result[len(records)-1-i] = record
+	}
+	return result
+}
+
+// recordDeployment stamps record with the time and requesting user and adds
+// it to the project's history.
+func (h *ComposeHandler) recordDeployment(r *http.Request, project string, record apitypes.DeploymentRecord) {
+	h.addDeployment(requestUser(r), project, record)
+}
+
+// addDeployment stamps record with the time and user and adds it to the
+// project's history, for deployments not made through a request.
+func (h *ComposeHandler) addDeployment(user, project string, record apitypes.DeploymentRecord) {
+	record.Time = time.Now().UTC()
+	record.User = user
+	if record.Images == nil {
+		record.Images = map[string]string{}
+	}
+	h.history.add(project, record)
+}
+
+// requestUser identifies who made a request: the logged-in user, the user
+// an authenticating reverse proxy passed along, or else the client address.
+func requestUser(r *http.Request) string {
+	if user, ok := auth.UserFromContext(r.Context()); ok {
+		return user
+	}
+	for _, header := range []string{"X-Forwarded-User", "X-Remote-User"} {
+		if user := r.Header.Get(header); user != "" {
+			return user
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// auditLog writes a security-relevant action to the log with audit=true and
+// the user who made the request
+func auditLog(r *http.Request, msg string, args ...any) {
+	slog.InfoContext(r.Context(), msg, append([]any{"audit", true, "user", requestUser(r)}, args...)...)
+}
+
+// GetProjectHistory returns the recorded up, down and scale actions of a
+// project, newest first. Projects never acted upon have an empty history.
+func (h *ComposeHandler) GetProjectHistory(w http.ResponseWriter, r *http.Request) {
+	name, ok := pathProject(w, r)
+	if !ok {
+		return
+	}
+
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeList(w, params, h.history.list(name))
+}
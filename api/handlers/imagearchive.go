@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// importProgressInterval is how often an image import reports the bytes
+// received while the daemon is silent
+const importProgressInterval = 500 * time.Millisecond
+
+// ExportImage streams an image as a tarball made by docker save, to be
+// imported on a host without registry access. X-Image-Size carries the
+// image's size so clients can estimate the download's progress. A POST with
+// target=s3 stores the tarball under exports/images/ in the bucket instead,
+// and returns the object.
+func (h *ImageHandler) ExportImage(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/export")
+	bucket, ok := exportTarget(w, r, h.config)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	inspect, _, err := h.client.ImageInspectWithRaw(ctx, ref)
+	cancel()
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Image not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect image: %v", err), failureStatus(err))
+		return
+	}
+
+	rc, err := h.client.ImageSave(r.Context(), []string{ref})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to export image: %v", err), failureStatus(err))
+		return
+	}
+	defer rc.Close()
+
+	// A large image takes longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(ref)
+	if bucket != nil {
+		key := fmt.Sprintf("exports/images/%s-%s.tar", name, time.Now().UTC().Format(storageStampFormat))
+		if exportObject(w, r, bucket, key, "application/x-tar", rc) {
+			auditLog(r, "Image exported", "image", ref, "id", inspect.ID, "key", key)
+		}
+		return
+	}
+	auditLog(r, "Image exported", "image", ref, "id", inspect.ID)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+	w.Header().Set("X-Image-Size", strconv.FormatInt(inspect.Size, 10))
+	copyDownload(w, r, rc, "Failed to export image", "image", ref)
+}
+
+// ImportImage loads the images in a tarball made by docker save (optionally
+// compressed), sent as the request body or as the image field of a
+// multipart form, or read from the object under key= in the bucket. Progress is streamed as NDJSON ImageLoadProgress lines:
+// the bytes received so far, the daemon's messages while it unpacks the
+// layers, a "loaded" line per image, and finally "done" with the images
+// loaded, or the error.
+func (h *ImageHandler) ImportImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The upload outlasts the server's timeouts and keeps being read while
+	// progress is written
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	controller.EnableFullDuplex()
+
+	var input io.Reader = r.Body
+	total := r.ContentLength
+	key := r.URL.Query().Get("key")
+	if key != "" {
+		bucket, ok := enabledBucket(w, h.config)
+		if !ok {
+			return
+		}
+		if !validObjectKey(key) {
+			http.Error(w, "Invalid object key", http.StatusBadRequest)
+			return
+		}
+		rc, obj, err := bucket.Get(r.Context(), key)
+		if err != nil {
+			writeObjectError(w, "read", err)
+			return
+		}
+		defer rc.Close()
+		input, total = rc, obj.Size
+	} else if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		// The file is read as it arrives rather than buffered to disk first
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				http.Error(w, "Missing image file", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "image" {
+				input = part
+				break
+			}
+		}
+	}
+	received := &countingReader{reader: input}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(event apitypes.ImageLoadProgress) {
+		event.BytesDone = received.n.Load()
+		if total > 0 {
+			event.BytesTotal = total
+		}
+		encoder.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// The load runs on its own goroutine so upload progress can be sent
+	// while the daemon is still reading; all writes stay on this one.
+	events := make(chan apitypes.ImageLoadProgress, 16)
+	done := make(chan error, 1)
+	var loaded []string
+	go func() {
+		var err error
+		loaded, err = docker.NewImageManager(h.client).Load(ctx, received, func(event apitypes.ImageLoadProgress) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+		done <- err
+	}()
+
+	ticker := time.NewTicker(importProgressInterval)
+	defer ticker.Stop()
+	var reported int64
+	for {
+		select {
+		case event := <-events:
+			reported = received.n.Load()
+			send(event)
+		case <-ticker.C:
+			if n := received.n.Load(); n != reported {
+				send(apitypes.ImageLoadProgress{Status: "uploading"})
+				reported = n
+			}
+		case err := <-done:
+			for drained := false; !drained; {
+				select {
+				case event := <-events:
+					send(event)
+				default:
+					drained = true
+				}
+			}
+			if err != nil {
+				auditLog(r, "Image import failed", "error", err)
+				send(apitypes.ImageLoadProgress{Status: "error", Error: err.Error(), Images: loaded})
+				return
+			}
+			auditLog(r, "Images imported", "images", strings.Join(loaded, ","), "bytes", received.n.Load(), "key", key)
+			send(apitypes.ImageLoadProgress{Status: "done", Images: loaded})
+			return
+		}
+	}
+}
+
+// countingReader counts the bytes read through it, safe to read from
+// another goroutine
+type countingReader struct {
+	reader io.Reader
+	n      atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -1,55 +1,169 @@
 package handlers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/system"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-units"
 	"golang.org/x/net/websocket"
 
 	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
 )
 
+// pullRetryBackoff is the delay before retrying a failed pull; it doubles
+// with each further attempt
+const pullRetryBackoff = 2 * time.Second
+
+// maxBatchImages caps the images one batch delete may name
+const maxBatchImages = 500
+
+// pullKeepAlive is how long a streamed pull may go without progress before
+// a keep-alive line is sent
+const pullKeepAlive = 5 * time.Second
+
 type ImageHandler struct {
 	client *client.Client
+	config *config.Store
+
+	// registryAuth holds registry logins for pulls, pushes and builds; nil
+	// if none are set up
+	registryAuth docker.RegistryAuth
 }
 
-func NewImageHandler(client *client.Client) *ImageHandler {
-	return &ImageHandler{client: client}
+func NewImageHandler(client *client.Client, cfg *config.Store, registryAuth docker.RegistryAuth) *ImageHandler {
+	return &ImageHandler{client: client, config: cfg, registryAuth: registryAuth}
 }
 
+// ListImages lists images, optionally filtered by dangling, reference (a
+// glob such as nginx:*) and label (passed to Docker), by minSize and maxSize
+// (byte sizes such as 100m) and by in_use, which is worked out from the
+// containers using each image. sort (size or created) and order (desc unless
+// asc is given) arrange the list; without sort, size-filtered results are
+// sorted largest first.
 func (h *ImageHandler) ListImages(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancel()
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var minSize, maxSize int64
+	for _, bound := range []struct {
+		name string
+		dst  *int64
+	}{{"minSize", &minSize}, {"maxSize", &maxSize}} {
+		v := query.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		size, err := units.RAMInBytes(v)
+		if err != nil || size < 0 {
+			http.Error(w, fmt.Sprintf("Invalid %s %q: must be a size such as 500k, 100m or 2g", bound.name, v), http.StatusBadRequest)
+			return
+		}
+		*bound.dst = size
+	}
+	if maxSize > 0 && minSize > maxSize {
+		http.Error(w, "Invalid size range: minSize is greater than maxSize", http.StatusBadRequest)
+		return
+	}
+	sizeFiltered := minSize > 0 || maxSize > 0
 
 	// Parse filter query parameters
 	filterArgs := filters.NewArgs()
-	if dangling := r.URL.Query().Get("dangling"); dangling != "" {
+	if dangling := query.Get("dangling"); dangling != "" {
+		if _, err := strconv.ParseBool(dangling); err != nil {
+			http.Error(w, "Invalid dangling: must be true or false", http.StatusBadRequest)
+			return
+		}
 		filterArgs.Add("dangling", dangling)
 	}
-	if reference := r.URL.Query().Get("reference"); reference != "" {
+	if reference := query.Get("reference"); reference != "" {
 		filterArgs.Add("reference", reference)
 	}
+	for _, label := range query["label"] {
+		if key, _, _ := strings.Cut(label, "="); key == "" {
+			http.Error(w, fmt.Sprintf("Invalid label %q: must be key or key=value", label), http.StatusBadRequest)
+			return
+		}
+		filterArgs.Add("label", label)
+	}
+	var inUse *bool
+	if v := query.Get("in_use"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid in_use: must be true or false", http.StatusBadRequest)
+			return
+		}
+		inUse = &b
+	}
+	sortBy := query.Get("sort")
+	if sortBy != "" && sortBy != "size" && sortBy != "created" {
+		http.Error(w, fmt.Sprintf("Invalid sort %q: must be size or created", sortBy), http.StatusBadRequest)
+		return
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		http.Error(w, fmt.Sprintf("Invalid order %q: must be asc or desc", order), http.StatusBadRequest)
+		return
+	}
 
-	images, err := h.client.ImageList(ctx, image.ListOptions{
-		All:     true,
-		Filters: filterArgs,
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	images, err := retryRead(ctx, h.config, func(ctx context.Context) ([]image.Summary, error) {
+		return h.client.ImageList(ctx, image.ListOptions{
+			All:     true,
+			Filters: filterArgs,
+		})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list images: %v", err), failureStatus(err))
+		return
+	}
+	// Every container counts, whatever the name prefix, since any of them
+	// keeps its image from being removed
+	containers, err := retryRead(ctx, h.config, func(ctx context.Context) ([]types.Container, error) {
+		return h.client.ContainerList(ctx, container.ListOptions{All: true})
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list images: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), failureStatus(err))
 		return
 	}
+	users := make(map[string]int)
+	for _, c := range containers {
+		users[c.ImageID]++
+	}
 
 	response := make([]apitypes.ImageInfo, 0, len(images))
 	for _, img := range images {
+		if img.Size < minSize || (maxSize > 0 && img.Size > maxSize) {
+			continue
+		}
+		if inUse != nil && (users[img.ID] > 0) != *inUse {
+			continue
+		}
 		response = append(response, apitypes.ImageInfo{
 			ID:          img.ID,
 			ParentID:    img.ParentID,
@@ -60,21 +174,49 @@ func (h *ImageHandler) ListImages(w http.ResponseWriter, r *http.Request) {
 			SharedSize:  img.SharedSize,
 			VirtualSize: img.VirtualSize,
 			Labels:      img.Labels,
+			Dangling:    danglingImage(img.RepoTags),
+			InUse:       users[img.ID] > 0,
+			Containers:  users[img.ID],
 		})
 	}
+	switch {
+	case sortBy != "":
+		sortImages(response, sortBy, order != "asc")
+	case sizeFiltered:
+		sortImages(response, "size", true)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeList(w, params, response)
+}
+
+// sortImages orders images by size or created time, breaking ties by id
+func sortImages(images []apitypes.ImageInfo, field string, desc bool) {
+	slices.SortStableFunc(images, func(a, b apitypes.ImageInfo) int {
+		c := cmp.Compare(a.Size, b.Size)
+		if field == "created" {
+			c = a.Created.Compare(b.Created)
+		}
+		if c == 0 {
+			c = strings.Compare(a.ID, b.ID)
+		}
+		if desc {
+			return -c
+		}
+		return c
+	})
 }
 
 func (h *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	id := strings.TrimPrefix(r.URL.Path, "/images/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	inspect, _, err := h.client.ImageInspectWithRaw(ctx, id)
+	inspect, err := retryRead(ctx, h.config, func(ctx context.Context) (types.ImageInspect, error) {
+		inspect, _, err := h.client.ImageInspectWithRaw(ctx, id)
+		return inspect, err
+	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Image not found: %v", err), http.StatusNotFound)
 		return
@@ -85,13 +227,13 @@ func (h *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *ImageHandler) RemoveImage(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	id := strings.TrimPrefix(r.URL.Path, "/images/")
 	id = strings.Split(id, "/")[0]
 
 	force := r.URL.Query().Get("force") == "true"
 	prune := r.URL.Query().Get("prune") == "true"
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
 	_, err := h.client.ImageRemove(ctx, id, image.RemoveOptions{
@@ -99,65 +241,513 @@ func (h *ImageHandler) RemoveImage(w http.ResponseWriter, r *http.Request) {
 		PruneChildren: prune,
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to remove image: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to remove image: %v", err), failureStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// BatchDeleteImages removes several images, one at a time in the order
+// given since removing one can change what a later id or tag refers to. A
+// failure does not stop the rest; each image gets its own result.
+func (h *ImageHandler) BatchDeleteImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apitypes.ImageBatchDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Images) == 0 {
+		http.Error(w, "No images given", http.StatusBadRequest)
+		return
+	}
+	if len(req.Images) > maxBatchImages {
+		http.Error(w, fmt.Sprintf("Too many images: at most %d per batch", maxBatchImages), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(req.Images))
+	for _, ref := range req.Images {
+		if ref == "" || seen[ref] {
+			http.Error(w, fmt.Sprintf("Invalid image %q: images must be non-empty and unique", ref), http.StatusBadRequest)
+			return
+		}
+		seen[ref] = true
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	slog.InfoContext(r.Context(), "Deleting images", "images", len(req.Images), "force", req.Force, "prune_children", req.PruneChildren)
+	batch := apitypes.ImageBatchDeleteResult{Images: make([]apitypes.ImageDeleteResult, 0, len(req.Images))}
+	for _, ref := range req.Images {
+		result := apitypes.ImageDeleteResult{Image: ref, Status: http.StatusOK}
+		deleted, err := h.client.ImageRemove(ctx, ref, image.RemoveOptions{
+			Force:         req.Force,
+			PruneChildren: req.PruneChildren,
+		})
+		switch {
+		case err == nil:
+			result.Success = true
+			for _, item := range deleted {
+				if item.Untagged != "" {
+					result.Untagged = append(result.Untagged, item.Untagged)
+				}
+				if item.Deleted != "" {
+					result.Deleted = append(result.Deleted, item.Deleted)
+				}
+			}
+			batch.Removed++
+		case errdefs.IsNotFound(err):
+			result.Status, result.Error = http.StatusNotFound, fmt.Sprintf("Image not found: %v", err)
+		case errdefs.IsConflict(err):
+			result.Status, result.Error = http.StatusConflict, fmt.Sprintf("Failed to remove image: %v", err)
+		default:
+			result.Status, result.Error = http.StatusInternalServerError, fmt.Sprintf("Failed to remove image: %v", err)
+		}
+		if !result.Success {
+			batch.Failed++
+		}
+		batch.Images = append(batch.Images, result)
+	}
+	batch.Success = batch.Failed == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// TagImage adds a tag to an image, at /images/{id}/tag. The id may be an
+// image ID or a reference, which can itself contain slashes.
+func (h *ImageHandler) TagImage(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/tag")
+
+	var req apitypes.ImageTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	target := req.Repo
+	if req.Tag != "" {
+		target += ":" + req.Tag
+	}
+	if _, err := reference.ParseNormalizedNamed(target); err != nil || req.Repo == "" {
+		http.Error(w, fmt.Sprintf("Invalid tag %q", target), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := docker.NewImageManager(h.client).Tag(ctx, id, target); err != nil {
+		status := http.StatusInternalServerError
+		if errdefs.IsNotFound(err) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to tag image: %v", err), status)
+		return
+	}
+	auditLog(r, "Image tagged", "image", id, "target", target)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// PushImage pushes an image reference to its registry, at
+// /images/{ref}/push, streaming NDJSON PushProgress lines. Credentials for
+// the registry come from the request body or else the stored logins.
+// all=true pushes every tag of the repository.
+func (h *ImageHandler) PushImage(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/push")
+
+	var req apitypes.PushRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	var cred *apitypes.RegistryCredential
+	if req.Username != "" {
+		cred = &apitypes.RegistryCredential{Username: req.Username, Password: req.Password}
+	}
+	encodedAuth, err := docker.EncodedRegistryAuth(h.registryAuth, ref, cred)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, parseErr := reference.ParseNormalizedNamed(ref); parseErr != nil {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Failed to push image: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(msg apitypes.PushProgress) {
+		encoder.Encode(msg)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	digest, err := docker.NewImageManager(h.client).Push(r.Context(), ref, encodedAuth, r.URL.Query().Get("all") == "true", send)
+	if err != nil {
+		auditLog(r, "Image push failed", "image", ref, "error", err)
+		send(apitypes.PushProgress{Status: "error", Error: err.Error()})
+		return
+	}
+	auditLog(r, "Image pushed", "image", ref, "digest", digest)
+	send(apitypes.PushProgress{Status: "done", Digest: digest})
+}
+
+// PullImage pulls an image, streaming the daemon's per-layer progress as
+// NDJSON PullProgress lines, or as server-sent events when the client
+// accepts text/event-stream. The image is given as JSON ({"image", "tag",
+// "registry"}) or with the name, tag and registry query parameters. While
+// the daemon reports nothing, a keep-alive line repeats the totals with
+// idleSeconds set, so clients can show a stalled pull. The last line has
+// status "done", or carries the error. WebSocket clients get the same
+// progress as JSON messages.
 func (h *ImageHandler) PullImage(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// A pull over a WebSocket is a GET, which isn't otherwise audited
+		recordAudit(r)
+		h.pullImageWebSocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pullReq apitypes.PullRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&pullReq); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	query := r.URL.Query()
+	pullReq.Image = firstNonEmpty(pullReq.Image, query.Get("name"), query.Get("image"))
+	pullReq.Tag = firstNonEmpty(pullReq.Tag, query.Get("tag"))
+	pullReq.Registry = firstNonEmpty(pullReq.Registry, query.Get("registry"))
+	if pullReq.Image == "" {
+		http.Error(w, "Missing image name", http.StatusBadRequest)
+		return
+	}
+	mirror, err := h.pullMirror(pullReq.Registry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(event apitypes.PullProgress) {
+		if sse {
+			payload, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", payload)
+		} else {
+			encoder.Encode(event)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// The pull runs on its own goroutine so keep-alives can be sent while
+	// the daemon is silent; all writes stay on this one.
+	events := make(chan apitypes.PullProgress, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.pull(ctx, pullImageRef(pullReq), mirror, func(event apitypes.PullProgress) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(pullKeepAlive)
+	defer ticker.Stop()
+	var last apitypes.PullProgress
+	lastAt := time.Now()
+	for {
+		select {
+		case event := <-events:
+			send(event)
+			last, lastAt = event, time.Now()
+		case <-ticker.C:
+			if idle := time.Since(lastAt); idle >= pullKeepAlive {
+				send(apitypes.PullProgress{
+					Status:      "waiting",
+					Attempt:     last.Attempt,
+					LayersDone:  last.LayersDone,
+					LayersTotal: last.LayersTotal,
+					BytesDone:   last.BytesDone,
+					BytesTotal:  last.BytesTotal,
+					IdleSeconds: int(idle.Seconds()),
+				})
+			}
+		case err := <-done:
+			// Whatever the pull sent before returning is still buffered
+			for drained := false; !drained; {
+				select {
+				case event := <-events:
+					send(event)
+					last = event
+				default:
+					drained = true
+				}
+			}
+			final := apitypes.PullProgress{
+				Status:      "done",
+				Attempt:     last.Attempt,
+				LayersDone:  last.LayersDone,
+				LayersTotal: last.LayersTotal,
+				BytesDone:   last.BytesDone,
+				BytesTotal:  last.BytesTotal,
+			}
+			if err != nil {
+				final.Status = "error"
+				final.Error = fmt.Sprintf("Failed to pull image: %v", err)
+			}
+			send(final)
+			return
+		}
+	}
+}
+
+// pullImageWebSocket is PullImage for WebSocket clients, which send the
+// pull request as the body
+func (h *ImageHandler) pullImageWebSocket(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
 
-		var pullReq struct {
-			Image string `json:"image"`
-			Tag   string `json:"tag"`
-		}
+		var pullReq apitypes.PullRequest
 		if err := json.NewDecoder(r.Body).Decode(&pullReq); err != nil {
 			websocket.JSON.Send(ws, map[string]string{"error": "Invalid request body"})
 			return
 		}
-
-		ctx := r.Context()
-		ref := pullReq.Image
-		if pullReq.Tag != "" {
-			ref = fmt.Sprintf("%s:%s", pullReq.Image, pullReq.Tag)
+		pullReq.Registry = firstNonEmpty(pullReq.Registry, r.URL.Query().Get("registry"))
+		mirror, err := h.pullMirror(pullReq.Registry)
+		if err != nil {
+			websocket.JSON.Send(ws, map[string]string{"error": err.Error()})
+			return
 		}
 
-		reader, err := h.client.ImagePull(ctx, ref, image.PullOptions{})
+		err = h.pull(r.Context(), pullImageRef(pullReq), mirror, func(event apitypes.PullProgress) {
+			websocket.JSON.Send(ws, event)
+		})
 		if err != nil {
 			websocket.JSON.Send(ws, map[string]string{"error": fmt.Sprintf("Failed to pull image: %v", err)})
-			return
 		}
-		defer reader.Close()
+	})
 
-		decoder := json.NewDecoder(reader)
-		for {
-			var event apitypes.PullProgress
-			if err := decoder.Decode(&event); err != nil {
-				if err != io.EOF {
-					websocket.JSON.Send(ws, map[string]string{"error": fmt.Sprintf("Error reading pull progress: %v", err)})
-				}
+	upgrader.ServeHTTP(w, r)
+}
+
+// pullMirror returns the registry mirror for a pull: the one requested, or
+// else KIBUTSU_REGISTRY_MIRROR
+func (h *ImageHandler) pullMirror(registry string) (string, error) {
+	if registry == "" {
+		return h.config.Get().RegistryMirror, nil
+	}
+	if err := config.ValidateRegistryMirror(registry); err != nil {
+		return "", fmt.Errorf("Invalid registry %q: %v", registry, err)
+	}
+	return registry, nil
+}
+
+func (h *ImageHandler) pull(ctx context.Context, ref, mirror string, send func(apitypes.PullProgress)) error {
+	policy := docker.RetryPolicy{Attempts: h.config.Get().PullRetries, Backoff: pullRetryBackoff}
+	manager := docker.NewImageManager(h.client)
+	manager.RegistryAuth = h.registryAuth
+	return manager.PullThroughMirror(ctx, ref, mirror, policy, send)
+}
+
+func pullImageRef(req apitypes.PullRequest) string {
+	if req.Tag != "" {
+		return fmt.Sprintf("%s:%s", req.Image, req.Tag)
+	}
+	return req.Image
+}
+
+// BuildImage builds an image from a multipart upload holding a tar build
+// context ("context") and JSON build options ("options"), or from JSON
+// build options alone naming a remote context, an inline Dockerfile, or
+// both. Output is streamed back as newline-delimited BuildProgress messages.
+func (h *ImageHandler) BuildImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var opts apitypes.BuildOptions
+	var buildContext io.Reader
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&opts); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid build options: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if raw := r.FormValue("options"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+				http.Error(w, "Invalid build options", http.StatusBadRequest)
 				return
 			}
-			websocket.JSON.Send(ws, event)
 		}
-	})
+		if file, _, err := r.FormFile("context"); err == nil {
+			defer file.Close()
+			buildContext = file
+		}
+	}
 
-	upgrader.ServeHTTP(w, r)
+	switch {
+	case buildContext != nil && (opts.Remote != "" || opts.DockerfileContent != ""):
+		http.Error(w, "Send either a build context or remote and dockerfile_content, not both", http.StatusBadRequest)
+		return
+	case opts.Remote != "":
+		if err := docker.ValidateRemoteContext(opts.Remote); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid remote context %q: %v", opts.Remote, err), http.StatusBadRequest)
+			return
+		}
+		if opts.DockerfileContent != "" {
+			buildContext = strings.NewReader(opts.DockerfileContent)
+		}
+	case opts.DockerfileContent != "":
+		dockerfileContext, err := docker.DockerfileContext(opts.DockerfileContent)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create build context: %v", err), failureStatus(err))
+			return
+		}
+		buildContext = dockerfileContext
+		opts.Dockerfile = ""
+	case buildContext == nil:
+		http.Error(w, "Missing build context", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	// The Engine API takes neither secrets nor a Dockerfile separate from a
+	// remote context; both need the docker CLI with BuildKit
+	feature := ""
+	switch {
+	case len(opts.Secrets) > 0:
+		feature = "Build secrets require"
+	case opts.Remote != "" && opts.DockerfileContent != "":
+		feature = "An inline Dockerfile with a remote context requires"
+	}
+	useBuildKit := feature != ""
+	if useBuildKit {
+		ping, err := h.client.Ping(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to query Docker daemon: %v", err), failureStatus(err))
+			return
+		}
+		if ping.BuilderVersion != types.BuilderBuildKit {
+			http.Error(w, feature+" BuildKit, which the Docker daemon does not support or has disabled", http.StatusNotImplemented)
+			return
+		}
+		if _, err := exec.LookPath("docker"); err != nil {
+			http.Error(w, feature+" the docker CLI to be installed on the kibutsu host", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	authConfigs, err := docker.BuildAuthConfigs(h.registryAuth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(msg apitypes.BuildProgress) {
+		encoder.Encode(msg)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if useBuildKit {
+		err := docker.BuildWithBuildKit(ctx, h.client.DaemonHost(), buildContext, opts, authConfigs, func(line string) {
+			send(apitypes.BuildProgress{Stream: line + "\n"})
+		})
+		if err != nil {
+			send(apitypes.BuildProgress{Error: err.Error()})
+		}
+		return
+	}
+
+	buildArgs := make(map[string]*string, len(opts.BuildArgs))
+	for k, v := range opts.BuildArgs {
+		v := v
+		buildArgs[k] = &v
+	}
+
+	resp, err := h.client.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
+		Tags:          opts.Tags,
+		Dockerfile:    opts.Dockerfile,
+		Target:        opts.Target,
+		BuildArgs:     buildArgs,
+		NoCache:       opts.NoCache,
+		PullParent:    opts.Pull,
+		RemoteContext: opts.Remote,
+		AuthConfigs:   authConfigs,
+		Remove:        true,
+	})
+	if err != nil {
+		send(apitypes.BuildProgress{Error: fmt.Sprintf("Failed to build image: %v", err)})
+		return
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg apitypes.BuildProgress
+		if err := decoder.Decode(&msg); err != nil {
+			if err != io.EOF {
+				send(apitypes.BuildProgress{Error: fmt.Sprintf("Error reading build output: %v", err)})
+			}
+			return
+		}
+		send(msg)
+	}
 }
 
 func (h *ImageHandler) GetImageHistory(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	id := strings.TrimPrefix(r.URL.Path, "/images/")
 	id = strings.Split(id, "/")[0]
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	history, err := h.client.ImageHistory(ctx, id)
+	history, err := retryRead(ctx, h.config, func(ctx context.Context) ([]image.HistoryResponseItem, error) {
+		return h.client.ImageHistory(ctx, id)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get image history: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get image history: %v", err), failureStatus(err))
 		return
 	}
 
@@ -166,12 +756,14 @@ func (h *ImageHandler) GetImageHistory(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *ImageHandler) GetSystemInfo(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	info, err := h.client.Info(ctx)
+	info, err := retryRead(ctx, h.config, func(ctx context.Context) (system.Info, error) {
+		return h.client.Info(ctx)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get system info: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get system info: %v", err), failureStatus(err))
 		return
 	}
 
@@ -180,12 +772,14 @@ func (h *ImageHandler) GetSystemInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *ImageHandler) GetSystemVersion(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := readContext(r, h.config)
 	defer cancel()
 
-	version, err := h.client.ServerVersion(ctx)
+	version, err := retryRead(ctx, h.config, func(ctx context.Context) (types.Version, error) {
+		return h.client.ServerVersion(ctx)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get system version: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get system version: %v", err), failureStatus(err))
 		return
 	}
 
@@ -194,15 +788,27 @@ func (h *ImageHandler) GetSystemVersion(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ImageHandler) GetDiskUsage(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := writeContext(w, r, h.config)
 	defer cancel()
 
-	usage, err := h.client.DiskUsage(ctx, types.DiskUsageOptions{})
+	usage, err := retryRead(ctx, h.config, func(ctx context.Context) (types.DiskUsage, error) {
+		return h.client.DiskUsage(ctx, types.DiskUsageOptions{})
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get disk usage: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get disk usage: %v", err), failureStatus(err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(usage)
 }
+
+// firstNonEmpty returns the first of values that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,628 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/google/uuid"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+	"kibutsu/jobs"
+	"kibutsu/notify"
+)
+
+// jobActions are the actions a job can run, and whether they act on a
+// target
+var jobActions = map[string]bool{
+	"prune-images":       false,
+	"prune-containers":   false,
+	"restart-container":  true,
+	"recreate-container": true,
+	"compose-update":     true,
+	"backup-volume":      true,
+	"backup-compose":     true,
+}
+
+// jobSchedulerUser is who scheduled runs are logged and recorded as
+const jobSchedulerUser = "scheduler"
+
+// jobIdleWait is how long the scheduler sleeps with no job scheduled
+const jobIdleWait = time.Hour
+
+// JobRunner carries out job actions on one Docker endpoint
+type JobRunner struct {
+	client     *client.Client
+	config     *config.Store
+	containers *ContainerHandler
+	compose    *ComposeHandler
+	backups    *BackupHandler
+}
+
+func NewJobRunner(client *client.Client, cfg *config.Store, containers *ContainerHandler, compose *ComposeHandler, backups *BackupHandler) *JobRunner {
+	return &JobRunner{client: client, config: cfg, containers: containers, compose: compose, backups: backups}
+}
+
+// run carries out a job's action, returning a summary of what it did
+func (j *JobRunner) run(ctx context.Context, job apitypes.Job) (string, error) {
+	cfg := j.config.Get()
+	stopTimeout := int(cfg.StopTimeout.Seconds())
+
+	switch job.Action {
+	case "prune-images":
+		// dangling=false widens the prune to every unused image
+		pruneFilters := filters.NewArgs(filters.Arg("dangling", strconv.FormatBool(!job.All)))
+		report, err := j.client.ImagesPrune(ctx, pruneFilters)
+		if err != nil {
+			return "", fmt.Errorf("failed to prune images: %w", err)
+		}
+		return fmt.Sprintf("Removed %d images, reclaimed %s", len(report.ImagesDeleted), units.HumanSize(float64(report.SpaceReclaimed))), nil
+
+	case "prune-containers":
+		var result *apitypes.ContainerPruneResult
+		var err error
+		if cfg.NamePrefix != "" {
+			result, err = j.containers.pruneWithPrefix(ctx, filters.NewArgs(), cfg.NamePrefix)
+		} else {
+			var report container.PruneReport
+			report, err = j.client.ContainersPrune(ctx, filters.NewArgs())
+			result = &apitypes.ContainerPruneResult{ContainersDeleted: report.ContainersDeleted, SpaceReclaimed: report.SpaceReclaimed}
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to prune containers: %w", err)
+		}
+		return fmt.Sprintf("Removed %d containers, reclaimed %s", len(result.ContainersDeleted), units.HumanSize(float64(result.SpaceReclaimed))), nil
+
+	case "restart-container":
+		if err := j.allowContainer(ctx, job.Target); err != nil {
+			return "", err
+		}
+		if err := j.client.ContainerRestart(ctx, job.Target, container.StopOptions{Timeout: &stopTimeout}); err != nil {
+			return "", fmt.Errorf("failed to restart container: %w", err)
+		}
+		return fmt.Sprintf("Restarted %s", job.Target), nil
+
+	case "recreate-container":
+		if err := j.allowContainer(ctx, job.Target); err != nil {
+			return "", err
+		}
+		result, err := j.containers.recreate(ctx, job.Target, false, true, stopTimeout)
+		if err != nil {
+			return "", fmt.Errorf("failed to recreate container: %w", err)
+		}
+		if !result.Recreated {
+			return fmt.Sprintf("%s is up to date", result.Name), nil
+		}
+		return fmt.Sprintf("Recreated %s from %s", result.Name, result.Image), nil
+
+	case "compose-update":
+		return j.composeUpdate(ctx, job.Target, stopTimeout)
+
+	case "backup-volume", "backup-compose":
+		return j.backup(ctx, strings.TrimPrefix(job.Action, "backup-"), job.Target, job.Keep)
+	}
+	return "", fmt.Errorf("unknown action %q", job.Action)
+}
+
+// allowContainer refuses containers outside the configured name prefix
+func (j *JobRunner) allowContainer(ctx context.Context, id string) error {
+	prefix := j.config.Get().NamePrefix
+	if prefix == "" {
+		return nil
+	}
+	inspect, err := j.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if !hasNamePrefix(inspect.Name, prefix) {
+		return fmt.Errorf("container %s is outside the %q name prefix", id, prefix)
+	}
+	return nil
+}
+
+// backup takes a backup of a volume or a compose project, then removes the
+// oldest of its backups beyond keep
+func (j *JobRunner) backup(ctx context.Context, kind, name string, keep int) (string, error) {
+	backup, err := j.backups.create(ctx, kind, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s %s: %w", kind, name, err)
+	}
+	summary := fmt.Sprintf("Backed up %s %s as %s (%s)", kind, name, backup.ID, units.HumanSize(float64(backup.Size)))
+	if keep == 0 {
+		return summary, nil
+	}
+	removed, err := j.backups.prune(ctx, kind, name, keep)
+	if err != nil {
+		return summary, fmt.Errorf("failed to remove old backups: %w", err)
+	}
+	if len(removed) > 0 {
+		summary += fmt.Sprintf(", removed %d old backups", len(removed))
+	}
+	return summary, nil
+}
+
+// composeUpdate pulls a project's images and, if any of its containers runs
+// an image that is no longer current, takes the project down and up again
+// so every service picks up the new images
+func (j *JobRunner) composeUpdate(ctx context.Context, name string, stopTimeout int) (string, error) {
+	composeConfig, err := j.compose.loadComposeFile(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to load compose file: %w", err)
+	}
+	project, err := docker.NewComposeProject(j.client, name, composeConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to create compose project: %w", err)
+	}
+	project.StopTimeout = stopTimeout
+	project.RegistryMirror = j.config.Get().RegistryMirror
+	project.RegistryAuth = j.compose.registryAuth
+
+	images := make(map[string]string, len(composeConfig.Services))
+	for service, spec := range composeConfig.Services {
+		images[service] = spec.Image
+	}
+	record := func(err error) {
+		rec := apitypes.DeploymentRecord{Action: "update", Success: err == nil, Images: images}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		j.compose.addDeployment(jobSchedulerUser, name, rec)
+	}
+
+	if _, err := project.Pull(ctx); err != nil {
+		err = fmt.Errorf("failed to pull images: %w", err)
+		record(err)
+		return "", err
+	}
+	outdated, err := j.outdatedServices(ctx, name, composeConfig)
+	if err != nil {
+		return "", err
+	}
+	if len(outdated) == 0 {
+		return fmt.Sprintf("Project %s is up to date", name), nil
+	}
+
+	discard := func(apitypes.ComposeProgress) {}
+	if _, _, err := j.compose.stopProject(ctx, name, stopTimeout, discard); err != nil {
+		err = fmt.Errorf("failed to stop project: %w", err)
+		record(err)
+		return "", err
+	}
+	result, err := j.compose.startProject(ctx, name, composeConfig, discard)
+	record(err)
+	if err != nil {
+		return "", err
+	}
+	summary := fmt.Sprintf("Redeployed %s for new images of %s", name, strings.Join(outdated, ", "))
+	if len(result.Failed) > 0 {
+		return summary, fmt.Errorf("services failed to start: %s", strings.Join(result.Failed, ", "))
+	}
+	return summary, nil
+}
+
+// outdatedServices returns the services of a project with a container
+// running something other than the service's current local image. A
+// project with no containers is treated as entirely outdated so it gets
+// started.
+func (j *JobRunner) outdatedServices(ctx context.Context, name string, composeConfig *apitypes.ComposeConfig) ([]string, error) {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", name))
+	containers, err := j.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project containers: %w", err)
+	}
+	if len(containers) == 0 {
+		return sortedKeys(composeConfig.Services), nil
+	}
+
+	imageIDs := make(map[string]string)
+	outdated := make(map[string]bool)
+	for _, c := range containers {
+		service := c.Labels["com.docker.compose.service"]
+		ref := composeConfig.Services[service].Image
+		if ref == "" {
+			continue
+		}
+		id, ok := imageIDs[ref]
+		if !ok {
+			image, _, err := j.client.ImageInspectWithRaw(ctx, ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+			}
+			id = image.ID
+			imageIDs[ref] = id
+		}
+		if c.ImageID != id {
+			outdated[service] = true
+		}
+	}
+	return sortedKeys(outdated), nil
+}
+
+// JobScheduler runs jobs on their cron schedules and on demand. Runs missed
+// while the server was down are not caught up.
+type JobScheduler struct {
+	store    *jobs.Store
+	config   *config.Store
+	wake     chan struct{}
+	notifier *notify.Notifier // told about failed runs, if set
+
+	mu      sync.Mutex
+	runners map[string]*JobRunner // by endpoint name
+	next    map[string]time.Time  // by job ID, for enabled jobs
+	running map[string]bool
+}
+
+func NewJobScheduler(store *jobs.Store, cfg *config.Store) *JobScheduler {
+	s := &JobScheduler{
+		store:   store,
+		config:  cfg,
+		wake:    make(chan struct{}, 1),
+		runners: make(map[string]*JobRunner),
+		next:    make(map[string]time.Time),
+		running: make(map[string]bool),
+	}
+	now := time.Now()
+	for _, job := range store.List() {
+		if err := s.schedule(job, now); err != nil {
+			slog.Warn("Not scheduling job with invalid schedule", "job", job.ID, "schedule", job.Schedule, "error", err)
+		}
+	}
+	return s
+}
+
+// UseNotifier sends notifications for failed job runs
+func (s *JobScheduler) UseNotifier(notifier *notify.Notifier) {
+	s.notifier = notifier
+}
+
+// AddEndpoint lets jobs run on the named endpoint
+func (s *JobScheduler) AddEndpoint(name string, runner *JobRunner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runners[name] = runner
+}
+
+// schedule works out when job next runs after now, unscheduling it if it is
+// disabled or has no schedule
+func (s *JobScheduler) schedule(job apitypes.Job, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.next, job.ID)
+	if !job.Enabled || job.Schedule == "" {
+		return nil
+	}
+	sched, err := jobs.Parse(job.Schedule)
+	if err != nil {
+		return err
+	}
+	if next := sched.Next(now); !next.IsZero() {
+		s.next[job.ID] = next
+	}
+	return nil
+}
+
+// Run starts jobs as they fall due until ctx is cancelled
+func (s *JobScheduler) Run(ctx context.Context) {
+	for {
+		wait := jobIdleWait
+		s.mu.Lock()
+		for _, next := range s.next {
+			wait = min(wait, time.Until(next))
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		var due []string
+		s.mu.Lock()
+		for id, next := range s.next {
+			if !next.After(now) {
+				due = append(due, id)
+			}
+		}
+		s.mu.Unlock()
+		for _, id := range due {
+			job, ok := s.store.Get(id)
+			if !ok {
+				continue
+			}
+			if err := s.schedule(job, now); err != nil {
+				slog.WarnContext(ctx, "Not scheduling job with invalid schedule", "job", id, "error", err)
+			}
+			if !s.claim(job.ID) {
+				slog.WarnContext(ctx, "Skipping scheduled job run, the previous run is still going", "job", job.ID, "name", job.Name)
+				continue
+			}
+			go s.execute(ctx, job, "schedule", jobSchedulerUser)
+		}
+	}
+}
+
+// reschedule wakes the run loop after the jobs changed
+func (s *JobScheduler) reschedule() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// claim marks a job as running, reporting false if it already is
+func (s *JobScheduler) claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[id] {
+		return false
+	}
+	s.running[id] = true
+	return true
+}
+
+// execute runs a job claimed with claim and records the run
+func (s *JobScheduler) execute(ctx context.Context, job apitypes.Job, trigger, user string) {
+	s.mu.Lock()
+	runner := s.runners[job.Endpoint]
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, job.ID)
+		s.mu.Unlock()
+	}()
+
+	run := apitypes.JobRun{Started: time.Now().UTC(), Trigger: trigger, User: user}
+	var err error
+	if runner == nil {
+		err = fmt.Errorf("unknown endpoint %q", job.Endpoint)
+	} else {
+		runCtx, cancel := context.WithTimeout(ctx, s.config.Get().DockerLongTimeout)
+		run.Result, err = runner.run(runCtx, job)
+		cancel()
+	}
+	run.DurationMS = time.Since(run.Started).Milliseconds()
+	run.Success = err == nil
+	if err != nil {
+		run.Error = err.Error()
+		slog.ErrorContext(ctx, "Job failed", "audit", true, "user", user, "job", job.ID, "name", job.Name, "action", job.Action, "target", job.Target, "error", err)
+		s.notifier.Notify(apitypes.Notification{
+			Event:    "job-failed",
+			Endpoint: job.Endpoint,
+			Title:    fmt.Sprintf("Job %s failed", job.Name),
+			Message:  fmt.Sprintf("The %s run of job %s (%s) failed: %v", trigger, job.Name, job.Action, err),
+			Job:      job.ID,
+		})
+	} else {
+		slog.InfoContext(ctx, "Job ran", "audit", true, "user", user, "job", job.ID, "name", job.Name, "action", job.Action, "target", job.Target, "result", run.Result)
+	}
+
+	if err := s.store.AddRun(job.ID, run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record job run", "job", job.ID, "error", err)
+	}
+}
+
+// describe adds the scheduler's view of a job: whether it is running and
+// when it next runs
+func (s *JobScheduler) describe(job apitypes.Job) apitypes.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Running = s.running[job.ID]
+	if next, ok := s.next[job.ID]; ok {
+		next = next.UTC()
+		job.NextRun = &next
+	}
+	return job
+}
+
+// jobFromRequest validates a job request, filling in job from it
+func (s *JobScheduler) jobFromRequest(r *http.Request, job *apitypes.Job) error {
+	var req apitypes.JobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	// Jobs without a schedule only run on demand or by webhook
+	if strings.TrimSpace(req.Schedule) != "" {
+		if _, err := jobs.Parse(req.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", req.Schedule, err)
+		}
+	}
+	needsTarget, ok := jobActions[req.Action]
+	if !ok {
+		return fmt.Errorf("unknown action %q; expected one of %s", req.Action, strings.Join(sortedKeys(jobActions), ", "))
+	}
+	req.Target = strings.TrimSpace(req.Target)
+	if needsTarget && req.Target == "" {
+		return fmt.Errorf("action %s needs a target", req.Action)
+	}
+	if !needsTarget && req.Target != "" {
+		return fmt.Errorf("action %s takes no target", req.Action)
+	}
+	if req.All && req.Action != "prune-images" {
+		return errors.New("all only applies to prune-images")
+	}
+	if req.Keep != 0 && !strings.HasPrefix(req.Action, "backup-") {
+		return errors.New("keep only applies to backup-volume and backup-compose")
+	}
+	if req.Keep < 0 {
+		return errors.New("keep must not be negative")
+	}
+	if req.Endpoint == "" {
+		req.Endpoint = config.LocalEndpoint
+	}
+	s.mu.Lock()
+	_, known := s.runners[req.Endpoint]
+	s.mu.Unlock()
+	if !known {
+		return fmt.Errorf("unknown endpoint %q", req.Endpoint)
+	}
+	if req.Name == "" {
+		req.Name = strings.TrimSpace(req.Action + " " + req.Target)
+	}
+
+	job.Name, job.Schedule, job.Endpoint = req.Name, strings.TrimSpace(req.Schedule), req.Endpoint
+	job.Action, job.Target, job.All, job.Keep = req.Action, req.Target, req.All, req.Keep
+	job.Enabled = req.Enabled == nil || *req.Enabled
+	job.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// jobID returns the job named in the path, writing a 404 if there is none
+func (s *JobScheduler) jobID(w http.ResponseWriter, r *http.Request) (apitypes.Job, bool) {
+	id := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")[0]
+	job, ok := s.store.Get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Job %s not found", id), http.StatusNotFound)
+	}
+	return job, ok
+}
+
+// ListJobs returns every job sorted by name
+func (s *JobScheduler) ListJobs(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list := s.store.List()
+	for i := range list {
+		list[i] = s.describe(list[i])
+	}
+	writeList(w, params, list)
+}
+
+func (s *JobScheduler) CreateJob(w http.ResponseWriter, r *http.Request) {
+	job := apitypes.Job{ID: uuid.New().String()}
+	if err := s.jobFromRequest(r, &job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.CreatedAt = job.UpdatedAt
+
+	if err := s.store.Put(job); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save job: %v", err), failureStatus(err))
+		return
+	}
+	s.schedule(job, time.Now())
+	s.reschedule()
+	auditLog(r, "Job created", "job", job.ID, "name", job.Name, "schedule", job.Schedule, "action", job.Action, "target", job.Target)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.describe(job))
+}
+
+func (s *JobScheduler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.describe(job))
+}
+
+// UpdateJob replaces a job's settings, keeping its run history. The next
+// run is worked out afresh from the new schedule.
+func (s *JobScheduler) UpdateJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	if err := s.jobFromRequest(r, &job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.store.Put(job); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save job: %v", err), failureStatus(err))
+		return
+	}
+	s.schedule(job, time.Now())
+	s.reschedule()
+	auditLog(r, "Job updated", "job", job.ID, "name", job.Name, "schedule", job.Schedule, "action", job.Action, "target", job.Target, "enabled", job.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.describe(job))
+}
+
+// DeleteJob removes a job and its run history. A run in progress is left to
+// finish.
+func (s *JobScheduler) DeleteJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	removed, err := s.store.Delete(job.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to remove job: %v", err), failureStatus(err))
+		return
+	}
+	if !removed {
+		http.Error(w, fmt.Sprintf("Job %s not found", job.ID), http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	delete(s.next, job.ID)
+	s.mu.Unlock()
+	auditLog(r, "Job removed", "job", job.ID, "name", job.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunJob starts a job now, outside its schedule, whether or not it is
+// enabled. The run happens in the background; its outcome shows up in the
+// job's runs.
+func (s *JobScheduler) RunJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	if !s.claim(job.ID) {
+		http.Error(w, fmt.Sprintf("Job %s is already running", job.ID), http.StatusConflict)
+		return
+	}
+
+	// The run outlives the request, but keeps its values for logging
+	ctx := context.WithoutCancel(r.Context())
+	user := requestUser(r)
+	go s.execute(ctx, job, "manual", user)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListJobRuns returns a job's recent runs, newest first
+func (s *JobScheduler) ListJobRuns(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	runs, _ := s.store.Runs(job.ID)
+	if runs == nil {
+		runs = []apitypes.JobRun{}
+	}
+	writeList(w, params, runs)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+// listParams holds the pagination query parameters shared by list endpoints.
+// Clients that still expect a bare JSON array pass envelope=false.
+type listParams struct {
+	limit    int
+	offset   int
+	envelope bool
+}
+
+func parseListParams(r *http.Request) (listParams, error) {
+	query := r.URL.Query()
+	p := listParams{envelope: query.Get("envelope") != "false"}
+
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &p.limit}, {"offset", &p.offset}} {
+		v := query.Get(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("%s must be a non-negative integer", param.name)
+		}
+		*param.dst = n
+	}
+	return p, nil
+}
+
+// page returns the slice of items selected by offset and limit.
+func page[T any](items []T, p listParams) []T {
+	if p.offset >= len(items) {
+		return []T{}
+	}
+	items = items[p.offset:]
+	if p.limit > 0 && p.limit < len(items) {
+		items = items[:p.limit]
+	}
+	return items
+}
+
+// writeList writes one page of items, wrapped in a ListResponse unless the
+// client opted out. X-Total-Count is set either way.
+func writeList[T any](w http.ResponseWriter, p listParams, items []T) {
+	writeListPage(w, p, page(items, p), len(items))
+}
+
+// writeListPage is writeList for handlers that page before doing the costly
+// part of building each item, leaving total to be counted beforehand.
+func writeListPage[T any](w http.ResponseWriter, p listParams, items []T, total int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	if !p.envelope {
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+	json.NewEncoder(w).Encode(apitypes.ListResponse[T]{
+		Items:       items,
+		Total:       total,
+		Limit:       p.limit,
+		Offset:      p.offset,
+		GeneratedAt: time.Now().UTC(),
+	})
+}
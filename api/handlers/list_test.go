@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"kibutsu/config"
+)
+
+// listDaemon is a Docker daemon holding three of each kind of object the
+// list endpoints read. Each container belongs to a compose project of its own.
+func listDaemon(t *testing.T) *client.Client {
+	t.Helper()
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[strings.Index(r.URL.Path[1:], "/")+1:] // drop the /v1.xx prefix
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case path == "/containers/json":
+			w.Write([]byte(`[
+				{"Id":"c1","Names":["/one"],"Image":"nginx","ImageID":"i1","State":"running","Labels":{"com.docker.compose.project":"alpha"}},
+				{"Id":"c2","Names":["/two"],"Image":"redis","ImageID":"i2","State":"running","Labels":{"com.docker.compose.project":"beta"}},
+				{"Id":"c3","Names":["/three"],"Image":"nginx","ImageID":"i1","State":"exited","Labels":{"com.docker.compose.project":"gamma"}}
+			]`))
+		case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+			id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+			w.Write([]byte(`{"Id":"` + id + `","Name":"/` + id + `","Created":"2024-01-01T00:00:00Z","NetworkSettings":{"Networks":{}}}`))
+		case path == "/images/json":
+			w.Write([]byte(`[
+				{"Id":"i1","RepoTags":["nginx:latest"],"Size":300},
+				{"Id":"i2","RepoTags":["redis:latest"],"Size":200},
+				{"Id":"i3","RepoTags":["alpine:latest"],"Size":100}
+			]`))
+		case path == "/volumes":
+			w.Write([]byte(`{"Volumes":[{"Name":"a","Driver":"local"},{"Name":"b","Driver":"local"},{"Name":"c","Driver":"local"}]}`))
+		case path == "/networks":
+			w.Write([]byte(`[{"Id":"n1","Name":"bridge"},{"Id":"n2","Name":"host"},{"Id":"n3","Name":"none"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// listEndpoints returns each list endpoint backed by listDaemon, all of
+// which list three items
+func listEndpoints(t *testing.T) map[string]http.HandlerFunc {
+	t.Helper()
+	c := listDaemon(t)
+	cfg := config.NewStore(&config.Config{DockerReadTimeout: 5 * time.Second}, config.Options{})
+	return map[string]http.HandlerFunc{
+		"containers": NewContainerHandler(c, cfg).ListContainers,
+		"images":     NewImageHandler(c, cfg, nil).ListImages,
+		"projects":   NewComposeHandler(c, cfg, nil).ListProjects,
+		"volumes":    NewVolumeHandler(c, cfg).ListVolumes,
+		"networks":   NewNetworkHandler(c, cfg).ListNetworks,
+	}
+}
+
+// listEnvelope is a ListResponse with its items left undecoded
+type listEnvelope struct {
+	Items       []json.RawMessage `json:"items"`
+	Total       *int              `json:"total"`
+	Limit       *int              `json:"limit"`
+	Offset      *int              `json:"offset"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+}
+
+func TestListEnvelope(t *testing.T) {
+	tests := []struct {
+		query             string
+		items, limit, off int
+	}{
+		{"", 3, 0, 0},
+		{"?limit=2", 2, 2, 0},
+		{"?limit=2&offset=2", 1, 2, 2},
+		{"?limit=10", 3, 10, 0}, // limit past the end keeps the rest
+		{"?offset=5", 0, 0, 5},  // offset past the end gives no items
+		{"?limit=0&offset=1", 2, 0, 1},
+	}
+	for name, handle := range listEndpoints(t) {
+		for _, tt := range tests {
+			start := time.Now().UTC().Add(-time.Second)
+			w := httptest.NewRecorder()
+			handle(w, httptest.NewRequest(http.MethodGet, "/"+name+tt.query, nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("%s%s: status = %d: %s", name, tt.query, w.Code, w.Body)
+				continue
+			}
+			if got := w.Header().Get("X-Total-Count"); got != "3" {
+				t.Errorf("%s%s: X-Total-Count = %q, want 3", name, tt.query, got)
+			}
+
+			var env listEnvelope
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+				t.Errorf("%s%s: %v: %s", name, tt.query, err, w.Body)
+				continue
+			}
+			if env.Items == nil || env.Total == nil || env.Limit == nil || env.Offset == nil || env.GeneratedAt.IsZero() {
+				t.Errorf("%s%s: envelope is missing fields: %s", name, tt.query, w.Body)
+				continue
+			}
+			if len(env.Items) != tt.items || *env.Total != 3 || *env.Limit != tt.limit || *env.Offset != tt.off {
+				t.Errorf("%s%s: got %d items, total %d, limit %d, offset %d; want %d, 3, %d, %d",
+					name, tt.query, len(env.Items), *env.Total, *env.Limit, *env.Offset, tt.items, tt.limit, tt.off)
+			}
+			if env.GeneratedAt.Before(start) || env.GeneratedAt.After(time.Now().UTC()) {
+				t.Errorf("%s%s: generatedAt = %s, want about now", name, tt.query, env.GeneratedAt)
+			}
+		}
+	}
+}
+
+func TestListRejectsInvalidPaging(t *testing.T) {
+	for name, handle := range listEndpoints(t) {
+		for _, query := range []string{"?limit=-1", "?offset=-1", "?limit=ten"} {
+			w := httptest.NewRecorder()
+			handle(w, httptest.NewRequest(http.MethodGet, "/"+name+query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s%s: status = %d, want %d", name, query, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+// envelope=false returns the bare page, except for projects, whose older
+// shape is a map of project name to containers
+func TestListWithoutEnvelope(t *testing.T) {
+	for name, handle := range listEndpoints(t) {
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(http.MethodGet, "/"+name+"?envelope=false&limit=2&offset=1", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d: %s", name, w.Code, w.Body)
+			continue
+		}
+		if got := w.Header().Get("X-Total-Count"); got != "3" {
+			t.Errorf("%s: X-Total-Count = %q, want 3", name, got)
+		}
+
+		var n int
+		if name == "projects" {
+			var projects map[string]json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &projects); err != nil {
+				t.Errorf("%s: %v: %s", name, err, w.Body)
+				continue
+			}
+			if _, ok := projects["beta"]; !ok {
+				t.Errorf("%s: page %s is missing beta", name, w.Body)
+			}
+			n = len(projects)
+		} else {
+			var items []json.RawMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+				t.Errorf("%s: want a bare array: %v: %s", name, err, w.Body)
+				continue
+			}
+			n = len(items)
+		}
+		if n != 2 {
+			t.Errorf("%s: got %d items, want 2: %s", name, n, w.Body)
+		}
+	}
+}
+
+func TestListPageOrder(t *testing.T) {
+	handle := listEndpoints(t)["volumes"]
+	w := httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodGet, "/volumes?limit=1&offset=1", nil))
+
+	var env struct {
+		Items []struct{ Name string } `json:"items"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Items) != 1 || env.Items[0].Name != "b" {
+		t.Errorf("items = %+v, want the second volume, b", env.Items)
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/logstore"
+)
+
+// logArchiveBatch is how many entries an import appends at a time
+const logArchiveBatch = 500
+
+// ArchiveStored stores a container's collected logs in the bucket under
+// logs/{endpoint}/, as gzipped JSON Lines: the container's description,
+// then its entries oldest first. The logs are kept in the log store too.
+func (c *LogCollector) ArchiveStored(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+	bucket, ok := enabledBucket(w, c.config)
+	if !ok {
+		return
+	}
+	stored, ok := c.storedContainer(w, r)
+	if !ok {
+		return
+	}
+	// Include the lines still buffered for the newest segment
+	if err := c.store.Flush(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to flush stored logs: %v", err), failureStatus(err))
+		return
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	entries := 0
+	key := fmt.Sprintf("logs/%s/%s-%s.jsonl.gz", c.endpoint, stored.Name, time.Now().UTC().Format(storageStampFormat))
+	obj, err := uploadObject(r.Context(), bucket, key, "application/gzip", func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		encoder := json.NewEncoder(zw)
+		if err := encoder.Encode(stored); err != nil {
+			return err
+		}
+		var writeErr error
+		err := c.store.Read(c.endpoint, stored.ID, time.Time{}, time.Time{}, func(entry apitypes.LogEntry) {
+			if writeErr == nil {
+				writeErr = encoder.Encode(entry)
+				entries++
+			}
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to archive stored logs: %v", err), http.StatusBadGateway)
+		return
+	}
+	auditLog(r, "Stored logs archived", "container", stored.Name, "id", stored.ID, "key", key, "entries", entries)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(obj)
+}
+
+// ImportStored puts the logs archived under key= back into the log store,
+// as a removed container of this endpoint, so they can be searched again.
+// Logs the store already has of the same container are left alone: the
+// import answers 409.
+func (c *LogCollector) ImportStored(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+	bucket, ok := enabledBucket(w, c.config)
+	if !ok {
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if !validObjectKey(key) {
+		http.Error(w, "Invalid object key", http.StatusBadRequest)
+		return
+	}
+	rc, _, err := bucket.Get(r.Context(), key)
+	if err != nil {
+		writeObjectError(w, "read", err)
+		return
+	}
+	defer rc.Close()
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid log archive: %v", err), http.StatusBadRequest)
+		return
+	}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+
+	var stored apitypes.StoredContainer
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &stored) != nil || stored.ID == "" {
+		http.Error(w, "Invalid log archive: missing container description", http.StatusBadRequest)
+		return
+	}
+	if existing, err := c.store.Find(c.endpoint, stored.ID); err == nil && existing.ID == stored.ID {
+		http.Error(w, fmt.Sprintf("Logs of container %s are already stored", stored.Name), http.StatusConflict)
+		return
+	} else if err != nil && !errors.Is(err, logstore.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Failed to find stored logs: %v", err), failureStatus(err))
+		return
+	}
+	if err := c.store.Track(c.endpoint, stored); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to import stored logs: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result := apitypes.StoredLogsImport{}
+	batch := make([]apitypes.LogEntry, 0, logArchiveBatch)
+	appendBatch := func() error {
+		err := c.store.Append(c.endpoint, stored.ID, batch...)
+		result.Entries += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	for scanner.Scan() {
+		var entry apitypes.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if batch = append(batch, entry); len(batch) == logArchiveBatch {
+			if err = appendBatch(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = appendBatch()
+	}
+	// The imported container doesn't run here; marking it removed closes
+	// its segment. The collector tracks it again if it does exist.
+	removedAt := time.Now().UTC()
+	if stored.RemovedAt != nil {
+		removedAt = *stored.RemovedAt
+	}
+	if markErr := c.store.MarkRemoved(c.endpoint, stored.ID, removedAt); err == nil {
+		err = markErr
+	}
+	if err != nil {
+		auditLog(r, "Stored logs import failed", "key", key, "container", stored.Name, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to import stored logs: %v", err), failureStatus(err))
+		return
+	}
+	result.Container, _ = c.store.Find(c.endpoint, stored.ID)
+	auditLog(r, "Stored logs imported", "key", key, "container", stored.Name, "id", stored.ID, "entries", result.Entries)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
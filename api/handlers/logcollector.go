@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	timetypes "github.com/docker/docker/api/types/time"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/logstore"
+)
+
+const (
+	// logCollectInterval is how often the collector looks for containers
+	// to read
+	logCollectInterval = 10 * time.Second
+
+	// logPruneInterval is how often retention is applied
+	logPruneInterval = 10 * time.Minute
+
+	// collectLogsLabel set to false opts a container out of collection
+	collectLogsLabel = "kibutsu.collect-logs"
+)
+
+// LogCollector copies the logs of the containers on one endpoint whose
+// names match KIBUTSU_LOG_COLLECT into the log store, resuming after the
+// last stored line, and serves the stored logs. Without a store it is
+// disabled.
+type LogCollector struct {
+	client   *client.Client
+	config   *config.Store
+	store    *logstore.Store
+	endpoint string
+
+	mu         sync.Mutex
+	collecting map[string]context.CancelFunc // by container ID
+	caughtUp   map[string]bool               // stopped containers read to the end
+	present    map[string]bool               // stored containers that still exist
+}
+
+func NewLogCollector(client *client.Client, cfg *config.Store, store *logstore.Store, endpoint string) *LogCollector {
+	return &LogCollector{
+		client:     client,
+		config:     cfg,
+		store:      store,
+		endpoint:   endpoint,
+		collecting: make(map[string]context.CancelFunc),
+		caughtUp:   make(map[string]bool),
+		present:    make(map[string]bool),
+	}
+}
+
+// Run collects logs until ctx is cancelled
+func (c *LogCollector) Run(ctx context.Context) {
+	if c.store == nil {
+		return
+	}
+	if stored, err := c.store.Containers(c.endpoint); err == nil {
+		for _, s := range stored {
+			if s.RemovedAt == nil {
+				c.present[s.ID] = true
+			}
+		}
+	}
+
+	scan := time.NewTicker(logCollectInterval)
+	defer scan.Stop()
+	prune := time.NewTicker(logPruneInterval)
+	defer prune.Stop()
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	c.scan(ctx)
+	c.prune(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			c.store.Flush()
+			return
+		case <-scan.C:
+			c.scan(ctx)
+		case <-prune.C:
+			c.prune(ctx)
+		case <-flush.C:
+			if err := c.store.Flush(); err != nil {
+				slog.WarnContext(ctx, "Failed to write collected logs", "endpoint", c.endpoint, "error", err)
+			}
+		}
+	}
+}
+
+// collected reports whether a container's logs are to be collected
+func (c *LogCollector) collected(listed types.Container) bool {
+	cfg := c.config.Get()
+	if listed.Labels[collectLogsLabel] == "false" || !listedWithPrefix(listed, cfg.NamePrefix) {
+		return false
+	}
+	for _, pattern := range cfg.LogCollect {
+		if ok, _ := path.Match(pattern, listedName(listed)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scan starts following running containers, reads stopped ones to the end
+// once, and notes the containers that were removed
+func (c *LogCollector) scan(ctx context.Context) {
+	listCtx, cancel := context.WithTimeout(ctx, c.config.Get().DockerReadTimeout)
+	listed, err := c.client.ContainerList(listCtx, container.ListOptions{All: true})
+	cancel()
+	if err != nil {
+		slog.DebugContext(ctx, "Log collector failed to list containers", "endpoint", c.endpoint, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exists := make(map[string]bool, len(listed))
+	for _, l := range listed {
+		exists[l.ID] = true
+		stop, busy := c.collecting[l.ID]
+		if !c.collected(l) {
+			if busy {
+				stop()
+			}
+			continue
+		}
+		running := l.State == "running"
+		if running {
+			delete(c.caughtUp, l.ID)
+		}
+		if busy || (!running && c.caughtUp[l.ID]) {
+			continue
+		}
+
+		err := c.store.Track(c.endpoint, apitypes.StoredContainer{
+			ID:      l.ID,
+			Name:    listedName(l),
+			Image:   l.Image,
+			Project: l.Labels["com.docker.compose.project"],
+			Service: l.Labels["com.docker.compose.service"],
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to track container logs", "endpoint", c.endpoint, "container", listedName(l), "error", err)
+			continue
+		}
+		c.present[l.ID] = true
+		collectCtx, stop := context.WithCancel(ctx)
+		c.collecting[l.ID] = stop
+		go c.collect(collectCtx, l.ID, listedName(l), running)
+	}
+
+	for id := range c.present {
+		if exists[id] {
+			continue
+		}
+		if err := c.store.MarkRemoved(c.endpoint, id, time.Now().UTC()); err != nil {
+			slog.WarnContext(ctx, "Failed to mark collected container as removed", "endpoint", c.endpoint, "container", id, "error", err)
+		}
+		delete(c.present, id)
+		delete(c.caughtUp, id)
+	}
+}
+
+// collect stores a container's logs from after the last stored line. A
+// running container is followed until it stops.
+func (c *LogCollector) collect(ctx context.Context, id, name string, follow bool) {
+	caughtUp := false
+	defer func() {
+		c.mu.Lock()
+		if stop := c.collecting[id]; stop != nil {
+			stop()
+		}
+		delete(c.collecting, id)
+		c.caughtUp[id] = caughtUp
+		c.mu.Unlock()
+	}()
+
+	inspect, err := c.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return
+	}
+	options := container.LogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: true, Follow: follow}
+	last, err := c.store.Last(c.endpoint, id)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read collected logs", "endpoint", c.endpoint, "container", name, "error", err)
+		return
+	}
+	if !last.IsZero() {
+		next := last.Add(time.Nanosecond)
+		options.Since = fmt.Sprintf("%d.%09d", next.Unix(), next.Nanosecond())
+	}
+	logs, err := openContainerLogs(ctx, c.client, id, options)
+	if err != nil {
+		slog.DebugContext(ctx, "Log collector can't read container logs", "endpoint", c.endpoint, "container", name, "error", logsUnavailableMessage(err))
+		// Logs the daemon can't serve won't become readable; don't retry
+		// until the container runs again
+		caughtUp = true
+		return
+	}
+	defer logs.Close()
+
+	var storeErr error
+	lines := func(stream string) *logLineWriter {
+		return &logLineWriter{emit: func(line string) {
+			ts, message := splitLogTimestamp(line)
+			// Lines already stored are skipped in case the driver reads since
+			// with less precision
+			if storeErr != nil || ts.IsZero() || !ts.After(last) {
+				return
+			}
+			storeErr = c.store.Append(c.endpoint, id, apitypes.LogEntry{Timestamp: ts, Stream: stream, Message: message})
+		}}
+	}
+	stdout, stderr := lines("stdout"), lines("stderr")
+	if hasTTY(inspect) {
+		_, err = io.Copy(stdout, logs)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	}
+	stdout.flush()
+	stderr.flush()
+	if storeErr != nil {
+		slog.WarnContext(ctx, "Failed to store container logs", "endpoint", c.endpoint, "container", name, "error", storeErr)
+		return
+	}
+	caughtUp = err == nil && ctx.Err() == nil
+}
+
+func (c *LogCollector) prune(ctx context.Context) {
+	cfg := c.config.Get()
+	freed, err := c.store.Prune(c.endpoint, cfg.LogRetention, int64(cfg.LogStoreMaxSize)<<20)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to apply log retention", "endpoint", c.endpoint, "error", err)
+	}
+	if freed > 0 {
+		slog.InfoContext(ctx, "Removed expired collected logs", "endpoint", c.endpoint, "bytes", freed)
+	}
+}
+
+// enabled answers 403 and reports false when there is no log store
+func (c *LogCollector) enabled(w http.ResponseWriter) bool {
+	if c.store == nil {
+		http.Error(w, "Log collection is disabled; set KIBUTSU_LOG_STORE_DIR to enable it", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ListStored describes the collector and the containers it has logs of,
+// including removed ones
+func (c *LogCollector) ListStored(w http.ResponseWriter, r *http.Request) {
+	cfg := c.config.Get()
+	report := apitypes.StoredLogs{
+		Enabled:    c.store != nil,
+		Collect:    cfg.LogCollect,
+		MaxSize:    cfg.LogStoreMaxSize,
+		Containers: []apitypes.StoredContainer{},
+	}
+	if cfg.LogRetention > 0 {
+		report.Retention = cfg.LogRetention.String()
+	}
+	if c.store != nil {
+		containers, err := c.store.Containers(c.endpoint)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list stored logs: %v", err), failureStatus(err))
+			return
+		}
+		c.mu.Lock()
+		for i := range containers {
+			_, containers[i].Collecting = c.collecting[containers[i].ID]
+		}
+		c.mu.Unlock()
+		report.Containers = containers
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// storedContainer resolves the container in the path by ID, ID prefix or
+// name among the stored ones, answering 404 if there is none
+func (c *LogCollector) storedContainer(w http.ResponseWriter, r *http.Request) (apitypes.StoredContainer, bool) {
+	ref := strings.Split(strings.TrimPrefix(r.URL.Path, "/logs/stored/"), "/")[0]
+	stored, err := c.store.Find(c.endpoint, ref)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, logstore.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to find stored logs: %v", err), status)
+		return stored, false
+	}
+	return stored, true
+}
+
+// SearchStored searches a container's collected logs, which outlive the
+// container. since and until bound the time range, and stream, q, regex,
+// level and limit work as for a live log search; the newest matches are
+// returned.
+func (c *LogCollector) SearchStored(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+	query := r.URL.Query()
+	filter, err := parseLogFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since, until time.Time
+	now := time.Now()
+	for param, target := range map[string]*time.Time{"since": &since, "until": &until} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		ts, err := timetypes.GetTimestamp(v, now)
+		if err == nil {
+			*target, err = parseDockerTimestamp(ts)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s must be a timestamp or a duration such as 10m", param), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultLogMatches
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLogMatches {
+			http.Error(w, fmt.Sprintf("Invalid limit %q: must be between 1 and %d", v, maxLogMatches), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	stored, ok := c.storedContainer(w, r)
+	if !ok {
+		return
+	}
+	matches := &logMatches{limit: limit}
+	err = c.store.Read(c.endpoint, stored.ID, since, until, func(entry apitypes.LogEntry) {
+		matches.scanned++
+		if level, ok := filter.match(entry.Stream, entry.Message); ok {
+			entry.Level = level
+			matches.add(entry)
+		}
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read stored logs: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches.result(stored.Name))
+}
+
+// DeleteStored removes a container's collected logs. A container that is
+// still collected starts over from its current logs.
+func (c *LogCollector) DeleteStored(w http.ResponseWriter, r *http.Request) {
+	if !c.enabled(w) {
+		return
+	}
+	stored, ok := c.storedContainer(w, r)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	if stop := c.collecting[stored.ID]; stop != nil {
+		stop()
+	}
+	delete(c.present, stored.ID)
+	delete(c.caughtUp, stored.ID)
+	c.mu.Unlock()
+
+	if err := c.store.Delete(c.endpoint, stored.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete stored logs: %v", err), failureStatus(err))
+		return
+	}
+	auditLog(r, "Stored logs deleted", "container", stored.Name, "id", stored.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseDockerTimestamp parses the seconds.nanoseconds form GetTimestamp
+// returns
+func parseDockerTimestamp(ts string) (time.Time, error) {
+	sec, nsec, err := timetypes.ParseTimestamps(ts, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, nsec), nil
+}
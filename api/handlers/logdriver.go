@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// localLogDrivers keep logs on the host where the daemon can read them back
+var localLogDrivers = map[string]bool{"json-file": true, "local": true}
+
+// describeLogConfig summarises a container's logging setup. json-file logs
+// grow without bound unless max-size is set; the local driver rotates by
+// default. journal says whether journald logs can be read from this host's
+// journal.
+func describeLogConfig(cfg container.LogConfig, journal bool) apitypes.LogConfig {
+	driver := cfg.Type
+	if driver == "" {
+		driver = "json-file"
+	}
+	options := cfg.Config
+	if options == nil {
+		options = map[string]string{}
+	}
+
+	result := apitypes.LogConfig{
+		Driver:   driver,
+		Options:  options,
+		MaxSize:  options["max-size"],
+		MaxFile:  options["max-file"],
+		Readable: localLogDrivers[driver] || (driver == "journald" && journal),
+	}
+
+	switch driver {
+	case "json-file":
+		result.Bounded = result.MaxSize != ""
+		if !result.Bounded {
+			result.Message = "json-file logs are not rotated; set max-size to bound disk usage"
+		}
+	case "local":
+		result.Bounded = true
+	case "none":
+		result.Message = "logging is disabled for this container"
+	case "journald":
+		result.Message = unreadableLogsMessage(driver)
+		if !journal {
+			result.Message = "container uses the journald logging driver, whose logs are in the journal of the daemon's host; " +
+				"read them with journalctl there, or enable the daemon's dual logging cache"
+		}
+	default:
+		result.Message = unreadableLogsMessage(driver)
+	}
+
+	return result
+}
+
+// journalReadable reports whether the logs of cli's containers using the
+// journald driver can be read from this host's journal: only when the daemon
+// runs here and journalctl is installed
+func journalReadable(cli *client.Client) bool {
+	return docker.LocalDaemon(cli) && docker.JournalAvailable()
+}
+
+// unreadableLogsMessage explains why logs can't be read for a remote driver
+func unreadableLogsMessage(driver string) string {
+	return fmt.Sprintf("container uses the %q logging driver, which ships logs off the host; "+
+		"read them from %s, or enable the daemon's dual logging cache", driver, driver)
+}
+
+// logHint suggests a host command for reading the logs of a container whose
+// driver keeps them outside the daemon
+func logHint(cfg apitypes.LogConfig, id string) string {
+	switch cfg.Driver {
+	case "journald":
+		return "journalctl CONTAINER_ID_FULL=" + id
+	case "syslog":
+		tag := cfg.Options["tag"]
+		if tag == "" {
+			tag = id[:min(12, len(id))]
+		}
+		if address := cfg.Options["syslog-address"]; address != "" && !strings.HasPrefix(address, "unix") {
+			return fmt.Sprintf("search the syslog server at %s for tag %s", address, tag)
+		}
+		return fmt.Sprintf("grep %s /var/log/syslog", tag)
+	}
+	return ""
+}
+
+// logsUnavailableError reports that a container's logs can't be read back,
+// carrying the logging setup and a hint for finding them
+type logsUnavailableError struct {
+	config apitypes.LogConfig
+}
+
+func (e *logsUnavailableError) Error() string {
+	return e.config.Message
+}
+
+// openContainerLogs reads a container's logs through the daemon. When the
+// daemon can't serve them, journald logs are read from the host journal
+// instead if the daemon is local; otherwise a *logsUnavailableError explains
+// where the logs went.
+func openContainerLogs(ctx context.Context, cli *client.Client, id string, options container.LogsOptions) (io.ReadCloser, error) {
+	logs, err := cli.ContainerLogs(ctx, id, options)
+	if err == nil {
+		return logs, nil
+	}
+	inspect, ierr := cli.ContainerInspect(ctx, id)
+	if ierr != nil || inspect.HostConfig == nil {
+		return nil, err
+	}
+	cfg := describeLogConfig(inspect.HostConfig.LogConfig, journalReadable(cli))
+	if localLogDrivers[cfg.Driver] {
+		return nil, err
+	}
+
+	if cfg.Driver == "journald" && cfg.Readable {
+		logs, jerr := docker.JournalLogs(ctx, inspect.ID, hasTTY(inspect), options)
+		if jerr == nil {
+			return logs, nil
+		}
+		cfg.Readable = false
+		cfg.Message = fmt.Sprintf("container uses the journald logging driver and its logs could not be read from the host journal (%v)", jerr)
+	}
+	cfg.Hint = logHint(cfg, inspect.ID)
+	return nil, &logsUnavailableError{config: cfg}
+}
+
+// logsUnavailableMessage formats err for plain-text log output, including
+// the hint when the logs live outside the daemon
+func logsUnavailableMessage(err error) string {
+	var unavailable *logsUnavailableError
+	if !errors.As(err, &unavailable) {
+		return fmt.Sprintf("Failed to read logs: %v", err)
+	}
+	if unavailable.config.Hint == "" {
+		return unavailable.config.Message
+	}
+	return fmt.Sprintf("%s; try: %s", unavailable.config.Message, unavailable.config.Hint)
+}
+
+func hasTTY(inspect types.ContainerJSON) bool {
+	return inspect.Config != nil && inspect.Config.Tty
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// A daemon reached over TCP keeps journald logs in its own host's journal,
+// so they aren't looked for in this one
+func TestOpenContainerLogsRemoteJournald(t *testing.T) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/logs") {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte(`{"message":"configured logging driver does not support reading"}`))
+			return
+		}
+		w.Write([]byte(`{"Id":"abc","Name":"/web","HostConfig":{"LogConfig":{"Type":"journald"}}}`))
+	}))
+	t.Cleanup(daemon.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = openContainerLogs(context.Background(), c, "abc", container.LogsOptions{ShowStdout: true})
+	var unavailable *logsUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("err = %v, want a logsUnavailableError", err)
+	}
+	if unavailable.config.Readable || unavailable.config.Hint == "" {
+		t.Errorf("config = %+v, want unreadable with a journalctl hint", unavailable.config)
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	timetypes "github.com/docker/docker/api/types/time"
+
+	apitypes "kibutsu/api/types"
+)
+
+const (
+	// defaultLogMatches and maxLogMatches bound how many matching lines a
+	// log search returns; the newest are kept
+	defaultLogMatches = 500
+	maxLogMatches     = 5000
+
+	// maxLogPattern bounds the length of a search string or regex
+	maxLogPattern = 1000
+)
+
+// logLevels are the levels a log line can be detected at, plus unknown for
+// lines that don't carry one
+var logLevels = []string{"debug", "info", "warn", "error", "fatal", "unknown"}
+
+// logLevelNames maps the spellings found in log lines to logLevels
+var logLevelNames = map[string]string{
+	"trace": "debug", "debug": "debug", "dbg": "debug",
+	"info": "info", "notice": "info", "inf": "info",
+	"warn": "warn", "warning": "warn", "wrn": "warn",
+	"error": "error", "err": "error", "eror": "error",
+	"fatal": "fatal", "panic": "fatal", "critical": "fatal", "crit": "fatal", "emerg": "fatal", "alert": "fatal",
+}
+
+var (
+	// logfmtLevel finds level=error and lvl="warn" style fields
+	logfmtLevel = regexp.MustCompile(`(?i)\b(?:level|lvl|severity)=["']?([a-z]+)`)
+	// wordLevel finds upper case or bracketed level words, such as ERROR,
+	// [warn] or <info>, near the start of a line
+	wordLevel = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|PANIC|CRITICAL|CRIT)\b|[\[<](?i:(trace|debug|info|notice|warn|warning|error|err|fatal|panic|critical|crit))[\]>]`)
+)
+
+// logFilter selects log lines by stream, level and content. The zero value
+// matches every line.
+type logFilter struct {
+	stdout, stderr bool
+	substring      string // lower case
+	pattern        *regexp.Regexp
+	levels         []string
+}
+
+// parseLogFilter reads the stream, q (a case-insensitive substring), regex
+// and level (repeatable or comma separated) query parameters
+func parseLogFilter(query url.Values) (*logFilter, error) {
+	f := &logFilter{stdout: true, stderr: true}
+	switch stream := query.Get("stream"); stream {
+	case "":
+	case "stdout":
+		f.stderr = false
+	case "stderr":
+		f.stdout = false
+	default:
+		return nil, fmt.Errorf("stream must be stdout or stderr")
+	}
+
+	if q := query.Get("q"); q != "" {
+		if len(q) > maxLogPattern {
+			return nil, fmt.Errorf("q must be at most %d characters", maxLogPattern)
+		}
+		f.substring = strings.ToLower(q)
+	}
+	if expr := query.Get("regex"); expr != "" {
+		if len(expr) > maxLogPattern {
+			return nil, fmt.Errorf("regex must be at most %d characters", maxLogPattern)
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("regex is invalid: %v", err)
+		}
+		f.pattern = pattern
+	}
+	for _, value := range query["level"] {
+		for _, level := range strings.Split(value, ",") {
+			level = strings.ToLower(strings.TrimSpace(level))
+			if level == "" {
+				continue
+			}
+			if !slices.Contains(logLevels, level) {
+				return nil, fmt.Errorf("level must be one of %s", strings.Join(logLevels, ", "))
+			}
+			f.levels = append(f.levels, level)
+		}
+	}
+	return f, nil
+}
+
+// searching reports whether the filter looks at the content of lines, as
+// opposed to only picking streams
+func (f *logFilter) searching() bool {
+	return f.substring != "" || f.pattern != nil || len(f.levels) > 0
+}
+
+// match reports whether a line from stream passes the filter, and the level
+// detected in its message
+func (f *logFilter) match(stream, message string) (string, bool) {
+	level := detectLogLevel(message)
+	if (stream == "stdout" && !f.stdout) || (stream == "stderr" && !f.stderr) {
+		return level, false
+	}
+	if f.substring != "" && !strings.Contains(strings.ToLower(message), f.substring) {
+		return level, false
+	}
+	if f.pattern != nil && !f.pattern.MatchString(message) {
+		return level, false
+	}
+	if len(f.levels) > 0 && !slices.Contains(f.levels, cmp.Or(level, "unknown")) {
+		return level, false
+	}
+	return level, true
+}
+
+// detectLogLevel finds the level of a log line: the level field of a JSON
+// line, a logfmt level= field, or a level word such as ERROR or [warn] in
+// the first 200 bytes. It returns "" when there is none.
+func detectLogLevel(message string) string {
+	if trimmed := strings.TrimSpace(message); strings.HasPrefix(trimmed, "{") {
+		var fields map[string]any
+		if json.Unmarshal([]byte(trimmed), &fields) == nil {
+			for _, key := range []string{"level", "lvl", "severity", "log.level"} {
+				if value, ok := fields[key].(string); ok {
+					return logLevelNames[strings.ToLower(value)]
+				}
+			}
+		}
+	}
+	head := message
+	if len(head) > 200 {
+		head = head[:200]
+	}
+	if m := logfmtLevel.FindStringSubmatch(head); m != nil {
+		if level, ok := logLevelNames[strings.ToLower(m[1])]; ok {
+			return level
+		}
+	}
+	if m := wordLevel.FindStringSubmatch(head); m != nil {
+		return logLevelNames[strings.ToLower(m[1]+m[2])]
+	}
+	return ""
+}
+
+// parseLogRange validates the tail, since and until query parameters.
+// tail defaults to defaultTail.
+func parseLogRange(query url.Values, defaultTail string) (tail, since, until string, err error) {
+	tail = query.Get("tail")
+	if tail == "" {
+		tail = defaultTail
+	} else if n, err := strconv.Atoi(tail); tail != "all" && (err != nil || n < 0) {
+		return "", "", "", fmt.Errorf("tail must be a non-negative number or \"all\"")
+	}
+	now := time.Now()
+	since, until = query.Get("since"), query.Get("until")
+	if since != "" {
+		if _, err := timetypes.GetTimestamp(since, now); err != nil {
+			return "", "", "", fmt.Errorf("since must be a timestamp or a duration such as 10m")
+		}
+	}
+	if until != "" {
+		if _, err := timetypes.GetTimestamp(until, now); err != nil {
+			return "", "", "", fmt.Errorf("until must be a timestamp or a duration such as 10m")
+		}
+	}
+	return tail, since, until, nil
+}
+
+// logMatches keeps the newest limit matching entries of a log search
+type logMatches struct {
+	limit   int
+	entries []apitypes.LogEntry // a ring once full
+	next    int
+	scanned int
+	matched int
+}
+
+func (m *logMatches) add(entry apitypes.LogEntry) {
+	m.matched++
+	if len(m.entries) < m.limit {
+		m.entries = append(m.entries, entry)
+		return
+	}
+	m.entries[m.next] = entry
+	m.next = (m.next + 1) % m.limit
+}
+
+// result returns the kept entries oldest first
+func (m *logMatches) result(name string) apitypes.LogSearchResult {
+	entries := make([]apitypes.LogEntry, 0, len(m.entries))
+	entries = append(append(entries, m.entries[m.next:]...), m.entries[:m.next]...)
+	return apitypes.LogSearchResult{
+		Container: name,
+		Entries:   entries,
+		Scanned:   m.scanned,
+		Matched:   m.matched,
+		Truncated: m.matched > len(entries),
+	}
+}
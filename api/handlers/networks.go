@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+type NetworkHandler struct {
+	client *client.Client
+	config *config.Store
+}
+
+func NewNetworkHandler(client *client.Client, cfg *config.Store) *NetworkHandler {
+	return &NetworkHandler{client: client, config: cfg}
+}
+
+// ListNetworks lists networks sorted by name, optionally filtered by driver,
+// name, label and dangling (passed to Docker).
+func (h *NetworkHandler) ListNetworks(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"driver", "name", "label", "dangling"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+
+	networks, err := retryRead(ctx, h.config, func(ctx context.Context) ([]network.Summary, error) {
+		return h.client.NetworkList(ctx, network.ListOptions{Filters: filterArgs})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list networks: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.NetworkDetails, 0, len(networks))
+	for _, n := range networks {
+		details := convertNetwork(n)
+		details.Containers = nil // the list doesn't report endpoints reliably
+		response = append(response, details)
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Name < response[j].Name })
+
+	writeList(w, params, response)
+}
+
+func (h *NetworkHandler) GetNetwork(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/networks/")
+	id = strings.Split(id, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := retryRead(ctx, h.config, func(ctx context.Context) (network.Inspect, error) {
+		return h.client.NetworkInspect(ctx, id, network.InspectOptions{})
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Network not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect network: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertNetwork(inspect))
+}
+
+func (h *NetworkHandler) CreateNetwork(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.NetworkCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	var ipam *network.IPAM
+	if len(req.Subnets) > 0 {
+		ipam = &network.IPAM{}
+		for _, s := range req.Subnets {
+			if _, _, err := net.ParseCIDR(s.Subnet); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid subnet %q: must be CIDR notation such as 172.30.0.0/16", s.Subnet), http.StatusBadRequest)
+				return
+			}
+			if s.Gateway != "" && net.ParseIP(s.Gateway) == nil {
+				http.Error(w, fmt.Sprintf("Invalid gateway %q: must be an IP address", s.Gateway), http.StatusBadRequest)
+				return
+			}
+			ipam.Config = append(ipam.Config, network.IPAMConfig{Subnet: s.Subnet, Gateway: s.Gateway, IPRange: s.IPRange})
+		}
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	enableIPv6 := req.EnableIPv6
+	created, err := h.client.NetworkCreate(ctx, req.Name, network.CreateOptions{
+		Driver:     req.Driver,
+		Internal:   req.Internal,
+		Attachable: req.Attachable,
+		EnableIPv6: &enableIPv6,
+		IPAM:       ipam,
+		Options:    req.Options,
+		Labels:     req.Labels,
+	})
+	if err != nil {
+		switch {
+		case errdefs.IsConflict(err):
+			http.Error(w, fmt.Sprintf("Network already exists: %v", err), http.StatusConflict)
+		case errdefs.IsInvalidParameter(err), errdefs.IsForbidden(err):
+			http.Error(w, fmt.Sprintf("Invalid network: %v", err), http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to create network: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	inspect, err := h.client.NetworkInspect(ctx, created.ID, network.InspectOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Network %s created but could not be inspected: %v", created.ID, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(convertNetwork(inspect))
+}
+
+// RemoveNetwork removes a network. The daemon's own networks are refused,
+// as are networks with containers attached.
+func (h *NetworkHandler) RemoveNetwork(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/networks/")
+	id = strings.Split(id, "/")[0]
+
+	if predefinedNetworks[id] {
+		http.Error(w, fmt.Sprintf("Network %s is predefined and cannot be removed", id), http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.NetworkRemove(ctx, id); err != nil {
+		switch {
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Network not found: %v", err), http.StatusNotFound)
+		case errdefs.IsForbidden(err):
+			http.Error(w, fmt.Sprintf("Network cannot be removed: %v", err), http.StatusForbidden)
+		case errdefs.IsConflict(err):
+			http.Error(w, fmt.Sprintf("Network has containers attached: %v", err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to remove network: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ConnectContainer attaches a container to a network, optionally with DNS
+// aliases and a static IPv4 address.
+func (h *NetworkHandler) ConnectContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/networks/")
+	id = strings.Split(id, "/")[0]
+
+	var req apitypes.NetworkConnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Container == "" {
+		http.Error(w, "Container is required", http.StatusBadRequest)
+		return
+	}
+	if req.IPv4Address != "" {
+		if ip := net.ParseIP(req.IPv4Address); ip == nil || ip.To4() == nil {
+			http.Error(w, fmt.Sprintf("Invalid ipv4_address %q", req.IPv4Address), http.StatusBadRequest)
+			return
+		}
+	}
+
+	settings := &network.EndpointSettings{Aliases: req.Aliases}
+	if req.IPv4Address != "" {
+		settings.IPAMConfig = &network.EndpointIPAMConfig{IPv4Address: req.IPv4Address}
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.NetworkConnect(ctx, id, req.Container, settings); err != nil {
+		switch {
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Network or container not found: %v", err), http.StatusNotFound)
+		case errdefs.IsConflict(err), errdefs.IsForbidden(err):
+			http.Error(w, fmt.Sprintf("Failed to connect container: %v", err), http.StatusConflict)
+		case errdefs.IsInvalidParameter(err):
+			http.Error(w, fmt.Sprintf("Invalid connect request: %v", err), http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to connect container: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DisconnectContainer detaches a container from a network
+func (h *NetworkHandler) DisconnectContainer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/networks/")
+	id = strings.Split(id, "/")[0]
+
+	var req apitypes.NetworkDisconnectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Container == "" {
+		http.Error(w, "Container is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.NetworkDisconnect(ctx, id, req.Container, req.Force); err != nil {
+		switch {
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Network or container not found: %v", err), http.StatusNotFound)
+		case errdefs.IsForbidden(err), errdefs.IsConflict(err):
+			http.Error(w, fmt.Sprintf("Failed to disconnect container: %v", err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to disconnect container: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func convertNetwork(n network.Inspect) apitypes.NetworkDetails {
+	details := apitypes.NetworkDetails{
+		ID:         n.ID,
+		Name:       n.Name,
+		Driver:     n.Driver,
+		Scope:      n.Scope,
+		Created:    n.Created,
+		Internal:   n.Internal,
+		Attachable: n.Attachable,
+		EnableIPv6: n.EnableIPv6,
+		Predefined: predefinedNetworks[n.Name],
+		Subnets:    make([]apitypes.NetworkSubnet, 0, len(n.IPAM.Config)),
+		Labels:     n.Labels,
+		Options:    n.Options,
+		Containers: make([]apitypes.NetworkEndpoint, 0, len(n.Containers)),
+	}
+	for _, c := range n.IPAM.Config {
+		details.Subnets = append(details.Subnets, apitypes.NetworkSubnet{Subnet: c.Subnet, Gateway: c.Gateway, IPRange: c.IPRange})
+	}
+	for id, e := range n.Containers {
+		details.Containers = append(details.Containers, apitypes.NetworkEndpoint{
+			ContainerID: id,
+			Name:        e.Name,
+			IPv4Address: e.IPv4Address,
+			IPv6Address: e.IPv6Address,
+			MacAddress:  e.MacAddress,
+		})
+	}
+	sort.Slice(details.Containers, func(i, j int) bool { return details.Containers[i].Name < details.Containers[j].Name })
+	return details
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/notify"
+)
+
+// NotificationHandler shows the notification settings and sends test
+// notifications
+type NotificationHandler struct {
+	notifier *notify.Notifier
+	config   *config.Store
+}
+
+func NewNotificationHandler(notifier *notify.Notifier, cfg *config.Store) *NotificationHandler {
+	return &NotificationHandler{notifier: notifier, config: cfg}
+}
+
+// GetSettings returns the configured channels, without their URLs or
+// credentials, and routes
+func (h *NotificationHandler) GetSettings(w http.ResponseWriter, r *http.Request) {
+	settings := apitypes.NotificationSettings{
+		Events:   config.NotifyEvents,
+		Channels: []apitypes.NotificationChannel{},
+		Routes:   []apitypes.NotificationRoute{},
+	}
+	if n := h.config.Get().Notifications; n != nil {
+		settings.Enabled = true
+		for _, c := range n.Channels {
+			settings.Channels = append(settings.Channels, apitypes.NotificationChannel{Name: c.Name, Type: c.Type})
+		}
+		for _, route := range n.Routes {
+			settings.Routes = append(settings.Routes, apitypes.NotificationRoute{
+				Events:     route.Events,
+				Channels:   route.Channels,
+				Endpoints:  route.Endpoints,
+				Containers: route.Containers,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// TestNotification sends a test notification to one channel, or to all of
+// them, and waits for the results. A channel that fails doesn't fail the
+// request; its result carries the error.
+func (h *NotificationHandler) TestNotification(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.NotificationTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.notifier.Test(r.Context(), req.Channel, config.LocalEndpoint)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, notify.ErrNotConfigured):
+			status = http.StatusConflict
+		case errors.Is(err, notify.ErrUnknownChannel):
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to send test notification: %v", err), status)
+		return
+	}
+	auditLog(r, "Test notification sent", "channel", req.Channel)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
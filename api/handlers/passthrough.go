@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+// passthroughAllowlist is the set of Docker API paths the passthrough may
+// call. All of them are read-only GETs; anything that changes state, streams
+// or reaches out to a registry is deliberately left out.
+var passthroughAllowlist = []*regexp.Regexp{
+	regexp.MustCompile(`^/(_ping|version|info|system/df)$`),
+	regexp.MustCompile(`^/containers/json$`),
+	regexp.MustCompile(`^/containers/[^/]+/(json|top|changes)$`),
+	regexp.MustCompile(`^/images/json$`),
+	regexp.MustCompile(`^/images/.+/(json|history)$`),
+	regexp.MustCompile(`^/(networks|volumes|plugins)$`),
+	regexp.MustCompile(`^/(networks|volumes)/[^/]+$`),
+	regexp.MustCompile(`^/exec/[^/]+/json$`),
+}
+
+// PassthroughHandler forwards allowlisted read-only calls to the daemon and
+// returns its raw JSON. It is an escape hatch for calls kibutsu doesn't
+// expose yet, disabled unless KIBUTSU_ENABLE_PASSTHROUGH is set.
+type PassthroughHandler struct {
+	client *client.Client
+	config *config.Store
+	http   *http.Client
+}
+
+func NewPassthroughHandler(client *client.Client, cfg *config.Store) *PassthroughHandler {
+	dial := client.Dialer()
+	return &PassthroughHandler{
+		client: client,
+		config: cfg,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dial(ctx)
+				},
+			},
+		},
+	}
+}
+
+func passthroughAllowed(p string) bool {
+	for _, re := range passthroughAllowlist {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward handles POST /docker/raw.
+func (h *PassthroughHandler) Forward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.config.Get().EnablePassthrough {
+		http.Error(w, "Docker passthrough is disabled; set KIBUTSU_ENABLE_PASSTHROUGH=1 to enable it", http.StatusForbidden)
+		return
+	}
+
+	var req apitypes.PassthroughRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.Path, "/") || path.Clean(req.Path) != req.Path || strings.Contains(req.Path, "..") {
+		http.Error(w, fmt.Sprintf("Invalid path %q: must be a clean absolute Docker API path", req.Path), http.StatusBadRequest)
+		return
+	}
+	if !passthroughAllowed(req.Path) {
+		auditLog(r, "Docker passthrough denied", "path", req.Path)
+		http.Error(w, fmt.Sprintf("Path %q is not in the passthrough allowlist", req.Path), http.StatusForbidden)
+		return
+	}
+
+	query := url.Values{}
+	for k, v := range req.Query {
+		query.Set(k, v)
+	}
+	target := url.URL{
+		Scheme:   "http",
+		Host:     "docker",
+		Path:     "/v" + h.client.ClientVersion() + req.Path,
+		RawQuery: query.Encode(),
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	upstream, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to build request: %v", err), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.http.Do(upstream)
+	if err != nil {
+		auditLog(r, "Docker passthrough failed", "path", req.Path, "error", err)
+		http.Error(w, fmt.Sprintf("Failed to call Docker API: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	auditLog(r, "Docker passthrough", "path", req.Path, "query", target.RawQuery, "status", resp.StatusCode)
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
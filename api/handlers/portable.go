@@ -0,0 +1,978 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxImportSize bounds the body of a container import
+const maxImportSize = 1 << 20
+
+// defaultShmSize is the /dev/shm size the daemon gives containers
+const defaultShmSize = 64 << 20
+
+// ExportContainerConfig returns a portable definition of a container: the
+// create request that makes it again, a compose file and a docker run
+// command. Settings inherited from the image are left out, and secret env
+// values are redacted unless reveal=true. format=compose or format=run
+// returns just the compose file or the command.
+func (h *ContainerHandler) ExportContainerConfig(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/containers/")
+	id = strings.Split(id, "/")[0]
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "compose" && format != "run" {
+		http.Error(w, "format must be json, compose or run", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+	// Without the image nothing can be told apart from its defaults, so
+	// everything is exported
+	imageConfig := &container.Config{}
+	if image, _, err := h.client.ImageInspectWithRaw(ctx, inspect.Image); err == nil && image.Config != nil {
+		imageConfig = image.Config
+	}
+
+	export := containerDefinition(inspect, imageConfig, h.config.Get().NamePrefix)
+	sanitized := h.envSanitizer(w, r, inspect.ID).env(export.Definition.Env)
+	for i, kv := range sanitized {
+		if kv != export.Definition.Env[i] {
+			name, _, _ := strings.Cut(kv, "=")
+			export.Redacted = append(export.Redacted, name)
+		}
+	}
+	export.Definition.Env = sanitized
+	compose, err := yaml.Marshal(composeDefinition(export.Definition))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write compose file: %v", err), failureStatus(err))
+		return
+	}
+	export.Compose = string(compose)
+	export.Run = runCommand(export.Definition)
+
+	switch format {
+	case "compose":
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(compose)
+	case "run":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, export.Run)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	}
+}
+
+// ImportContainer creates a container from a portable definition: an
+// export's JSON or just its definition, or with a YAML content type or
+// format=compose a compose file, whose service is picked with service when
+// it has several. name overrides the container's name and start=true starts
+// it.
+func (h *ContainerHandler) ImportContainer(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxImportSize {
+		http.Error(w, fmt.Sprintf("Definition is too large: at most %d bytes", maxImportSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	query := r.URL.Query()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var req apitypes.CreateContainerRequest
+	if query.Get("format") == "compose" || strings.HasSuffix(mediaType, "yaml") {
+		req, err = definitionFromCompose(body, query.Get("service"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid compose file: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var export struct {
+			Definition *apitypes.CreateContainerRequest `json:"definition"`
+		}
+		err := json.Unmarshal(body, &export)
+		if err == nil && export.Definition != nil {
+			req = *export.Definition
+		} else if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				http.Error(w, fmt.Sprintf("Invalid request body: %s must be a %s", typeErr.Field, typeErr.Type), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, kv := range req.Env {
+		if name, value, _ := strings.Cut(kv, "="); value == redactedValue {
+			http.Error(w, fmt.Sprintf("Environment variable %s is redacted: export with reveal=true or set its value", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if name := query.Get("name"); name != "" {
+		req.Name = name
+	}
+	if query.Get("start") == "true" {
+		req.Start = true
+	}
+	h.createContainer(w, r, req)
+}
+
+// containerDefinition builds the create request that makes a container
+// again, leaving out what it inherits from its image, and lists the
+// settings the request can't carry
+func containerDefinition(inspect types.ContainerJSON, image *container.Config, prefix string) apitypes.ContainerExport {
+	cfg, hc := inspect.Config, inspect.HostConfig
+	if cfg == nil {
+		cfg = &container.Config{}
+	}
+	if hc == nil {
+		hc = &container.HostConfig{}
+	}
+	var omitted []string
+
+	def := apitypes.CreateContainerRequest{
+		Image: cfg.Image,
+		Name:  strings.TrimPrefix(strings.TrimPrefix(inspect.Name, "/"), prefix),
+		Init:  hc.Init,
+	}
+	// A new entrypoint drops the image's command, so it's kept with it
+	if !slices.Equal(cfg.Entrypoint, image.Entrypoint) {
+		def.Entrypoint = cfg.Entrypoint
+		def.Cmd = cfg.Cmd
+	} else if !slices.Equal(cfg.Cmd, image.Cmd) {
+		def.Cmd = cfg.Cmd
+	}
+	if cfg.WorkingDir != image.WorkingDir {
+		def.WorkingDir = cfg.WorkingDir
+	}
+	if cfg.User != image.User {
+		def.User = cfg.User
+	}
+	// The daemon names containers' hosts after their ID
+	if cfg.Hostname != "" && !strings.HasPrefix(inspect.ID, cfg.Hostname) {
+		def.Hostname = cfg.Hostname
+	}
+	for _, kv := range cfg.Env {
+		if !slices.Contains(image.Env, kv) {
+			def.Env = append(def.Env, kv)
+		}
+	}
+	for k, v := range cfg.Labels {
+		if inherited, ok := image.Labels[k]; (ok && inherited == v) || strings.HasPrefix(k, "com.docker.compose.") {
+			continue
+		}
+		if def.Labels == nil {
+			def.Labels = make(map[string]string)
+		}
+		def.Labels[k] = v
+	}
+
+	for port, bindings := range hc.PortBindings {
+		for _, b := range bindings {
+			mapping := apitypes.PortMapping{HostIP: b.HostIP, ContainerPort: uint16(port.Int()), Protocol: port.Proto()}
+			// Host port ranges let the daemon pick; any free port will do
+			if hostPort, err := strconv.ParseUint(b.HostPort, 10, 16); err == nil {
+				mapping.HostPort = uint16(hostPort)
+			}
+			def.Ports = append(def.Ports, mapping)
+		}
+	}
+	sort.Slice(def.Ports, func(i, j int) bool {
+		a, b := def.Ports[i], def.Ports[j]
+		return a.ContainerPort < b.ContainerPort || (a.ContainerPort == b.ContainerPort && a.Protocol < b.Protocol)
+	})
+
+	for _, m := range inspect.Mounts {
+		switch m.Type {
+		case mount.TypeBind:
+			def.Mounts = append(def.Mounts, apitypes.MountRequest{Type: "bind", Source: m.Source, Target: m.Destination, ReadOnly: !m.RW})
+		case mount.TypeVolume:
+			source := m.Name
+			if isAnonymousVolume(m.Name) {
+				// The image's volumes are created anyway
+				if _, ok := image.Volumes[m.Destination]; ok {
+					continue
+				}
+				source = ""
+			}
+			def.Mounts = append(def.Mounts, apitypes.MountRequest{Type: "volume", Source: source, Target: m.Destination, ReadOnly: !m.RW})
+		case mount.TypeTmpfs:
+			def.Mounts = append(def.Mounts, apitypes.MountRequest{Type: "tmpfs", Target: m.Destination})
+		default:
+			omitted = append(omitted, fmt.Sprintf("--mount type=%s,target=%s", m.Type, m.Destination))
+		}
+	}
+	for target, options := range hc.Tmpfs {
+		if !slices.ContainsFunc(def.Mounts, func(m apitypes.MountRequest) bool { return m.Target == target }) {
+			def.Mounts = append(def.Mounts, apitypes.MountRequest{Type: "tmpfs", Target: target})
+		}
+		if options != "" {
+			omitted = append(omitted, fmt.Sprintf("--tmpfs %s:%s", target, options))
+		}
+	}
+	sort.Slice(def.Mounts, func(i, j int) bool { return def.Mounts[i].Target < def.Mounts[j].Target })
+
+	if name := hc.RestartPolicy.Name; name != "" && name != container.RestartPolicyDisabled {
+		def.RestartPolicy = &apitypes.RestartPolicy{Name: string(name), MaximumRetryCount: hc.RestartPolicy.MaximumRetryCount}
+	}
+	def.CPUs = float64(hc.NanoCPUs) / 1e9
+	def.Memory = hc.Memory
+	def.Sysctls = hc.Sysctls
+	def.CapAdd = hc.CapAdd
+	def.CapDrop = hc.CapDrop
+	if len(hc.Ulimits) > 0 {
+		def.Ulimits = convertUlimitsToAPI(hc.Ulimits)
+	}
+	if len(hc.DeviceRequests) > 0 {
+		def.DeviceRequests = convertDeviceRequestsToAPI(hc.DeviceRequests)
+	}
+	if len(hc.Devices) > 0 {
+		def.Devices = convertDeviceMappingsToAPI(hc.Devices)
+	}
+
+	mode := hc.NetworkMode
+	switch {
+	case mode.IsContainer():
+		omitted = append(omitted, "--network "+string(mode))
+	case !mode.IsDefault() && !mode.IsBridge():
+		def.Network = string(mode)
+	}
+	if inspect.NetworkSettings != nil {
+		for _, name := range sortedKeys(inspect.NetworkSettings.Networks) {
+			if name != string(mode) && !(name == "bridge" && (mode.IsDefault() || mode.IsBridge())) {
+				omitted = append(omitted, "--network "+name)
+			}
+		}
+	}
+
+	for flag, set := range map[string]bool{
+		"--privileged":   hc.Privileged,
+		"--read-only":    hc.ReadonlyRootfs,
+		"--add-host":     len(hc.ExtraHosts) > 0,
+		"--dns":          len(hc.DNS) > 0,
+		"--security-opt": len(hc.SecurityOpt) > 0,
+		"--link":         len(hc.Links) > 0,
+		"--pid":          hc.PidMode != "",
+		"--ipc":          hc.IpcMode != "" && !hc.IpcMode.IsPrivate() && !hc.IpcMode.IsShareable(),
+		"--shm-size":     hc.ShmSize != 0 && hc.ShmSize != defaultShmSize,
+		"--log-opt":      len(hc.LogConfig.Config) > 0,
+		"--health-cmd":   cfg.Healthcheck != nil && !reflect.DeepEqual(cfg.Healthcheck, image.Healthcheck),
+		"--stop-signal":  cfg.StopSignal != "" && cfg.StopSignal != image.StopSignal,
+	} {
+		if set {
+			omitted = append(omitted, flag)
+		}
+	}
+	sort.Strings(omitted)
+
+	return apitypes.ContainerExport{Definition: def, Omitted: omitted}
+}
+
+// runCommand renders a definition as a docker run command
+func runCommand(def apitypes.CreateContainerRequest) string {
+	args := []string{"docker", "run", "-d"}
+	if def.Name != "" {
+		args = append(args, "--name", def.Name)
+	}
+	if def.Hostname != "" {
+		args = append(args, "--hostname", def.Hostname)
+	}
+	if def.User != "" {
+		args = append(args, "--user", def.User)
+	}
+	if def.WorkingDir != "" {
+		args = append(args, "--workdir", def.WorkingDir)
+	}
+	if def.Network != "" {
+		args = append(args, "--network", def.Network)
+	}
+	if def.RestartPolicy != nil {
+		args = append(args, "--restart", restartPolicyString(*def.RestartPolicy))
+	}
+	if def.Init != nil && *def.Init {
+		args = append(args, "--init")
+	}
+	if def.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(def.CPUs, 'f', -1, 64))
+	}
+	if def.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(def.Memory, 10))
+	}
+	for _, kv := range def.Env {
+		args = append(args, "-e", kv)
+	}
+	for _, k := range sortedKeys(def.Labels) {
+		args = append(args, "--label", k+"="+def.Labels[k])
+	}
+	for _, p := range def.Ports {
+		args = append(args, "-p", portString(p))
+	}
+	for _, m := range def.Mounts {
+		switch {
+		case m.Type == "tmpfs":
+			args = append(args, "--tmpfs", m.Target)
+		case m.Source == "":
+			args = append(args, "-v", m.Target)
+		default:
+			args = append(args, "-v", volumeString(m))
+		}
+	}
+	for _, d := range def.Devices {
+		args = append(args, "--device", deviceString(d))
+	}
+	for _, req := range def.DeviceRequests {
+		gpus := "all"
+		if len(req.DeviceIDs) > 0 {
+			gpus = `"device=` + strings.Join(req.DeviceIDs, ",") + `"`
+		} else if req.Count > 0 {
+			gpus = strconv.Itoa(req.Count)
+		}
+		args = append(args, "--gpus", gpus)
+	}
+	for _, c := range def.CapAdd {
+		args = append(args, "--cap-add", c)
+	}
+	for _, c := range def.CapDrop {
+		args = append(args, "--cap-drop", c)
+	}
+	for _, k := range sortedKeys(def.Sysctls) {
+		args = append(args, "--sysctl", k+"="+def.Sysctls[k])
+	}
+	for _, u := range def.Ulimits {
+		hard := u.Soft
+		if u.Hard != nil {
+			hard = *u.Hard
+		}
+		args = append(args, "--ulimit", fmt.Sprintf("%s=%d:%d", u.Name, u.Soft, hard))
+	}
+
+	// --entrypoint takes a single program; its arguments go before the
+	// command
+	command := def.Cmd
+	if len(def.Entrypoint) > 0 {
+		args = append(args, "--entrypoint", def.Entrypoint[0])
+		command = append(slices.Clone(def.Entrypoint[1:]), def.Cmd...)
+	}
+	args = append(args, def.Image)
+	return shellJoin(append(args, command...))
+}
+
+// composeFile is the subset of a compose file a single container maps to
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+	Networks map[string]composeNetwork `yaml:"networks,omitempty"`
+}
+
+type composeNetwork struct {
+	External bool `yaml:"external,omitempty"`
+}
+
+type composeService struct {
+	Image         string                   `yaml:"image"`
+	ContainerName string                   `yaml:"container_name,omitempty"`
+	Hostname      string                   `yaml:"hostname,omitempty"`
+	User          string                   `yaml:"user,omitempty"`
+	WorkingDir    string                   `yaml:"working_dir,omitempty"`
+	Entrypoint    composeCommand           `yaml:"entrypoint,omitempty"`
+	Command       composeCommand           `yaml:"command,omitempty"`
+	Environment   composeMap               `yaml:"environment,omitempty"`
+	Labels        composeMap               `yaml:"labels,omitempty"`
+	Ports         composePorts             `yaml:"ports,omitempty"`
+	Volumes       composeVolumes           `yaml:"volumes,omitempty"`
+	Tmpfs         composeList              `yaml:"tmpfs,omitempty"`
+	Devices       composeDevices           `yaml:"devices,omitempty"`
+	Restart       string                   `yaml:"restart,omitempty"`
+	Init          *bool                    `yaml:"init,omitempty"`
+	CPUs          composeCPUs              `yaml:"cpus,omitempty"`
+	MemLimit      composeBytes             `yaml:"mem_limit,omitempty"`
+	CapAdd        []string                 `yaml:"cap_add,omitempty"`
+	CapDrop       []string                 `yaml:"cap_drop,omitempty"`
+	Sysctls       composeMap               `yaml:"sysctls,omitempty"`
+	Ulimits       map[string]composeUlimit `yaml:"ulimits,omitempty"`
+	NetworkMode   string                   `yaml:"network_mode,omitempty"`
+	Networks      apitypes.ServiceRefs     `yaml:"networks,omitempty"`
+	Deploy        *composeDeploy           `yaml:"deploy,omitempty"`
+}
+
+type composeDeploy struct {
+	Resources struct {
+		Reservations struct {
+			Devices []composeGPU `yaml:"devices,omitempty"`
+		} `yaml:"reservations"`
+	} `yaml:"resources"`
+}
+
+type composeGPU struct {
+	Driver       string            `yaml:"driver,omitempty"`
+	Count        composeCount      `yaml:"count,omitempty"`
+	DeviceIDs    []string          `yaml:"device_ids,omitempty"`
+	Capabilities []string          `yaml:"capabilities,omitempty"`
+	Options      map[string]string `yaml:"options,omitempty"`
+}
+
+// composeDefinition renders a definition as a compose file with a single
+// service named after the container. A user-defined network is declared
+// external.
+func composeDefinition(def apitypes.CreateContainerRequest) composeFile {
+	svc := composeService{
+		Image:         def.Image,
+		ContainerName: def.Name,
+		Hostname:      def.Hostname,
+		User:          def.User,
+		WorkingDir:    def.WorkingDir,
+		Entrypoint:    def.Entrypoint,
+		Command:       def.Cmd,
+		Labels:        def.Labels,
+		Ports:         def.Ports,
+		Devices:       def.Devices,
+		Init:          def.Init,
+		CPUs:          composeCPUs(def.CPUs),
+		MemLimit:      composeBytes(def.Memory),
+		CapAdd:        def.CapAdd,
+		CapDrop:       def.CapDrop,
+		Sysctls:       def.Sysctls,
+	}
+	if len(def.Env) > 0 {
+		svc.Environment = make(composeMap, len(def.Env))
+		for _, kv := range def.Env {
+			name, value, _ := strings.Cut(kv, "=")
+			svc.Environment[name] = value
+		}
+	}
+	for _, m := range def.Mounts {
+		if m.Type == "tmpfs" {
+			svc.Tmpfs = append(svc.Tmpfs, m.Target)
+		} else {
+			svc.Volumes = append(svc.Volumes, m)
+		}
+	}
+	if def.RestartPolicy != nil {
+		svc.Restart = restartPolicyString(*def.RestartPolicy)
+	}
+	if len(def.Ulimits) > 0 {
+		svc.Ulimits = make(map[string]composeUlimit, len(def.Ulimits))
+		for _, u := range def.Ulimits {
+			hard := u.Soft
+			if u.Hard != nil {
+				hard = *u.Hard
+			}
+			svc.Ulimits[u.Name] = composeUlimit{Soft: u.Soft, Hard: hard}
+		}
+	}
+	if len(def.DeviceRequests) > 0 {
+		svc.Deploy = &composeDeploy{}
+		for _, req := range def.DeviceRequests {
+			gpu := composeGPU{Driver: req.Driver, Count: composeCount(req.Count), DeviceIDs: req.DeviceIDs, Options: req.Options}
+			if len(req.Capabilities) > 0 {
+				gpu.Capabilities = req.Capabilities[0]
+			}
+			svc.Deploy.Resources.Reservations.Devices = append(svc.Deploy.Resources.Reservations.Devices, gpu)
+		}
+	}
+
+	file := composeFile{}
+	switch mode := container.NetworkMode(def.Network); {
+	case def.Network == "":
+	case mode.IsHost() || mode.IsNone() || mode.IsContainer() || mode.IsBridge():
+		svc.NetworkMode = def.Network
+	default:
+		svc.Networks = apitypes.ServiceRefs{def.Network}
+		file.Networks = map[string]composeNetwork{def.Network: {External: true}}
+	}
+
+	name := def.Name
+	if name == "" {
+		name = "app"
+	}
+	file.Services = map[string]composeService{name: svc}
+	return file
+}
+
+// definitionFromCompose reads a service of a compose file as a create
+// request. service may be empty when the file has only one.
+func definitionFromCompose(data []byte, service string) (apitypes.CreateContainerRequest, error) {
+	var file composeFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return apitypes.CreateContainerRequest{}, err
+	}
+	if service == "" {
+		if len(file.Services) != 1 {
+			return apitypes.CreateContainerRequest{}, fmt.Errorf("service is required: the file defines %s", strings.Join(sortedKeys(file.Services), ", "))
+		}
+		service = sortedKeys(file.Services)[0]
+	}
+	svc, ok := file.Services[service]
+	if !ok {
+		return apitypes.CreateContainerRequest{}, fmt.Errorf("service %q is not defined", service)
+	}
+
+	def := apitypes.CreateContainerRequest{
+		Image:      svc.Image,
+		Name:       cmp.Or(svc.ContainerName, service),
+		Hostname:   svc.Hostname,
+		User:       svc.User,
+		WorkingDir: svc.WorkingDir,
+		Entrypoint: svc.Entrypoint,
+		Cmd:        svc.Command,
+		Labels:     svc.Labels,
+		Ports:      svc.Ports,
+		Mounts:     svc.Volumes,
+		Devices:    svc.Devices,
+		Init:       svc.Init,
+		CPUs:       float64(svc.CPUs),
+		Memory:     int64(svc.MemLimit),
+		CapAdd:     svc.CapAdd,
+		CapDrop:    svc.CapDrop,
+		Sysctls:    svc.Sysctls,
+		Network:    svc.NetworkMode,
+	}
+	for _, name := range sortedKeys(svc.Environment) {
+		def.Env = append(def.Env, name+"="+svc.Environment[name])
+	}
+	for _, target := range svc.Tmpfs {
+		def.Mounts = append(def.Mounts, apitypes.MountRequest{Type: "tmpfs", Target: target})
+	}
+	if svc.Restart != "" {
+		name, count, _ := strings.Cut(svc.Restart, ":")
+		policy := &apitypes.RestartPolicy{Name: name}
+		if count != "" {
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return def, fmt.Errorf("restart %q must be on-failure:<count>", svc.Restart)
+			}
+			policy.MaximumRetryCount = n
+		}
+		def.RestartPolicy = policy
+	}
+	for _, name := range sortedKeys(svc.Ulimits) {
+		hard := svc.Ulimits[name].Hard
+		def.Ulimits = append(def.Ulimits, apitypes.Ulimit{Name: name, Soft: svc.Ulimits[name].Soft, Hard: &hard})
+	}
+	if len(svc.Networks) > 0 {
+		if len(svc.Networks) > 1 || def.Network != "" {
+			return def, fmt.Errorf("only one network can be imported")
+		}
+		def.Network = svc.Networks[0]
+	}
+	if svc.Deploy != nil {
+		for _, gpu := range svc.Deploy.Resources.Reservations.Devices {
+			req := apitypes.DeviceRequest{Driver: gpu.Driver, Count: int(gpu.Count), DeviceIDs: gpu.DeviceIDs, Options: gpu.Options}
+			if len(gpu.Capabilities) > 0 {
+				req.Capabilities = [][]string{gpu.Capabilities}
+			}
+			def.DeviceRequests = append(def.DeviceRequests, req)
+		}
+	}
+	return def, nil
+}
+
+func restartPolicyString(p apitypes.RestartPolicy) string {
+	if p.Name == string(container.RestartPolicyOnFailure) && p.MaximumRetryCount > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaximumRetryCount)
+	}
+	return p.Name
+}
+
+// portString writes a port mapping in the [ip:][host:]container[/protocol]
+// form of docker run -p and compose
+func portString(p apitypes.PortMapping) string {
+	s := strconv.Itoa(int(p.ContainerPort))
+	if p.Protocol != "" && p.Protocol != "tcp" {
+		s += "/" + p.Protocol
+	}
+	if p.HostPort == 0 && p.HostIP == "" {
+		return s
+	}
+	host := ""
+	if p.HostPort != 0 {
+		host = strconv.Itoa(int(p.HostPort))
+	}
+	s = host + ":" + s
+	if p.HostIP != "" {
+		ip := p.HostIP
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		s = ip + ":" + s
+	}
+	return s
+}
+
+// volumeString writes a bind or named volume mount as source:target[:ro]
+func volumeString(m apitypes.MountRequest) string {
+	s := m.Source + ":" + m.Target
+	if m.ReadOnly {
+		s += ":ro"
+	}
+	return s
+}
+
+// deviceString writes a device mapping as host[:container[:permissions]]
+func deviceString(d apitypes.DeviceMapping) string {
+	s := d.PathOnHost
+	permissions := d.CgroupPermissions != "" && d.CgroupPermissions != "rwm"
+	if (d.PathInContainer != "" && d.PathInContainer != d.PathOnHost) || permissions {
+		s += ":" + cmp.Or(d.PathInContainer, d.PathOnHost)
+	}
+	if permissions {
+		s += ":" + d.CgroupPermissions
+	}
+	return s
+}
+
+// composeCommand is a command written as a list or as a string split like
+// a shell would
+type composeCommand []string
+
+func (c *composeCommand) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		words, err := shellSplit(value.Value)
+		*c = words
+		return err
+	}
+	var words []string
+	err := value.Decode(&words)
+	*c = words
+	return err
+}
+
+// composeList is a list that may be written as a single string
+type composeList []string
+
+func (l *composeList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = composeList{value.Value}
+		return nil
+	}
+	var items []string
+	err := value.Decode(&items)
+	*l = items
+	return err
+}
+
+// composeMap is a mapping that may be written as a list of KEY=VALUE
+type composeMap map[string]string
+
+func (m *composeMap) UnmarshalYAML(value *yaml.Node) error {
+	result := composeMap{}
+	switch value.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			v := value.Content[i+1]
+			if v.Tag == "!!null" {
+				result[value.Content[i].Value] = ""
+			} else {
+				result[value.Content[i].Value] = v.Value
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range value.Content {
+			k, v, _ := strings.Cut(item.Value, "=")
+			result[k] = v
+		}
+	default:
+		return fmt.Errorf("expected a mapping or a list of KEY=VALUE, got %q", value.Value)
+	}
+	*m = result
+	return nil
+}
+
+// composePorts are port mappings in the short or long syntax
+type composePorts []apitypes.PortMapping
+
+func (p composePorts) MarshalYAML() (any, error) {
+	// Quoted so YAML 1.1 parsers don't read 80:80 as a number
+	seq := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, mapping := range p {
+		seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: portString(mapping)})
+	}
+	return seq, nil
+}
+
+func (p *composePorts) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return fmt.Errorf("ports must be a list")
+	}
+	var result composePorts
+	for _, item := range value.Content {
+		if item.Kind == yaml.MappingNode {
+			var long struct {
+				Target    uint16 `yaml:"target"`
+				Published string `yaml:"published"`
+				HostIP    string `yaml:"host_ip"`
+				Protocol  string `yaml:"protocol"`
+			}
+			if err := item.Decode(&long); err != nil {
+				return err
+			}
+			mapping := apitypes.PortMapping{HostIP: long.HostIP, ContainerPort: long.Target, Protocol: long.Protocol}
+			if long.Published != "" {
+				n, err := strconv.ParseUint(long.Published, 10, 16)
+				if err != nil {
+					return fmt.Errorf("published port %q must be a single port", long.Published)
+				}
+				mapping.HostPort = uint16(n)
+			}
+			result = append(result, mapping)
+			continue
+		}
+		mappings, err := nat.ParsePortSpec(item.Value)
+		if err != nil {
+			return fmt.Errorf("port %q: %w", item.Value, err)
+		}
+		for _, m := range mappings {
+			mapping := apitypes.PortMapping{HostIP: m.Binding.HostIP, ContainerPort: uint16(m.Port.Int()), Protocol: m.Port.Proto()}
+			if m.Binding.HostPort != "" {
+				n, err := strconv.ParseUint(m.Binding.HostPort, 10, 16)
+				if err != nil {
+					return fmt.Errorf("port %q: host port must be a single port", item.Value)
+				}
+				mapping.HostPort = uint16(n)
+			}
+			result = append(result, mapping)
+		}
+	}
+	*p = result
+	return nil
+}
+
+// composeVolumes are bind and volume mounts in the short or long syntax
+type composeVolumes []apitypes.MountRequest
+
+func (v composeVolumes) MarshalYAML() (any, error) {
+	items := make([]string, len(v))
+	for i, m := range v {
+		if m.Source == "" {
+			items[i] = m.Target
+		} else {
+			items[i] = volumeString(m)
+		}
+	}
+	return items, nil
+}
+
+func (v *composeVolumes) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		return fmt.Errorf("volumes must be a list")
+	}
+	var result composeVolumes
+	for _, item := range value.Content {
+		if item.Kind == yaml.MappingNode {
+			var long struct {
+				Type     string `yaml:"type"`
+				Source   string `yaml:"source"`
+				Target   string `yaml:"target"`
+				ReadOnly bool   `yaml:"read_only"`
+			}
+			if err := item.Decode(&long); err != nil {
+				return err
+			}
+			result = append(result, apitypes.MountRequest{Type: long.Type, Source: long.Source, Target: long.Target, ReadOnly: long.ReadOnly})
+			continue
+		}
+		parts := strings.Split(item.Value, ":")
+		if len(parts) == 1 {
+			result = append(result, apitypes.MountRequest{Type: "volume", Target: parts[0]})
+			continue
+		}
+		if len(parts) > 3 {
+			return fmt.Errorf("volume %q must be source:target[:mode]", item.Value)
+		}
+		m := apitypes.MountRequest{Type: "volume", Source: parts[0], Target: parts[1]}
+		if strings.ContainsAny(parts[0][:min(1, len(parts[0]))], "/.~") {
+			m.Type = "bind"
+		}
+		if len(parts) == 3 {
+			m.ReadOnly = slices.Contains(strings.Split(parts[2], ","), "ro")
+		}
+		result = append(result, m)
+	}
+	*v = result
+	return nil
+}
+
+// composeDevices are device mappings written as host[:container[:permissions]]
+type composeDevices []apitypes.DeviceMapping
+
+func (d composeDevices) MarshalYAML() (any, error) {
+	items := make([]string, len(d))
+	for i, device := range d {
+		items[i] = deviceString(device)
+	}
+	return items, nil
+}
+
+func (d *composeDevices) UnmarshalYAML(value *yaml.Node) error {
+	var items []string
+	if err := value.Decode(&items); err != nil {
+		return err
+	}
+	result := make(composeDevices, len(items))
+	for i, item := range items {
+		parts := strings.SplitN(item, ":", 3)
+		result[i].PathOnHost = parts[0]
+		if len(parts) > 1 {
+			result[i].PathInContainer = parts[1]
+		}
+		if len(parts) > 2 {
+			result[i].CgroupPermissions = parts[2]
+		}
+	}
+	*d = result
+	return nil
+}
+
+// composeCPUs is a CPU count, which compose allows to be quoted
+type composeCPUs float64
+
+func (c *composeCPUs) UnmarshalYAML(value *yaml.Node) error {
+	n, err := strconv.ParseFloat(value.Value, 64)
+	if err != nil {
+		return fmt.Errorf("cpus must be a number, got %q", value.Value)
+	}
+	*c = composeCPUs(n)
+	return nil
+}
+
+// composeBytes is a size in bytes, or with a unit such as 512m
+type composeBytes int64
+
+func (b *composeBytes) UnmarshalYAML(value *yaml.Node) error {
+	n, err := units.RAMInBytes(value.Value)
+	if err != nil {
+		return fmt.Errorf("mem_limit must be a size such as 512m, got %q", value.Value)
+	}
+	*b = composeBytes(n)
+	return nil
+}
+
+// composeUlimit is a ulimit with soft and hard limits, or a single number
+// for both
+type composeUlimit struct {
+	Soft int64 `yaml:"soft"`
+	Hard int64 `yaml:"hard"`
+}
+
+func (u *composeUlimit) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		n, err := strconv.ParseInt(value.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("ulimit must be a number or soft and hard, got %q", value.Value)
+		}
+		u.Soft, u.Hard = n, n
+		return nil
+	}
+	type plain composeUlimit
+	return value.Decode((*plain)(u))
+}
+
+// composeCount is a device count where all is -1
+type composeCount int
+
+func (c composeCount) MarshalYAML() (any, error) {
+	if c == -1 {
+		return "all", nil
+	}
+	return int(c), nil
+}
+
+func (c *composeCount) UnmarshalYAML(value *yaml.Node) error {
+	if value.Value == "all" {
+		*c = -1
+		return nil
+	}
+	n, err := strconv.Atoi(value.Value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("count must be a positive number or all, got %q", value.Value)
+	}
+	*c = composeCount(n)
+	return nil
+}
+
+// shellSplit splits a command line into words as a POSIX shell would,
+// honouring single and double quotes and backslashes
+func shellSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
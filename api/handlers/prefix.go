@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// When KIBUTSU_NAME_PREFIX is set, the container endpoints only see
+// containers whose names start with the prefix. This keeps teams sharing a
+// daemon out of each other's way; it does not stop anyone with access to the
+// daemon from reaching other containers.
+
+// hasNamePrefix reports whether a container name, with or without Docker's
+// leading slash, is within prefix. An empty prefix allows every name.
+func hasNamePrefix(name, prefix string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix)
+}
+
+// listedWithPrefix reports whether any of a listed container's names is
+// within prefix.
+func listedWithPrefix(c types.Container, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	for _, name := range c.Names {
+		if hasNamePrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// outsidePrefixError is returned when an operation would touch a container
+// outside the configured name prefix.
+type outsidePrefixError struct {
+	name, prefix string
+}
+
+func (e *outsidePrefixError) Error() string {
+	return fmt.Sprintf("container %s is outside the %q name prefix", e.name, e.prefix)
+}
+
+// checkPrefix returns an *outsidePrefixError for the first of the listed
+// containers that is outside prefix.
+func checkPrefix(containers []types.Container, prefix string) error {
+	for _, c := range containers {
+		if listedWithPrefix(c, prefix) {
+			continue
+		}
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		return &outsidePrefixError{name: name, prefix: prefix}
+	}
+	return nil
+}
+
+// AllowContainer reports whether the container id may be used under the
+// configured name prefix, writing a 403 if not. Containers that can't be
+// inspected are allowed through so the handler reports the real error.
+func (h *ContainerHandler) AllowContainer(w http.ResponseWriter, r *http.Request, id string) bool {
+	prefix := h.config.Get().NamePrefix
+	if prefix == "" {
+		return true
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return true
+	}
+	if !hasNamePrefix(inspect.Name, prefix) {
+		http.Error(w, fmt.Sprintf("Container %s is outside the %q name prefix", id, prefix), http.StatusForbidden)
+		return false
+	}
+	return true
+}
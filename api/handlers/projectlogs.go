@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	apitypes "kibutsu/api/types"
+)
+
+// logSlot is a container's fixed place in a project log stream
+type logSlot struct {
+	service    string
+	container  string
+	index      int
+	colorIndex int
+}
+
+// assignLogSlots gives every service a color index from its position among
+// the sorted service names and every container a replica index, taken from
+// its compose labels where possible. Services from the compose file are
+// included so colors don't shift when a service has no containers.
+func assignLogSlots(containers []types.Container, declared []string) map[string]logSlot {
+	services := make(map[string]bool)
+	for _, s := range declared {
+		services[s] = true
+	}
+	byService := make(map[string][]types.Container)
+	for _, c := range containers {
+		service := c.Labels["com.docker.compose.service"]
+		services[service] = true
+		byService[service] = append(byService[service], c)
+	}
+
+	slots := make(map[string]logSlot, len(containers))
+	for color, service := range sortedKeys(services) {
+		replicas := byService[service]
+		sort.Slice(replicas, func(i, j int) bool { return listedName(replicas[i]) < listedName(replicas[j]) })
+
+		used := make(map[int]bool)
+		var unnumbered []types.Container
+		for _, c := range replicas {
+			n, ok := replicaNumber(c.Labels)
+			if !ok || used[n] {
+				unnumbered = append(unnumbered, c)
+				continue
+			}
+			used[n] = true
+			slots[c.ID] = logSlot{service: service, container: listedName(c), index: n, colorIndex: color}
+		}
+		next := 1
+		for _, c := range unnumbered {
+			for used[next] {
+				next++
+			}
+			used[next] = true
+			slots[c.ID] = logSlot{service: service, container: listedName(c), index: next, colorIndex: color}
+		}
+	}
+	return slots
+}
+
+// replicaNumber reads a container's 1-based replica number from the labels
+// set by docker compose or, 0-based, by kibutsu itself.
+func replicaNumber(labels map[string]string) (int, bool) {
+	if n, err := strconv.Atoi(labels["com.docker.compose.container-number"]); err == nil && n > 0 {
+		return n, true
+	}
+	if n, err := strconv.Atoi(labels["com.docker.compose.instance"]); err == nil && n >= 0 {
+		return n + 1, true
+	}
+	return 0, false
+}
+
+func listedName(c types.Container) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID[:12]
+}
+
+// streamProjectLogs writes the logs of all containers as NDJSON LogFrames.
+// With follow=true it keeps streaming until the client disconnects,
+// resuming each container's logs after it restarts.
+func (h *ComposeHandler) streamProjectLogs(w http.ResponseWriter, r *http.Request, project string, containers []types.Container) {
+	follow := r.URL.Query().Get("follow") == "true"
+	tail := r.URL.Query().Get("tail")
+	if tail == "" {
+		tail = "100"
+	}
+
+	ctx := r.Context()
+	if !follow {
+		var cancel context.CancelFunc
+		ctx, cancel = writeContext(w, r, h.config)
+		defer cancel()
+	}
+
+	var declared []string
+	if config, err := h.loadComposeFile(project); err == nil {
+		declared = sortedKeys(config.Services)
+	}
+	slots := assignLogSlots(containers, declared)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	var mu sync.Mutex
+	send := func(frame apitypes.LogFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(frame)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		wg.Add(1)
+		go func(id string, slot logSlot) {
+			defer wg.Done()
+			h.containerLogFrames(ctx, id, slot, tail, follow, send)
+		}(c.ID, slots[c.ID])
+	}
+	wg.Wait()
+}
+
+// containerLogFrames sends one container's logs as frames
+func (h *ComposeHandler) containerLogFrames(ctx context.Context, id string, slot logSlot, tail string, follow bool, send func(apitypes.LogFrame)) {
+	options := container.LogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: true, Follow: follow, Tail: tail}
+	readContainerLogs(ctx, h.client, id, options, time.Time{}, func(stream, message string, ts time.Time) {
+		send(slot.frame(stream, message, ts))
+	})
+}
+
+// frame tags a log line with the slot's container, service and colors
+func (slot logSlot) frame(stream, message string, ts time.Time) apitypes.LogFrame {
+	return apitypes.LogFrame{
+		Service:    slot.service,
+		Container:  slot.container,
+		Index:      slot.index,
+		ColorIndex: slot.colorIndex,
+		Stream:     stream,
+		Timestamp:  ts,
+		Message:    message,
+	}
+}
+
+// readContainerLogs passes a container's log lines to emit, starting after
+// the time after if it is set. When following, it waits for a stopped
+// container to run again and picks up after the last line it read. It
+// returns the timestamp of the last line.
+func readContainerLogs(ctx context.Context, cli *client.Client, id string, options container.LogsOptions, after time.Time, emit func(stream, message string, ts time.Time)) time.Time {
+	last := after
+	for {
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return last
+		}
+
+		if !last.IsZero() {
+			next := last.Add(time.Nanosecond)
+			options.Since = fmt.Sprintf("%d.%09d", next.Unix(), next.Nanosecond())
+			options.Tail = ""
+		}
+		logs, err := openContainerLogs(ctx, cli, id, options)
+		if err != nil {
+			emit("error", logsUnavailableMessage(err), time.Now().UTC())
+			return last
+		}
+
+		lines := func(stream string) *logLineWriter {
+			return &logLineWriter{emit: func(line string) {
+				ts, message := splitLogTimestamp(line)
+				if !ts.IsZero() {
+					last = ts
+				}
+				emit(stream, message, ts)
+			}}
+		}
+		stdout, stderr := lines("stdout"), lines("stderr")
+		if hasTTY(inspect) {
+			io.Copy(stdout, logs)
+		} else {
+			stdcopy.StdCopy(stdout, stderr, logs)
+		}
+		stdout.flush()
+		stderr.flush()
+		logs.Close()
+
+		if !options.Follow || ctx.Err() != nil {
+			return last
+		}
+		if last.IsZero() {
+			last = time.Now()
+		}
+		if !waitRunning(ctx, cli, id) {
+			return last
+		}
+	}
+}
+
+// waitRunning polls until the container is running again, reporting false
+// if it was removed or the context ended.
+func waitRunning(ctx context.Context, cli *client.Client, id string) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return false
+		}
+		if inspect.State != nil && inspect.State.Running {
+			return true
+		}
+	}
+}
+
+// splitLogTimestamp separates the RFC 3339 timestamp Docker prefixes each
+// line with from the message.
+func splitLogTimestamp(line string) (time.Time, string) {
+	prefix, message, ok := strings.Cut(line, " ")
+	if !ok {
+		return time.Time{}, line
+	}
+	ts, err := time.Parse(time.RFC3339Nano, prefix)
+	if err != nil {
+		return time.Time{}, line
+	}
+	return ts, message
+}
+
+// logLineWriter splits written output into lines
+type logLineWriter struct {
+	buf  []byte
+	emit func(string)
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush emits any trailing partial line.
+func (w *logLineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
+}
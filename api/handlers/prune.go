@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+
+	apitypes "kibutsu/api/types"
+)
+
+// pruneScopes are what a system prune can cover, in the order they are
+// pruned: containers go first so whatever only they used is freed for the
+// scopes after them
+var pruneScopes = []string{"containers", "networks", "volumes", "images", "build-cache"}
+
+// defaultPruneScopes match docker system prune, which leaves volumes alone
+var defaultPruneScopes = map[string]bool{"containers": true, "networks": true, "images": true, "build-cache": true}
+
+// anonymousVolumeLabel marks the volumes the daemon named itself, the only
+// ones a volume prune removes by default
+const anonymousVolumeLabel = "com.docker.volume.anonymous"
+
+// PruneSystem removes stopped containers, unused networks, unused anonymous
+// volumes, dangling images and unused build cache, or with dry_run=true only
+// reports what would go. scope picks among containers, networks, volumes,
+// images and build-cache (all but volumes by default); all=true widens the
+// image and build cache prunes to everything unused.
+func (h *SystemHandler) PruneSystem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	scopes, err := parsePruneScopes(query["scope"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all := query.Get("all") == "true"
+	dryRun := query.Get("dry_run") == "true"
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	result, err := h.planPrune(ctx, scopes, all)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to plan prune: %v", err), failureStatus(err))
+		return
+	}
+	if !dryRun {
+		h.prune(ctx, result, all)
+		auditLog(r, "System pruned", "scopes", strings.Join(sortedKeys(scopes), ","), "all", all, "reclaimed_bytes", result.SpaceReclaimed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func parsePruneScopes(values []string) (map[string]bool, error) {
+	scopes := make(map[string]bool)
+	for _, v := range values {
+		for _, scope := range strings.Split(v, ",") {
+			if scope = strings.TrimSpace(scope); scope == "" {
+				continue
+			}
+			if !defaultPruneScopes[scope] && scope != "volumes" {
+				return nil, fmt.Errorf("unknown prune scope %q; expected %s", scope, strings.Join(pruneScopes, ", "))
+			}
+			scopes[scope] = true
+		}
+	}
+	if len(scopes) == 0 {
+		return maps.Clone(defaultPruneScopes), nil
+	}
+	return scopes, nil
+}
+
+// planPrune works out what a prune of scopes would remove. Images, volumes
+// and networks used only by containers that are themselves pruned count as
+// unused, as they are once the containers are gone. Sizes are what each
+// item frees on its own, so space shared between removed images makes the
+// real total somewhat larger.
+func (h *SystemHandler) planPrune(ctx context.Context, scopes map[string]bool, all bool) (*apitypes.SystemPruneResult, error) {
+	prefix := h.config.Get().NamePrefix
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true, Size: scopes["containers"]})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	result := &apitypes.SystemPruneResult{DryRun: true}
+	usedImages := make(map[string]bool)
+	usedVolumes := make(map[string]bool)
+	usedNetworks := make(map[string]bool) // by ID and name
+	var removed []apitypes.PruneItem
+	for _, c := range containers {
+		if scopes["containers"] && prunableContainer(c, prefix) {
+			removed = append(removed, apitypes.PruneItem{ID: c.ID, Name: listedName(c), Size: c.SizeRw})
+			continue
+		}
+		usedImages[c.ImageID] = true
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeVolume {
+				usedVolumes[m.Name] = true
+			}
+		}
+		// Only a running container's endpoints keep a network from being
+		// pruned
+		if c.NetworkSettings != nil && (c.State == "running" || c.State == "paused" || c.State == "restarting") {
+			for name, ep := range c.NetworkSettings.Networks {
+				usedNetworks[name] = true
+				if ep != nil {
+					usedNetworks[ep.NetworkID] = true
+				}
+			}
+		}
+	}
+	if scopes["containers"] {
+		result.Containers = pruneScope(removed)
+	}
+
+	var objects []types.DiskUsageObject
+	if scopes["images"] {
+		objects = append(objects, types.ImageObject)
+	}
+	if scopes["volumes"] {
+		objects = append(objects, types.VolumeObject)
+	}
+	if scopes["build-cache"] {
+		objects = append(objects, types.BuildCacheObject)
+	}
+	var usage types.DiskUsage
+	if len(objects) > 0 {
+		if usage, err = h.client.DiskUsage(ctx, types.DiskUsageOptions{Types: objects}); err != nil {
+			return nil, fmt.Errorf("failed to get disk usage: %w", err)
+		}
+	}
+
+	if scopes["images"] {
+		removed = nil
+		for _, img := range usage.Images {
+			if usedImages[img.ID] || (!all && !danglingImage(img.RepoTags)) {
+				continue
+			}
+			size := img.Size
+			if img.SharedSize > 0 {
+				size -= img.SharedSize
+			}
+			name := img.ID
+			if !danglingImage(img.RepoTags) {
+				name = img.RepoTags[0]
+			}
+			removed = append(removed, apitypes.PruneItem{ID: img.ID, Name: name, Size: size})
+		}
+		result.Images = pruneScope(removed)
+	}
+
+	if scopes["volumes"] {
+		removed = nil
+		for _, v := range usage.Volumes {
+			if _, anonymous := v.Labels[anonymousVolumeLabel]; !anonymous || usedVolumes[v.Name] {
+				continue
+			}
+			size := int64(-1)
+			if v.UsageData != nil {
+				size = v.UsageData.Size
+			}
+			removed = append(removed, apitypes.PruneItem{Name: v.Name, Size: size})
+		}
+		result.Volumes = pruneScope(removed)
+	}
+
+	if scopes["networks"] {
+		networks, err := h.client.NetworkList(ctx, network.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list networks: %w", err)
+		}
+		removed = nil
+		for _, n := range networks {
+			if predefinedNetworks[n.Name] || n.Scope != "local" || n.Ingress || usedNetworks[n.ID] || usedNetworks[n.Name] {
+				continue
+			}
+			removed = append(removed, apitypes.PruneItem{ID: n.ID, Name: n.Name})
+		}
+		result.Networks = pruneScope(removed)
+	}
+
+	if scopes["build-cache"] {
+		removed = nil
+		for _, record := range usage.BuildCache {
+			// Without all, BuildKit keeps shared records and its own
+			// internal and frontend ones
+			if record.InUse || (!all && (record.Shared || record.Type == "internal" || record.Type == "frontend")) {
+				continue
+			}
+			removed = append(removed, apitypes.PruneItem{ID: record.ID, Name: record.Description, Size: record.Size})
+		}
+		result.BuildCache = pruneScope(removed)
+	}
+
+	result.SpaceReclaimed = totalReclaimed(result)
+	return result, nil
+}
+
+// prune carries out a planned prune, replacing each scope's plan with what
+// was actually removed. A scope that fails keeps its error and the others
+// go ahead.
+func (h *SystemHandler) prune(ctx context.Context, result *apitypes.SystemPruneResult, all bool) {
+	result.DryRun = false
+	for _, scope := range pruneScopes {
+		switch scope {
+		case "containers":
+			if result.Containers != nil {
+				result.Containers = h.pruneContainers(ctx, result.Containers)
+			}
+		case "networks":
+			if result.Networks != nil {
+				report, err := h.client.NetworksPrune(ctx, filters.NewArgs())
+				result.Networks = prunedScope(result.Networks, report.NetworksDeleted, 0, err, func(name string) apitypes.PruneItem {
+					return apitypes.PruneItem{Name: name}
+				})
+			}
+		case "volumes":
+			if result.Volumes != nil {
+				report, err := h.client.VolumesPrune(ctx, filters.NewArgs())
+				result.Volumes = prunedScope(result.Volumes, report.VolumesDeleted, report.SpaceReclaimed, err, func(name string) apitypes.PruneItem {
+					return apitypes.PruneItem{Name: name, Size: -1}
+				})
+			}
+		case "images":
+			if result.Images != nil {
+				report, err := h.client.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", strconv.FormatBool(!all))))
+				// The report also lists the layers and parent images
+				// removed along the way; only the images are reported
+				var deleted []string
+				for _, d := range report.ImagesDeleted {
+					if d.Deleted != "" {
+						deleted = append(deleted, d.Deleted)
+					}
+				}
+				result.Images = prunedScope(result.Images, deleted, report.SpaceReclaimed, err, nil)
+			}
+		case "build-cache":
+			if result.BuildCache != nil {
+				var deleted []string
+				var reclaimed uint64
+				report, err := h.client.BuildCachePrune(ctx, types.BuildCachePruneOptions{All: all})
+				if report != nil {
+					deleted, reclaimed = report.CachesDeleted, report.SpaceReclaimed
+				}
+				result.BuildCache = prunedScope(result.BuildCache, deleted, reclaimed, err, func(id string) apitypes.PruneItem {
+					return apitypes.PruneItem{ID: id, Size: -1}
+				})
+			}
+		}
+	}
+	result.SpaceReclaimed = totalReclaimed(result)
+}
+
+// pruneContainers removes stopped containers. With a name prefix configured
+// only the planned containers, which are within it, are removed one at a
+// time, since the daemon's prune can't be limited by name.
+func (h *SystemHandler) pruneContainers(ctx context.Context, plan *apitypes.PruneScopeResult) *apitypes.PruneScopeResult {
+	if h.config.Get().NamePrefix == "" {
+		report, err := h.client.ContainersPrune(ctx, filters.NewArgs())
+		return prunedScope(plan, report.ContainersDeleted, report.SpaceReclaimed, err, func(id string) apitypes.PruneItem {
+			return apitypes.PruneItem{ID: id, Size: -1}
+		})
+	}
+
+	var deleted []string
+	var reclaimed uint64
+	for _, item := range plan.Items {
+		if err := h.client.ContainerRemove(ctx, item.ID, container.RemoveOptions{}); err != nil {
+			slog.WarnContext(ctx, "Failed to prune container", "container", item.ID, "error", err)
+			continue
+		}
+		deleted = append(deleted, item.ID)
+		reclaimed += uint64(max(item.Size, 0))
+	}
+	return prunedScope(plan, deleted, reclaimed, nil, nil)
+}
+
+// prunableContainer reports whether a prune removes c: it is not running
+// and, with a name prefix configured, within it
+func prunableContainer(c types.Container, prefix string) bool {
+	switch c.State {
+	case "created", "exited", "dead":
+		return listedWithPrefix(c, prefix)
+	}
+	return false
+}
+
+// danglingImage reports whether an image has no tags
+func danglingImage(tags []string) bool {
+	for _, tag := range tags {
+		if tag != "<none>:<none>" {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneScope sorts the items of a scope and adds up their sizes
+func pruneScope(items []apitypes.PruneItem) *apitypes.PruneScopeResult {
+	scope := &apitypes.PruneScopeResult{Items: make([]apitypes.PruneItem, 0, len(items))}
+	scope.Items = append(scope.Items, items...)
+	sort.Slice(scope.Items, func(i, j int) bool {
+		if scope.Items[i].Name != scope.Items[j].Name {
+			return scope.Items[i].Name < scope.Items[j].Name
+		}
+		return scope.Items[i].ID < scope.Items[j].ID
+	})
+	for _, item := range scope.Items {
+		if item.Size > 0 {
+			scope.SpaceReclaimed += uint64(item.Size)
+		}
+	}
+	return scope
+}
+
+// prunedScope reports what a prune removed, describing each removed ID or
+// name as planned. Removed things that weren't planned are described by
+// unknown, or left out if it is nil. reclaimed is the space the daemon
+// reported; when it reports none the planned sizes are added up instead.
+func prunedScope(plan *apitypes.PruneScopeResult, removed []string, reclaimed uint64, err error, unknown func(string) apitypes.PruneItem) *apitypes.PruneScopeResult {
+	if err != nil {
+		return &apitypes.PruneScopeResult{Items: []apitypes.PruneItem{}, Error: err.Error()}
+	}
+	planned := make(map[string]apitypes.PruneItem, len(plan.Items))
+	for _, item := range plan.Items {
+		if item.ID != "" {
+			planned[item.ID] = item
+		}
+		if item.Name != "" {
+			planned[item.Name] = item
+		}
+	}
+	var items []apitypes.PruneItem
+	for _, key := range removed {
+		if item, ok := planned[key]; ok {
+			items = append(items, item)
+		} else if unknown != nil {
+			items = append(items, unknown(key))
+		}
+	}
+	scope := pruneScope(items)
+	if reclaimed > 0 {
+		scope.SpaceReclaimed = reclaimed
+	}
+	return scope
+}
+
+func totalReclaimed(result *apitypes.SystemPruneResult) uint64 {
+	var total uint64
+	for _, scope := range []*apitypes.PruneScopeResult{result.Containers, result.Images, result.Volumes, result.Networks, result.BuildCache} {
+		if scope != nil {
+			total += scope.SpaceReclaimed
+		}
+	}
+	return total
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// RegistryHandler adds, lists and removes the registry logins kept in the
+// encrypted store. A nil store means KIBUTSU_SECRET_KEY is not set.
+type RegistryHandler struct {
+	store  *docker.RegistryStore
+	client *client.Client // verifies new logins
+	config *config.Store
+}
+
+func NewRegistryHandler(store *docker.RegistryStore, client *client.Client, cfg *config.Store) *RegistryHandler {
+	return &RegistryHandler{store: store, client: client, config: cfg}
+}
+
+// ListRegistries returns the stored logins without their passwords
+func (h *RegistryHandler) ListRegistries(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+	list, err := h.store.All()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list registry logins: %v", err), failureStatus(err))
+		return
+	}
+	for i := range list {
+		list[i].Password = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// AddRegistry stores a login, replacing any for the same registry. The
+// login is first checked with the Docker daemon unless verify=false.
+func (h *RegistryHandler) AddRegistry(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+
+	var cred apitypes.RegistryCredential
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if cred.Registry == "" || cred.Username == "" || cred.Password == "" {
+		http.Error(w, "registry, username and password are required", http.StatusBadRequest)
+		return
+	}
+	cred.Registry = docker.NormalizeRegistryHost(cred.Registry)
+
+	if r.URL.Query().Get("verify") != "false" {
+		ctx, cancel := writeContext(w, r, h.config)
+		defer cancel()
+		address := cred.Registry
+		if address == "docker.io" {
+			address = ""
+		}
+		_, err := h.client.RegistryLogin(ctx, registry.AuthConfig{
+			Username:      cred.Username,
+			Password:      cred.Password,
+			ServerAddress: address,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to log in to %s: %v", cred.Registry, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.store.Set(cred); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save registry login: %v", err), failureStatus(err))
+		return
+	}
+	auditLog(r, "Registry login saved", "registry", cred.Registry, "username", cred.Username)
+
+	cred.Password = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cred)
+}
+
+// RemoveRegistry deletes the login for the registry in the path
+func (h *RegistryHandler) RemoveRegistry(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w) {
+		return
+	}
+	host := strings.TrimPrefix(r.URL.Path, "/registries/")
+
+	removed, err := h.store.Delete(host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to remove registry login: %v", err), failureStatus(err))
+		return
+	}
+	if !removed {
+		http.Error(w, fmt.Sprintf("No login stored for %s", host), http.StatusNotFound)
+		return
+	}
+	auditLog(r, "Registry login removed", "registry", docker.NormalizeRegistryHost(host))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *RegistryHandler) enabled(w http.ResponseWriter) bool {
+	if h.store == nil {
+		http.Error(w, "Registry logins are disabled; set KIBUTSU_SECRET_KEY to enable them", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+// redactedValue replaces the value of environment variables that look secret
+const redactedValue = "********"
+
+// envSanitizer redacts environment values whose names match the configured
+// secret patterns. Every handler returning container environment must pass
+// it through here so nothing leaks into the UI or logs by default.
+type envSanitizer struct {
+	patterns []string
+	reveal   bool
+}
+
+// envSanitizer returns the sanitizer for a request. reveal=true disables
+// redaction; each reveal is written to the audit log.
+func (h *ContainerHandler) envSanitizer(w http.ResponseWriter, r *http.Request, id string) envSanitizer {
+	return requestEnvSanitizer(r, h.config, "container", id)
+}
+
+// requestEnvSanitizer returns the sanitizer for a request about the object
+// of the given kind and id, auditing a reveal.
+func requestEnvSanitizer(r *http.Request, cfg *config.Store, kind, id string) envSanitizer {
+	s := envSanitizer{patterns: cfg.Get().SecretEnvPatterns}
+	if r.URL.Query().Get("reveal") == "true" {
+		s.reveal = true
+		recordAudit(r)
+		auditLog(r, "Secret environment revealed", kind, id, "method", r.Method, "path", r.URL.Path)
+	}
+	return s
+}
+
+// secret reports whether the variable name matches a secret pattern. Names
+// are matched case-insensitively.
+func (s envSanitizer) secret(name string) bool {
+	name = strings.ToUpper(name)
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns v, or the redaction marker if name is secret.
+func (s envSanitizer) value(name, v string) string {
+	if s.reveal || v == "" || !s.secret(name) {
+		return v
+	}
+	return redactedValue
+}
+
+// env sanitizes a list of KEY=VALUE pairs.
+func (s envSanitizer) env(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	result := make([]string, len(env))
+	for i, kv := range env {
+		name, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			result[i] = kv
+			continue
+		}
+		result[i] = name + "=" + s.value(name, v)
+	}
+	return result
+}
+
+// vars splits a list of KEY=VALUE pairs into sanitized variables.
+func (s envSanitizer) vars(env []string) []apitypes.EnvVar {
+	result := make([]apitypes.EnvVar, 0, len(env))
+	for _, kv := range env {
+		name, v, _ := strings.Cut(kv, "=")
+		sanitized := s.value(name, v)
+		result = append(result, apitypes.EnvVar{Name: name, Value: sanitized, Redacted: sanitized != v})
+	}
+	return result
+}
+
+// differences sanitizes the env.* entries of a drift report.
+func (s envSanitizer) differences(diffs []apitypes.ConfigDifference) {
+	for i, d := range diffs {
+		if name, ok := strings.CutPrefix(d.Field, "env."); ok {
+			diffs[i].Expected = s.value(name, d.Expected)
+			diffs[i].Actual = s.value(name, d.Actual)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/objectstore"
+)
+
+// storageStampFormat names exported objects after when they were made
+const storageStampFormat = "20060102-150405"
+
+// StorageHandler browses the object storage bucket, where backups, exports
+// and log archives are kept
+type StorageHandler struct {
+	config *config.Store
+}
+
+func NewStorageHandler(cfg *config.Store) *StorageHandler {
+	return &StorageHandler{config: cfg}
+}
+
+// enabledBucket returns the configured bucket, writing a 403 when there is
+// none
+func enabledBucket(w http.ResponseWriter, cfg *config.Store) (*objectstore.Bucket, bool) {
+	storage := cfg.Get().ObjectStorage
+	if storage == nil {
+		http.Error(w, "Object storage is disabled; set KIBUTSU_S3_BUCKET to enable it", http.StatusForbidden)
+		return nil, false
+	}
+	return objectstore.New(storage), true
+}
+
+// uploadObject stores the output of write under key. It is staged in a
+// temporary file first, since an upload needs its size up front.
+func uploadObject(ctx context.Context, bucket *objectstore.Bucket, key, contentType string, write func(w io.Writer) error) (apitypes.StorageObject, error) {
+	tmp, err := os.CreateTemp("", "kibutsu-upload-*")
+	if err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	if err := bucket.Put(ctx, key, tmp, size, contentType); err != nil {
+		return apitypes.StorageObject{}, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return apitypes.StorageObject{Key: key, Size: size, Modified: time.Now().UTC()}, nil
+}
+
+// exportTarget reads where an export goes: a POST with target=s3 sends it
+// to the bucket, which is returned; a GET downloads it and the bucket is
+// nil. It writes an error and reports false otherwise.
+func exportTarget(w http.ResponseWriter, r *http.Request, cfg *config.Store) (*objectstore.Bucket, bool) {
+	target := r.URL.Query().Get("target")
+	if (target == "") != (r.Method == http.MethodGet) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	switch target {
+	case "":
+		return nil, true
+	case "s3":
+		return enabledBucket(w, cfg)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid target %q: must be s3", target), http.StatusBadRequest)
+		return nil, false
+	}
+}
+
+// exportObject uploads an export read from rc under key and answers 201
+// with the object, or writes the error and reports false
+func exportObject(w http.ResponseWriter, r *http.Request, bucket *objectstore.Bucket, key, contentType string, rc io.Reader) bool {
+	obj, err := uploadObject(r.Context(), bucket, key, contentType, func(w io.Writer) error {
+		_, err := io.Copy(w, rc)
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to export to object storage: %v", err), http.StatusBadGateway)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(obj)
+	return true
+}
+
+// validObjectKey reports whether key may name an object: relative, without
+// empty, dot or dot-dot segments
+func validObjectKey(key string) bool {
+	if key == "" || len(key) > 1024 {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// objectKey returns the key in the path, below /storage/objects/
+func objectKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := strings.TrimPrefix(r.URL.Path, "/storage/objects/")
+	if !validObjectKey(key) {
+		http.Error(w, "Invalid object key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// ListObjects lists the objects in the bucket, in key order, narrowed by
+// prefix (such as backups/, exports/ or logs/)
+func (h *StorageHandler) ListObjects(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bucket, ok := enabledBucket(w, h.config)
+	if !ok {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	list, err := bucket.List(ctx, r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list objects: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeList(w, params, list)
+}
+
+// DownloadObject streams an object from the bucket
+func (h *StorageHandler) DownloadObject(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := enabledBucket(w, h.config)
+	if !ok {
+		return
+	}
+	key, ok := objectKey(w, r)
+	if !ok {
+		return
+	}
+	rc, obj, err := bucket.Get(r.Context(), key)
+	if err != nil {
+		writeObjectError(w, "download", err)
+		return
+	}
+	defer rc.Close()
+
+	// A large object takes longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	name := key[strings.LastIndex(key, "/")+1:]
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if obj.Size >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(obj.Size))
+	}
+	copyDownload(w, r, rc, "Failed to download object", "key", key)
+}
+
+// DeleteObject removes an object from the bucket
+func (h *StorageHandler) DeleteObject(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := enabledBucket(w, h.config)
+	if !ok {
+		return
+	}
+	key, ok := objectKey(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := bucket.Delete(ctx, key); err != nil {
+		writeObjectError(w, "remove", err)
+		return
+	}
+	auditLog(r, "Object removed", "key", key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeObjectError reports a failure to reach an object in the bucket
+func writeObjectError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, objectstore.ErrNotFound) {
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to %s object: %v", action, err), http.StatusBadGateway)
+}
@@ -0,0 +1,525 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// SwarmHandler manages the Swarm an endpoint's daemon belongs to. Every
+// handler but GetSwarm needs the daemon to be a manager.
+type SwarmHandler struct {
+	client *client.Client
+	config *config.Store
+
+	// registryAuth holds registry logins for pulling a service's new image;
+	// nil if none are set up
+	registryAuth docker.RegistryAuth
+}
+
+func NewSwarmHandler(client *client.Client, cfg *config.Store, registryAuth docker.RegistryAuth) *SwarmHandler {
+	return &SwarmHandler{client: client, config: cfg, registryAuth: registryAuth}
+}
+
+// swarmInfo describes the daemon's Swarm membership from its info
+func swarmInfo(info system.Info) apitypes.SwarmInfo {
+	s := info.Swarm
+	result := apitypes.SwarmInfo{
+		State:    string(s.LocalNodeState),
+		Manager:  s.LocalNodeState == swarm.LocalNodeStateActive && s.ControlAvailable,
+		NodeID:   s.NodeID,
+		NodeAddr: s.NodeAddr,
+		Error:    s.Error,
+	}
+	if result.State == "" {
+		result.State = string(swarm.LocalNodeStateInactive)
+	}
+	if s.Cluster != nil {
+		result.ClusterID = s.Cluster.ID
+	}
+	if result.Manager {
+		result.Nodes, result.Managers = s.Nodes, s.Managers
+	}
+	return result
+}
+
+// manager checks that the endpoint's daemon is a Swarm manager, answering
+// 409 otherwise: only managers know the Swarm's services, nodes and tasks
+func (h *SwarmHandler) manager(w http.ResponseWriter, r *http.Request) bool {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	info, err := retryRead(ctx, h.config, h.client.Info)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get Docker info: %v", err), failureStatus(err))
+		return false
+	}
+	switch s := swarmInfo(info); {
+	case s.State != string(swarm.LocalNodeStateActive):
+		http.Error(w, fmt.Sprintf("Swarm mode is not active on this endpoint (node state %s)", s.State), http.StatusConflict)
+		return false
+	case !s.Manager:
+		http.Error(w, "This endpoint is a Swarm worker; services, nodes and tasks can only be managed through a manager", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// GetSwarm reports whether the endpoint is in Swarm mode and, on a
+// manager, the size of the Swarm
+func (h *SwarmHandler) GetSwarm(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	info, err := retryRead(ctx, h.config, h.client.Info)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get Docker info: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(swarmInfo(info))
+}
+
+// serviceMode names a service's scheduling mode
+func serviceMode(mode swarm.ServiceMode) string {
+	switch {
+	case mode.Global != nil:
+		return "global"
+	case mode.ReplicatedJob != nil:
+		return "replicated-job"
+	case mode.GlobalJob != nil:
+		return "global-job"
+	default:
+		return "replicated"
+	}
+}
+
+func convertService(s swarm.Service) apitypes.SwarmService {
+	service := apitypes.SwarmService{
+		ID:      s.ID,
+		Name:    s.Spec.Name,
+		Mode:    serviceMode(s.Spec.Mode),
+		Labels:  s.Spec.Labels,
+		Created: s.CreatedAt,
+		Updated: s.UpdatedAt,
+	}
+	if spec := s.Spec.TaskTemplate.ContainerSpec; spec != nil {
+		service.Image = spec.Image
+	}
+	if s.Spec.Mode.Replicated != nil {
+		service.Replicas = s.Spec.Mode.Replicated.Replicas
+	}
+	if s.ServiceStatus != nil {
+		service.Running, service.Desired = s.ServiceStatus.RunningTasks, s.ServiceStatus.DesiredTasks
+	}
+	for _, p := range s.Endpoint.Ports {
+		service.Ports = append(service.Ports, apitypes.SwarmPort{
+			Protocol:      string(p.Protocol),
+			TargetPort:    p.TargetPort,
+			PublishedPort: p.PublishedPort,
+			PublishMode:   string(p.PublishMode),
+		})
+	}
+	if s.UpdateStatus != nil {
+		service.UpdateState, service.UpdateMessage = string(s.UpdateStatus.State), s.UpdateStatus.Message
+	}
+	return service
+}
+
+// ListServices lists the Swarm's services sorted by name, with their
+// running and desired task counts, optionally filtered by name, label and
+// mode (replicated or global)
+func (h *SwarmHandler) ListServices(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"name", "label", "mode"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+	services, err := retryRead(ctx, h.config, func(ctx context.Context) ([]swarm.Service, error) {
+		return h.client.ServiceList(ctx, types.ServiceListOptions{Filters: filterArgs, Status: true})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.SwarmService, 0, len(services))
+	for _, s := range services {
+		response = append(response, convertService(s))
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Name < response[j].Name })
+
+	writeList(w, params, response)
+}
+
+// serviceID returns the service ID or name in the path
+func serviceID(r *http.Request) string {
+	return strings.Split(strings.TrimPrefix(r.URL.Path, "/swarm/services/"), "/")[0]
+}
+
+// GetService inspects a service by ID or name, as the daemon reports it
+// apart from its tasks' environment, which is sanitized like a container's
+func (h *SwarmHandler) GetService(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	service, _, err := h.client.ServiceInspectWithRaw(ctx, serviceID(r), types.ServiceInspectOptions{})
+	if err != nil {
+		writeSwarmError(w, "inspect service", err)
+		return
+	}
+	sanitizer := requestEnvSanitizer(r, h.config, "service", service.ID)
+	for _, spec := range []*swarm.ServiceSpec{&service.Spec, service.PreviousSpec} {
+		if spec != nil && spec.TaskTemplate.ContainerSpec != nil {
+			spec.TaskTemplate.ContainerSpec.Env = sanitizer.env(spec.TaskTemplate.ContainerSpec.Env)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(service)
+}
+
+// ScaleService sets a replicated service's number of replicas
+func (h *SwarmHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.SwarmServiceScaleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Replicas == nil {
+		http.Error(w, "Invalid request body: replicas is required", http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+
+	result, err := h.updateService(w, r, serviceID(r), "", func(service *swarm.Service) error {
+		if service.Spec.Mode.Replicated == nil {
+			return fmt.Errorf("%w: only replicated services can be scaled, %s is %s", errInvalidServiceUpdate, service.Spec.Name, serviceMode(service.Spec.Mode))
+		}
+		service.Spec.Mode.Replicated.Replicas = req.Replicas
+		return nil
+	})
+	if err != nil {
+		writeSwarmError(w, "scale service", err)
+		return
+	}
+	auditLog(r, "Service scaled", "service", result.Name, "id", result.ID, "replicas", *req.Replicas)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// UpdateService changes a service's image, environment or labels, forces
+// a redeploy of its tasks, or rolls it back to its previous definition. The
+// orchestrator rolls the change out following the service's update config;
+// follow it through the service's UpdateState and its tasks.
+func (h *SwarmHandler) UpdateService(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.SwarmServiceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	changes := req.Image != "" || req.Env != nil || req.Labels != nil || req.Force
+	if req.Rollback == changes {
+		http.Error(w, "Invalid request body: set rollback alone, or at least one of image, env, labels and force", http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+
+	rollback := ""
+	if req.Rollback {
+		rollback = "previous"
+	}
+	result, err := h.updateService(w, r, serviceID(r), rollback, func(service *swarm.Service) error {
+		if req.Rollback {
+			if service.PreviousSpec == nil {
+				return fmt.Errorf("%w: service %s has no previous definition", errInvalidServiceUpdate, service.Spec.Name)
+			}
+			return nil
+		}
+		spec := service.Spec.TaskTemplate.ContainerSpec
+		if spec == nil && (req.Image != "" || req.Env != nil) {
+			return fmt.Errorf("%w: service %s doesn't run containers", errInvalidServiceUpdate, service.Spec.Name)
+		}
+		if req.Image != "" {
+			spec.Image = req.Image
+		}
+		if req.Env != nil {
+			spec.Env = *req.Env
+		}
+		if req.Labels != nil {
+			service.Spec.Labels = *req.Labels
+		}
+		if req.Force {
+			service.Spec.TaskTemplate.ForceUpdate++
+		}
+		return nil
+	})
+	if err != nil {
+		writeSwarmError(w, "update service", err)
+		return
+	}
+	auditLog(r, "Service updated", "service", result.Name, "id", result.ID, "image", req.Image, "force", req.Force, "rollback", req.Rollback)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// errInvalidServiceUpdate marks changes a service can't take
+var errInvalidServiceUpdate = errors.New("invalid service update")
+
+// updateService applies change to the current definition of a service and
+// submits it. The service's version guards against concurrent updates, which
+// the daemon refuses. A new image is pulled with the registry login that
+// holds its registry.
+func (h *SwarmHandler) updateService(w http.ResponseWriter, r *http.Request, id, rollback string, change func(*swarm.Service) error) (apitypes.SwarmServiceUpdateResult, error) {
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	service, _, err := h.client.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
+	if err != nil {
+		return apitypes.SwarmServiceUpdateResult{}, err
+	}
+	image := ""
+	if spec := service.Spec.TaskTemplate.ContainerSpec; spec != nil {
+		image = spec.Image
+	}
+	if err := change(&service); err != nil {
+		return apitypes.SwarmServiceUpdateResult{}, err
+	}
+
+	options := types.ServiceUpdateOptions{Rollback: rollback}
+	if spec := service.Spec.TaskTemplate.ContainerSpec; spec != nil && spec.Image != image {
+		auth, err := docker.EncodedRegistryAuth(h.registryAuth, spec.Image, nil)
+		if err != nil {
+			return apitypes.SwarmServiceUpdateResult{}, fmt.Errorf("%w: %v", errInvalidServiceUpdate, err)
+		}
+		options.EncodedRegistryAuth = auth
+		options.QueryRegistry = true
+	}
+	resp, err := h.client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, options)
+	if err != nil {
+		return apitypes.SwarmServiceUpdateResult{}, err
+	}
+	return apitypes.SwarmServiceUpdateResult{ID: service.ID, Name: service.Spec.Name, Warnings: resp.Warnings}, nil
+}
+
+func convertNode(n swarm.Node) apitypes.SwarmNode {
+	node := apitypes.SwarmNode{
+		ID:            n.ID,
+		Hostname:      n.Description.Hostname,
+		Role:          string(n.Spec.Role),
+		Availability:  string(n.Spec.Availability),
+		State:         string(n.Status.State),
+		Message:       n.Status.Message,
+		Addr:          n.Status.Addr,
+		EngineVersion: n.Description.Engine.EngineVersion,
+		OS:            n.Description.Platform.OS,
+		Architecture:  n.Description.Platform.Architecture,
+		NanoCPUs:      n.Description.Resources.NanoCPUs,
+		MemoryBytes:   n.Description.Resources.MemoryBytes,
+		Labels:        n.Spec.Labels,
+	}
+	if n.ManagerStatus != nil {
+		node.Leader = n.ManagerStatus.Leader
+		node.Reachability = string(n.ManagerStatus.Reachability)
+	}
+	return node
+}
+
+// ListNodes lists the Swarm's nodes, managers first and then by hostname,
+// optionally filtered by role and label
+func (h *SwarmHandler) ListNodes(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"role", "label", "node.label"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+	nodes, err := retryRead(ctx, h.config, func(ctx context.Context) ([]swarm.Node, error) {
+		return h.client.NodeList(ctx, types.NodeListOptions{Filters: filterArgs})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list nodes: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.SwarmNode, 0, len(nodes))
+	for _, n := range nodes {
+		response = append(response, convertNode(n))
+	}
+	sort.Slice(response, func(i, j int) bool {
+		if response[i].Role != response[j].Role {
+			return response[i].Role == string(swarm.NodeRoleManager)
+		}
+		return response[i].Hostname < response[j].Hostname
+	})
+
+	writeList(w, params, response)
+}
+
+// GetNode inspects a node by ID or hostname, as the daemon reports it
+func (h *SwarmHandler) GetNode(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	id := strings.Split(strings.TrimPrefix(r.URL.Path, "/swarm/nodes/"), "/")[0]
+	node, _, err := h.client.NodeInspectWithRaw(ctx, id)
+	if err != nil {
+		writeSwarmError(w, "inspect node", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(node)
+}
+
+// ListTasks lists the Swarm's tasks, newest first, with the names of their
+// service and node. service (ID or name), node, desired-state (running,
+// shutdown or accepted) and label filter them; the tasks of one service are
+// also at /swarm/services/{id}/tasks.
+func (h *SwarmHandler) ListTasks(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"service", "node", "desired-state", "label"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/swarm/services/") {
+		service, _, err := h.client.ServiceInspectWithRaw(ctx, serviceID(r), types.ServiceInspectOptions{})
+		if err != nil {
+			writeSwarmError(w, "inspect service", err)
+			return
+		}
+		filterArgs.Add("service", service.ID)
+	}
+
+	tasks, err := retryRead(ctx, h.config, func(ctx context.Context) ([]swarm.Task, error) {
+		return h.client.TaskList(ctx, types.TaskListOptions{Filters: filterArgs})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list tasks: %v", err), failureStatus(err))
+		return
+	}
+
+	// Names are looked up best effort; tasks are still listed without them
+	serviceNames := make(map[string]string)
+	if services, err := h.client.ServiceList(ctx, types.ServiceListOptions{}); err == nil {
+		for _, s := range services {
+			serviceNames[s.ID] = s.Spec.Name
+		}
+	}
+	nodeNames := make(map[string]string)
+	if nodes, err := h.client.NodeList(ctx, types.NodeListOptions{}); err == nil {
+		for _, n := range nodes {
+			nodeNames[n.ID] = n.Description.Hostname
+		}
+	}
+
+	response := make([]apitypes.SwarmTask, 0, len(tasks))
+	for _, t := range tasks {
+		task := apitypes.SwarmTask{
+			ID:           t.ID,
+			ServiceID:    t.ServiceID,
+			ServiceName:  serviceNames[t.ServiceID],
+			Slot:         t.Slot,
+			NodeID:       t.NodeID,
+			NodeName:     nodeNames[t.NodeID],
+			DesiredState: string(t.DesiredState),
+			State:        string(t.Status.State),
+			Message:      t.Status.Message,
+			Error:        t.Status.Err,
+			Created:      t.CreatedAt,
+			Updated:      t.UpdatedAt,
+		}
+		if spec := t.Spec.ContainerSpec; spec != nil {
+			task.Image = spec.Image
+		}
+		if cs := t.Status.ContainerStatus; cs != nil {
+			task.ContainerID = cs.ContainerID
+			if t.Status.State == swarm.TaskStateFailed || t.Status.State == swarm.TaskStateComplete {
+				exitCode := cs.ExitCode
+				task.ExitCode = &exitCode
+			}
+		}
+		response = append(response, task)
+	}
+	sort.SliceStable(response, func(i, j int) bool { return response[i].Updated.After(response[j].Updated) })
+
+	writeList(w, params, response)
+}
+
+// writeSwarmError reports a failed call about a Swarm object
+func writeSwarmError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, errInvalidServiceUpdate):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case client.IsErrNotFound(err):
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusNotFound)
+	case errdefs.IsInvalidParameter(err):
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusBadRequest)
+	case errdefs.IsConflict(err):
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", action, err), http.StatusInternalServerError)
+	}
+}
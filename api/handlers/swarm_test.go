@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+
+	"kibutsu/config"
+)
+
+// swarmDaemon is a Swarm manager running one service, web, whose current
+// and previous specs both hold a secret in their environment
+func swarmDaemon(t *testing.T) *client.Client {
+	t.Helper()
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/info"):
+			w.Write([]byte(`{"Swarm":{"LocalNodeState":"active","ControlAvailable":true}}`))
+		case strings.HasSuffix(r.URL.Path, "/services/web"):
+			spec := `{"Name":"web","TaskTemplate":{"ContainerSpec":{"Image":"nginx","Env":["MODE=prod","DB_PASSWORD=hunter2"]}}}`
+			w.Write([]byte(`{"ID":"svc1","Spec":` + spec + `,"PreviousSpec":` + spec + `}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestGetServiceRedactsEnv(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		DockerReadTimeout: 5 * time.Second,
+		SecretEnvPatterns: config.DefaultSecretEnvPatterns,
+	}, config.Options{})
+	h := NewSwarmHandler(swarmDaemon(t), cfg, nil)
+
+	for query, want := range map[string][]string{
+		"":             {"MODE=prod", "DB_PASSWORD=" + redactedValue},
+		"?reveal=true": {"MODE=prod", "DB_PASSWORD=hunter2"},
+	} {
+		w := httptest.NewRecorder()
+		h.GetService(w, httptest.NewRequest(http.MethodGet, "/swarm/services/web"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status = %d: %s", query, w.Code, w.Body)
+		}
+		var service swarm.Service
+		if err := json.Unmarshal(w.Body.Bytes(), &service); err != nil {
+			t.Fatal(err)
+		}
+		for _, spec := range []*swarm.ServiceSpec{&service.Spec, service.PreviousSpec} {
+			if got := spec.TaskTemplate.ContainerSpec.Env; !slices.Equal(got, want) {
+				t.Errorf("%q: env = %q, want %q", query, got, want)
+			}
+		}
+	}
+}
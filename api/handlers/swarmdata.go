@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxSwarmDataSize bounds the content of a secret or config; the daemon
+// allows 500KB for secrets and 1000KB for configs
+const maxSwarmDataSize = 1000 << 10
+
+// readSwarmData reads the name, labels and content of a new secret or
+// config, sent either as JSON (SwarmDataRequest) or as a multipart form
+// with a name field, label fields of key=value and a file field
+func readSwarmData(w http.ResponseWriter, r *http.Request) (apitypes.SwarmDataRequest, []byte, bool) {
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxSwarmDataSize+64<<10)
+
+	var req apitypes.SwarmDataRequest
+	var data []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxSwarmDataSize); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form: %v", err), http.StatusBadRequest)
+			return req, nil, false
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Missing file: %v", err), http.StatusBadRequest)
+			return req, nil, false
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(io.LimitReader(file, maxSwarmDataSize+1)); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusBadRequest)
+			return req, nil, false
+		}
+		req.Name = r.FormValue("name")
+		for _, label := range r.MultipartForm.Value["label"] {
+			key, value, _ := strings.Cut(label, "=")
+			if req.Labels == nil {
+				req.Labels = make(map[string]string)
+			}
+			req.Labels[key] = value
+		}
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return req, nil, false
+		}
+		data = []byte(req.Data)
+	}
+	if len(data) > maxSwarmDataSize {
+		http.Error(w, fmt.Sprintf("Content exceeds %d bytes", maxSwarmDataSize), http.StatusRequestEntityTooLarge)
+		return req, nil, false
+	}
+	if req.Name == "" || len(data) == 0 {
+		http.Error(w, "Invalid request: name and content are required", http.StatusBadRequest)
+		return req, nil, false
+	}
+	return req, data, true
+}
+
+// serviceRefs maps the IDs of the secrets and configs in use to the names
+// of the services using them, sorted
+func (h *SwarmHandler) serviceRefs(ctx context.Context) (secrets, configs map[string][]string, err error) {
+	services, err := h.client.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets, configs = make(map[string][]string), make(map[string][]string)
+	for _, s := range services {
+		spec := s.Spec.TaskTemplate.ContainerSpec
+		if spec == nil {
+			continue
+		}
+		for _, ref := range spec.Secrets {
+			secrets[ref.SecretID] = append(secrets[ref.SecretID], s.Spec.Name)
+		}
+		for _, ref := range spec.Configs {
+			configs[ref.ConfigID] = append(configs[ref.ConfigID], s.Spec.Name)
+		}
+	}
+	for _, refs := range []map[string][]string{secrets, configs} {
+		for _, names := range refs {
+			sort.Strings(names)
+		}
+	}
+	return secrets, configs, nil
+}
+
+// nameFilters passes the name and label query parameters to the daemon
+func nameFilters(r *http.Request) filters.Args {
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"name", "label"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+	return filterArgs
+}
+
+func convertSecret(s swarm.Secret, services []string) apitypes.SwarmSecret {
+	secret := apitypes.SwarmSecret{
+		ID:       s.ID,
+		Name:     s.Spec.Name,
+		Labels:   s.Spec.Labels,
+		Created:  s.CreatedAt,
+		Updated:  s.UpdatedAt,
+		Services: services,
+	}
+	if secret.Services == nil {
+		secret.Services = []string{}
+	}
+	if s.Spec.Driver != nil {
+		secret.Driver = s.Spec.Driver.Name
+	}
+	return secret
+}
+
+func convertConfig(c swarm.Config, services []string) apitypes.SwarmConfig {
+	config := apitypes.SwarmConfig{
+		ID:       c.ID,
+		Name:     c.Spec.Name,
+		Labels:   c.Spec.Labels,
+		Size:     len(c.Spec.Data),
+		Created:  c.CreatedAt,
+		Updated:  c.UpdatedAt,
+		Services: services,
+	}
+	if config.Services == nil {
+		config.Services = []string{}
+	}
+	return config
+}
+
+// ListSecrets lists the Swarm's secrets sorted by name, with the services
+// using them (name and label filters). Their values are never returned.
+func (h *SwarmHandler) ListSecrets(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	secrets, err := retryRead(ctx, h.config, func(ctx context.Context) ([]swarm.Secret, error) {
+		return h.client.SecretList(ctx, types.SecretListOptions{Filters: nameFilters(r)})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list secrets: %v", err), failureStatus(err))
+		return
+	}
+	refs, _, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.SwarmSecret, 0, len(secrets))
+	for _, s := range secrets {
+		response = append(response, convertSecret(s, refs[s.ID]))
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Name < response[j].Name })
+
+	writeList(w, params, response)
+}
+
+// GetSecret describes a secret by ID or name
+func (h *SwarmHandler) GetSecret(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/swarm/secrets/")
+	secret, _, err := h.client.SecretInspectWithRaw(ctx, id)
+	if err != nil {
+		writeSwarmError(w, "inspect secret", err)
+		return
+	}
+	refs, _, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertSecret(secret, refs[secret.ID]))
+}
+
+// CreateSecret creates a secret from uploaded content, as JSON
+// ({"name", "data", "labels"}) or a multipart form with name, label and
+// file fields. Secrets can't be changed afterwards; create one under a new
+// name and point the services at it.
+func (h *SwarmHandler) CreateSecret(w http.ResponseWriter, r *http.Request) {
+	req, data, ok := readSwarmData(w, r)
+	if !ok {
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	resp, err := h.client.SecretCreate(ctx, swarm.SecretSpec{
+		Annotations: swarm.Annotations{Name: req.Name, Labels: req.Labels},
+		Data:        data,
+	})
+	if err != nil {
+		writeSwarmError(w, "create secret", err)
+		return
+	}
+	auditLog(r, "Secret created", "secret", req.Name, "id", resp.ID)
+
+	created, _, err := h.client.SecretInspectWithRaw(ctx, resp.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Secret created but failed to inspect it: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(convertSecret(created, nil))
+}
+
+// RemoveSecret removes a secret, answering 409 while services use it
+func (h *SwarmHandler) RemoveSecret(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/swarm/secrets/")
+	secret, _, err := h.client.SecretInspectWithRaw(ctx, id)
+	if err != nil {
+		writeSwarmError(w, "inspect secret", err)
+		return
+	}
+	refs, _, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+	if services := refs[secret.ID]; len(services) > 0 {
+		http.Error(w, fmt.Sprintf("Secret %s is in use by services %s", secret.Spec.Name, strings.Join(services, ", ")), http.StatusConflict)
+		return
+	}
+	if err := h.client.SecretRemove(ctx, secret.ID); err != nil {
+		writeSwarmError(w, "remove secret", err)
+		return
+	}
+	auditLog(r, "Secret removed", "secret", secret.Spec.Name, "id", secret.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListConfigs lists the Swarm's configs sorted by name, with their size and
+// the services using them (name and label filters)
+func (h *SwarmHandler) ListConfigs(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	configs, err := retryRead(ctx, h.config, func(ctx context.Context) ([]swarm.Config, error) {
+		return h.client.ConfigList(ctx, types.ConfigListOptions{Filters: nameFilters(r)})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list configs: %v", err), failureStatus(err))
+		return
+	}
+	_, refs, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.SwarmConfig, 0, len(configs))
+	for _, c := range configs {
+		response = append(response, convertConfig(c, refs[c.ID]))
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Name < response[j].Name })
+
+	writeList(w, params, response)
+}
+
+// GetConfig describes a config by ID or name
+func (h *SwarmHandler) GetConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/swarm/configs/")
+	config, _, err := h.client.ConfigInspectWithRaw(ctx, id)
+	if err != nil {
+		writeSwarmError(w, "inspect config", err)
+		return
+	}
+	_, refs, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertConfig(config, refs[config.ID]))
+}
+
+// CreateConfig creates a config from uploaded content, as CreateSecret
+// does. Configs can't be changed afterwards either.
+func (h *SwarmHandler) CreateConfig(w http.ResponseWriter, r *http.Request) {
+	req, data, ok := readSwarmData(w, r)
+	if !ok {
+		return
+	}
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	resp, err := h.client.ConfigCreate(ctx, swarm.ConfigSpec{
+		Annotations: swarm.Annotations{Name: req.Name, Labels: req.Labels},
+		Data:        data,
+	})
+	if err != nil {
+		writeSwarmError(w, "create config", err)
+		return
+	}
+	auditLog(r, "Config created", "config", req.Name, "id", resp.ID)
+
+	created, _, err := h.client.ConfigInspectWithRaw(ctx, resp.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Config created but failed to inspect it: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(convertConfig(created, nil))
+}
+
+// RemoveConfig removes a config, answering 409 while services use it
+func (h *SwarmHandler) RemoveConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.manager(w, r) {
+		return
+	}
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/swarm/configs/")
+	config, _, err := h.client.ConfigInspectWithRaw(ctx, id)
+	if err != nil {
+		writeSwarmError(w, "inspect config", err)
+		return
+	}
+	_, refs, err := h.serviceRefs(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), failureStatus(err))
+		return
+	}
+	if services := refs[config.ID]; len(services) > 0 {
+		http.Error(w, fmt.Sprintf("Config %s is in use by services %s", config.Spec.Name, strings.Join(services, ", ")), http.StatusConflict)
+		return
+	}
+	if err := h.client.ConfigRemove(ctx, config.ID); err != nil {
+		writeSwarmError(w, "remove config", err)
+		return
+	}
+	auditLog(r, "Config removed", "config", config.Spec.Name, "id", config.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
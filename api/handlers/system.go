@@ -0,0 +1,480 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// usageAuditTTL is how long a computed usage audit is served from cache
+const usageAuditTTL = 30 * time.Second
+
+// minUsageInterval is the shortest sampling interval a client may request.
+// Each sample takes about a second since the daemon waits for two readings.
+const minUsageInterval = time.Second
+
+// metricsIdle is how long the metrics sampler keeps running after the last
+// request for metrics
+const metricsIdle = time.Minute
+
+// usageConcurrency caps the stats requests in flight per usage sample
+const usageConcurrency = 8
+
+// predefinedNetworks are created by the daemon and can never be pruned
+var predefinedNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+type SystemHandler struct {
+	client *client.Client
+	config *config.Store
+
+	auditMu sync.Mutex
+	audit   *apitypes.UsageAudit
+
+	metricsMu    sync.Mutex
+	metrics      *apitypes.SystemMetrics
+	metricsErr   error
+	metricsSeen  time.Time
+	metricsReady chan struct{} // nil while the sampler is stopped
+}
+
+func NewSystemHandler(client *client.Client, cfg *config.Store) *SystemHandler {
+	return &SystemHandler{client: client, config: cfg}
+}
+
+// GetUsageAudit reports which networks and volumes are in use and by whom.
+// Pass refresh=true to bypass the cache.
+func (h *SystemHandler) GetUsageAudit(w http.ResponseWriter, r *http.Request) {
+	refresh := r.URL.Query().Get("refresh") == "true"
+
+	h.auditMu.Lock()
+	defer h.auditMu.Unlock()
+
+	if !refresh && h.audit != nil && time.Since(h.audit.GeneratedAt) < usageAuditTTL {
+		cached := *h.audit
+		cached.Cached = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cached)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	audit, err := h.computeUsageAudit(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to compute usage audit: %v", err), failureStatus(err))
+		return
+	}
+	h.audit = audit
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(audit)
+}
+
+func (h *SystemHandler) computeUsageAudit(ctx context.Context) (*apitypes.UsageAudit, error) {
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	networks, err := h.client.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	usage, err := h.client.DiskUsage(ctx, types.DiskUsageOptions{
+		Types: []types.DiskUsageObject{types.VolumeObject},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume usage: %w", err)
+	}
+
+	networkUsers := make(map[string][]string)
+	volumeUsers := make(map[string][]string)
+	for _, c := range containers {
+		name := c.ID[:12]
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if c.NetworkSettings != nil {
+			for _, endpoint := range c.NetworkSettings.Networks {
+				if endpoint != nil {
+					networkUsers[endpoint.NetworkID] = append(networkUsers[endpoint.NetworkID], name)
+				}
+			}
+		}
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeVolume {
+				volumeUsers[m.Name] = append(volumeUsers[m.Name], name)
+			}
+		}
+	}
+
+	audit := &apitypes.UsageAudit{
+		GeneratedAt:    time.Now().UTC(),
+		Networks:       make([]apitypes.NetworkUsage, 0, len(networks)),
+		Volumes:        make([]apitypes.VolumeUsage, 0, len(usage.Volumes)),
+		UnusedNetworks: make([]string, 0),
+		UnusedVolumes:  make([]string, 0),
+	}
+
+	for _, n := range networks {
+		if predefinedNetworks[n.Name] {
+			continue
+		}
+		users := networkUsers[n.ID]
+		audit.Networks = append(audit.Networks, apitypes.NetworkUsage{
+			ID:         n.ID,
+			Name:       n.Name,
+			Driver:     n.Driver,
+			Containers: nonNil(users),
+			Unused:     len(users) == 0,
+		})
+		if len(users) == 0 {
+			audit.UnusedNetworks = append(audit.UnusedNetworks, n.Name)
+		}
+	}
+
+	for _, v := range usage.Volumes {
+		size := int64(-1)
+		if v.UsageData != nil {
+			size = v.UsageData.Size
+		}
+		users := volumeUsers[v.Name]
+		audit.Volumes = append(audit.Volumes, apitypes.VolumeUsage{
+			Name:       v.Name,
+			Driver:     v.Driver,
+			Size:       size,
+			Containers: nonNil(users),
+			Unused:     len(users) == 0,
+		})
+		if len(users) == 0 {
+			audit.UnusedVolumes = append(audit.UnusedVolumes, v.Name)
+			if size > 0 {
+				audit.ReclaimableBytes += size
+			}
+		}
+	}
+
+	sort.Slice(audit.Networks, func(i, j int) bool { return audit.Networks[i].Name < audit.Networks[j].Name })
+	sort.Slice(audit.Volumes, func(i, j int) bool { return audit.Volumes[i].Name < audit.Volumes[j].Name })
+	sort.Strings(audit.UnusedNetworks)
+	sort.Strings(audit.UnusedVolumes)
+
+	return audit, nil
+}
+
+// GetDockerDiagnostics reports which daemon features are available and which
+// kibutsu features are degraded because of what is missing.
+func (h *SystemHandler) GetDockerDiagnostics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	diag, err := h.dockerDiagnostics(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to probe Docker daemon: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diag)
+}
+
+func (h *SystemHandler) dockerDiagnostics(ctx context.Context) (*apitypes.DockerDiagnostics, error) {
+	ping, err := h.client.Ping(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping daemon: %w", err)
+	}
+	info, err := h.client.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daemon info: %w", err)
+	}
+	version, err := h.client.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daemon version: %w", err)
+	}
+	_, cliErr := exec.LookPath("docker")
+
+	diag := &apitypes.DockerDiagnostics{
+		GeneratedAt:      time.Now().UTC(),
+		ServerVersion:    version.Version,
+		APIVersion:       version.APIVersion,
+		MinAPIVersion:    version.MinAPIVersion,
+		ClientAPIVersion: h.client.ClientVersion(),
+		BuildKit:         ping.BuilderVersion == types.BuilderBuildKit,
+		Experimental:     info.ExperimentalBuild,
+		SwarmActive:      info.Swarm.LocalNodeState == swarm.LocalNodeStateActive,
+		Runtimes:         make([]string, 0, len(info.Runtimes)),
+		CDISpecDirs:      nonNil(info.CDISpecDirs),
+		DockerCLI:        cliErr == nil,
+	}
+	for name := range info.Runtimes {
+		diag.Runtimes = append(diag.Runtimes, name)
+	}
+	sort.Strings(diag.Runtimes)
+	_, hasNvidia := info.Runtimes["nvidia"]
+
+	diag.Features = []apitypes.FeatureStatus{
+		feature("build-secrets", []string{"POST /api/images/build (with secrets)"}, map[string]bool{
+			"BuildKit enabled on the daemon":       diag.BuildKit,
+			"docker CLI installed on kibutsu host": diag.DockerCLI,
+		}),
+		feature("gpu-devices", []string{"POST /api/containers (with nvidia deviceRequests)"}, map[string]bool{
+			"nvidia runtime or CDI specs configured on the daemon": hasNvidia || len(info.CDISpecDirs) > 0,
+		}),
+	}
+	for _, f := range diag.Features {
+		if !f.Available {
+			diag.Degraded = true
+		}
+	}
+
+	return diag, nil
+}
+
+// feature builds a FeatureStatus from its named dependencies.
+func feature(name string, endpoints []string, deps map[string]bool) apitypes.FeatureStatus {
+	status := apitypes.FeatureStatus{Name: name, Available: true, Endpoints: endpoints}
+	for dep, ok := range deps {
+		if !ok {
+			status.Available = false
+			status.Missing = append(status.Missing, dep)
+		}
+	}
+	sort.Strings(status.Missing)
+	return status
+}
+
+// nonNil returns s, or an empty slice if s is nil, so it encodes as [].
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// StreamUsage sends the combined CPU and memory usage of all running
+// containers as server-sent events until the client disconnects. The
+// interval query parameter (e.g. 2s) overrides KIBUTSU_USAGE_INTERVAL.
+func (h *SystemHandler) StreamUsage(w http.ResponseWriter, r *http.Request) {
+	interval := h.config.Get().UsageInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minUsageInterval {
+			http.Error(w, fmt.Sprintf("Invalid interval: must be a duration of at least %s", minUsageInterval), http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	info, err := retryRead(ctx, h.config, func(ctx context.Context) (system.Info, error) {
+		return h.client.Info(ctx)
+	})
+	cancel()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get system info: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	send := func(event string, data any) error {
+		payload, _ := json.Marshal(data)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	fmt.Fprintf(w, "retry: %d\n\n", interval.Milliseconds())
+
+	// A failed write means the connection is gone, so the stream ends
+	// rather than sampling for a client that will never read it
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		usage, err := h.sampleUsage(w, r, info)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			err = send("error", map[string]string{"error": err.Error()})
+		} else {
+			err = send("usage", usage)
+		}
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sampleUsage sums one stats sample of every running container.
+func (h *SystemHandler) sampleUsage(w http.ResponseWriter, r *http.Request, info system.Info) (apitypes.SystemUsage, error) {
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	samples, err := docker.SampleRunning(ctx, h.client, usageConcurrency)
+	if err != nil && len(samples) == 0 {
+		return apitypes.SystemUsage{}, fmt.Errorf("failed to sample container stats: %w", err)
+	}
+	return summarizeUsage(info, samples), nil
+}
+
+func summarizeUsage(info system.Info, samples []docker.ContainerSample) apitypes.SystemUsage {
+	usage := apitypes.SystemUsage{
+		Time:       time.Now().UTC(),
+		Containers: len(samples),
+		HostCPUs:   info.NCPU,
+		HostMemory: info.MemTotal,
+	}
+	for _, s := range samples {
+		usage.CPUPercent += s.Stats.CPU.UsagePercent
+		usage.MemoryUsage += s.Stats.Memory.Usage
+	}
+	if info.NCPU > 0 {
+		usage.HostCPUPercent = usage.CPUPercent / float64(info.NCPU)
+	}
+	if info.MemTotal > 0 {
+		usage.MemoryPercent = float64(usage.MemoryUsage) / float64(info.MemTotal) * 100
+	}
+	return usage
+}
+
+// GetMetrics returns the aggregate usage of all running containers and the
+// host details in one response. A background sampler refreshes the figures
+// every KIBUTSU_USAGE_INTERVAL while clients keep asking for them.
+func (h *SystemHandler) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	select {
+	case <-h.watchMetrics():
+	case <-ctx.Done():
+		http.Error(w, fmt.Sprintf("Failed to get system metrics: %v", ctx.Err()), http.StatusGatewayTimeout)
+		return
+	}
+
+	h.metricsMu.Lock()
+	metrics, err := h.metrics, h.metricsErr
+	h.metricsMu.Unlock()
+	if metrics == nil {
+		http.Error(w, fmt.Sprintf("Failed to get system metrics: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// watchMetrics notes that metrics were asked for, starting the sampler if it
+// isn't running, and returns a channel closed once a sample is available
+func (h *SystemHandler) watchMetrics() <-chan struct{} {
+	h.metricsMu.Lock()
+	defer h.metricsMu.Unlock()
+
+	h.metricsSeen = time.Now()
+	if h.metricsReady == nil {
+		ready := make(chan struct{})
+		h.metricsReady = ready
+		go h.runMetricsSampler(ready)
+	}
+	return h.metricsReady
+}
+
+// runMetricsSampler samples until no client has asked for metrics for
+// metricsIdle, so an unwatched endpoint isn't polled for stats
+func (h *SystemHandler) runMetricsSampler(ready chan struct{}) {
+	first := true
+	for {
+		start := time.Now()
+		metrics, err := h.sampleMetrics()
+
+		h.metricsMu.Lock()
+		if err == nil {
+			h.metrics = metrics
+		} else if first {
+			// A stale sample from an earlier run is worse than none
+			h.metrics = nil
+		}
+		h.metricsErr = err
+		if first {
+			close(ready)
+			first = false
+		}
+		if time.Since(h.metricsSeen) > metricsIdle {
+			h.metricsReady = nil
+			h.metricsMu.Unlock()
+			return
+		}
+		h.metricsMu.Unlock()
+
+		time.Sleep(h.config.Get().UsageInterval - time.Since(start))
+	}
+}
+
+func (h *SystemHandler) sampleMetrics() (*apitypes.SystemMetrics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Get().DockerWriteTimeout)
+	defer cancel()
+
+	info, err := retryRead(ctx, h.config, func(ctx context.Context) (system.Info, error) {
+		return h.client.Info(ctx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system info: %w", err)
+	}
+	samples, err := docker.SampleRunning(ctx, h.client, usageConcurrency)
+	if err != nil && len(samples) == 0 {
+		return nil, fmt.Errorf("failed to sample container stats: %w", err)
+	}
+
+	metrics := &apitypes.SystemMetrics{
+		SystemUsage: summarizeUsage(info, samples),
+		Host: apitypes.HostMetrics{
+			Name:              info.Name,
+			OperatingSystem:   info.OperatingSystem,
+			KernelVersion:     info.KernelVersion,
+			Architecture:      info.Architecture,
+			DockerVersion:     info.ServerVersion,
+			Containers:        info.Containers,
+			ContainersRunning: info.ContainersRunning,
+			ContainersPaused:  info.ContainersPaused,
+			ContainersStopped: info.ContainersStopped,
+			Images:            info.Images,
+		},
+	}
+	for _, s := range samples {
+		metrics.NetworkRxBytes += s.Stats.Network.RxBytes
+		metrics.NetworkTxBytes += s.Stats.Network.TxBytes
+		metrics.BlockReadBytes += s.Stats.BlockIO.Read
+		metrics.BlockWriteBytes += s.Stats.BlockIO.Write
+		metrics.PIDs += s.Stats.PIDs
+	}
+	return metrics, nil
+}
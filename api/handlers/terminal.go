@@ -2,21 +2,43 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"golang.org/x/net/websocket"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
 )
 
+// pendingExecTTL is how long an exec created through the API waits for a
+// WebSocket to attach to it
+const pendingExecTTL = time.Minute
+
 type TerminalHandler struct {
 	client *client.Client
+
+	mu      sync.Mutex
+	pending map[string]pendingExec // exec ID -> exec awaiting attach
+}
+
+// pendingExec is an exec instance that has been created but not started
+type pendingExec struct {
+	containerID string
+	config      docker.ExecConfig
+	created     time.Time
 }
 
 type TerminalMessage struct {
@@ -25,16 +47,163 @@ type TerminalMessage struct {
 	Cols    uint   `json:"cols,omitempty"`
 	Rows    uint   `json:"rows,omitempty"`
 	Command string `json:"command,omitempty"`
+
+	// Exec is sent once the exec starts, describing what the terminal is
+	// attached to
+	Exec *docker.ExecInfo `json:"exec,omitempty"`
 }
 
 func NewTerminalHandler(client *client.Client) *TerminalHandler {
-	return &TerminalHandler{client: client}
+	return &TerminalHandler{client: client, pending: make(map[string]pendingExec)}
+}
+
+// CreateExec creates an exec instance in a running container without
+// starting it. The command defaults to /bin/sh. The returned ID is attached
+// to with a WebSocket on /containers/{id}/exec/{execId} within a minute,
+// which starts the command.
+func (h *TerminalHandler) CreateExec(w http.ResponseWriter, r *http.Request) {
+	containerId := strings.TrimPrefix(r.URL.Path, "/containers/")
+	containerId = strings.Split(containerId, "/")[0]
+
+	var req apitypes.ExecConfig
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Cmd) == 0 {
+		req.Cmd = []string{"/bin/sh"}
+	}
+	config := docker.ExecConfig{
+		Cmd:          req.Cmd,
+		Tty:          req.Tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		WorkingDir:   req.WorkingDir,
+		Env:          req.Env,
+		User:         req.User,
+		Privileged:   req.Privileged,
+	}
+	if err := docker.ValidateExecConfig(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	inspect, err := h.client.ContainerInspect(ctx, containerId)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect container: %v", err), failureStatus(err))
+		return
+	}
+	if !inspect.State.Running {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	exec, err := h.client.ContainerExecCreate(ctx, inspect.ID, types.ExecConfig{
+		AttachStdin:  config.AttachStdin,
+		AttachStdout: config.AttachStdout,
+		AttachStderr: config.AttachStderr,
+		Tty:          config.Tty,
+		Cmd:          config.Cmd,
+		Env:          config.Env,
+		User:         config.User,
+		WorkingDir:   config.WorkingDir,
+		Privileged:   config.Privileged,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create exec: %v", err), failureStatus(err))
+		return
+	}
+
+	h.mu.Lock()
+	for id, p := range h.pending {
+		if time.Since(p.created) > pendingExecTTL {
+			delete(h.pending, id)
+		}
+	}
+	h.pending[exec.ID] = pendingExec{containerID: inspect.ID, config: config, created: time.Now()}
+	h.mu.Unlock()
+
+	auditLog(r, "Exec created", "exec", exec.ID[:12], "container", inspect.ID[:12], "command", shellJoin(config.Cmd))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(docker.ExecInfo{
+		ID:          exec.ID,
+		ContainerID: inspect.ID,
+		Cmd:         config.Cmd,
+		User:        config.User,
+		WorkingDir:  config.WorkingDir,
+		Tty:         config.Tty,
+	})
+}
+
+// AttachExec starts an exec created by CreateExec and bridges it to a
+// WebSocket using TerminalMessage frames: "input" and "resize" from the
+// client, "exec", "output", "error" and "exit" from the server. An exec can
+// only be attached once.
+func (h *TerminalHandler) AttachExec(w http.ResponseWriter, r *http.Request) {
+	recordAudit(r)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	containerId, execId := parts[0], parts[2]
+
+	inspect, err := h.client.ContainerInspect(r.Context(), containerId)
+	if err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	h.mu.Lock()
+	pending, ok := h.pending[execId]
+	if ok && pending.containerID == inspect.ID {
+		delete(h.pending, execId)
+	}
+	h.mu.Unlock()
+	if !ok || pending.containerID != inspect.ID || time.Since(pending.created) > pendingExecTTL {
+		http.Error(w, fmt.Sprintf("Exec %s not found or already attached", execId), http.StatusNotFound)
+		return
+	}
+
+	// The session outlives the request timeout; it ends when either side
+	// closes.
+	ctx := context.WithoutCancel(r.Context())
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		h.bridge(ctx, ws, execId, inspect.ID, pending.config)
+	}).ServeHTTP(w, r)
 }
 
+// HandleTerminal opens an interactive shell in a container over a WebSocket.
+// The user (name or uid, with optional :group) and workingDir (absolute)
+// query parameters choose who the shell runs as and where it starts.
 func (h *TerminalHandler) HandleTerminal(w http.ResponseWriter, r *http.Request) {
-	containerId := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	recordAudit(r)
+	containerId := strings.TrimPrefix(r.URL.Path, "/containers/")
 	containerId = strings.TrimSuffix(containerId, "/exec")
 
+	execConfig := docker.ExecConfig{
+		Cmd:          []string{"/bin/sh"},
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		User:         r.URL.Query().Get("user"),
+		WorkingDir:   r.URL.Query().Get("workingDir"),
+	}
+	if err := docker.ValidateExecConfig(execConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Verify container exists and is running
 	ctx := r.Context()
 	container, err := h.client.ContainerInspect(ctx, containerId)
@@ -48,50 +217,82 @@ func (h *TerminalHandler) HandleTerminal(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Upgrade connection to websocket
+	// Upgrade connection to websocket. The session outlives the request
+	// timeout; it ends when either side closes.
+	ctx = context.WithoutCancel(ctx)
 	websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
-		h.handleConnection(ctx, ws, containerId)
+		h.handleConnection(ctx, ws, container.ID, execConfig)
 	}).ServeHTTP(w, r)
 }
 
-func (h *TerminalHandler) handleConnection(ctx context.Context, ws *websocket.Conn, containerId string) {
-	// Create exec configuration
-	execConfig := types.ExecConfig{
-		AttachStdin:  true,
-		AttachStdout: true,
-		AttachStderr: true,
-		Tty:          true,
-		Cmd:          []string{"/bin/sh"},
-	}
-
+func (h *TerminalHandler) handleConnection(ctx context.Context, ws *websocket.Conn, containerId string, config docker.ExecConfig) {
 	// Create exec instance
-	exec, err := h.client.ContainerExecCreate(ctx, containerId, execConfig)
+	exec, err := h.client.ContainerExecCreate(ctx, containerId, types.ExecConfig{
+		AttachStdin:  config.AttachStdin,
+		AttachStdout: config.AttachStdout,
+		AttachStderr: config.AttachStderr,
+		Tty:          config.Tty,
+		Cmd:          config.Cmd,
+		User:         config.User,
+		WorkingDir:   config.WorkingDir,
+	})
 	if err != nil {
-		log.Printf("Error creating exec: %v", err)
+		slog.ErrorContext(ctx, "Failed to create exec", "container", containerId, "error", err)
+		websocket.JSON.Send(ws, TerminalMessage{Type: "error", Data: fmt.Sprintf("Failed to create exec: %v", err)})
 		return
 	}
 
+	h.bridge(ctx, ws, exec.ID, containerId, config)
+}
+
+// bridge starts an exec instance and copies between it and the WebSocket
+// until the process exits or the client goes away.
+func (h *TerminalHandler) bridge(ctx context.Context, ws *websocket.Conn, execID, containerId string, config docker.ExecConfig) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Attach to exec instance
-	resp, err := h.client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: true})
+	resp, err := h.client.ContainerExecAttach(ctx, execID, types.ExecStartCheck{Tty: config.Tty})
 	if err != nil {
-		log.Printf("Error attaching to exec: %v", err)
+		slog.ErrorContext(ctx, "Failed to attach to exec", "container", containerId, "error", err)
+		websocket.JSON.Send(ws, TerminalMessage{Type: "error", Data: fmt.Sprintf("Failed to start exec: %v", err)})
 		return
 	}
 	defer resp.Close()
 
-	// Start copying data between websocket and container
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// Output, pings and the final exit message share the connection.
+	var mu sync.Mutex
+	send := func(msg TerminalMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return websocket.JSON.Send(ws, msg)
+	}
+	go pingWebSocket(ctx, ws, &mu, cancel)
 
-	// Copy from websocket to container
+	info := &docker.ExecInfo{
+		ID:          execID,
+		ContainerID: containerId,
+		Cmd:         config.Cmd,
+		User:        config.User,
+		WorkingDir:  config.WorkingDir,
+		Tty:         config.Tty,
+	}
+	if inspect, err := h.client.ContainerExecInspect(ctx, execID); err == nil {
+		info.Running = inspect.Running
+		info.Pid = inspect.Pid
+	}
+	send(TerminalMessage{Type: "exec", Exec: info})
+
+	// Copy from websocket to container. When the client goes away the
+	// attach connection is closed, which ends the copy below.
 	go func() {
-		defer wg.Done()
+		defer resp.Close()
 		for {
 			var msg TerminalMessage
 			if err := websocket.JSON.Receive(ws, &msg); err != nil {
-				if err != io.EOF {
-					log.Printf("Error receiving websocket message: %v", err)
+				if err != io.EOF && ctx.Err() == nil {
+					slog.WarnContext(ctx, "Failed to receive WebSocket message", "error", err)
 				}
 				return
 			}
@@ -99,61 +300,86 @@ func (h *TerminalHandler) handleConnection(ctx context.Context, ws *websocket.Co
 			switch msg.Type {
 			case "resize":
 				// Handle terminal resize
-				if err := h.client.ContainerExecResize(ctx, exec.ID, container.ResizeOptions{
+				if err := h.client.ContainerExecResize(ctx, execID, container.ResizeOptions{
 					Height: msg.Rows,
 					Width:  msg.Cols,
 				}); err != nil {
-					log.Printf("Error resizing terminal: %v", err)
+					slog.WarnContext(ctx, "Failed to resize terminal", "error", err)
 				}
 			case "input":
 				// Send input to container
 				if _, err := resp.Conn.Write([]byte(msg.Data)); err != nil {
-					log.Printf("Error writing to container: %v", err)
+					slog.WarnContext(ctx, "Failed to write to container", "error", err)
 					return
 				}
 			}
 		}
 	}()
 
-	// Copy from container to websocket
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 4096)
-		for {
-			n, err := resp.Reader.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from container: %v", err)
-				}
-				return
-			}
-
-			msg := TerminalMessage{
-				Type: "output",
-				Data: string(buffer[:n]),
-			}
-
-			if err := websocket.JSON.Send(ws, msg); err != nil {
-				log.Printf("Error sending websocket message: %v", err)
-				return
-			}
-		}
-	}()
-
-	// Wait for both goroutines to complete
-	wg.Wait()
+	// Copy from container to websocket. Without a TTY stdout and stderr
+	// arrive multiplexed.
+	output := &terminalOutput{send: send}
+	if config.Tty {
+		_, err = io.Copy(output, resp.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(output, output, resp.Reader)
+	}
+	output.flush()
+	if err != nil && ctx.Err() == nil && !errors.Is(err, io.ErrClosedPipe) {
+		slog.WarnContext(ctx, "Failed to read from container", "error", err)
+	}
 
 	// Get exec instance info to check exit code
-	inspect, err := h.client.ContainerExecInspect(ctx, exec.ID)
+	inspect, err := h.client.ContainerExecInspect(ctx, execID)
 	if err != nil {
-		log.Printf("Error inspecting exec instance: %v", err)
+		slog.ErrorContext(ctx, "Failed to inspect exec", "error", err)
 		return
 	}
+	if inspect.Running {
+		return // the client left; the process keeps running
+	}
 
 	// Send exit message
 	exitMsg := TerminalMessage{
 		Type: "exit",
 		Data: fmt.Sprintf("Process exited with code %d", inspect.ExitCode),
 	}
-	websocket.JSON.Send(ws, exitMsg)
+	send(exitMsg)
+}
+
+// terminalOutput sends process output as "output" messages. JSON strings
+// must be valid UTF-8, so a multi-byte character split across reads is held
+// back until the rest of it arrives.
+type terminalOutput struct {
+	send    func(TerminalMessage) error
+	partial []byte
+}
+
+func (o *terminalOutput) Write(p []byte) (int, error) {
+	data := append(o.partial, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	o.partial = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+	if err := o.send(TerminalMessage{Type: "output", Data: string(data[:cut])}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush sends any bytes still held back
+func (o *terminalOutput) flush() {
+	if len(o.partial) > 0 {
+		o.send(TerminalMessage{Type: "output", Data: string(o.partial)})
+		o.partial = nil
+	}
 }
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// Docker calls are bounded by their own timeouts, derived from the request
+// context, so a hung daemon releases the handler even if the client stays
+// connected. Reads keep the request's own deadline when it is sooner; writes
+// and long operations replace it with theirs, which are usually longer.
+
+// requestContextKey holds a request's context as it was before
+// WithRequestTimeout bounded it
+type requestContextKey struct{}
+
+// WithRequestTimeout bounds a request's context by timeout, remembering the
+// unbounded context so that WithoutRequestTimeout can recover it.
+func WithRequestTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithValue(ctx, requestContextKey{}, ctx), timeout)
+}
+
+// WithoutRequestTimeout lifts the bound set by WithRequestTimeout, for
+// streams and operations with timeouts of their own. The context keeps its
+// values and is still cancelled when the client goes away.
+func WithoutRequestTimeout(ctx context.Context) context.Context {
+	parent, ok := ctx.Value(requestContextKey{}).(context.Context)
+	if !ok {
+		return ctx
+	}
+	return unbounded{Context: ctx, parent: parent}
+}
+
+// unbounded takes its values from the request's context and its
+// cancellation from the context before the request timeout
+type unbounded struct {
+	context.Context
+	parent context.Context
+}
+
+func (c unbounded) Deadline() (time.Time, bool) { return c.parent.Deadline() }
+func (c unbounded) Done() <-chan struct{}       { return c.parent.Done() }
+func (c unbounded) Err() error                  { return c.parent.Err() }
+
+// readContext bounds quick reads such as list, inspect and info.
+func readContext(r *http.Request, cfg *config.Store) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), cfg.Get().DockerReadTimeout)
+}
+
+// writeContext bounds state changes and reads that are expensive to compute.
+func writeContext(w http.ResponseWriter, r *http.Request, cfg *config.Store) (context.Context, context.CancelFunc) {
+	return callContext(w, r, cfg.Get(), cfg.Get().DockerWriteTimeout)
+}
+
+// longContext bounds operations that act on many containers in sequence.
+func longContext(w http.ResponseWriter, r *http.Request, cfg *config.Store) (context.Context, context.CancelFunc) {
+	return callContext(w, r, cfg.Get(), cfg.Get().DockerLongTimeout)
+}
+
+// callContext bounds a call by timeout in place of the request timeout,
+// pushing the connection's write deadline back so the response can still be
+// written once the call returns. Streams have no write deadline to push.
+func callContext(w http.ResponseWriter, r *http.Request, cfg *config.Config, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if cfg.ServerWriteTimeout > 0 && r.Context().Value(streamKey{}) == nil {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + cfg.ServerWriteTimeout))
+	}
+	return context.WithTimeout(WithoutRequestTimeout(r.Context()), timeout)
+}
+
+// streamKey marks the context of a stream
+type streamKey struct{}
+
+// AsStream marks ctx as a stream's, whose connection has had its write
+// deadline cleared for good
+func AsStream(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamKey{}, true)
+}
+
+// failureStatus is the status for a failed call: 504 if it ran out of time,
+// otherwise 500
+func failureStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// retryRead runs an idempotent Docker read, retrying transient failures with
+// the configured backoff. Never use it for calls that change state.
+func retryRead[T any](ctx context.Context, cfg *config.Store, op func(context.Context) (T, error)) (T, error) {
+	c := cfg.Get()
+	return docker.Retry(ctx, docker.RetryPolicy{Attempts: c.DockerRetries, Backoff: c.DockerRetryBackoff}, op)
+}
+
+// stopTimeout returns the graceful stop timeout in seconds: the request's
+// timeout query parameter if set, otherwise the configured default. The
+// second value says which one was used, for logging.
+func stopTimeout(r *http.Request, cfg *config.Store) (int, string, error) {
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return 0, "", fmt.Errorf("invalid timeout %q: must be a non-negative number of seconds", v)
+		}
+		return seconds, "request", nil
+	}
+	return int(cfg.Get().StopTimeout.Seconds()), "default", nil
+}
+
+// stopContext bounds a stop call, allowing for the graceful stop timeout on
+// top of the usual write timeout.
+func stopContext(w http.ResponseWriter, r *http.Request, cfg *config.Store, seconds int) (context.Context, context.CancelFunc) {
+	return callContext(w, r, cfg.Get(), cfg.Get().DockerWriteTimeout+time.Duration(seconds)*time.Second)
+}
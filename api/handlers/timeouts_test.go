@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"kibutsu/config"
+)
+
+// hungDaemon is a Docker daemon that accepts requests and never answers
+func hungDaemon(t *testing.T) *client.Client {
+	t.Helper()
+	stop := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		daemon.Close()
+	})
+
+	c, err := client.NewClientWithOpts(client.WithHost("tcp://"+daemon.Listener.Addr().String()), client.WithVersion("1.45"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// A write to a hung daemon answers 504 once the write timeout runs out, even
+// when that is longer than the request timeout
+func TestWriteTimeoutOutlivesRequestTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:     50 * time.Millisecond,
+		DockerWriteTimeout: 300 * time.Millisecond,
+	}, config.Options{})
+	h := NewVolumeHandler(hungDaemon(t), cfg)
+
+	r := httptest.NewRequest(http.MethodPost, "/volumes", strings.NewReader(`{"name":"data"}`))
+	ctx, cancel := WithRequestTimeout(r.Context(), cfg.Get().RequestTimeout)
+	defer cancel()
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	h.CreateVolume(w, r.WithContext(ctx))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusGatewayTimeout, w.Body)
+	}
+	if elapsed < cfg.Get().DockerWriteTimeout || elapsed > 2*time.Second {
+		t.Fatalf("answered after %s, want about %s", elapsed, cfg.Get().DockerWriteTimeout)
+	}
+}
+
+// A long operation gets the long timeout rather than the request timeout
+func TestLongTimeoutOutlivesRequestTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:    50 * time.Millisecond,
+		DockerLongTimeout: 300 * time.Millisecond,
+	}, config.Options{})
+	h := NewVolumeHandler(hungDaemon(t), cfg)
+
+	r := httptest.NewRequest(http.MethodPost, "/volumes/prune", nil)
+	ctx, cancel := WithRequestTimeout(r.Context(), cfg.Get().RequestTimeout)
+	defer cancel()
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	h.PruneVolumes(w, r.WithContext(ctx))
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusGatewayTimeout, w.Body)
+	}
+	if elapsed < cfg.Get().DockerLongTimeout || elapsed > 2*time.Second {
+		t.Fatalf("answered after %s, want about %s", elapsed, cfg.Get().DockerLongTimeout)
+	}
+}
+
+// The request's context is still cancelled when the client goes away
+func TestWithoutRequestTimeoutKeepsCancellation(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := WithRequestTimeout(parent, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	unbounded := WithoutRequestTimeout(ctx)
+	if err := unbounded.Err(); err != nil {
+		t.Fatalf("unbounded context ended with the request timeout: %v", err)
+	}
+	cancelParent()
+	select {
+	case <-unbounded.Done():
+	case <-time.After(time.Second):
+		t.Fatal("unbounded context not cancelled with the request")
+	}
+}
+
+// The response to a write that outlasts the server's write timeout still
+// reaches the client
+func TestWriteTimeoutOutlivesServerWriteTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:     50 * time.Millisecond,
+		ServerWriteTimeout: 50 * time.Millisecond,
+		DockerWriteTimeout: 300 * time.Millisecond,
+	}, config.Options{})
+	h := NewVolumeHandler(hungDaemon(t), cfg)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := WithRequestTimeout(r.Context(), cfg.Get().RequestTimeout)
+		defer cancel()
+		h.CreateVolume(w, r.WithContext(ctx))
+	}))
+	srv.Config.WriteTimeout = cfg.Get().ServerWriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"name":"data"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
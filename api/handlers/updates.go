@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/docker"
+	"kibutsu/notify"
+)
+
+// autoUpdateLabel opts a container into being recreated when the update
+// checker finds a newer image for it
+const autoUpdateLabel = "kibutsu.auto-update"
+
+// updateStartDelay is how long after startup the first check runs, so a
+// restart doesn't hit the registries while everything is coming up
+const updateStartDelay = time.Minute
+
+// UpdateChecker periodically compares the images of running containers with
+// their registries and recreates opted-in containers that are outdated
+type UpdateChecker struct {
+	client     *client.Client
+	config     *config.Store
+	containers *ContainerHandler
+	trigger    chan struct{}
+
+	// notifier, if set, is told when a container's image first has an
+	// update available
+	notifier *notify.Notifier
+	endpoint string
+
+	mu        sync.Mutex
+	results   map[string]apitypes.ContainerUpdate
+	checking  bool
+	lastCheck time.Time
+	nextCheck time.Time
+	lastErr   string
+}
+
+func NewUpdateChecker(client *client.Client, cfg *config.Store, containers *ContainerHandler) *UpdateChecker {
+	return &UpdateChecker{
+		client:     client,
+		config:     cfg,
+		containers: containers,
+		trigger:    make(chan struct{}, 1),
+		results:    make(map[string]apitypes.ContainerUpdate),
+	}
+}
+
+// UseNotifier sends notifications for updates found on the endpoint
+func (u *UpdateChecker) UseNotifier(notifier *notify.Notifier, endpoint string) {
+	u.notifier = notifier
+	u.endpoint = endpoint
+}
+
+// Run checks for updates every UpdateCheckInterval, and when asked through
+// CheckNow, until ctx is cancelled. The interval is re-read after every
+// check, so a reload applies from the next one.
+func (u *UpdateChecker) Run(ctx context.Context) {
+	next := time.Now().Add(updateStartDelay)
+	for {
+		enabled := u.config.Get().UpdateCheckInterval > 0
+		wait := time.Until(next)
+		if !enabled {
+			// Look again later in case a reload turns the checks on
+			wait = updateStartDelay
+		}
+		u.mu.Lock()
+		u.nextCheck = time.Time{}
+		if enabled {
+			u.nextCheck = next
+		}
+		u.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if u.config.Get().UpdateCheckInterval == 0 {
+				continue
+			}
+		case <-u.trigger:
+			timer.Stop()
+		}
+		u.check(ctx)
+		next = time.Now().Add(u.config.Get().UpdateCheckInterval)
+	}
+}
+
+// check compares every running container's image with its registry,
+// checking each image once however many containers use it
+func (u *UpdateChecker) check(ctx context.Context) {
+	u.mu.Lock()
+	u.checking = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.checking = false
+		u.mu.Unlock()
+	}()
+
+	cfg := u.config.Get()
+	listCtx, cancel := context.WithTimeout(ctx, cfg.DockerReadTimeout)
+	containers, err := u.client.ContainerList(listCtx, container.ListOptions{})
+	cancel()
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to list containers for update check", "error", err)
+		u.mu.Lock()
+		u.lastCheck, u.lastErr = time.Now().UTC(), err.Error()
+		u.mu.Unlock()
+		return
+	}
+
+	u.mu.Lock()
+	previous := u.results
+	u.mu.Unlock()
+
+	manager := docker.NewImageManager(u.client)
+	manager.RegistryAuth = u.containers.registryAuth
+	checks := make(map[[2]string]apitypes.ImageUpdateCheck)
+	results := make(map[string]apitypes.ContainerUpdate, len(containers))
+	for _, c := range containers {
+		if !listedWithPrefix(c, cfg.NamePrefix) {
+			continue
+		}
+		key := [2]string{c.Image, c.ImageID}
+		check, ok := checks[key]
+		if !ok {
+			checkCtx, cancel := context.WithTimeout(ctx, cfg.DockerWriteTimeout)
+			check = manager.CheckUpdate(checkCtx, c.Image, c.ImageID)
+			cancel()
+			checks[key] = check
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		update := apitypes.ContainerUpdate{
+			ContainerID: c.ID,
+			Name:        listedName(c),
+			ImageID:     c.ImageID,
+			Check:       check,
+			CheckedAt:   time.Now().UTC(),
+		}
+		update.AutoUpdate, _ = strconv.ParseBool(c.Labels[autoUpdateLabel])
+		if update.AutoUpdate && check.UpdateAvailable {
+			u.autoUpdate(ctx, &update)
+		}
+		if check.UpdateAvailable && !previous[c.ID].Check.UpdateAvailable {
+			u.notify(c, update)
+		}
+		results[c.ID] = update
+	}
+
+	u.mu.Lock()
+	u.results = results
+	u.lastCheck, u.lastErr = time.Now().UTC(), ""
+	u.mu.Unlock()
+}
+
+// autoUpdate recreates an opted-in container with the newer image, noting
+// the outcome on update
+func (u *UpdateChecker) autoUpdate(ctx context.Context, update *apitypes.ContainerUpdate) {
+	cfg := u.config.Get()
+	recreateCtx, cancel := context.WithTimeout(ctx, cfg.DockerLongTimeout)
+	defer cancel()
+
+	result, err := u.containers.recreate(recreateCtx, update.ContainerID, false, true, int(cfg.StopTimeout.Seconds()))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to auto-update container", "container", update.ContainerID, "image", update.Check.Image, "error", err)
+		update.RecreateError = err.Error()
+		return
+	}
+	update.Recreated = &result
+	if result.Recreated {
+		slog.InfoContext(ctx, "Container auto-updated", "audit", true, "user", "update-checker", "container", result.OldID, "replacement", result.ID, "image", result.Image, "image_id", result.ImageID)
+	}
+}
+
+// notify reports an update newly found for a container, and whether it was
+// applied
+func (u *UpdateChecker) notify(c types.Container, update apitypes.ContainerUpdate) {
+	if u.notifier == nil {
+		return
+	}
+	message := fmt.Sprintf("The registry has a newer image for %s than container %s runs.", update.Check.Image, update.Name)
+	switch {
+	case update.Recreated != nil && update.Recreated.Recreated:
+		message += " The container was recreated with it."
+	case update.RecreateError != "":
+		message += " Recreating the container failed: " + update.RecreateError
+	}
+	u.notifier.Notify(apitypes.Notification{
+		Event:       "image-update",
+		Endpoint:    u.endpoint,
+		Title:       fmt.Sprintf("Update available for %s", update.Check.Image),
+		Message:     message,
+		Container:   update.Name,
+		ContainerID: update.ContainerID,
+		Project:     c.Labels["com.docker.compose.project"],
+	})
+}
+
+// CheckNow starts a check without waiting for the interval. A check already
+// asked for is not queued twice.
+func (u *UpdateChecker) CheckNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case u.trigger <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListUpdates reports the outdated containers found by the last check, or
+// every checked container with all=true, sorted by name
+func (u *UpdateChecker) ListUpdates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+	interval := u.config.Get().UpdateCheckInterval
+
+	u.mu.Lock()
+	report := apitypes.UpdateReport{
+		Enabled:    interval > 0,
+		Checking:   u.checking,
+		LastError:  u.lastErr,
+		Containers: make([]apitypes.ContainerUpdate, 0),
+	}
+	if interval > 0 {
+		report.Interval = interval.String()
+	}
+	if !u.lastCheck.IsZero() {
+		last := u.lastCheck
+		report.LastCheck = &last
+	}
+	if !u.nextCheck.IsZero() {
+		next := u.nextCheck.UTC()
+		report.NextCheck = &next
+	}
+	for _, update := range u.results {
+		if all || update.Check.UpdateAvailable {
+			report.Containers = append(report.Containers, update)
+		}
+	}
+	u.mu.Unlock()
+
+	sort.Slice(report.Containers, func(i, j int) bool {
+		return report.Containers[i].Name < report.Containers[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// backupTimeFormat stamps the names of downloaded volume backups
+const backupTimeFormat = "20060102-150405"
+
+// BackupVolume downloads a volume's contents as a tar.gz, taken through a
+// helper container. Backups kept on the server are taken through
+// /backups instead.
+func (h *VolumeHandler) BackupVolume(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	name = strings.Split(name, "/")[0]
+
+	// A large volume takes longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	out := &downloadWriter{w: w, filename: fmt.Sprintf("%s-%s.tar.gz", name, time.Now().UTC().Format(backupTimeFormat))}
+	err := docker.BackupVolume(r.Context(), h.client, name, h.config.Get().VolumeHelperImage, out)
+	if err != nil {
+		if out.started {
+			downloadFailed(r, err, "Failed to back up volume", "volume", name)
+			return
+		}
+		writeVolumeError(w, "back up", err)
+		return
+	}
+	auditLog(r, "Volume backed up", "volume", name)
+}
+
+// RestoreVolume fills a volume from a tar archive (optionally compressed)
+// sent as the request body or as the archive field of a multipart form. The
+// volume is created if it doesn't exist. replace=true empties it first;
+// otherwise the archive is extracted over what is there.
+func (h *VolumeHandler) RestoreVolume(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	name = strings.Split(name, "/")[0]
+	replace := r.URL.Query().Get("replace") == "true"
+
+	var input io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		// The archive is read as it arrives rather than buffered to disk first
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				http.Error(w, "Missing archive file", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "archive" {
+				input = part
+				break
+			}
+		}
+	}
+	// The upload outlasts the server's read timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	received := &countingReader{reader: input}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	if err := docker.RestoreVolume(ctx, h.client, name, h.config.Get().VolumeHelperImage, received, replace); err != nil {
+		writeVolumeError(w, "restore", err)
+		return
+	}
+	auditLog(r, "Volume restored", "volume", name, "replace", replace, "bytes", received.n.Load())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apitypes.VolumeRestoreResult{
+		Volume:   name,
+		Bytes:    received.n.Load(),
+		Replaced: replace,
+	})
+}
+
+// writeVolumeError reports a failed backup or restore
+func writeVolumeError(w http.ResponseWriter, action string, err error) {
+	if client.IsErrNotFound(err) {
+		http.Error(w, fmt.Sprintf("Volume not found: %v", err), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to %s volume: %v", action, err), http.StatusInternalServerError)
+}
+
+// downloadWriter sends the headers of a tar.gz download on the first write,
+// so a failure before any data can still be reported with its status
+type downloadWriter struct {
+	w        http.ResponseWriter
+	filename string
+	started  bool
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	if !d.started {
+		d.started = true
+		d.w.Header().Set("Content-Type", "application/gzip")
+		d.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.filename))
+	}
+	return d.w.Write(p)
+}
+
+// copyDownload sends a download read from rc, once its headers are set
+func copyDownload(w http.ResponseWriter, r *http.Request, rc io.Reader, msg string, args ...any) {
+	if _, err := io.Copy(w, rc); err != nil {
+		downloadFailed(r, err, msg, args...)
+	}
+}
+
+// downloadFailed logs a download that failed after its headers were sent.
+// The status can't change any more, but the truncated archive will fail to
+// unpack on the client.
+func downloadFailed(r *http.Request, err error, msg string, args ...any) {
+	slog.ErrorContext(r.Context(), msg, append(args, "error", err)...)
+}
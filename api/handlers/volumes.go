@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+type VolumeHandler struct {
+	client *client.Client
+	config *config.Store
+}
+
+func NewVolumeHandler(client *client.Client, cfg *config.Store) *VolumeHandler {
+	return &VolumeHandler{client: client, config: cfg}
+}
+
+// ListVolumes lists volumes sorted by name, optionally filtered by dangling,
+// driver, name and label (passed to Docker).
+func (h *VolumeHandler) ListVolumes(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	filterArgs := filters.NewArgs()
+	for _, key := range []string{"dangling", "driver", "name", "label"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			filterArgs.Add(key, v)
+		}
+	}
+
+	list, err := retryRead(ctx, h.config, func(ctx context.Context) (volume.ListResponse, error) {
+		return h.client.VolumeList(ctx, volume.ListOptions{Filters: filterArgs})
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list volumes: %v", err), failureStatus(err))
+		return
+	}
+
+	response := make([]apitypes.VolumeInfo, 0, len(list.Volumes))
+	for _, v := range list.Volumes {
+		response = append(response, convertVolume(*v))
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Name < response[j].Name })
+
+	writeList(w, params, response)
+}
+
+func (h *VolumeHandler) GetVolume(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	name = strings.Split(name, "/")[0]
+
+	ctx, cancel := readContext(r, h.config)
+	defer cancel()
+
+	v, err := retryRead(ctx, h.config, func(ctx context.Context) (volume.Volume, error) {
+		return h.client.VolumeInspect(ctx, name)
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, fmt.Sprintf("Volume not found: %v", err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to inspect volume: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertVolume(v))
+}
+
+func (h *VolumeHandler) CreateVolume(w http.ResponseWriter, r *http.Request) {
+	var req apitypes.VolumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	v, err := h.client.VolumeCreate(ctx, volume.CreateOptions{
+		Name:       req.Name,
+		Driver:     req.Driver,
+		DriverOpts: req.DriverOpts,
+		Labels:     req.Labels,
+	})
+	if err != nil {
+		if errdefs.IsInvalidParameter(err) {
+			http.Error(w, fmt.Sprintf("Invalid volume: %v", err), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to create volume: %v", err), failureStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(convertVolume(v))
+}
+
+// RemoveVolume removes a volume. A volume in use is refused with 409 unless
+// force=true.
+func (h *VolumeHandler) RemoveVolume(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	name = strings.Split(name, "/")[0]
+
+	force := r.URL.Query().Get("force") == "true"
+
+	ctx, cancel := writeContext(w, r, h.config)
+	defer cancel()
+
+	if err := h.client.VolumeRemove(ctx, name, force); err != nil {
+		switch {
+		case client.IsErrNotFound(err):
+			http.Error(w, fmt.Sprintf("Volume not found: %v", err), http.StatusNotFound)
+		case errdefs.IsConflict(err):
+			http.Error(w, fmt.Sprintf("Volume is in use: %v", err), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to remove volume: %v", err), failureStatus(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PruneVolumes removes volumes no container uses. Only anonymous volumes
+// are removed unless all=true; label narrows the prune to matching volumes.
+func (h *VolumeHandler) PruneVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pruneFilters := filters.NewArgs()
+	if r.URL.Query().Get("all") == "true" {
+		pruneFilters.Add("all", "true")
+	}
+	if label := r.URL.Query().Get("label"); label != "" {
+		pruneFilters.Add("label", label)
+	}
+
+	ctx, cancel := longContext(w, r, h.config)
+	defer cancel()
+
+	report, err := h.client.VolumesPrune(ctx, pruneFilters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prune volumes: %v", err), failureStatus(err))
+		return
+	}
+	auditLog(r, "Volumes pruned", "count", len(report.VolumesDeleted), "reclaimed_bytes", report.SpaceReclaimed)
+
+	result := apitypes.VolumePruneResult{
+		VolumesDeleted: report.VolumesDeleted,
+		SpaceReclaimed: report.SpaceReclaimed,
+	}
+	if result.VolumesDeleted == nil {
+		result.VolumesDeleted = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func convertVolume(v volume.Volume) apitypes.VolumeInfo {
+	created, _ := time.Parse(time.RFC3339, v.CreatedAt)
+	info := apitypes.VolumeInfo{
+		Name:       v.Name,
+		Driver:     v.Driver,
+		Mountpoint: v.Mountpoint,
+		Scope:      v.Scope,
+		Created:    created,
+		Labels:     v.Labels,
+		Options:    v.Options,
+		Size:       -1,
+		RefCount:   -1,
+	}
+	if v.UsageData != nil {
+		info.Size = v.UsageData.Size
+		info.RefCount = v.UsageData.RefCount
+	}
+	return info
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxWebhookBody caps the payload of a webhook delivery. CI systems and
+// registries send a few kilobytes of JSON.
+const maxWebhookBody = 1 << 20
+
+// webhookUser is who webhook runs are logged and recorded as
+const webhookUser = "webhook"
+
+// webhookSignatureHeaders carry a delivery's "sha256=<hex>" HMAC of the
+// body: GitHub's header, and a generic one for CI pipelines
+var webhookSignatureHeaders = []string{"X-Hub-Signature-256", "X-Signature-256"}
+
+// CreateWebhook gives a job a new webhook, replacing any it had, and
+// returns its token and secret. They aren't shown again.
+func (s *JobScheduler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	var req apitypes.JobWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	token, err := randomToken()
+	if err == nil && req.Signed && req.Secret == "" {
+		req.Secret, err = randomToken()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate webhook token: %v", err), failureStatus(err))
+		return
+	}
+
+	webhook, ok, err := s.store.SetWebhook(job.ID, webhookTokenHash(token), req.Secret)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save webhook: %v", err), failureStatus(err))
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Job %s not found", job.ID), http.StatusNotFound)
+		return
+	}
+	auditLog(r, "Job webhook created", "job", job.ID, "name", job.Name, "signed", webhook.Signed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apitypes.JobWebhookCreated{
+		JobWebhook: *webhook,
+		Token:      token,
+		Path:       s.config.Get().BasePath + "/api/webhooks/" + token,
+		Secret:     req.Secret,
+	})
+}
+
+// DeleteWebhook removes a job's webhook; its token stops working
+func (s *JobScheduler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobID(w, r)
+	if !ok {
+		return
+	}
+	removed, err := s.store.RemoveWebhook(job.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to remove webhook: %v", err), failureStatus(err))
+		return
+	}
+	if !removed {
+		http.Error(w, fmt.Sprintf("Job %s has no webhook", job.ID), http.StatusNotFound)
+		return
+	}
+	auditLog(r, "Job webhook removed", "job", job.ID, "name", job.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReceiveWebhook runs the job a webhook token belongs to, in the background
+// like RunJob. It is reached without a session: the token in the path, and
+// the signature for signed webhooks, are what authorize it. Disabled jobs
+// don't accept deliveries.
+func (s *JobScheduler) ReceiveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"), "/")[0]
+	job, secret, ok := s.store.WebhookJob(webhookTokenHash(token))
+	if token == "" || !ok {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if secret != "" && !validWebhookSignature(r, body, secret) {
+		slog.WarnContext(r.Context(), "Rejected webhook delivery with a missing or invalid signature", "job", job.ID, "name", job.Name)
+		http.Error(w, "Missing or invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if !job.Enabled {
+		http.Error(w, fmt.Sprintf("Job %s is disabled", job.ID), http.StatusConflict)
+		return
+	}
+	if !s.claim(job.ID) {
+		http.Error(w, fmt.Sprintf("Job %s is already running", job.ID), http.StatusConflict)
+		return
+	}
+
+	// The run outlives the request, but keeps its values for logging
+	ctx := context.WithoutCancel(r.Context())
+	go s.execute(ctx, job, "webhook", webhookUser)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validWebhookSignature checks the HMAC-SHA256 of body sent in any of the
+// signature headers
+func validWebhookSignature(r *http.Request, body []byte, secret string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, header := range webhookSignatureHeaders {
+		got, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(header), "sha256="))
+		if err == nil && len(got) > 0 && hmac.Equal(got, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 32 random bytes, hex encoded
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
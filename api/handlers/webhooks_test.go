@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+	"kibutsu/jobs"
+)
+
+func TestCreateWebhookPathHasBasePath(t *testing.T) {
+	store, err := jobs.NewStore(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(apitypes.Job{ID: "j1", Name: "deploy", Action: "prune-images"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewJobScheduler(store, config.NewStore(&config.Config{BasePath: "/kibutsu"}, config.Options{}))
+
+	w := httptest.NewRecorder()
+	s.CreateWebhook(w, httptest.NewRequest(http.MethodPost, "/jobs/j1/webhook", nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var created apitypes.JobWebhookCreated
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/kibutsu/api/webhooks/" + created.Token; created.Path != want {
+		t.Errorf("path = %q, want %q", created.Path, want)
+	}
+}
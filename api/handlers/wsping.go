@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsPingInterval is how often WebSocket clients are pinged; their pongs mark
+// the stream active for the idle sweeper.
+const wsPingInterval = 30 * time.Second
+
+// pingWebSocket pings ws every wsPingInterval until ctx ends. mu guards
+// writes to ws, which the caller shares with its own sends; onError is
+// called if a ping can't be written.
+func pingWebSocket(ctx context.Context, ws *websocket.Conn, mu *sync.Mutex, onError func()) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mu.Lock()
+			ws.PayloadType = websocket.PingFrame
+			_, err := ws.Write(nil)
+			ws.PayloadType = websocket.TextFrame
+			mu.Unlock()
+			if err != nil {
+				onError()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// AuditEntry records one state-changing API call
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`             // logged-in or proxy-supplied user, or the client address
+	Endpoint   string    `json:"endpoint"`         // the Docker endpoint acted on
+	Resource   string    `json:"resource"`         // containers, images, project, volumes, ...
+	Target     string    `json:"target,omitempty"` // the container, image, project, ... acted on
+	Action     string    `json:"action"`           // create, remove, update, or the path action such as stop
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"` // the start of the error response
+	DurationMS int64     `json:"durationMs"`
+	RequestID  string    `json:"requestId,omitempty"`
+}
@@ -0,0 +1,19 @@
+package types
+
+import "time"
+
+// LoginRequest holds the credentials posted to /auth/login
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// AuthSession describes the caller's session. Token is only sent in the
+// login response, for clients that authenticate with a bearer token rather
+// than the session cookie.
+type AuthSession struct {
+	Enabled   bool       `json:"enabled"` // false when no users file is configured and the API is open
+	Username  string     `json:"username,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Token     string     `json:"token,omitempty"`
+}
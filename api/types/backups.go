@@ -0,0 +1,30 @@
+package types
+
+import "time"
+
+// Backup is an archive of a volume or a compose project kept in the backup
+// directory
+type Backup struct {
+	ID      string    `json:"id"`   // kind/name/timestamp
+	Kind    string    `json:"kind"` // volume or compose
+	Name    string    `json:"name"` // the volume or project backed up
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"` // bytes
+}
+
+// BackupRequest takes a backup now
+type BackupRequest struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// BackupRestoreResult reports what restoring a backup put back
+type BackupRestoreResult struct {
+	Backup  string   `json:"backup"`
+	Volumes []string `json:"volumes"` // volumes emptied and refilled
+	Project string   `json:"project,omitempty"`
+
+	// Files is set when a compose project's files were registered again;
+	// they are left alone when the project still exists
+	Files bool `json:"files"`
+}
@@ -1,6 +1,12 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
 
 // ComposeProject represents a Docker Compose project
 type ComposeProject struct {
@@ -40,10 +46,37 @@ type ServiceSpec struct {
 	Environment map[string]string `json:"environment,omitempty"`
 	Ports       []string          `json:"ports,omitempty"`
 	Volumes     []string          `json:"volumes,omitempty"`
-	DependsOn   []string          `json:"depends_on,omitempty"`
+	DependsOn   ServiceRefs       `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+	Links       []string          `json:"links,omitempty"`
+	Networks    ServiceRefs       `json:"networks,omitempty"`
 	Deploy      *DeploySpec       `json:"deploy,omitempty"`
 }
 
+// ServiceRefs is a list of names that compose allows to be written either as
+// a sequence or as a mapping whose keys are the names (the long syntax of
+// depends_on and networks).
+type ServiceRefs []string
+
+func (r *ServiceRefs) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+		*r = names
+	case yaml.MappingNode:
+		names := make([]string, 0, len(value.Content)/2)
+		for i := 0; i < len(value.Content); i += 2 {
+			names = append(names, value.Content[i].Value)
+		}
+		*r = names
+	default:
+		return fmt.Errorf("expected a list or mapping, got %q", value.Value)
+	}
+	return nil
+}
+
 // DeploySpec defines deployment configuration for a service
 type DeploySpec struct {
 	Replicas int `json:"replicas,omitempty"`
@@ -79,3 +112,226 @@ type ComposeOperation struct {
 	EndTime   time.Time `json:"endTime,omitempty"`
 	Error     string    `json:"error,omitempty"`
 }
+
+// ServiceGraph is the dependency topology of a compose project
+type ServiceGraph struct {
+	Project string      `json:"project"`
+	Nodes   []GraphNode `json:"nodes"`
+	Edges   []GraphEdge `json:"edges"`
+	Cycles  [][]string  `json:"cycles"`
+}
+
+// GraphNode is a service in the dependency graph
+type GraphNode struct {
+	ID       string `json:"id"`
+	Image    string `json:"image"`
+	Replicas int    `json:"replicas"` // desired replica count
+	Running  int    `json:"running"`  // containers currently running
+	State    string `json:"state"`    // running, partial, stopped or not_created
+}
+
+// GraphEdge is a relationship between two services. For depends_on and link
+// edges From depends on To; network edges are undirected.
+type GraphEdge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Type    string `json:"type"` // depends_on, link or network
+	Network string `json:"network,omitempty"`
+	Cyclic  bool   `json:"cyclic,omitempty"`
+}
+
+// BundleImport summarizes a compose project bundle that was imported
+type BundleImport struct {
+	Project  string   `json:"project"`
+	Services []string `json:"services"`
+	Files    []string `json:"files"` // paths relative to the project directory
+	Bytes    int64    `json:"bytes"`
+}
+
+// ComposeProjectCreateRequest registers a new project from a compose file
+type ComposeProjectCreateRequest struct {
+	Name    string `json:"name"`
+	Compose string `json:"compose"` // contents of docker-compose.yml
+}
+
+// ComposeProjectCreated describes a newly registered project
+type ComposeProjectCreated struct {
+	Project  string            `json:"project"`
+	Services []string          `json:"services"`
+	Git      *ComposeGitSource `json:"git,omitempty"` // set for projects imported from Git
+}
+
+// ComposeGitImportRequest registers a project from a Git repository
+type ComposeGitImportRequest struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`                // https, http, ssh or git URL, or user@host:path
+	Branch   string `json:"branch,omitempty"`   // defaults to the remote's default branch
+	Path     string `json:"path,omitempty"`     // directory holding docker-compose.yml, defaults to the root
+	Username string `json:"username,omitempty"` // for http(s) URLs
+	Password string `json:"password,omitempty"` // a password or access token
+}
+
+// ComposeGitSource describes where a Git-backed project comes from.
+// Credentials are never returned.
+type ComposeGitSource struct {
+	Project        string    `json:"project"`
+	URL            string    `json:"url"`
+	Branch         string    `json:"branch,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	HasCredentials bool      `json:"hasCredentials"`
+	Commit         string    `json:"commit"` // checked out revision
+	SyncedAt       time.Time `json:"syncedAt"`
+}
+
+// ComposeSyncResult reports what syncing a Git-backed project did
+type ComposeSyncResult struct {
+	Project        string         `json:"project"`
+	PreviousCommit string         `json:"previousCommit"`
+	Commit         string         `json:"commit"`
+	Changed        bool           `json:"changed"`  // a new commit was checked out
+	Deployed       bool           `json:"deployed"` // the project was taken down and up again
+	Result         *ComposeResult `json:"result,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// ComposeFileChange reports what saving a new compose file changes (or,
+// for a dry run, would change) in a project's services
+type ComposeFileChange struct {
+	Project  string          `json:"project"`
+	Saved    bool            `json:"saved"` // false for a dry run
+	Added    []string        `json:"added"`
+	Removed  []string        `json:"removed"`
+	Changed  []ServiceChange `json:"changed"`
+	Checksum string          `json:"checksum"` // of the new file, for the next If-Match
+}
+
+// ServiceChange lists the fields of a service that differ between two
+// compose files
+type ServiceChange struct {
+	Service string   `json:"service"`
+	Fields  []string `json:"fields"` // compose keys, such as image or depends_on
+}
+
+// ComposeRunRequest overrides a service definition for a one-off container
+type ComposeRunRequest struct {
+	Command []string          `json:"command,omitempty"` // replaces the service command
+	Env     map[string]string `json:"env,omitempty"`     // merged over the service environment
+	Remove  bool              `json:"rm"`                // remove the container once it exits
+	Detach  bool              `json:"detach"`            // return immediately instead of streaming output
+}
+
+// ComposeRunResponse identifies a one-off container started detached
+type ComposeRunResponse struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// RunOutput is a single line of NDJSON output from an attached one-off run.
+// The first message carries the container ID and the last its exit code.
+type RunOutput struct {
+	ID       string `json:"id,omitempty"`
+	Stream   string `json:"stream,omitempty"` // stdout or stderr
+	Data     string `json:"data,omitempty"`
+	ExitCode *int64 `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ComposeProgress is a single line of NDJSON progress from compose up or
+// down. The final line has status "done" and carries the aggregate result.
+type ComposeProgress struct {
+	Project   string              `json:"project,omitempty"` // set by batch operations
+	Service   string              `json:"service,omitempty"`
+	Container string              `json:"container,omitempty"`
+	Status    string              `json:"status"` // pulling, pulled, creating, starting, started, stopping, stopped, restarting, restarted, removing, removed, skipped, error or done
+	Error     string              `json:"error,omitempty"`
+	Result    *ComposeResult      `json:"result,omitempty"`
+	Batch     *ComposeBatchResult `json:"batch,omitempty"` // final line of a batch operation
+}
+
+// ComposeResult summarizes a compose up or down across services
+type ComposeResult struct {
+	Operation string   `json:"operation"` // up, down, pull, start, stop or restart
+	Success   bool     `json:"success"`
+	Succeeded []string `json:"succeeded"`
+	Failed    []string `json:"failed"`
+	Skipped   []string `json:"skipped"` // not attempted because a dependency failed
+}
+
+// ComposeBatchRequest applies one action to several compose projects
+type ComposeBatchRequest struct {
+	Action      string           `json:"action"` // up, down or pull
+	Projects    ProjectSelection `json:"projects"`
+	Concurrency int              `json:"concurrency,omitempty"` // projects handled at once
+}
+
+// ProjectSelection is a list of project names, or the string "all"
+type ProjectSelection struct {
+	All   bool
+	Names []string
+}
+
+func (s *ProjectSelection) UnmarshalJSON(data []byte) error {
+	var all string
+	if err := json.Unmarshal(data, &all); err == nil {
+		if all != "all" {
+			return fmt.Errorf("projects must be a list of names or \"all\", got %q", all)
+		}
+		*s = ProjectSelection{All: true}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("projects must be a list of names or \"all\"")
+	}
+	*s = ProjectSelection{Names: names}
+	return nil
+}
+
+func (s ProjectSelection) MarshalJSON() ([]byte, error) {
+	if s.All {
+		return json.Marshal("all")
+	}
+	return json.Marshal(s.Names)
+}
+
+// ComposeBatchResult reports a batch action per project
+type ComposeBatchResult struct {
+	Action   string                      `json:"action"`
+	Success  bool                        `json:"success"`
+	Projects []ComposeBatchProjectResult `json:"projects"`
+}
+
+// ComposeBatchProjectResult is the outcome of a batch action on one project
+type ComposeBatchProjectResult struct {
+	Project string         `json:"project"`
+	Success bool           `json:"success"`
+	Error   string         `json:"error,omitempty"`
+	Result  *ComposeResult `json:"result,omitempty"`
+}
+
+// DeploymentRecord is one action taken on a compose project through the API
+type DeploymentRecord struct {
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`             // up, down, pull, start, stop, restart, scale, update or sync
+	Service  string            `json:"service,omitempty"`  // the scaled service
+	Services []string          `json:"services,omitempty"` // the services acted on, if not all
+	Replicas int               `json:"replicas,omitempty"` // the requested replica count for scale
+	User     string            `json:"user"`               // proxy-supplied user, or the client address
+	Success  bool              `json:"success"`
+	Error    string            `json:"error,omitempty"`
+	Images   map[string]string `json:"images"` // service name to image reference
+}
+
+// LogFrame is a single log line from a project's NDJSON log stream. Service
+// colors and replica indexes stay fixed for the whole stream, and colors are
+// derived from the sorted service names so they survive reconnects.
+type LogFrame struct {
+	Service    string    `json:"service"`
+	Container  string    `json:"container"`
+	Index      int       `json:"index"`      // replica number within the service, from 1
+	ColorIndex int       `json:"colorIndex"` // position of the service in sorted order
+	Stream     string    `json:"stream"`     // stdout, stderr or error
+	Timestamp  time.Time `json:"timestamp"`
+	Level      string    `json:"level,omitempty"` // detected level, on container log streams
+	Message    string    `json:"message"`
+}
@@ -21,6 +21,100 @@ type ContainerResponse struct {
 	Mounts     []MountInfo      `json:"mounts"`
 	Labels     map[string]string `json:"labels"`
 	RestartCount int            `json:"restartCount"`
+	DeviceRequests []DeviceRequest `json:"deviceRequests,omitempty"`
+	Devices        []DeviceMapping `json:"devices,omitempty"`
+	Health         string          `json:"health"` // healthy, unhealthy, starting or none
+	FailingStreak  int             `json:"failingStreak,omitempty"` // consecutive failed health probes
+	Env            []string        `json:"env,omitempty"` // secret values are redacted unless revealed
+	Init           bool            `json:"init"`          // an init process runs as PID 1
+	Sysctls        map[string]string `json:"sysctls,omitempty"`
+	Ulimits        []Ulimit          `json:"ulimits,omitempty"`
+	CapAdd         []string          `json:"capAdd,omitempty"`
+	CapDrop        []string          `json:"capDrop,omitempty"`
+	RestartPolicy  RestartPolicy     `json:"restartPolicy"`
+}
+
+// CreateContainerRequest is the body accepted when creating a container
+type CreateContainerRequest struct {
+	Image          string          `json:"image"`
+	Name           string          `json:"name,omitempty"`
+	Cmd            []string        `json:"cmd,omitempty"`
+	Env            []string        `json:"env,omitempty"`
+	DeviceRequests []DeviceRequest `json:"deviceRequests,omitempty"`
+	Devices        []DeviceMapping `json:"devices,omitempty"`
+	Start          bool            `json:"start,omitempty"`
+	Preset         string          `json:"preset,omitempty"` // named resource preset
+	CPUs           float64         `json:"cpus,omitempty"`   // overrides the preset's CPUs
+	Memory         int64           `json:"memory,omitempty"` // bytes, overrides the preset's memory
+	Init           *bool           `json:"init,omitempty"`   // run an init process as PID 1 to reap zombies
+	Sysctls        map[string]string `json:"sysctls,omitempty"` // namespaced kernel parameters, e.g. net.core.somaxconn
+	Ulimits        []Ulimit          `json:"ulimits,omitempty"`
+	CapAdd         []string          `json:"capAdd,omitempty"`  // e.g. NET_ADMIN, with or without the CAP_ prefix
+	CapDrop        []string          `json:"capDrop,omitempty"` // ALL drops every capability
+	Ports          []PortMapping     `json:"ports,omitempty"`   // hostPort 0 picks a free port; protocol defaults to tcp
+	Mounts         []MountRequest    `json:"mounts,omitempty"`
+	RestartPolicy  *RestartPolicy    `json:"restartPolicy,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Entrypoint     []string          `json:"entrypoint,omitempty"`
+	WorkingDir     string            `json:"workingDir,omitempty"`
+	User           string            `json:"user,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Network        string            `json:"network,omitempty"` // bridge, host, none or a network name
+}
+
+// ContainerExport is a portable definition of a container, to create it
+// again on another host
+type ContainerExport struct {
+	Definition CreateContainerRequest `json:"definition"`
+	Compose    string                 `json:"compose"`            // compose file with the container as its only service
+	Run        string                 `json:"run"`                // equivalent docker run command
+	Omitted    []string               `json:"omitted,omitempty"`  // settings the definition can't carry, as docker run flags
+	Redacted   []string               `json:"redacted,omitempty"` // env vars whose secret values were redacted
+}
+
+// MountRequest mounts a bind path, named volume or tmpfs into a new container
+type MountRequest struct {
+	Type     string `json:"type"`             // bind, volume or tmpfs
+	Source   string `json:"source,omitempty"` // host path for bind, volume name for volume (empty creates an anonymous volume)
+	Target   string `json:"target"`           // absolute path in the container
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// RestartPolicy is a container's restart policy
+type RestartPolicy struct {
+	Name              string `json:"name"` // no, always, unless-stopped or on-failure
+	MaximumRetryCount int    `json:"maximumRetryCount,omitempty"` // only for on-failure
+}
+
+// Ulimit sets a resource limit such as nofile inside the container
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard *int64 `json:"hard,omitempty"` // defaults to Soft
+}
+
+// CreateContainerResponse is returned after a container has been created
+type CreateContainerResponse struct {
+	ID       string   `json:"id"`
+	Warnings []string `json:"warnings,omitempty"`
+	Started  bool     `json:"started"`
+}
+
+// DeviceRequest asks the daemon for devices such as GPUs.
+// Leaving both Count and DeviceIDs empty requests all devices.
+type DeviceRequest struct {
+	Driver       string            `json:"driver,omitempty"`       // defaults to "nvidia"
+	Count        int               `json:"count,omitempty"`        // -1 requests all devices
+	DeviceIDs    []string          `json:"deviceIds,omitempty"`    // specific device IDs or UUIDs
+	Capabilities [][]string        `json:"capabilities,omitempty"` // defaults to [["gpu"]]
+	Options      map[string]string `json:"options,omitempty"`
+}
+
+// DeviceMapping maps a host device into the container (like --device)
+type DeviceMapping struct {
+	PathOnHost        string `json:"pathOnHost"`
+	PathInContainer   string `json:"pathInContainer,omitempty"`   // defaults to PathOnHost
+	CgroupPermissions string `json:"cgroupPermissions,omitempty"` // defaults to "rwm"
 }
 
 // PortMapping represents container port mappings
@@ -42,10 +136,23 @@ type NetworkInfo struct {
 // MountInfo represents container mount information
 type MountInfo struct {
 	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
 	Mode        string `json:"mode"`
 	RW          bool   `json:"rw"`
+	Size        *int64 `json:"size,omitempty"`        // on-disk size in bytes, only set when requested
+	SizePartial bool   `json:"sizePartial,omitempty"` // Size is a lower bound: measuring stopped early
+}
+
+// RemovePreview describes what removing a container would affect
+type RemovePreview struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Volumes   []string  `json:"volumes"` // anonymous volumes deleted when removing with volumes=true
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
 }
 
 // ContainerStats represents container resource usage statistics
@@ -88,10 +195,20 @@ type ContainerLogs struct {
 // LogEntry represents a single container log entry
 type LogEntry struct {
 	Timestamp time.Time `json:"timestamp"`
-	Stream    string    `json:"stream"` // "stdout" or "stderr"
+	Stream    string    `json:"stream"`          // "stdout" or "stderr"
+	Level     string    `json:"level,omitempty"` // debug, info, warn, error or fatal, when detected
 	Message   string    `json:"message"`
 }
 
+// LogSearchResult holds the newest log lines matching a search
+type LogSearchResult struct {
+	Container string     `json:"container"`
+	Entries   []LogEntry `json:"entries"` // oldest first
+	Scanned   int        `json:"scanned"` // lines read from the daemon
+	Matched   int        `json:"matched"`
+	Truncated bool       `json:"truncated"` // older matches were dropped to stay within the limit
+}
+
 // Container operation errors
 type ContainerError struct {
 	ID      string `json:"id"`
@@ -109,4 +226,209 @@ var (
 	ErrContainerAlreadyRunning = &ContainerError{Op: "start", Message: "container already running"}
 	ErrContainerNotRunning = &ContainerError{Op: "stop", Message: "container not running"}
 	ErrContainerAccessDenied = &ContainerError{Op: "access", Message: "access denied"}
-) 
\ No newline at end of file
+) 
+// LogConfig describes a container's logging driver and whether its logs are
+// bounded and readable through the logs endpoints
+type LogConfig struct {
+	Driver   string            `json:"driver"`
+	Options  map[string]string `json:"options"`
+	MaxSize  string            `json:"maxSize,omitempty"`
+	MaxFile  string            `json:"maxFile,omitempty"`
+	Bounded  bool              `json:"bounded"`  // log files are rotated with a size cap
+	Readable bool              `json:"readable"` // logs can be read via the logs endpoints
+	Message  string            `json:"message,omitempty"`
+	Hint     string            `json:"hint,omitempty"` // host command for reading logs kept outside the daemon
+}
+
+// CrashLoopInfo describes a container that keeps restarting
+type CrashLoopInfo struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Image           string    `json:"image"`
+	RestartCount    int       `json:"restartCount"`
+	RestartsPerHour float64   `json:"restartsPerHour"` // average since the container was created
+	Restarting      bool      `json:"restarting"`
+	LastExitCode    int       `json:"lastExitCode"`
+	OOMKilled       bool      `json:"oomKilled"`
+	Error           string    `json:"error,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	LogTail         []string  `json:"logTail"`
+}
+
+// CommandDefaults is the entrypoint, command and working directory an image
+// declares
+type CommandDefaults struct {
+	Entrypoint []string `json:"entrypoint"`
+	Cmd        []string `json:"cmd"`
+	WorkingDir string   `json:"workingDir"`
+}
+
+// ContainerCommand describes what a container actually executes and which
+// parts were overridden when the container was created
+type ContainerCommand struct {
+	Entrypoint           []string         `json:"entrypoint"`
+	Cmd                  []string         `json:"cmd"`
+	WorkingDir           string           `json:"workingDir"`
+	EntrypointOverridden bool             `json:"entrypointOverridden"`
+	CmdOverridden        bool             `json:"cmdOverridden"`
+	WorkingDirOverridden bool             `json:"workingDirOverridden"`
+	ImageDefaults        *CommandDefaults `json:"imageDefaults,omitempty"` // nil if the image is no longer present
+	Display              string           `json:"display"`                 // entrypoint and cmd joined as a shell command line
+}
+
+// ContainerHealth is a container's health check, its state and the results
+// of its most recent probes
+type ContainerHealth struct {
+	Status        string        `json:"status"` // healthy, unhealthy, starting or none
+	FailingStreak int           `json:"failingStreak"`
+	Check         *HealthCheck  `json:"check,omitempty"` // nil without a health check
+	Log           []HealthProbe `json:"log"`             // oldest first; Docker keeps the last five
+}
+
+// HealthCheck is a container's HEALTHCHECK configuration. Durations are Go
+// duration strings, empty when the daemon default applies.
+type HealthCheck struct {
+	Test          []string `json:"test"`
+	Interval      string   `json:"interval,omitempty"`
+	Timeout       string   `json:"timeout,omitempty"`
+	StartPeriod   string   `json:"startPeriod,omitempty"`
+	StartInterval string   `json:"startInterval,omitempty"`
+	Retries       int      `json:"retries,omitempty"`
+}
+
+// HealthProbe is the result of one health check run
+type HealthProbe struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"` // 0 healthy, 1 unhealthy, anything else failed to run
+	Output   string    `json:"output"`
+}
+
+// ConfigDrift compares a container's runtime config with what its image and
+// compose file declare
+type ConfigDrift struct {
+	ID             string             `json:"id"`
+	Name           string             `json:"name"`
+	Image          string             `json:"image"`
+	ComposeProject string             `json:"composeProject,omitempty"`
+	ComposeService string             `json:"composeService,omitempty"`
+	ComposeChecked bool               `json:"composeChecked"`
+	ComposeMessage string             `json:"composeMessage,omitempty"` // why the compose file could not be compared
+	Drifted        bool               `json:"drifted"`
+	Differences    []ConfigDifference `json:"differences"`
+}
+
+// ConfigDifference is a single field whose runtime value differs from the
+// declared one. An empty Expected means the value was not declared; an empty
+// Actual means it is missing at runtime.
+type ConfigDifference struct {
+	Source   string `json:"source"` // image or compose
+	Field    string `json:"field"`  // e.g. env.PATH, ports, mounts, command
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// ContainerSize is the disk usage of a container's filesystem
+type ContainerSize struct {
+	ID          string    `json:"id"`
+	SizeRw      int64     `json:"sizeRw"`     // bytes in the writable layer
+	SizeRootFs  int64     `json:"sizeRootFs"` // writable layer plus image layers
+	GeneratedAt time.Time `json:"generatedAt"`
+	Cached      bool      `json:"cached"` // served from the short-lived cache
+}
+
+// RestartResponse is returned by a restart that also checked for a newer image
+type RestartResponse struct {
+	Restarted  bool              `json:"restarted"`
+	ImageCheck *ImageUpdateCheck `json:"imageCheck,omitempty"`
+}
+
+// ResourcePreset is a named template of resource limits for new containers
+type ResourcePreset struct {
+	Name   string  `json:"name"`
+	CPUs   float64 `json:"cpus"`   // zero means unlimited
+	Memory int64   `json:"memory"` // bytes, zero means unlimited
+}
+
+// EnvVar is a single environment variable of a container
+type EnvVar struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Redacted bool   `json:"redacted"` // the value matched a secret pattern and was hidden
+}
+
+// StopAndRemoveResult reports what a combined stop and remove did
+type StopAndRemoveResult struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Stopped        bool   `json:"stopped"`             // false if it wasn't running
+	StopError      string `json:"stopError,omitempty"` // set when the stop failed and force removed it anyway
+	Removed        bool   `json:"removed"`
+	VolumesRemoved bool   `json:"volumesRemoved"` // anonymous volumes were removed too
+}
+
+// ContainerPruneResult reports what a container prune removed
+type ContainerPruneResult struct {
+	ContainersDeleted []string `json:"containersDeleted"`
+	SpaceReclaimed    uint64   `json:"spaceReclaimed"` // bytes
+}
+
+// UpdateContainerRequest changes limits of an existing container. Omitted
+// fields are left as they are.
+type UpdateContainerRequest struct {
+	Preset        string         `json:"preset,omitempty"`     // named resource preset
+	CPUs          float64        `json:"cpus,omitempty"`       // overrides the preset's CPUs
+	Memory        int64          `json:"memory,omitempty"`     // bytes, overrides the preset's memory
+	MemorySwap    int64          `json:"memorySwap,omitempty"` // bytes of memory plus swap, -1 for unlimited swap
+	RestartPolicy *RestartPolicy `json:"restartPolicy,omitempty"`
+}
+
+// UpdateContainerResponse is returned after a container has been updated
+type UpdateContainerResponse struct {
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// RecreateResult reports what recreating a container with a fresh pull of
+// its image did
+type RecreateResult struct {
+	OldID           string   `json:"oldId"`
+	ID              string   `json:"id"` // the replacement, or OldID if nothing was recreated
+	Name            string   `json:"name"`
+	Image           string   `json:"image"`
+	PreviousImageID string   `json:"previousImageId"`
+	ImageID         string   `json:"imageId"`
+	Recreated       bool     `json:"recreated"` // false when the image was already up to date
+	Started         bool     `json:"started"`
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+// ContainerBatchRequest applies one action to several containers
+type ContainerBatchRequest struct {
+	Action      string            `json:"action"` // start, stop, restart or remove
+	IDs         []string          `json:"ids"`
+	Force       bool              `json:"force,omitempty"`       // remove running containers
+	Volumes     bool              `json:"volumes,omitempty"`     // remove anonymous volumes too
+	Tokens      map[string]string `json:"tokens,omitempty"`      // id to remove-preview token, when removal needs confirming
+	Concurrency int               `json:"concurrency,omitempty"` // containers handled at once
+}
+
+// ContainerBatchResult reports a batch action per container, in the order
+// the ids were given
+type ContainerBatchResult struct {
+	Action     string                     `json:"action"`
+	Success    bool                       `json:"success"`
+	Succeeded  int                        `json:"succeeded"`
+	Failed     int                        `json:"failed"`
+	Containers []ContainerBatchItemResult `json:"containers"`
+}
+
+// ContainerBatchItemResult is the outcome of a batch action on one container.
+// Status is the HTTP status the single-container endpoint would have used.
+type ContainerBatchItemResult struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Success bool   `json:"success"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
@@ -0,0 +1,32 @@
+package types
+
+import "time"
+
+// Event is a Docker event as broadcast to WebSocket clients. Seq increases by
+// one for every event the hub sees, so clients can tell which events they
+// already have.
+type Event struct {
+	Epoch   string    `json:"epoch"` // names the server process the sequence numbers belong to
+	Seq     uint64    `json:"seq"`
+	Type    string    `json:"type"` // container, image, network, volume or system
+	Action  string    `json:"action"`
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Project string    `json:"project,omitempty"` // compose project of the container, if any
+	Time    time.Time `json:"time"`
+	Replay  bool      `json:"replay,omitempty"` // sent from the replay buffer on connect
+}
+
+// ReplayEnd separates replayed events from the live stream. If Truncated is
+// set, events after the requested sequence were dropped from the buffer and
+// the client should refetch its state instead of relying on the replay.
+// Reset is set when the client's epoch is from an earlier server process,
+// whose sequence numbers don't apply: the whole buffer is replayed instead.
+type ReplayEnd struct {
+	Type      string `json:"type"` // always "replay_end"
+	Epoch     string `json:"epoch"`
+	Reset     bool   `json:"reset,omitempty"`
+	Replayed  int    `json:"replayed"`
+	Seq       uint64 `json:"seq"` // sequence number of the last event sent
+	Truncated bool   `json:"truncated"`
+}
@@ -0,0 +1,30 @@
+package types
+
+import "time"
+
+// ContainerFile is an entry of a container's filesystem
+type ContainerFile struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"` // file, dir, symlink or other
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"` // as ls -l shows it, e.g. drwxr-xr-x
+	ModTime    time.Time `json:"modTime"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
+// ContainerFileList is the content of a directory in a container
+type ContainerFileList struct {
+	Path    string          `json:"path"`
+	Entries []ContainerFile `json:"entries"`
+
+	// Truncated is set when the directory held too many entries to list,
+	// or its entries came after too much content to read through
+	Truncated bool `json:"truncated"`
+}
+
+// ContainerChange is a path a container has changed relative to its image
+type ContainerChange struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // added, modified or deleted
+}
@@ -30,6 +30,16 @@ type ImageInfo struct {
 
 	// Labels are the metadata labels associated with the image
 	Labels map[string]string `json:"labels,omitempty"`
+
+	// Dangling is set for images without a tag
+	Dangling bool `json:"dangling"`
+
+	// InUse is set when any container, running or not, uses the image.
+	// Images neither in use nor dangling are still safe to delete.
+	InUse bool `json:"in_use"`
+
+	// Containers counts the containers using the image
+	Containers int `json:"containers"`
 }
 
 // ImageHistory represents a layer in the image history
@@ -53,7 +63,8 @@ type ImageHistory struct {
 	Tags []string `json:"tags,omitempty"`
 }
 
-// PullProgress represents the progress of an image pull operation
+// PullProgress represents the progress of an image pull operation. Streamed
+// pulls end with a message whose status is "done" or "error".
 type PullProgress struct {
 	// Status is the current status message
 	Status string `json:"status"`
@@ -72,6 +83,30 @@ type PullProgress struct {
 
 	// Error is set if an error occurred
 	Error string `json:"error,omitempty"`
+
+	// Attempt is the pull attempt the message belongs to, starting at 1
+	Attempt int `json:"attempt,omitempty"`
+
+	// LayersDone and LayersTotal count the layers seen so far, including
+	// layers completed by earlier attempts
+	LayersDone  int `json:"layersDone"`
+	LayersTotal int `json:"layersTotal"`
+
+	// BytesDone and BytesTotal sum the download progress of all layers seen
+	// so far; completed layers count in full across retries
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`
+
+	// IdleSeconds is set on keep-alive messages, sent while the daemon
+	// reports no progress, to how long it has been silent
+	IdleSeconds int `json:"idleSeconds,omitempty"`
+}
+
+// PullRequest names the image to pull
+type PullRequest struct {
+	Image    string `json:"image"`
+	Tag      string `json:"tag"`
+	Registry string `json:"registry"` // overrides KIBUTSU_REGISTRY_MIRROR for this pull
 }
 
 // ImageError represents an error that occurred during image operations
@@ -95,3 +130,172 @@ var (
 		Message: "failed to pull image",
 	}
 )
+
+// BuildOptions are the options accepted by the image build endpoint
+type BuildOptions struct {
+	// Tags to apply to the built image
+	Tags []string `json:"tags,omitempty"`
+
+	// Dockerfile is the path of the Dockerfile within the build context
+	Dockerfile string `json:"dockerfile,omitempty"`
+
+	// Target is the stage to build in a multi-stage Dockerfile
+	Target string `json:"target,omitempty"`
+
+	// BuildArgs are passed to the build as --build-arg values
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+
+	// Secrets maps secret IDs to their values for RUN --mount=type=secret.
+	// Requesting secrets routes the build through BuildKit.
+	Secrets map[string]string `json:"secrets,omitempty"`
+
+	// NoCache disables the build cache
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// Pull always attempts to pull newer base images
+	Pull bool `json:"pull,omitempty"`
+
+	// Remote is a Git repository or tarball URL the daemon fetches the
+	// build context from, instead of an uploaded one
+	Remote string `json:"remote,omitempty"`
+
+	// DockerfileContent is a Dockerfile to build from. Without a context
+	// it is built on its own; with Remote it replaces the repository's
+	// Dockerfile, which needs BuildKit.
+	DockerfileContent string `json:"dockerfile_content,omitempty"`
+}
+
+// BuildProgress is a single line of build output
+type BuildProgress struct {
+	// Stream is build log output
+	Stream string `json:"stream,omitempty"`
+
+	// Status is a status message, e.g. while pulling base images
+	Status string `json:"status,omitempty"`
+
+	// ID is the layer or step ID the status refers to
+	ID string `json:"id,omitempty"`
+
+	// Error is set if the build failed
+	Error string `json:"error,omitempty"`
+}
+
+// ImageUpdateCheck compares a local image with the registry's current
+// manifest for the same tag
+type ImageUpdateCheck struct {
+	// Image is the reference the container was created from
+	Image string `json:"image"`
+
+	// Checked is true when both digests were available and compared
+	Checked bool `json:"checked"`
+
+	// UpdateAvailable is true when the registry has a different manifest
+	UpdateAvailable bool `json:"updateAvailable"`
+
+	// LocalDigests are the registry digests recorded for the local image
+	LocalDigests []string `json:"localDigests"`
+
+	// RemoteDigest is the registry's current manifest digest for the tag
+	RemoteDigest string `json:"remoteDigest,omitempty"`
+
+	// Warning explains why the check was skipped or incomplete
+	Warning string `json:"warning,omitempty"`
+}
+
+// RegistryCredential is a login for a container registry
+type RegistryCredential struct {
+	// Registry is the registry host, such as ghcr.io; docker.io for Docker Hub
+	Registry string `json:"registry" yaml:"registry"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password,omitempty" yaml:"password"` // a password or access token
+}
+
+// ImageTagRequest names the tag to add to an image
+type ImageTagRequest struct {
+	Repo string `json:"repo"`          // repository, such as registry.example.com/team/app
+	Tag  string `json:"tag,omitempty"` // defaults to latest
+}
+
+// ImageBatchDeleteRequest removes several images, given as ids or references
+type ImageBatchDeleteRequest struct {
+	Images        []string `json:"images"`
+	Force         bool     `json:"force,omitempty"`          // remove images used by stopped containers, and all tags of an id
+	PruneChildren bool     `json:"prune_children,omitempty"` // remove untagged parents too
+}
+
+// ImageBatchDeleteResult reports a batch delete per image, in the order the
+// images were given
+type ImageBatchDeleteResult struct {
+	Success bool                `json:"success"`
+	Removed int                 `json:"removed"`
+	Failed  int                 `json:"failed"`
+	Images  []ImageDeleteResult `json:"images"`
+}
+
+// ImageDeleteResult is the outcome of deleting one image. Status is 409 when
+// the image is in use or, without force, has several tags.
+type ImageDeleteResult struct {
+	Image    string   `json:"image"`
+	Success  bool     `json:"success"`
+	Status   int      `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Untagged []string `json:"untagged,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"` // image and layer ids
+}
+
+// ContainerCommitRequest snapshots a container into a new image
+type ContainerCommitRequest struct {
+	Repo    string `json:"repo,omitempty"` // leave empty for an untagged image
+	Tag     string `json:"tag,omitempty"`  // defaults to latest
+	Comment string `json:"comment,omitempty"`
+	Author  string `json:"author,omitempty"`
+
+	// Pause pauses the container while it is committed, as docker commit
+	// does by default. Unset means true.
+	Pause *bool `json:"pause,omitempty"`
+}
+
+// ContainerCommitResponse identifies the image a commit created
+type ContainerCommitResponse struct {
+	ID        string `json:"id"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// PushRequest optionally overrides the stored credentials for a push
+type PushRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// PushProgress is a single line of image push progress. Streamed pushes end
+// with a message whose status is "done", carrying the pushed digest, or
+// "error".
+type PushProgress struct {
+	Status         string `json:"status"`
+	ID             string `json:"id,omitempty"` // the layer being pushed
+	Progress       string `json:"progress,omitempty"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Digest string `json:"digest,omitempty"` // set once the registry accepted the manifest
+	Error  string `json:"error,omitempty"`
+}
+
+// ImageLoadProgress is a line of an image import's NDJSON output
+type ImageLoadProgress struct {
+	// Status is "uploading" while the tarball is received, the daemon's
+	// message (such as "Loading layer") while it unpacks, "loaded" for each
+	// image, then "done" or "error"
+	Status         string `json:"status"`
+	ID             string `json:"id,omitempty"` // the layer being loaded
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	BytesDone  int64    `json:"bytesDone"`            // bytes of the upload received so far
+	BytesTotal int64    `json:"bytesTotal,omitempty"` // size of the upload, when the client sent it
+	Image      string   `json:"image,omitempty"`      // the image loaded, a tag or an ID
+	Images     []string `json:"images,omitempty"`     // every image loaded, once done
+	Error      string   `json:"error,omitempty"`
+}
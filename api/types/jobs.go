@@ -0,0 +1,89 @@
+package types
+
+import "time"
+
+// Job is an action run on a cron schedule
+type Job struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"` // five-field cron expression, @daily and the like, or @every 1h; empty for jobs only run on demand or by webhook
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Action is prune-images, prune-containers, restart-container,
+	// recreate-container, compose-update, backup-volume or backup-compose
+	Action string `json:"action"`
+
+	// Target is the container of the container actions, the project of
+	// compose-update and backup-compose, and the volume of backup-volume
+	Target string `json:"target,omitempty"`
+
+	// All makes prune-images remove every unused image, not just dangling
+	// ones
+	All bool `json:"all,omitempty"`
+
+	// Keep is how many backups of its target a backup job keeps, removing
+	// the oldest after each run. Zero keeps them all.
+	Keep int `json:"keep,omitempty"`
+
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Running bool       `json:"running"`
+	NextRun *time.Time `json:"nextRun,omitempty"` // unset while disabled
+	LastRun *JobRun    `json:"lastRun,omitempty"`
+
+	// Webhook is set when the job can be triggered by a webhook
+	Webhook *JobWebhook `json:"webhook,omitempty"`
+
+	// LastError is the error of the most recent failed run, kept until a
+	// run succeeds
+	LastError string `json:"lastError,omitempty"`
+}
+
+// JobRun is one run of a job
+type JobRun struct {
+	Started    time.Time `json:"started"`
+	DurationMS int64     `json:"durationMs"`
+	Trigger    string    `json:"trigger"` // schedule, manual or webhook
+	User       string    `json:"user,omitempty"`
+	Success    bool      `json:"success"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// JobRequest creates or replaces a job
+type JobRequest struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Endpoint string `json:"endpoint"`
+	Action   string `json:"action"`
+	Target   string `json:"target"`
+	All      bool   `json:"all"`
+	Keep     int    `json:"keep"`
+	Enabled  *bool  `json:"enabled"` // defaults to true
+}
+
+// JobWebhook describes the webhook that triggers a job. The token it is
+// reached by is only returned when it is created.
+type JobWebhook struct {
+	Signed        bool       `json:"signed"` // deliveries must carry an HMAC-SHA256 signature
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastTriggered *time.Time `json:"lastTriggered,omitempty"`
+}
+
+// JobWebhookRequest creates or replaces a job's webhook. Setting a secret,
+// or signed to have one generated, makes deliveries need a signature.
+type JobWebhookRequest struct {
+	Signed bool   `json:"signed"`
+	Secret string `json:"secret"`
+}
+
+// JobWebhookCreated is a new webhook with its token and secret, which
+// aren't shown again
+type JobWebhookCreated struct {
+	JobWebhook
+	Token  string `json:"token"`
+	Path   string `json:"path"` // {base path}/api/webhooks/{token}, the path to deliver to
+	Secret string `json:"secret,omitempty"`
+}
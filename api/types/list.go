@@ -0,0 +1,19 @@
+package types
+
+import "time"
+
+// ListResponse is the envelope returned by list endpoints. Total counts the
+// items that matched before limit and offset were applied.
+type ListResponse[T any] struct {
+	Items       []T       `json:"items"`
+	Total       int       `json:"total"`
+	Limit       int       `json:"limit"` // 0 means no limit
+	Offset      int       `json:"offset"`
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// ProjectContainers is a compose project and the containers that belong to it
+type ProjectContainers struct {
+	Name       string              `json:"name"`
+	Containers []ContainerResponse `json:"containers"`
+}
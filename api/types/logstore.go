@@ -0,0 +1,29 @@
+package types
+
+import "time"
+
+// StoredContainer is a container whose logs are collected, or were until
+// it was removed
+type StoredContainer struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Image     string     `json:"image"`
+	Project   string     `json:"project,omitempty"` // compose project
+	Service   string     `json:"service,omitempty"` // compose service
+	FirstLog  *time.Time `json:"firstLog,omitempty"`
+	LastLog   *time.Time `json:"lastLog,omitempty"`
+	Size      int64      `json:"size"` // bytes on disk
+	RemovedAt *time.Time `json:"removedAt,omitempty"`
+
+	// Collecting is set while the container's logs are being read
+	Collecting bool `json:"collecting"`
+}
+
+// StoredLogs describes the log collector and the containers it has logs of
+type StoredLogs struct {
+	Enabled    bool              `json:"enabled"`
+	Collect    []string          `json:"collect"`             // container name globs
+	Retention  string            `json:"retention,omitempty"` // empty keeps logs until the size cap
+	MaxSize    int               `json:"maxSize"`             // megabytes per container, 0 for unlimited
+	Containers []StoredContainer `json:"containers"`
+}
@@ -0,0 +1,109 @@
+package types
+
+import "time"
+
+// NetworkDetails represents a Docker network
+type NetworkDetails struct {
+	// ID is the unique identifier of the network
+	ID string `json:"id"`
+
+	// Name is the name of the network
+	Name string `json:"name"`
+
+	// Driver is the network driver, e.g. bridge, overlay or macvlan
+	Driver string `json:"driver"`
+
+	// Scope is "local", "global" or "swarm"
+	Scope string `json:"scope"`
+
+	// Created is the timestamp when the network was created
+	Created time.Time `json:"created"`
+
+	// Internal networks have no route to the outside world
+	Internal bool `json:"internal"`
+
+	// Attachable networks accept standalone containers in swarm mode
+	Attachable bool `json:"attachable"`
+
+	// EnableIPv6 is true when the network has IPv6 addressing
+	EnableIPv6 bool `json:"enable_ipv6"`
+
+	// Predefined networks are created by the daemon and can't be removed
+	Predefined bool `json:"predefined"`
+
+	// Subnets are the network's IPAM address pools
+	Subnets []NetworkSubnet `json:"subnets"`
+
+	// Labels are the metadata labels associated with the network
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Options are the driver options the network was created with
+	Options map[string]string `json:"options,omitempty"`
+
+	// Containers are the attached containers; only filled when inspecting
+	Containers []NetworkEndpoint `json:"containers,omitempty"`
+}
+
+// NetworkSubnet is one IPAM address pool of a network
+type NetworkSubnet struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway,omitempty"`
+	IPRange string `json:"ip_range,omitempty"`
+}
+
+// NetworkEndpoint is a container attached to a network
+type NetworkEndpoint struct {
+	ContainerID string `json:"container_id"`
+	Name        string `json:"name"`
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	IPv6Address string `json:"ipv6_address,omitempty"`
+	MacAddress  string `json:"mac_address,omitempty"`
+}
+
+// NetworkCreateRequest is the body accepted when creating a network
+type NetworkCreateRequest struct {
+	// Name of the network, required
+	Name string `json:"name"`
+
+	// Driver defaults to "bridge"
+	Driver string `json:"driver,omitempty"`
+
+	// Internal blocks external access from the network
+	Internal bool `json:"internal,omitempty"`
+
+	// Attachable lets standalone containers join a swarm network
+	Attachable bool `json:"attachable,omitempty"`
+
+	// EnableIPv6 enables IPv6 addressing
+	EnableIPv6 bool `json:"enable_ipv6,omitempty"`
+
+	// Subnets set the address pools; the daemon picks one when empty
+	Subnets []NetworkSubnet `json:"subnets,omitempty"`
+
+	// Options are passed to the driver
+	Options map[string]string `json:"options,omitempty"`
+
+	// Labels to set on the network
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NetworkConnectRequest attaches a container to a network
+type NetworkConnectRequest struct {
+	// Container is the ID or name of the container
+	Container string `json:"container"`
+
+	// Aliases are extra DNS names for the container on this network
+	Aliases []string `json:"aliases,omitempty"`
+
+	// IPv4Address requests a static address from one of the subnets
+	IPv4Address string `json:"ipv4_address,omitempty"`
+}
+
+// NetworkDisconnectRequest detaches a container from a network
+type NetworkDisconnectRequest struct {
+	// Container is the ID or name of the container
+	Container string `json:"container"`
+
+	// Force disconnects even if the container is not running
+	Force bool `json:"force,omitempty"`
+}
@@ -0,0 +1,54 @@
+package types
+
+import "time"
+
+// Notification is a message sent to the notification channels
+type Notification struct {
+	Event       string    `json:"event"` // container-exited, health-failing, image-update, job-failed or test
+	Endpoint    string    `json:"endpoint"`
+	Title       string    `json:"title"`
+	Message     string    `json:"message"`
+	Container   string    `json:"container,omitempty"` // container name
+	ContainerID string    `json:"containerId,omitempty"`
+	Project     string    `json:"project,omitempty"` // compose project of the container
+	Job         string    `json:"job,omitempty"`     // job ID
+	Time        time.Time `json:"time"`
+}
+
+// NotificationChannel describes a configured channel, without its URL or
+// credentials
+type NotificationChannel struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // slack, discord, email or webhook
+}
+
+// NotificationRoute sends matching events to channels. Empty lists match
+// anything.
+type NotificationRoute struct {
+	Events     []string `json:"events"`
+	Channels   []string `json:"channels"`
+	Endpoints  []string `json:"endpoints"`
+	Containers []string `json:"containers"`
+}
+
+// NotificationSettings are the configured channels and routes
+type NotificationSettings struct {
+	Enabled  bool                  `json:"enabled"`
+	Events   []string              `json:"events"` // the events routes can name
+	Channels []NotificationChannel `json:"channels"`
+	Routes   []NotificationRoute   `json:"routes"`
+}
+
+// NotificationTestRequest picks the channel a test notification goes to;
+// empty sends it to every channel
+type NotificationTestRequest struct {
+	Channel string `json:"channel"`
+}
+
+// NotificationResult is the outcome of sending to one channel
+type NotificationResult struct {
+	Channel string `json:"channel"`
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
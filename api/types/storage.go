@@ -0,0 +1,18 @@
+package types
+
+import "time"
+
+// StorageObject is an object in the object storage bucket. Keys are
+// relative to the configured prefix.
+type StorageObject struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// StoredLogsImport reports logs put back into the log store from an
+// archive
+type StoredLogsImport struct {
+	Container StoredContainer `json:"container"`
+	Entries   int             `json:"entries"`
+}
@@ -0,0 +1,177 @@
+package types
+
+import "time"
+
+// SwarmInfo describes the Swarm an endpoint's daemon belongs to, if any
+type SwarmInfo struct {
+	// State is the node's Swarm state: inactive, pending, active, error or
+	// locked
+	State string `json:"state"`
+
+	// Manager is true when the node is a manager, so the Swarm can be
+	// inspected and changed through it
+	Manager bool `json:"manager"`
+
+	NodeID    string `json:"nodeId,omitempty"`
+	NodeAddr  string `json:"nodeAddr,omitempty"`
+	ClusterID string `json:"clusterId,omitempty"`
+	Nodes     int    `json:"nodes,omitempty"`
+	Managers  int    `json:"managers,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SwarmService is a Swarm service with its task counts
+type SwarmService struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+
+	// Mode is replicated, global, replicated-job or global-job
+	Mode string `json:"mode"`
+
+	// Replicas is the requested number of tasks of a replicated service
+	Replicas *uint64 `json:"replicas,omitempty"`
+
+	// Running and Desired count the service's running tasks and the tasks
+	// the orchestrator wants
+	Running uint64 `json:"running"`
+	Desired uint64 `json:"desired"`
+
+	Ports   []SwarmPort       `json:"ports,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+
+	// UpdateState is the state of the service's latest rolling update, such
+	// as updating, completed, paused or rollback_completed
+	UpdateState   string `json:"updateState,omitempty"`
+	UpdateMessage string `json:"updateMessage,omitempty"`
+}
+
+// SwarmPort is a port a service publishes
+type SwarmPort struct {
+	Protocol      string `json:"protocol"`
+	TargetPort    uint32 `json:"targetPort"`
+	PublishedPort uint32 `json:"publishedPort,omitempty"`
+	PublishMode   string `json:"publishMode,omitempty"` // ingress or host
+}
+
+// SwarmServiceScaleRequest sets a replicated service's replicas
+type SwarmServiceScaleRequest struct {
+	Replicas *uint64 `json:"replicas"`
+}
+
+// SwarmServiceUpdateRequest changes a service. Unset fields are left alone.
+type SwarmServiceUpdateRequest struct {
+	// Image replaces the image the tasks run
+	Image string `json:"image,omitempty"`
+
+	// Env replaces the tasks' environment, as KEY=value entries
+	Env *[]string `json:"env,omitempty"`
+
+	// Labels replaces the service's labels
+	Labels *map[string]string `json:"labels,omitempty"`
+
+	// Force redeploys every task even if nothing changed
+	Force bool `json:"force,omitempty"`
+
+	// Rollback reverts the service to its previous definition; it can't
+	// be combined with other changes
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+// SwarmServiceUpdateResult reports an accepted service update, which the
+// orchestrator rolls out task by task
+type SwarmServiceUpdateResult struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// SwarmNode is a node of the Swarm
+type SwarmNode struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+
+	// Role is manager or worker
+	Role string `json:"role"`
+
+	// Availability is active, pause or drain
+	Availability string `json:"availability"`
+
+	// State is unknown, down, ready or disconnected
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+
+	// Leader is the manager leading the Raft consensus
+	Leader bool `json:"leader,omitempty"`
+
+	// Reachability of a manager: unknown, unreachable or reachable
+	Reachability string `json:"reachability,omitempty"`
+
+	EngineVersion string            `json:"engineVersion,omitempty"`
+	OS            string            `json:"os,omitempty"`
+	Architecture  string            `json:"architecture,omitempty"`
+	NanoCPUs      int64             `json:"nanoCpus,omitempty"`
+	MemoryBytes   int64             `json:"memoryBytes,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// SwarmTask is one scheduled instance of a service
+type SwarmTask struct {
+	ID          string `json:"id"`
+	ServiceID   string `json:"serviceId"`
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// Slot numbers the tasks of a replicated service; global services' tasks
+	// are told apart by node instead
+	Slot     int    `json:"slot,omitempty"`
+	NodeID   string `json:"nodeId,omitempty"`
+	NodeName string `json:"nodeName,omitempty"`
+	Image    string `json:"image"`
+
+	// DesiredState is the state the orchestrator is driving the task to;
+	// State is where it is, such as pending, running, failed or shutdown
+	DesiredState string    `json:"desiredState"`
+	State        string    `json:"state"`
+	Message      string    `json:"message,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ExitCode     *int      `json:"exitCode,omitempty"`
+	ContainerID  string    `json:"containerId,omitempty"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+}
+
+// SwarmSecret is a Swarm secret's metadata; its value can't be read back
+type SwarmSecret struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Driver  string            `json:"driver,omitempty"` // external secret store, if any
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+
+	// Services are the names of the services using the secret
+	Services []string `json:"services"`
+}
+
+// SwarmConfig is a Swarm config's metadata
+type SwarmConfig struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Size    int               `json:"size"` // bytes of content
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+
+	// Services are the names of the services using the config
+	Services []string `json:"services"`
+}
+
+// SwarmDataRequest creates a secret or config from Data, given as text
+type SwarmDataRequest struct {
+	Name   string            `json:"name"`
+	Data   string            `json:"data"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // SystemInfo represents information about the Docker system
 type SystemInfo struct {
 	// ID is the unique identifier of the daemon
@@ -87,3 +89,215 @@ type VolumeDiskUsage struct {
 	Mountpoint string `json:"mountpoint"`
 	Size       int64  `json:"size"`
 }
+
+// UsageAudit cross-references networks and volumes against the containers
+// using them, as a read-only report of what a prune would remove
+type UsageAudit struct {
+	// GeneratedAt is when the audit was computed
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// Cached is true when the audit was served from the short-lived cache
+	Cached bool `json:"cached"`
+
+	// Networks lists every user-defined network and its attached containers
+	Networks []NetworkUsage `json:"networks"`
+
+	// Volumes lists every volume and the containers mounting it
+	Volumes []VolumeUsage `json:"volumes"`
+
+	// UnusedNetworks are the networks no container is attached to
+	UnusedNetworks []string `json:"unused_networks"`
+
+	// UnusedVolumes are the volumes no container mounts
+	UnusedVolumes []string `json:"unused_volumes"`
+
+	// ReclaimableBytes is the space freed by pruning the unused volumes
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+// NetworkUsage describes which containers are attached to a network
+type NetworkUsage struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Driver     string   `json:"driver"`
+	Containers []string `json:"containers"`
+	Unused     bool     `json:"unused"`
+}
+
+// VolumeUsage describes which containers mount a volume
+type VolumeUsage struct {
+	Name       string   `json:"name"`
+	Driver     string   `json:"driver"`
+	Size       int64    `json:"size"` // -1 when the daemon can't report it
+	Containers []string `json:"containers"`
+	Unused     bool     `json:"unused"`
+}
+
+// DockerDiagnostics reports which daemon features are available and which
+// kibutsu features are degraded because a dependency is missing
+type DockerDiagnostics struct {
+	// GeneratedAt is when the daemon was probed
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// ServerVersion is the version of the Docker daemon
+	ServerVersion string `json:"server_version"`
+
+	// APIVersion is the highest API version the daemon supports
+	APIVersion string `json:"api_version"`
+
+	// MinAPIVersion is the lowest API version the daemon supports
+	MinAPIVersion string `json:"min_api_version"`
+
+	// ClientAPIVersion is the API version kibutsu negotiated with the daemon
+	ClientAPIVersion string `json:"client_api_version"`
+
+	// BuildKit is true when the daemon's default builder is BuildKit
+	BuildKit bool `json:"buildkit"`
+
+	// Experimental is true when the daemon runs with experimental features
+	Experimental bool `json:"experimental"`
+
+	// SwarmActive is true when the daemon is part of an active swarm
+	SwarmActive bool `json:"swarm_active"`
+
+	// Runtimes lists the configured OCI runtimes
+	Runtimes []string `json:"runtimes"`
+
+	// CDISpecDirs lists the directories the daemon reads CDI device specs from
+	CDISpecDirs []string `json:"cdi_spec_dirs"`
+
+	// DockerCLI is true when the docker CLI is installed on the kibutsu host
+	DockerCLI bool `json:"docker_cli"`
+
+	// Features lists kibutsu features and whether their dependencies are met
+	Features []FeatureStatus `json:"features"`
+
+	// Degraded is true when any feature is unavailable
+	Degraded bool `json:"degraded"`
+}
+
+// FeatureStatus describes whether a kibutsu feature can work on this daemon
+type FeatureStatus struct {
+	// Name identifies the feature
+	Name string `json:"name"`
+
+	// Available is true when every dependency is met
+	Available bool `json:"available"`
+
+	// Endpoints lists the API endpoints that depend on the feature
+	Endpoints []string `json:"endpoints"`
+
+	// Missing lists the unmet dependencies
+	Missing []string `json:"missing,omitempty"`
+}
+
+// SystemUsage is the combined resource usage of all running containers at a
+// point in time, alongside the host's capacity
+type SystemUsage struct {
+	// Time is when the sample was taken
+	Time time.Time `json:"time"`
+
+	// Containers is the number of running containers that were sampled
+	Containers int `json:"containers"`
+
+	// CPUPercent is the summed CPU usage of all containers, where 100 is one
+	// full CPU
+	CPUPercent float64 `json:"cpu_percent"`
+
+	// HostCPUs is the number of CPUs on the host
+	HostCPUs int `json:"host_cpus"`
+
+	// HostCPUPercent is CPUPercent as a share of all host CPUs (0-100)
+	HostCPUPercent float64 `json:"host_cpu_percent"`
+
+	// MemoryUsage is the summed memory usage of all containers in bytes
+	MemoryUsage uint64 `json:"memory_usage"`
+
+	// HostMemory is the total memory of the host in bytes
+	HostMemory int64 `json:"host_memory"`
+
+	// MemoryPercent is MemoryUsage as a share of HostMemory (0-100)
+	MemoryPercent float64 `json:"memory_percent"`
+}
+
+// SystemMetrics is the aggregate dashboard view of an endpoint: the summed
+// usage of all running containers plus host details
+type SystemMetrics struct {
+	SystemUsage
+
+	// NetworkRxBytes and NetworkTxBytes are the bytes received and sent by
+	// all running containers since they started
+	NetworkRxBytes uint64 `json:"network_rx_bytes"`
+	NetworkTxBytes uint64 `json:"network_tx_bytes"`
+
+	// BlockReadBytes and BlockWriteBytes are the bytes read from and written
+	// to block devices by all running containers since they started
+	BlockReadBytes  uint64 `json:"block_read_bytes"`
+	BlockWriteBytes uint64 `json:"block_write_bytes"`
+
+	// PIDs is the number of processes across all running containers
+	PIDs int `json:"pids"`
+
+	Host HostMetrics `json:"host"`
+}
+
+// HostMetrics describes the Docker host
+type HostMetrics struct {
+	Name              string `json:"name"`
+	OperatingSystem   string `json:"operating_system"`
+	KernelVersion     string `json:"kernel_version"`
+	Architecture      string `json:"architecture"`
+	DockerVersion     string `json:"docker_version"`
+	Containers        int    `json:"containers"`
+	ContainersRunning int    `json:"containers_running"`
+	ContainersPaused  int    `json:"containers_paused"`
+	ContainersStopped int    `json:"containers_stopped"`
+	Images            int    `json:"images"`
+}
+
+// PassthroughRequest names a read-only Docker API call to forward
+type PassthroughRequest struct {
+	// Path is the Docker API path without the version prefix, such as
+	// /containers/{id}/json
+	Path string `json:"path"`
+
+	// Query holds the query parameters to send
+	Query map[string]string `json:"query,omitempty"`
+}
+
+// PruneItem is something a system prune removed, or would remove
+type PruneItem struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	// Size is the disk space freed by removing the item alone, or -1 if
+	// unknown
+	Size int64 `json:"size"`
+}
+
+// PruneScopeResult reports one scope of a system prune
+type PruneScopeResult struct {
+	Items []PruneItem `json:"items"`
+
+	// SpaceReclaimed is the disk space freed, or that would be freed, in
+	// bytes
+	SpaceReclaimed uint64 `json:"space_reclaimed"`
+
+	// Error is set if the scope could not be pruned; the other scopes are
+	// still attempted
+	Error string `json:"error,omitempty"`
+}
+
+// SystemPruneResult reports a system prune. Only the requested scopes are
+// set.
+type SystemPruneResult struct {
+	DryRun     bool              `json:"dry_run"`
+	Containers *PruneScopeResult `json:"containers,omitempty"`
+	Images     *PruneScopeResult `json:"images,omitempty"`
+	Volumes    *PruneScopeResult `json:"volumes,omitempty"`
+	Networks   *PruneScopeResult `json:"networks,omitempty"`
+	BuildCache *PruneScopeResult `json:"build_cache,omitempty"`
+
+	// SpaceReclaimed is the total over every scope in bytes
+	SpaceReclaimed uint64 `json:"space_reclaimed"`
+}
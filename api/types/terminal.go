@@ -45,6 +45,38 @@ type ExecConfig struct {
 	Tty bool `json:"tty"`
 }
 
+// ExecRunRequest runs a command to completion in a container
+type ExecRunRequest struct {
+	// Cmd is the command and its arguments
+	Cmd []string `json:"cmd"`
+
+	// Stdin is written to the command's standard input, which is then closed
+	Stdin string `json:"stdin,omitempty"`
+
+	// User, WorkingDir and Env are as for ExecConfig
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Env        []string `json:"env,omitempty"`
+
+	// Timeout is how long to wait for the command, in seconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ExecRunResponse is the result of a command run to completion
+type ExecRunResponse struct {
+	// ExitCode is the command's exit status; non-zero means it failed
+	ExitCode int `json:"exitCode"`
+
+	// Output is stdout and stderr interleaved
+	Output string `json:"output"`
+
+	// Truncated is true if output beyond the size cap was discarded
+	Truncated bool `json:"truncated"`
+
+	// DurationMs is how long the command ran, in milliseconds
+	DurationMs int64 `json:"durationMs"`
+}
+
 // TerminalError represents an error that occurred during terminal operations
 type TerminalError struct {
 	Type    string `json:"type"`
@@ -0,0 +1,37 @@
+package types
+
+import "time"
+
+// ContainerUpdate is the result of checking a running container's image
+// for a newer version
+type ContainerUpdate struct {
+	ContainerID string           `json:"containerId"`
+	Name        string           `json:"name"`
+	ImageID     string           `json:"imageId"`
+	Check       ImageUpdateCheck `json:"check"`
+	CheckedAt   time.Time        `json:"checkedAt"`
+
+	// AutoUpdate is set for containers labelled kibutsu.auto-update=true,
+	// which are recreated when an update is found
+	AutoUpdate bool `json:"autoUpdate"`
+
+	// Recreated is set when the container was recreated with the update,
+	// RecreateError when that failed
+	Recreated     *RecreateResult `json:"recreated,omitempty"`
+	RecreateError string          `json:"recreateError,omitempty"`
+}
+
+// UpdateReport is the state of the background image update checker
+type UpdateReport struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval,omitempty"`
+	Checking bool   `json:"checking"`
+
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	NextCheck *time.Time `json:"nextCheck,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+
+	// Containers are the outdated containers, or every checked container
+	// when all=true is passed
+	Containers []ContainerUpdate `json:"containers"`
+}
@@ -0,0 +1,71 @@
+package types
+
+import "time"
+
+// VolumeInfo represents information about a Docker volume
+type VolumeInfo struct {
+	// Name is the unique name of the volume
+	Name string `json:"name"`
+
+	// Driver is the volume driver, usually "local"
+	Driver string `json:"driver"`
+
+	// Mountpoint is where the volume lives on the host
+	Mountpoint string `json:"mountpoint"`
+
+	// Scope is "local" or "global"
+	Scope string `json:"scope"`
+
+	// Created is the timestamp when the volume was created
+	Created time.Time `json:"created"`
+
+	// Labels are the metadata labels associated with the volume
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Options are the driver options the volume was created with
+	Options map[string]string `json:"options,omitempty"`
+
+	// Size is the size of the volume in bytes, or -1 when the daemon hasn't
+	// computed it
+	Size int64 `json:"size"`
+
+	// RefCount is how many containers use the volume, or -1 when unknown
+	RefCount int64 `json:"ref_count"`
+}
+
+// VolumeCreateRequest is the body accepted when creating a volume
+type VolumeCreateRequest struct {
+	// Name of the volume; the daemon generates one when empty
+	Name string `json:"name,omitempty"`
+
+	// Driver defaults to "local"
+	Driver string `json:"driver,omitempty"`
+
+	// DriverOpts are passed to the driver, e.g. type, device and o for
+	// local NFS or tmpfs volumes
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+
+	// Labels to set on the volume
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// VolumePruneResult reports what a volume prune removed
+type VolumePruneResult struct {
+	// VolumesDeleted are the names of the removed volumes
+	VolumesDeleted []string `json:"volumes_deleted"`
+
+	// SpaceReclaimed is the disk space freed in bytes
+	SpaceReclaimed uint64 `json:"space_reclaimed"`
+}
+
+// VolumeRestoreResult reports a volume restore
+type VolumeRestoreResult struct {
+	// Volume is the name of the volume restored
+	Volume string `json:"volume"`
+
+	// Bytes is the size of the archive read
+	Bytes int64 `json:"bytes"`
+
+	// Replaced is set when the volume was emptied before the restore
+	Replaced bool `json:"replaced"`
+}
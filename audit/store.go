@@ -0,0 +1,125 @@
+// Package audit keeps an append-only record of the state-changing calls
+// made through the API.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxLine bounds a single entry when reading the file back
+const maxLine = 1 << 20
+
+// Store appends entries to a JSON Lines file. Entries are never rewritten or
+// removed, so the file can be shipped or rotated by external tooling.
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewStore opens the audit file at path for appending, creating it readable
+// only by its owner
+func NewStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, file: file}, nil
+}
+
+// Append writes entry as one line
+func (s *Store) Append(entry apitypes.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Filter selects entries. Zero fields match everything.
+type Filter struct {
+	Since    time.Time
+	Until    time.Time
+	User     string
+	Resource string
+	Target   string
+	Action   string
+	Success  *bool
+}
+
+func (f Filter) match(e apitypes.AuditEntry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.User != "" && !strings.EqualFold(e.User, f.User):
+		return false
+	case f.Resource != "" && e.Resource != f.Resource:
+		return false
+	case f.Target != "" && !strings.HasPrefix(e.Target, f.Target):
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Success != nil && e.Success != *f.Success:
+		return false
+	}
+	return true
+}
+
+// Query returns the entries matching filter, newest first. Lines that can't
+// be parsed, such as one cut short by a crash, are skipped.
+func (s *Store) Query(filter Filter) ([]apitypes.AuditEntry, error) {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []apitypes.AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []apitypes.AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		var entry apitypes.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]apitypes.AuditEntry, len(entries))
+	for i, entry := range entries {
+		result[len(entries)-1-i] = entry
+	}
+	return result, nil
+}
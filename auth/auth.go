@@ -0,0 +1,127 @@
+// Package auth logs users in against a UserStore and keeps their sessions.
+// Requests authenticate with the session cookie set at login or with the
+// session token as a bearer token.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"kibutsu/config"
+)
+
+// CookieName is the name of the session cookie
+const CookieName = "kibutsu_session"
+
+// ErrInvalidCredentials is returned for an unknown user or wrong password
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type contextKey struct{}
+
+// Authenticator checks credentials and tracks sessions
+type Authenticator struct {
+	users    UserStore
+	config   *config.Store
+	sessions *sessionStore
+
+	// dummyHash is checked for unknown users so a login takes as long
+	// whether or not the user exists
+	dummyHash string
+}
+
+func NewAuthenticator(users UserStore, cfg *config.Store) (*Authenticator, error) {
+	dummyHash, err := HashPassword("")
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{
+		users:     users,
+		config:    cfg,
+		sessions:  newSessionStore(),
+		dummyHash: dummyHash,
+	}, nil
+}
+
+// Login checks a username and password and starts a session lasting
+// KIBUTSU_SESSION_TTL.
+func (a *Authenticator) Login(username, password string) (Session, error) {
+	user, err := a.users.Lookup(username)
+	if err != nil {
+		return Session{}, err
+	}
+	if user == nil {
+		VerifyPassword(a.dummyHash, password)
+		return Session{}, ErrInvalidCredentials
+	}
+	if !VerifyPassword(user.PasswordHash, password) {
+		return Session{}, ErrInvalidCredentials
+	}
+	return a.sessions.create(user.Username, a.config.Get().SessionTTL)
+}
+
+// Logout ends the session of a request, if it has one
+func (a *Authenticator) Logout(r *http.Request) {
+	if token := requestToken(r); token != "" {
+		a.sessions.delete(token)
+	}
+}
+
+// Authenticate returns the session of a request, from its session cookie
+// or bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (Session, bool) {
+	token := requestToken(r)
+	if token == "" {
+		return Session{}, false
+	}
+	return a.sessions.get(token)
+}
+
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// SetCookie sets the session cookie for s. It is marked Secure when the
+// request came over HTTPS, directly or through a proxy.
+func SetCookie(w http.ResponseWriter, r *http.Request, s Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    s.Token,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ClearCookie removes the session cookie
+func ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// WithUser returns a context carrying the authenticated username
+func WithUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, contextKey{}, username)
+}
+
+// UserFromContext returns the username stored by WithUser, if any
+func UserFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(contextKey{}).(string)
+	return username, ok && username != ""
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Session is a logged-in user's session
+type Session struct {
+	Token     string
+	Username  string
+	ExpiresAt time.Time
+}
+
+// sessionStore keeps sessions in memory, so they end when the server
+// restarts
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *sessionStore) create(username string, ttl time.Duration) (Session, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	session := Session{Token: hex.EncodeToString(buf), Username: username, ExpiresAt: now.Add(ttl)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, existing := range s.sessions {
+		if now.After(existing.ExpiresAt) {
+			delete(s.sessions, token)
+		}
+	}
+	s.sessions[session.Token] = session
+	return session, nil
+}
+
+func (s *sessionStore) get(token string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[token]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, token)
+		return Session{}, false
+	}
+	return session, true
+}
+
+func (s *sessionStore) delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
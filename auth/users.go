@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// User is an account that may log in
+type User struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"passwordHash"` // made by HashPassword
+}
+
+// UserStore looks up accounts by name. Lookup returns nil, without an
+// error, for unknown users.
+type UserStore interface {
+	Lookup(username string) (*User, error)
+}
+
+// FileStore reads users from a YAML file holding a list of username and
+// passwordHash pairs. The file is re-read when its modification time
+// changes, so users can be added or removed without a restart.
+type FileStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]User
+}
+
+// NewFileStore loads the users file at path
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) Lookup(username string) (*User, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// refresh reloads the file if it changed since it was last read
+func (s *FileStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users != nil && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	users, err := loadUsers(s.path)
+	if err != nil {
+		return err
+	}
+	s.users = users
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func loadUsers(path string) (map[string]User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []User
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no users defined")
+	}
+
+	users := make(map[string]User, len(list))
+	for _, u := range list {
+		if u.Username == "" {
+			return nil, fmt.Errorf("user without a username")
+		}
+		if _, _, _, err := parseHash(u.PasswordHash); err != nil {
+			return nil, fmt.Errorf("user %q: invalid passwordHash: %w", u.Username, err)
+		}
+		if _, ok := users[u.Username]; ok {
+			return nil, fmt.Errorf("user %q is defined twice", u.Username)
+		}
+		users[u.Username] = u
+	}
+	return users, nil
+}
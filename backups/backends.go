@@ -0,0 +1,153 @@
+package backups
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kibutsu/objectstore"
+)
+
+// dirBackend keeps backup files under a directory
+type dirBackend struct {
+	dir string
+}
+
+func (d dirBackend) create(ctx context.Context, key string, write func(w io.Writer) error) error {
+	path := filepath.Join(d.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d dirBackend) list(ctx context.Context, prefix string) ([]file, error) {
+	var files []file
+	root := filepath.Join(d.dir, filepath.FromSlash(prefix))
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{key: filepath.ToSlash(rel), size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+func (d dirBackend) stat(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(filepath.Join(d.dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (d dirBackend) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d dirBackend) remove(ctx context.Context, key string) error {
+	if err := os.Remove(filepath.Join(d.dir, filepath.FromSlash(key))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// bucketBackend keeps backup files in an object storage bucket, under a
+// prefix ending in a slash
+type bucketBackend struct {
+	bucket *objectstore.Bucket
+	prefix string
+}
+
+// create stages the backup in a temporary file, since an upload needs its
+// size up front
+func (b bucketBackend) create(ctx context.Context, key string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp("", "kibutsu-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return b.bucket.Put(ctx, b.prefix+key, tmp, size, "application/octet-stream")
+}
+
+func (b bucketBackend) list(ctx context.Context, prefix string) ([]file, error) {
+	objects, err := b.bucket.List(ctx, b.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]file, 0, len(objects))
+	for _, obj := range objects {
+		files = append(files, file{key: strings.TrimPrefix(obj.Key, b.prefix), size: obj.Size})
+	}
+	return files, nil
+}
+
+func (b bucketBackend) stat(ctx context.Context, key string) (int64, error) {
+	obj, err := b.bucket.Stat(ctx, b.prefix+key)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return 0, ErrNotFound
+	}
+	return obj.Size, err
+}
+
+func (b bucketBackend) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, _, err := b.bucket.Get(ctx, b.prefix+key)
+	if errors.Is(err, objectstore.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	return rc, err
+}
+
+func (b bucketBackend) remove(ctx context.Context, key string) error {
+	return b.bucket.Delete(ctx, b.prefix+key)
+}
@@ -0,0 +1,229 @@
+// Package backups keeps archives of volumes and compose projects in a
+// directory or an object storage bucket, as kind/name/timestamp files.
+package backups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/objectstore"
+)
+
+// The kinds of backup
+const (
+	KindVolume  = "volume"
+	KindCompose = "compose"
+)
+
+// extensions are the file extensions of each kind's archives. Volume
+// backups are compressed tars; compose backups are plain tars of the
+// project bundle and its compressed volume archives.
+var extensions = map[string]string{
+	KindVolume:  ".tar.gz",
+	KindCompose: ".tar",
+}
+
+// timeFormat names backups after when they were taken, so they sort in
+// time order
+const timeFormat = "20060102-150405.000"
+
+// ErrNotFound is returned for a backup that doesn't exist
+var ErrNotFound = errors.New("backup not found")
+
+// namePattern matches the volume and project names backups are kept under;
+// it is the daemon's rule for volume names
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// backend holds the backup files, by slash-separated key. It reports
+// missing files as ErrNotFound.
+type backend interface {
+	create(ctx context.Context, key string, write func(w io.Writer) error) error
+	list(ctx context.Context, prefix string) ([]file, error)
+	stat(ctx context.Context, key string) (int64, error)
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+	remove(ctx context.Context, key string) error
+}
+
+// file is a backup file a backend lists
+type file struct {
+	key  string
+	size int64
+}
+
+// Store keeps backups as kind/name/timestamp files. It holds no state of
+// its own, so several stores may share a directory or bucket.
+type Store struct {
+	backend backend
+}
+
+// NewStore keeps backups under dir
+func NewStore(dir string) *Store {
+	return &Store{backend: dirBackend{dir: dir}}
+}
+
+// NewBucketStore keeps backups in bucket, under prefix
+func NewBucketStore(bucket *objectstore.Bucket, prefix string) *Store {
+	return &Store{backend: bucketBackend{bucket: bucket, prefix: strings.Trim(prefix, "/") + "/"}}
+}
+
+// ValidKind reports whether kind is a kind of backup
+func ValidKind(kind string) bool {
+	_, ok := extensions[kind]
+	return ok
+}
+
+// Validate checks that a backup of kind and name can be kept
+func Validate(kind, name string) error {
+	if !ValidKind(kind) {
+		return fmt.Errorf("unknown kind %q; expected volume or compose", kind)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// Create takes a backup of kind and name, whose contents write produces.
+// The backup only appears once write has succeeded.
+func (s *Store) Create(ctx context.Context, kind, name string, write func(w io.Writer) error) (apitypes.Backup, error) {
+	if err := Validate(kind, name); err != nil {
+		return apitypes.Backup{}, err
+	}
+	backup := apitypes.Backup{Kind: kind, Name: name, Created: time.Now().UTC().Truncate(time.Millisecond)}
+	if err := s.backend.create(ctx, key(backup), write); err != nil {
+		return apitypes.Backup{}, err
+	}
+	return s.stat(ctx, kind, name, backup.Created.Format(timeFormat))
+}
+
+// List returns the backups, newest first. kind and name, when set, narrow
+// the list to one kind or one volume or project.
+func (s *Store) List(ctx context.Context, kind, name string) ([]apitypes.Backup, error) {
+	kinds := []string{KindCompose, KindVolume}
+	if kind != "" {
+		kinds = []string{kind}
+	}
+	if name != "" && !namePattern.MatchString(name) {
+		return []apitypes.Backup{}, nil
+	}
+
+	list := make([]apitypes.Backup, 0)
+	for _, kind := range kinds {
+		prefix := kind + "/"
+		if name != "" {
+			prefix += name + "/"
+		}
+		files, err := s.backend.list(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			backup, err := parseKey(f.key)
+			if err != nil {
+				continue
+			}
+			backup.Size = f.size
+			list = append(list, backup)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, nil
+}
+
+// Get describes the backup with the given ID
+func (s *Store) Get(ctx context.Context, id string) (apitypes.Backup, error) {
+	kind, name, stamp, err := parseID(id)
+	if err != nil {
+		return apitypes.Backup{}, err
+	}
+	return s.stat(ctx, kind, name, stamp)
+}
+
+// Open returns the contents of a backup
+func (s *Store) Open(ctx context.Context, id string) (io.ReadCloser, apitypes.Backup, error) {
+	backup, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, backup, err
+	}
+	rc, err := s.backend.open(ctx, key(backup))
+	return rc, backup, err
+}
+
+// Delete removes a backup
+func (s *Store) Delete(ctx context.Context, id string) error {
+	backup, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.backend.remove(ctx, key(backup))
+}
+
+// Prune removes the oldest backups of kind and name beyond the newest keep,
+// returning those removed
+func (s *Store) Prune(ctx context.Context, kind, name string, keep int) ([]apitypes.Backup, error) {
+	list, err := s.List(ctx, kind, name)
+	if err != nil || len(list) <= keep {
+		return nil, err
+	}
+	var removed []apitypes.Backup
+	for _, backup := range list[keep:] {
+		if err := s.backend.remove(ctx, key(backup)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backup)
+	}
+	return removed, nil
+}
+
+func (s *Store) stat(ctx context.Context, kind, name, stamp string) (apitypes.Backup, error) {
+	created, err := time.Parse(timeFormat, stamp)
+	if err != nil {
+		return apitypes.Backup{}, ErrNotFound
+	}
+	backup := apitypes.Backup{ID: kind + "/" + name + "/" + stamp, Kind: kind, Name: name, Created: created}
+	backup.Size, err = s.backend.stat(ctx, key(backup))
+	return backup, err
+}
+
+// key returns the key a backup's file is kept under
+func key(backup apitypes.Backup) string {
+	return backup.Kind + "/" + backup.Name + "/" + backup.Created.Format(timeFormat) + extensions[backup.Kind]
+}
+
+// parseKey describes the backup kept under key, without its size
+func parseKey(key string) (apitypes.Backup, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || !ValidKind(parts[0]) {
+		return apitypes.Backup{}, ErrNotFound
+	}
+	stamp, ok := strings.CutSuffix(parts[2], extensions[parts[0]])
+	if !ok {
+		return apitypes.Backup{}, ErrNotFound
+	}
+	kind, name, stamp, err := parseID(parts[0] + "/" + parts[1] + "/" + stamp)
+	if err != nil {
+		return apitypes.Backup{}, err
+	}
+	created, _ := time.Parse(timeFormat, stamp)
+	return apitypes.Backup{ID: kind + "/" + name + "/" + stamp, Kind: kind, Name: name, Created: created}, nil
+}
+
+// parseID splits a backup ID into its kind, name and timestamp. IDs that
+// couldn't have been made by Create are reported as not found.
+func parseID(id string) (kind, name, stamp string, err error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 || Validate(parts[0], parts[1]) != nil {
+		return "", "", "", ErrNotFound
+	}
+	if _, err := time.Parse(timeFormat, parts[2]); err != nil {
+		return "", "", "", ErrNotFound
+	}
+	return parts[0], parts[1], parts[2], nil
+}
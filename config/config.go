@@ -0,0 +1,792 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the service settings read from the environment
+type Config struct {
+	// ListenAddr is the address the HTTP server binds to. Changing it requires a restart.
+	ListenAddr string
+
+	// BasePath is the subpath, in "/prefix" form, the UI and API are served
+	// under. Empty serves them at the root. Changing it requires a restart.
+	BasePath string
+
+	// ServerReadTimeout, ServerWriteTimeout and ServerIdleTimeout are the
+	// HTTP server's connection timeouts. Changing them requires a restart.
+	ServerReadTimeout  time.Duration
+	ServerWriteTimeout time.Duration
+	ServerIdleTimeout  time.Duration
+
+	// StartupTimeout bounds the wait for the Docker daemon at startup
+	StartupTimeout time.Duration
+
+	// ShutdownTimeout is how long in-flight requests get to finish when the
+	// server shuts down
+	ShutdownTimeout time.Duration
+
+	// DockerHost is the daemon address (unix://, tcp://, ssh:// or, on
+	// Windows, npipe://). Empty means DOCKER_HOST or the platform default. Changing it
+	// requires a restart.
+	DockerHost string
+
+	// Endpoints are further Docker daemons, selected per request by name.
+	// KIBUTSU_ENDPOINTS_FILE points at the file listing them. Changing them
+	// requires a restart.
+	Endpoints []Endpoint
+
+	// CORSOrigins are the origins allowed to call the API ("*" allows any)
+	CORSOrigins []string
+
+	// RequestTimeout bounds the lifetime of each HTTP request context
+	RequestTimeout time.Duration
+
+	// DockerReadTimeout bounds quick Docker reads such as list, inspect and info
+	DockerReadTimeout time.Duration
+
+	// DockerWriteTimeout bounds state changes and expensive reads
+	DockerWriteTimeout time.Duration
+
+	// DockerLongTimeout bounds operations spanning many containers, such as
+	// bringing a compose project up or down
+	DockerLongTimeout time.Duration
+
+	// RateLimit is the sustained number of requests per second allowed per
+	// client IP. Zero disables rate limiting.
+	RateLimit float64
+
+	// RateBurst is the number of requests a client may make in a burst
+	RateBurst int
+
+	// LogLevel is one of debug, info, warn or error
+	LogLevel string
+
+	// LogFormat is text or json
+	LogFormat string
+
+	// LogFile is the file logs are written to, or stdout or stderr
+	LogFile string
+
+	// LogMaxSize is the size in megabytes at which LogFile is rotated. Zero
+	// never rotates it.
+	LogMaxSize int
+
+	// LogMaxBackups is how many rotated log files are kept
+	LogMaxBackups int
+
+	// MaxStreams caps concurrent streaming connections (logs, stats, events,
+	// builds) across all clients. Zero means unlimited.
+	MaxStreams int
+
+	// MaxStreamsPerClient caps concurrent streaming connections from a single
+	// client IP. Zero means unlimited.
+	MaxStreamsPerClient int
+
+	// StreamIdleTimeout is how long a stream may go without activity before
+	// it is force-closed. Zero keeps idle streams open.
+	StreamIdleTimeout time.Duration
+
+	// StopTimeout is how long containers get to shut down gracefully before
+	// being killed, unless a request sets its own timeout
+	StopTimeout time.Duration
+
+	// DockerRetries is the number of attempts made for idempotent Docker
+	// reads that fail with a transient error. One disables retrying.
+	DockerRetries int
+
+	// PullRetries is the number of attempts made for an image pull that
+	// fails with a transient network error. One disables retrying.
+	PullRetries int
+
+	// DockerRetryBackoff is the delay before the first retry; it doubles
+	// with each further attempt
+	DockerRetryBackoff time.Duration
+
+	// EventReplaySize is how many recent events new WebSocket clients are
+	// sent on connect. Zero disables replay.
+	EventReplaySize int
+
+	// ComposeDir is the directory holding a subdirectory with a
+	// docker-compose.yml for each registered compose project
+	ComposeDir string
+
+	// ResourcePresets are the named resource limits containers can be
+	// created with. KIBUTSU_RESOURCE_PRESETS points at a file replacing the
+	// defaults.
+	ResourcePresets map[string]ResourcePreset
+
+	// UsageInterval is how often the system usage stream samples containers,
+	// unless a client asks for its own interval
+	UsageInterval time.Duration
+
+	// UpdateCheckInterval is how often running containers' images are
+	// compared with their registries. Zero turns the checks off.
+	UpdateCheckInterval time.Duration
+
+	// NamePrefix, when set, is prepended to the names of created containers
+	// and limits the container endpoints to containers whose names start
+	// with it. This is namespacing for convenience, not an isolation boundary.
+	NamePrefix string
+
+	// SecretEnvPatterns are glob patterns, matched case-insensitively against
+	// environment variable names, whose values are redacted in responses
+	SecretEnvPatterns []string
+
+	// AdminToken is the bearer token for the admin endpoints, which are
+	// disabled when it is empty
+	AdminToken string
+
+	// MetricsToken, when set, is the bearer token Prometheus must send to
+	// scrape /metrics. Empty leaves /metrics open.
+	MetricsToken string
+
+	// ConfirmDestructive requires a remove-preview token before containers
+	// are removed. Changing it requires a restart.
+	ConfirmDestructive bool
+
+	// EnablePassthrough turns on the admin-only endpoint that forwards
+	// allowlisted read-only calls to the Docker API
+	EnablePassthrough bool
+
+	// RegistryMirror, when set, is a registry host (with an optional path
+	// prefix) that Docker Hub images are pulled through
+	RegistryMirror string
+
+	// RegistryAuthFile is a YAML file of registry logins used for image
+	// pulls, pushes and builds. Changing it requires a restart; its contents
+	// are re-read when it changes.
+	RegistryAuthFile string
+
+	// SecretKey is the 32-byte key the registry logins managed through the
+	// API are encrypted with. Without it those endpoints are disabled.
+	// Changing it requires a restart.
+	SecretKey []byte
+
+	// AuditFile is the append-only JSON Lines file every state-changing API
+	// call is recorded in. Changing it requires a restart.
+	AuditFile string
+
+	// RegistryStoreFile is where the encrypted registry logins are kept.
+	// Changing it requires a restart.
+	RegistryStoreFile string
+
+	// JobsFile is where scheduled jobs and their run history are kept.
+	// Changing it requires a restart.
+	JobsFile string
+
+	// LogStoreDir, when set, is where the logs of the containers matching
+	// LogCollect are copied to, so they survive the container's removal.
+	// Changing it requires a restart.
+	LogStoreDir string
+
+	// LogCollect are glob patterns of the container names whose logs are
+	// collected into LogStoreDir. Containers labelled
+	// kibutsu.collect-logs=false are skipped.
+	LogCollect []string
+
+	// LogRetention is how long collected logs are kept. Zero keeps them
+	// until LogStoreMaxSize is reached.
+	LogRetention time.Duration
+
+	// LogStoreMaxSize caps each container's collected logs, in megabytes;
+	// the oldest are dropped first. Zero is unlimited.
+	LogStoreMaxSize int
+
+	// BackupDir, when set, is where backups of volumes and compose
+	// projects are kept, in a subdirectory per endpoint
+	BackupDir string
+
+	// ObjectStorage, when set, is the bucket backups are kept in instead of
+	// BackupDir, and that exports and log archives can be sent to
+	ObjectStorage *ObjectStorage
+
+	// VolumeHelperImage is the image of the containers volume backups and
+	// restores mount the volume in. It needs a POSIX shell to empty a
+	// volume before a replacing restore.
+	VolumeHelperImage string
+
+	// UsersFile is the YAML file of accounts that may log in. When set, every
+	// /api endpoint requires a session; when empty the API is open. Changing
+	// it requires a restart.
+	UsersFile string
+
+	// SessionTTL is how long a login session lasts
+	SessionTTL time.Duration
+
+	// TLSCertFile and TLSKeyFile, when set, serve HTTPS with this PEM
+	// certificate and key. The files are reloaded when they change, so
+	// certificates renewed by an ACME client such as certbot are picked up
+	// without a restart. Changing the paths requires a restart.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// HTTPRedirectAddr, when set with TLS, is an address on which plain HTTP
+	// requests are redirected to HTTPS. Changing it requires a restart.
+	HTTPRedirectAddr string
+
+	// ACMEDomains, when set, serve HTTPS with certificates for these host
+	// names obtained and renewed from an ACME CA such as Let's Encrypt, in
+	// place of TLSCertFile. Certificates are kept in ACMECacheDir; the CA
+	// reaches the HTTP-01 challenge through HTTPRedirectAddr (:80 unless
+	// set) and TLS-ALPN-01 through the listen address. ACMEDirectoryURL
+	// overrides the Let's Encrypt production directory, such as with its
+	// staging one. Changing them requires a restart.
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMECacheDir     string
+	ACMEDirectoryURL string
+
+	// Notifications are the channels and routing rules read from
+	// KIBUTSU_NOTIFICATIONS_FILE; nil sends no notifications
+	Notifications *Notifications
+}
+
+// DefaultSecretEnvPatterns match the usual names of credentials
+var DefaultSecretEnvPatterns = []string{
+	"*PASSWORD*", "*PASSWD*", "*SECRET*", "*TOKEN*", "*API_KEY*", "*APIKEY*",
+	"*PRIVATE_KEY*", "*ACCESS_KEY*", "*CREDENTIAL*",
+}
+
+// Load reads the configuration from command-line flags, environment
+// variables and the config file, in that order of precedence, applying
+// defaults for anything unset.
+func Load(opts Options) (*Config, error) {
+	src, err := newSource(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		ListenAddr:          ":8080",
+		ServerReadTimeout:   15 * time.Second,
+		ServerWriteTimeout:  15 * time.Second,
+		ServerIdleTimeout:   60 * time.Second,
+		StartupTimeout:      10 * time.Second,
+		ShutdownTimeout:     30 * time.Second,
+		CORSOrigins:         []string{"http://localhost:5173"},
+		RequestTimeout:      30 * time.Second,
+		DockerReadTimeout:   10 * time.Second,
+		DockerWriteTimeout:  60 * time.Second,
+		DockerLongTimeout:   5 * time.Minute,
+		StopTimeout:         30 * time.Second,
+		DockerRetries:       3,
+		PullRetries:         3,
+		DockerRetryBackoff:  200 * time.Millisecond,
+		RateBurst:           20,
+		LogLevel:            "info",
+		LogFormat:           "text",
+		LogFile:             "stdout",
+		LogMaxSize:          100,
+		LogMaxBackups:       5,
+		MaxStreams:          200,
+		MaxStreamsPerClient: 20,
+		StreamIdleTimeout:   10 * time.Minute,
+		EventReplaySize:     100,
+		ResourcePresets:     DefaultResourcePresets,
+		ComposeDir:          "compose",
+		UsageInterval:       5 * time.Second,
+		UpdateCheckInterval: 6 * time.Hour,
+		SecretEnvPatterns:   DefaultSecretEnvPatterns,
+		SessionTTL:          12 * time.Hour,
+		RegistryStoreFile:   "registries.enc",
+		AuditFile:           "audit.jsonl",
+		JobsFile:            "jobs.json",
+		LogCollect:          []string{"*"},
+		LogRetention:        7 * 24 * time.Hour,
+		LogStoreMaxSize:     100,
+		VolumeHelperImage:   "busybox:latest",
+	}
+
+	if port := src.get("PORT"); port != "" {
+		cfg.ListenAddr = ":" + strings.TrimPrefix(port, ":")
+	}
+	if host := src.get("KIBUTSU_DOCKER_HOST"); host != "" {
+		if err := validateDockerHost(host); err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_DOCKER_HOST %q: %w", host, err)
+		}
+		cfg.DockerHost = host
+	} else if host := os.Getenv("DOCKER_HOST"); host != "" {
+		if err := validateDockerHost(host); err != nil {
+			return nil, fmt.Errorf("invalid DOCKER_HOST %q: %w", host, err)
+		}
+	}
+	if basePath := strings.Trim(src.get("KIBUTSU_BASE_PATH"), "/"); basePath != "" {
+		cfg.BasePath = "/" + basePath
+	}
+	cfg.NamePrefix = strings.TrimPrefix(src.get("KIBUTSU_NAME_PREFIX"), "/")
+	cfg.AdminToken = src.get("KIBUTSU_ADMIN_TOKEN")
+	cfg.MetricsToken = src.get("KIBUTSU_METRICS_TOKEN")
+	cfg.ConfirmDestructive = src.get("KIBUTSU_CONFIRM_DESTRUCTIVE") == "1"
+	cfg.EnablePassthrough = src.get("KIBUTSU_ENABLE_PASSTHROUGH") == "1"
+	cfg.UsersFile = src.get("KIBUTSU_USERS_FILE")
+	if path := src.get("KIBUTSU_AUDIT_FILE"); path != "" {
+		cfg.AuditFile = path
+	}
+	cfg.RegistryAuthFile = src.get("KIBUTSU_REGISTRY_AUTH_FILE")
+	if key := src.get("KIBUTSU_SECRET_KEY"); key != "" {
+		secretKey, err := parseSecretKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_SECRET_KEY: %w", err)
+		}
+		cfg.SecretKey = secretKey
+	}
+	if path := src.get("KIBUTSU_REGISTRY_STORE"); path != "" {
+		cfg.RegistryStoreFile = path
+	}
+	if path := src.get("KIBUTSU_JOBS_FILE"); path != "" {
+		cfg.JobsFile = path
+	}
+	cfg.LogStoreDir = src.get("KIBUTSU_LOG_STORE_DIR")
+	if v := src.get("KIBUTSU_LOG_COLLECT"); v != "" {
+		patterns := splitList(v)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid KIBUTSU_LOG_COLLECT pattern %q: %w", pattern, err)
+			}
+		}
+		cfg.LogCollect = patterns
+	}
+	cfg.BackupDir = src.get("KIBUTSU_BACKUP_DIR")
+	if cfg.ObjectStorage, err = loadObjectStorage(src); err != nil {
+		return nil, err
+	}
+	if ref := src.get("KIBUTSU_VOLUME_HELPER_IMAGE"); ref != "" {
+		cfg.VolumeHelperImage = ref
+	}
+	cfg.TLSCertFile = src.get("KIBUTSU_TLS_CERT")
+	cfg.TLSKeyFile = src.get("KIBUTSU_TLS_KEY")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("KIBUTSU_TLS_CERT and KIBUTSU_TLS_KEY must be set together")
+	}
+	if domains := src.get("KIBUTSU_ACME_DOMAINS"); domains != "" {
+		if cfg.TLSCertFile != "" {
+			return nil, fmt.Errorf("KIBUTSU_ACME_DOMAINS can't be set together with KIBUTSU_TLS_CERT")
+		}
+		for _, domain := range splitList(domains) {
+			if strings.ContainsAny(domain, "/:*") || !strings.Contains(domain, ".") {
+				return nil, fmt.Errorf("invalid KIBUTSU_ACME_DOMAINS entry %q: must be a fully qualified host name", domain)
+			}
+			cfg.ACMEDomains = append(cfg.ACMEDomains, strings.ToLower(domain))
+		}
+		cfg.ACMEEmail = src.get("KIBUTSU_ACME_EMAIL")
+		cfg.ACMECacheDir = "acme"
+		if dir := src.get("KIBUTSU_ACME_CACHE_DIR"); dir != "" {
+			cfg.ACMECacheDir = dir
+		}
+		if dirURL := src.get("KIBUTSU_ACME_DIRECTORY_URL"); dirURL != "" {
+			if u, err := url.Parse(dirURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				return nil, fmt.Errorf("invalid KIBUTSU_ACME_DIRECTORY_URL %q: must be an https URL", dirURL)
+			}
+			cfg.ACMEDirectoryURL = dirURL
+		}
+		// The HTTP-01 challenge is answered on port 80
+		cfg.HTTPRedirectAddr = ":80"
+	}
+	if addr := src.get("KIBUTSU_HTTP_REDIRECT_ADDR"); addr != "" {
+		if cfg.TLSCertFile == "" && len(cfg.ACMEDomains) == 0 {
+			return nil, fmt.Errorf("KIBUTSU_HTTP_REDIRECT_ADDR requires KIBUTSU_TLS_CERT and KIBUTSU_TLS_KEY or KIBUTSU_ACME_DOMAINS")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_HTTP_REDIRECT_ADDR %q: %w", addr, err)
+		}
+		cfg.HTTPRedirectAddr = addr
+	}
+	if path := src.get("KIBUTSU_ENDPOINTS_FILE"); path != "" {
+		endpoints, err := loadEndpoints(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_ENDPOINTS_FILE %q: %w", path, err)
+		}
+		cfg.Endpoints = endpoints
+	}
+	if path := src.get("KIBUTSU_NOTIFICATIONS_FILE"); path != "" {
+		notifications, err := loadNotifications(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_NOTIFICATIONS_FILE %q: %w", path, err)
+		}
+		cfg.Notifications = notifications
+	}
+	if dir := src.get("KIBUTSU_COMPOSE_DIR"); dir != "" {
+		cfg.ComposeDir = dir
+	}
+	if mirror := src.get("KIBUTSU_REGISTRY_MIRROR"); mirror != "" {
+		if err := ValidateRegistryMirror(mirror); err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_REGISTRY_MIRROR %q: %w", mirror, err)
+		}
+		cfg.RegistryMirror = mirror
+	}
+	if origins := src.get("CORS_ORIGIN"); origins != "" {
+		cfg.CORSOrigins = splitList(origins)
+	}
+	for name, target := range map[string]*time.Duration{
+		"KIBUTSU_REQUEST_TIMEOUT":      &cfg.RequestTimeout,
+		"KIBUTSU_DOCKER_READ_TIMEOUT":  &cfg.DockerReadTimeout,
+		"KIBUTSU_DOCKER_WRITE_TIMEOUT": &cfg.DockerWriteTimeout,
+		"KIBUTSU_DOCKER_LONG_TIMEOUT":  &cfg.DockerLongTimeout,
+		"KIBUTSU_DOCKER_RETRY_BACKOFF": &cfg.DockerRetryBackoff,
+		"KIBUTSU_STOP_TIMEOUT":         &cfg.StopTimeout,
+		"KIBUTSU_USAGE_INTERVAL":       &cfg.UsageInterval,
+		"KIBUTSU_SESSION_TTL":          &cfg.SessionTTL,
+		"KIBUTSU_SERVER_READ_TIMEOUT":  &cfg.ServerReadTimeout,
+		"KIBUTSU_SERVER_WRITE_TIMEOUT": &cfg.ServerWriteTimeout,
+		"KIBUTSU_SERVER_IDLE_TIMEOUT":  &cfg.ServerIdleTimeout,
+		"KIBUTSU_STARTUP_TIMEOUT":      &cfg.StartupTimeout,
+		"KIBUTSU_SHUTDOWN_TIMEOUT":     &cfg.ShutdownTimeout,
+	} {
+		if v := src.get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s %q: must be a positive duration", name, v)
+			}
+			*target = d
+		}
+	}
+	for name, target := range map[string]*time.Duration{
+		"KIBUTSU_STREAM_IDLE_TIMEOUT":   &cfg.StreamIdleTimeout,
+		"KIBUTSU_UPDATE_CHECK_INTERVAL": &cfg.UpdateCheckInterval,
+		"KIBUTSU_LOG_RETENTION":         &cfg.LogRetention,
+	} {
+		if v := src.get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s %q: must be a non-negative duration", name, v)
+			}
+			*target = d
+		}
+	}
+	for name, target := range map[string]*int{
+		"KIBUTSU_DOCKER_RETRIES": &cfg.DockerRetries,
+		"KIBUTSU_PULL_RETRIES":   &cfg.PullRetries,
+	} {
+		if v := src.get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid %s %q: must be a positive integer", name, v)
+			}
+			*target = n
+		}
+	}
+	if v := src.get("KIBUTSU_RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid KIBUTSU_RATE_LIMIT %q: must be a non-negative number", v)
+		}
+		cfg.RateLimit = rate
+	}
+	if v := src.get("KIBUTSU_RATE_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid KIBUTSU_RATE_BURST %q: must be a positive integer", v)
+		}
+		cfg.RateBurst = burst
+	}
+	for name, target := range map[string]*int{
+		"KIBUTSU_MAX_STREAMS":            &cfg.MaxStreams,
+		"KIBUTSU_MAX_STREAMS_PER_CLIENT": &cfg.MaxStreamsPerClient,
+		"KIBUTSU_EVENT_REPLAY":           &cfg.EventReplaySize,
+		"KIBUTSU_LOG_MAX_SIZE":           &cfg.LogMaxSize,
+		"KIBUTSU_LOG_MAX_BACKUPS":        &cfg.LogMaxBackups,
+		"KIBUTSU_LOG_STORE_MAX_SIZE":     &cfg.LogStoreMaxSize,
+	} {
+		if v := src.get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+			}
+			*target = n
+		}
+	}
+	if v := src.get("KIBUTSU_SECRET_ENV_PATTERNS"); v != "" {
+		patterns := splitList(v)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid KIBUTSU_SECRET_ENV_PATTERNS pattern %q: %w", pattern, err)
+			}
+		}
+		cfg.SecretEnvPatterns = patterns
+	}
+	if path := src.get("KIBUTSU_RESOURCE_PRESETS"); path != "" {
+		presets, err := loadResourcePresets(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KIBUTSU_RESOURCE_PRESETS %q: %w", path, err)
+		}
+		cfg.ResourcePresets = presets
+	}
+	if v := src.get("KIBUTSU_LOG_LEVEL"); v != "" {
+		level := strings.ToLower(v)
+		switch level {
+		case "debug", "info", "warn", "error":
+			cfg.LogLevel = level
+		default:
+			return nil, fmt.Errorf("invalid KIBUTSU_LOG_LEVEL %q: must be debug, info, warn or error", v)
+		}
+	}
+	if v := src.get("KIBUTSU_LOG_FORMAT"); v != "" {
+		format := strings.ToLower(v)
+		if format != "text" && format != "json" {
+			return nil, fmt.Errorf("invalid KIBUTSU_LOG_FORMAT %q: must be text or json", v)
+		}
+		cfg.LogFormat = format
+	}
+	if v := src.get("KIBUTSU_LOG_FILE"); v != "" {
+		cfg.LogFile = v
+	}
+
+	return cfg, nil
+}
+
+// Store holds the live configuration. Readers always see a complete Config,
+// and Reload swaps it atomically so in-flight requests are unaffected.
+type Store struct {
+	current atomic.Pointer[Config]
+	opts    Options
+}
+
+// NewStore creates a store holding cfg, which Reload re-reads from opts
+func NewStore(cfg *Config, opts Options) *Store {
+	s := &Store{opts: opts}
+	s.current.Store(cfg)
+	return s
+}
+
+// Get returns the current configuration. Callers must not modify it.
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// ReloadResult reports what a reload changed
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// Reload re-reads the configuration and applies the settings that can change
+// at runtime. Settings that need a restart keep their current value and are
+// listed in the result instead.
+func (s *Store) Reload() (*ReloadResult, error) {
+	next, err := Load(s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := s.Get()
+	result := &ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+
+	if next.ListenAddr != prev.ListenAddr {
+		result.RestartRequired = append(result.RestartRequired, "ListenAddr")
+		next.ListenAddr = prev.ListenAddr
+	}
+	if next.DockerHost != prev.DockerHost {
+		result.RestartRequired = append(result.RestartRequired, "DockerHost")
+		next.DockerHost = prev.DockerHost
+	}
+	if !slices.Equal(next.Endpoints, prev.Endpoints) {
+		result.RestartRequired = append(result.RestartRequired, "Endpoints")
+		next.Endpoints = prev.Endpoints
+	}
+	if next.BasePath != prev.BasePath {
+		result.RestartRequired = append(result.RestartRequired, "BasePath")
+		next.BasePath = prev.BasePath
+	}
+	if next.ServerReadTimeout != prev.ServerReadTimeout || next.ServerWriteTimeout != prev.ServerWriteTimeout ||
+		next.ServerIdleTimeout != prev.ServerIdleTimeout {
+		result.RestartRequired = append(result.RestartRequired, "ServerTimeouts")
+		next.ServerReadTimeout, next.ServerWriteTimeout = prev.ServerReadTimeout, prev.ServerWriteTimeout
+		next.ServerIdleTimeout = prev.ServerIdleTimeout
+	}
+	if next.LogFormat != prev.LogFormat || next.LogFile != prev.LogFile ||
+		next.LogMaxSize != prev.LogMaxSize || next.LogMaxBackups != prev.LogMaxBackups {
+		result.RestartRequired = append(result.RestartRequired, "LogOutput")
+		next.LogFormat, next.LogFile = prev.LogFormat, prev.LogFile
+		next.LogMaxSize, next.LogMaxBackups = prev.LogMaxSize, prev.LogMaxBackups
+	}
+	if next.AuditFile != prev.AuditFile {
+		result.RestartRequired = append(result.RestartRequired, "AuditFile")
+		next.AuditFile = prev.AuditFile
+	}
+	if next.JobsFile != prev.JobsFile {
+		result.RestartRequired = append(result.RestartRequired, "JobsFile")
+		next.JobsFile = prev.JobsFile
+	}
+	if next.LogStoreDir != prev.LogStoreDir {
+		result.RestartRequired = append(result.RestartRequired, "LogStoreDir")
+		next.LogStoreDir = prev.LogStoreDir
+	}
+	if next.ConfirmDestructive != prev.ConfirmDestructive {
+		result.RestartRequired = append(result.RestartRequired, "ConfirmDestructive")
+		next.ConfirmDestructive = prev.ConfirmDestructive
+	}
+	if next.UsersFile != prev.UsersFile {
+		result.RestartRequired = append(result.RestartRequired, "UsersFile")
+		next.UsersFile = prev.UsersFile
+	}
+	if next.RegistryAuthFile != prev.RegistryAuthFile {
+		result.RestartRequired = append(result.RestartRequired, "RegistryAuthFile")
+		next.RegistryAuthFile = prev.RegistryAuthFile
+	}
+	if !bytes.Equal(next.SecretKey, prev.SecretKey) || next.RegistryStoreFile != prev.RegistryStoreFile {
+		result.RestartRequired = append(result.RestartRequired, "RegistryStore")
+		next.SecretKey, next.RegistryStoreFile = prev.SecretKey, prev.RegistryStoreFile
+	}
+	if next.TLSCertFile != prev.TLSCertFile || next.TLSKeyFile != prev.TLSKeyFile ||
+		next.HTTPRedirectAddr != prev.HTTPRedirectAddr {
+		result.RestartRequired = append(result.RestartRequired, "TLS")
+		next.TLSCertFile, next.TLSKeyFile = prev.TLSCertFile, prev.TLSKeyFile
+		next.HTTPRedirectAddr = prev.HTTPRedirectAddr
+	}
+	if !slices.Equal(next.ACMEDomains, prev.ACMEDomains) || next.ACMEEmail != prev.ACMEEmail ||
+		next.ACMECacheDir != prev.ACMECacheDir || next.ACMEDirectoryURL != prev.ACMEDirectoryURL {
+		result.RestartRequired = append(result.RestartRequired, "ACME")
+		next.ACMEDomains, next.ACMEEmail = prev.ACMEDomains, prev.ACMEEmail
+		next.ACMECacheDir, next.ACMEDirectoryURL = prev.ACMECacheDir, prev.ACMEDirectoryURL
+	}
+	if strings.Join(next.CORSOrigins, ",") != strings.Join(prev.CORSOrigins, ",") {
+		result.Applied = append(result.Applied, "CORSOrigins")
+	}
+	if next.RequestTimeout != prev.RequestTimeout {
+		result.Applied = append(result.Applied, "RequestTimeout")
+	}
+	if next.DockerReadTimeout != prev.DockerReadTimeout ||
+		next.DockerWriteTimeout != prev.DockerWriteTimeout ||
+		next.DockerLongTimeout != prev.DockerLongTimeout {
+		result.Applied = append(result.Applied, "DockerTimeouts")
+	}
+	if next.StopTimeout != prev.StopTimeout {
+		result.Applied = append(result.Applied, "StopTimeout")
+	}
+	if next.DockerRetries != prev.DockerRetries || next.DockerRetryBackoff != prev.DockerRetryBackoff ||
+		next.PullRetries != prev.PullRetries {
+		result.Applied = append(result.Applied, "DockerRetries")
+	}
+	if next.RateLimit != prev.RateLimit || next.RateBurst != prev.RateBurst {
+		result.Applied = append(result.Applied, "RateLimit")
+	}
+	if next.LogLevel != prev.LogLevel {
+		result.Applied = append(result.Applied, "LogLevel")
+	}
+	if next.MaxStreams != prev.MaxStreams || next.MaxStreamsPerClient != prev.MaxStreamsPerClient ||
+		next.StreamIdleTimeout != prev.StreamIdleTimeout {
+		result.Applied = append(result.Applied, "StreamLimits")
+	}
+	if next.EventReplaySize != prev.EventReplaySize {
+		result.Applied = append(result.Applied, "EventReplaySize")
+	}
+	if strings.Join(next.SecretEnvPatterns, ",") != strings.Join(prev.SecretEnvPatterns, ",") {
+		result.Applied = append(result.Applied, "SecretEnvPatterns")
+	}
+	if next.RegistryMirror != prev.RegistryMirror {
+		result.Applied = append(result.Applied, "RegistryMirror")
+	}
+	if next.EnablePassthrough != prev.EnablePassthrough {
+		result.Applied = append(result.Applied, "EnablePassthrough")
+	}
+	if next.NamePrefix != prev.NamePrefix {
+		result.Applied = append(result.Applied, "NamePrefix")
+	}
+	if next.ComposeDir != prev.ComposeDir {
+		result.Applied = append(result.Applied, "ComposeDir")
+	}
+	if next.UsageInterval != prev.UsageInterval {
+		result.Applied = append(result.Applied, "UsageInterval")
+	}
+	if next.UpdateCheckInterval != prev.UpdateCheckInterval {
+		result.Applied = append(result.Applied, "UpdateCheckInterval")
+	}
+	if next.ShutdownTimeout != prev.ShutdownTimeout {
+		result.Applied = append(result.Applied, "ShutdownTimeout")
+	}
+	if next.AdminToken != prev.AdminToken {
+		result.Applied = append(result.Applied, "AdminToken")
+	}
+	if next.MetricsToken != prev.MetricsToken {
+		result.Applied = append(result.Applied, "MetricsToken")
+	}
+	if next.SessionTTL != prev.SessionTTL {
+		result.Applied = append(result.Applied, "SessionTTL")
+	}
+	if !maps.Equal(next.ResourcePresets, prev.ResourcePresets) {
+		result.Applied = append(result.Applied, "ResourcePresets")
+	}
+	if strings.Join(next.LogCollect, ",") != strings.Join(prev.LogCollect, ",") || next.LogRetention != prev.LogRetention || next.LogStoreMaxSize != prev.LogStoreMaxSize {
+		result.Applied = append(result.Applied, "LogCollection")
+	}
+	if next.BackupDir != prev.BackupDir || next.VolumeHelperImage != prev.VolumeHelperImage {
+		result.Applied = append(result.Applied, "Backups")
+	}
+	if !reflect.DeepEqual(next.ObjectStorage, prev.ObjectStorage) {
+		result.Applied = append(result.Applied, "ObjectStorage")
+	}
+	if !reflect.DeepEqual(next.Notifications, prev.Notifications) {
+		result.Applied = append(result.Applied, "Notifications")
+	}
+
+	s.current.Store(next)
+	return result, nil
+}
+
+// validateDockerHost checks that host uses a scheme the Docker client can
+// dial on this platform.
+func validateDockerHost(host string) error {
+	scheme, addr, ok := strings.Cut(host, "://")
+	if !ok || addr == "" {
+		return fmt.Errorf("must be of the form scheme://address")
+	}
+	switch scheme {
+	case "unix", "tcp":
+		return nil
+	case "npipe":
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("npipe:// hosts are only supported on Windows")
+		}
+		return nil
+	case "ssh":
+		u, err := url.Parse(host)
+		if err != nil || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("must be of the form ssh://[user@]host[:port]")
+		}
+		if _, ok := u.User.Password(); ok {
+			return fmt.Errorf("ssh:// hosts can't carry a password; use a key or the SSH agent")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported scheme %q: use unix://, tcp://, ssh:// or npipe://", scheme)
+	}
+}
+
+func splitList(v string) []string {
+	var result []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseSecretKey decodes a 32-byte key given as hex or base64, as printed
+// by "kibutsu generate-key"
+func parseSecretKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes in hex or base64")
+	}
+	return key, nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LocalEndpoint is the name of the endpoint for the daemon set with
+// KIBUTSU_DOCKER_HOST (or DOCKER_HOST), which requests use by default
+const LocalEndpoint = "local"
+
+var endpointName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Endpoint is an additional Docker daemon kibutsu manages
+type Endpoint struct {
+	Name string `yaml:"name"`
+	Host string `yaml:"host"` // unix://, tcp:// or ssh://
+
+	// TLSCA, TLSCert and TLSKey are PEM files for a daemon listening with
+	// --tlsverify. The CA may be omitted to trust the system roots.
+	TLSCA   string `yaml:"tlsCa"`
+	TLSCert string `yaml:"tlsCert"`
+	TLSKey  string `yaml:"tlsKey"`
+}
+
+// TLS reports whether the endpoint is reached over TLS
+func (e Endpoint) TLS() bool {
+	return e.TLSCA != "" || e.TLSCert != ""
+}
+
+func loadEndpoints(path string) ([]Endpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	if err := yaml.Unmarshal(data, &endpoints); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{LocalEndpoint: true}
+	for _, e := range endpoints {
+		if !endpointName.MatchString(e.Name) {
+			return nil, fmt.Errorf("invalid endpoint name %q: use lower case letters, digits, - and _", e.Name)
+		}
+		if seen[e.Name] {
+			return nil, fmt.Errorf("endpoint %q is defined twice (%q is the default daemon)", e.Name, LocalEndpoint)
+		}
+		seen[e.Name] = true
+		if err := validateDockerHost(e.Host); err != nil {
+			return nil, fmt.Errorf("endpoint %q: invalid host %q: %w", e.Name, e.Host, err)
+		}
+		if e.TLS() && strings.HasPrefix(e.Host, "ssh://") {
+			return nil, fmt.Errorf("endpoint %q: TLS settings don't apply to ssh:// hosts", e.Name)
+		}
+		if (e.TLSCert == "") != (e.TLSKey == "") {
+			return nil, fmt.Errorf("endpoint %q: tlsCert and tlsKey must be set together", e.Name)
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// ValidateRegistryMirror checks that mirror is a registry host, with an
+// optional port and path prefix, such as mirror.example.com:5000/dockerhub.
+func ValidateRegistryMirror(mirror string) error {
+	if strings.Contains(mirror, "://") {
+		return fmt.Errorf("must be a registry host without a scheme")
+	}
+	host, _, _ := strings.Cut(mirror, "/")
+	named, err := reference.ParseNormalizedNamed(strings.TrimSuffix(mirror, "/") + "/library/busybox")
+	if err != nil || reference.Domain(named) != host {
+		return fmt.Errorf("must be a registry host such as mirror.example.com or localhost:5000, optionally followed by a path")
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NotifyEvents are the events notifications can be routed for
+var NotifyEvents = []string{"container-exited", "health-failing", "image-update", "job-failed"}
+
+var channelName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Notifications are the channels notifications are sent to and the rules
+// deciding which events go where
+type Notifications struct {
+	Channels []NotifyChannel `yaml:"channels"`
+	Routes   []NotifyRoute   `yaml:"routes"`
+}
+
+// NotifyChannel is somewhere notifications are delivered
+type NotifyChannel struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // slack, discord, email or webhook
+
+	// URL is the incoming webhook of a Slack or Discord channel, or where a
+	// webhook channel posts the notification as JSON
+	URL string `yaml:"url"`
+
+	// Secret, for webhook channels, signs the body with HMAC-SHA256 in the
+	// X-Signature-256 header
+	Secret string `yaml:"secret"`
+
+	// SMTPHost (host:port), Username, Password, From and To configure an
+	// email channel. The connection is upgraded with STARTTLS when the
+	// server offers it.
+	SMTPHost string   `yaml:"smtpHost"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// NotifyRoute sends the events it matches to its channels. Empty lists
+// match anything.
+type NotifyRoute struct {
+	Events     []string `yaml:"events"`
+	Channels   []string `yaml:"channels"`
+	Endpoints  []string `yaml:"endpoints"`
+	Containers []string `yaml:"containers"` // name globs; routes with them skip events without a container
+}
+
+// Matches reports whether the route takes an event from endpoint, about the
+// named container if any
+func (r NotifyRoute) Matches(event, endpoint, container string) bool {
+	if len(r.Events) > 0 && !slices.Contains(r.Events, event) {
+		return false
+	}
+	if len(r.Endpoints) > 0 && !slices.Contains(r.Endpoints, endpoint) {
+		return false
+	}
+	if len(r.Containers) == 0 {
+		return true
+	}
+	for _, pattern := range r.Containers {
+		if ok, _ := path.Match(pattern, container); ok && container != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadNotifications reads the channels and routes from a YAML file, e.g.
+//
+//	channels:
+//	  - name: ops
+//	    type: slack
+//	    url: https://hooks.slack.com/services/...
+//	routes:
+//	  - events: [container-exited, health-failing]
+//	    channels: [ops]
+func loadNotifications(file string) (*Notifications, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var n Notifications
+	if err := yaml.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+
+	channels := make(map[string]bool, len(n.Channels))
+	for _, c := range n.Channels {
+		if !channelName.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid channel name %q: use lower case letters, digits, - and _", c.Name)
+		}
+		if channels[c.Name] {
+			return nil, fmt.Errorf("channel %q is defined twice", c.Name)
+		}
+		channels[c.Name] = true
+		if err := validateChannel(c); err != nil {
+			return nil, fmt.Errorf("channel %q: %w", c.Name, err)
+		}
+	}
+	for i, r := range n.Routes {
+		if len(r.Channels) == 0 {
+			return nil, fmt.Errorf("route %d: no channels", i+1)
+		}
+		for _, name := range r.Channels {
+			if !channels[name] {
+				return nil, fmt.Errorf("route %d: unknown channel %q", i+1, name)
+			}
+		}
+		for _, event := range r.Events {
+			if !slices.Contains(NotifyEvents, event) {
+				return nil, fmt.Errorf("route %d: unknown event %q", i+1, event)
+			}
+		}
+		for _, pattern := range r.Containers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %d: invalid container pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+	return &n, nil
+}
+
+func validateChannel(c NotifyChannel) error {
+	switch c.Type {
+	case "slack", "discord", "webhook":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid url %q: must be an http(s) URL", c.URL)
+		}
+		if c.Secret != "" && c.Type != "webhook" {
+			return fmt.Errorf("secret only applies to webhook channels")
+		}
+	case "email":
+		if _, _, err := net.SplitHostPort(c.SMTPHost); err != nil {
+			return fmt.Errorf("invalid smtpHost %q: must be host:port", c.SMTPHost)
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return fmt.Errorf("email channels need from and to")
+		}
+	default:
+		return fmt.Errorf("invalid type %q: must be slack, discord, email or webhook", c.Type)
+	}
+	return nil
+}
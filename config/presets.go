@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// ResourcePreset is a named set of resource limits applied when creating
+// containers
+type ResourcePreset struct {
+	CPUs   float64 // fractional CPUs; zero means unlimited
+	Memory int64   // bytes; zero means unlimited
+}
+
+// DefaultResourcePresets are used when no presets file is configured
+var DefaultResourcePresets = map[string]ResourcePreset{
+	"small":  {CPUs: 0.5, Memory: 256 * units.MiB},
+	"medium": {CPUs: 1, Memory: 1 * units.GiB},
+	"large":  {CPUs: 2, Memory: 2 * units.GiB},
+}
+
+// loadResourcePresets reads presets from a YAML (or JSON) file mapping each
+// preset name to its limits, e.g.
+//
+//	small:
+//	  cpus: 0.5
+//	  memory: 256m
+func loadResourcePresets(path string) (map[string]ResourcePreset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]struct {
+		CPUs   float64 `yaml:"cpus"`
+		Memory string  `yaml:"memory"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no presets defined")
+	}
+
+	presets := make(map[string]ResourcePreset, len(raw))
+	for name, p := range raw {
+		if p.CPUs < 0 {
+			return nil, fmt.Errorf("preset %q: cpus must not be negative", name)
+		}
+		preset := ResourcePreset{CPUs: p.CPUs}
+		if p.Memory != "" {
+			preset.Memory, err = units.RAMInBytes(p.Memory)
+			if err != nil || preset.Memory < 0 {
+				return nil, fmt.Errorf("preset %q: invalid memory %q", name, p.Memory)
+			}
+		}
+		presets[name] = preset
+	}
+	return presets, nil
+}
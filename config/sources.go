@@ -0,0 +1,211 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the environment variables the configuration is read from.
+// Each can also be set in the config file, keyed by its name without the
+// KIBUTSU_ prefix in lower case (request_timeout), or with a flag of the
+// same name in kebab case (--request-timeout).
+var settings = map[string]string{
+	"PORT":                           "port to listen on",
+	"CORS_ORIGIN":                    "comma-separated origins allowed to call the API",
+	"KIBUTSU_DOCKER_HOST":            "Docker daemon address (unix://, tcp:// or npipe://)",
+	"KIBUTSU_ENDPOINTS_FILE":         "further Docker daemons to manage",
+	"KIBUTSU_BASE_PATH":              "subpath the UI and API are served under",
+	"KIBUTSU_REQUEST_TIMEOUT":        "per-request timeout",
+	"KIBUTSU_DOCKER_READ_TIMEOUT":    "timeout for Docker reads",
+	"KIBUTSU_DOCKER_WRITE_TIMEOUT":   "timeout for Docker state changes",
+	"KIBUTSU_DOCKER_LONG_TIMEOUT":    "timeout for multi-container operations",
+	"KIBUTSU_DOCKER_RETRIES":         "attempts for Docker reads hitting transient errors",
+	"KIBUTSU_DOCKER_RETRY_BACKOFF":   "delay before the first retry",
+	"KIBUTSU_PULL_RETRIES":           "attempts for interrupted image pulls",
+	"KIBUTSU_STARTUP_TIMEOUT":        "how long to wait for the Docker daemon at startup",
+	"KIBUTSU_SERVER_READ_TIMEOUT":    "HTTP server read timeout",
+	"KIBUTSU_SERVER_WRITE_TIMEOUT":   "HTTP server write timeout",
+	"KIBUTSU_SERVER_IDLE_TIMEOUT":    "HTTP keep-alive idle timeout",
+	"KIBUTSU_SHUTDOWN_TIMEOUT":       "how long in-flight requests get to finish on shutdown",
+	"KIBUTSU_STOP_TIMEOUT":           "default graceful container stop timeout",
+	"KIBUTSU_MAX_STREAMS":            "concurrent streams across all clients (0 = unlimited)",
+	"KIBUTSU_MAX_STREAMS_PER_CLIENT": "concurrent streams per client IP (0 = unlimited)",
+	"KIBUTSU_STREAM_IDLE_TIMEOUT":    "force-close streams idle this long (0 = never)",
+	"KIBUTSU_EVENT_REPLAY":           "recent events replayed to clients on connect",
+	"KIBUTSU_SECRET_ENV_PATTERNS":    "env var name globs whose values are redacted",
+	"KIBUTSU_NAME_PREFIX":            "prefix of the containers kibutsu manages",
+	"KIBUTSU_USAGE_INTERVAL":         "sampling interval for the system usage stream",
+	"KIBUTSU_UPDATE_CHECK_INTERVAL":  "interval between image update checks (0 = never)",
+	"KIBUTSU_RESOURCE_PRESETS":       "resource presets file",
+	"KIBUTSU_COMPOSE_DIR":            "directory of compose projects",
+	"KIBUTSU_RATE_LIMIT":             "requests per second per client IP (0 disables)",
+	"KIBUTSU_RATE_BURST":             "burst size for the rate limiter",
+	"KIBUTSU_LOG_LEVEL":              "debug, info, warn or error",
+	"KIBUTSU_LOG_FORMAT":             "text or json",
+	"KIBUTSU_LOG_FILE":               "stdout, stderr or a file to write logs to",
+	"KIBUTSU_LOG_MAX_SIZE":           "megabytes at which the log file is rotated (0 = never)",
+	"KIBUTSU_LOG_MAX_BACKUPS":        "rotated log files to keep",
+	"KIBUTSU_ADMIN_TOKEN":            "bearer token for the admin endpoints",
+	"KIBUTSU_METRICS_TOKEN":          "bearer token required to scrape /metrics",
+	"KIBUTSU_ENABLE_PASSTHROUGH":     "1 enables the Docker API passthrough",
+	"KIBUTSU_CONFIRM_DESTRUCTIVE":    "1 requires a remove-preview token before removing containers",
+	"KIBUTSU_REGISTRY_MIRROR":        "registry Docker Hub images are pulled through",
+	"KIBUTSU_REGISTRY_AUTH_FILE":     "registry logins used to pull, push and build images",
+	"KIBUTSU_REGISTRY_STORE":         "encrypted file of registry logins added through the API",
+	"KIBUTSU_SECRET_KEY":             "key the registry store is encrypted with",
+	"KIBUTSU_AUDIT_FILE":             "append-only log of state-changing API calls",
+	"KIBUTSU_JOBS_FILE":              "scheduled jobs and their run history",
+	"KIBUTSU_NOTIFICATIONS_FILE":     "notification channels and routing rules",
+	"KIBUTSU_LOG_STORE_DIR":          "directory container logs are collected into",
+	"KIBUTSU_LOG_COLLECT":            "name globs of the containers whose logs are collected",
+	"KIBUTSU_LOG_RETENTION":          "how long collected logs are kept (0 = until the size cap)",
+	"KIBUTSU_LOG_STORE_MAX_SIZE":     "megabytes of collected logs kept per container (0 = unlimited)",
+	"KIBUTSU_BACKUP_DIR":             "directory backups of volumes and compose projects are kept in",
+	"KIBUTSU_VOLUME_HELPER_IMAGE":    "image of the containers that mount volumes for backups",
+	"KIBUTSU_S3_ENDPOINT":            "URL of an S3-compatible storage server (default AWS S3)",
+	"KIBUTSU_S3_REGION":              "region of the S3 bucket",
+	"KIBUTSU_S3_BUCKET":              "bucket backups, exports and log archives are kept in",
+	"KIBUTSU_S3_PREFIX":              "prefix of the object keys in the bucket",
+	"KIBUTSU_S3_ACCESS_KEY":          "access key of the S3 bucket",
+	"KIBUTSU_S3_SECRET_KEY":          "secret key of the S3 bucket",
+	"KIBUTSU_S3_PATH_STYLE":          "1 names the bucket in the path, 0 in the host name",
+	"KIBUTSU_USERS_FILE":             "accounts allowed to log in",
+	"KIBUTSU_SESSION_TTL":            "how long a login session lasts",
+	"KIBUTSU_TLS_CERT":               "PEM certificate to serve HTTPS with",
+	"KIBUTSU_TLS_KEY":                "private key of the TLS certificate",
+	"KIBUTSU_HTTP_REDIRECT_ADDR":     "address redirecting plain HTTP to HTTPS",
+	"KIBUTSU_ACME_DOMAINS":           "host names to get Let's Encrypt certificates for",
+	"KIBUTSU_ACME_EMAIL":             "contact email of the ACME account",
+	"KIBUTSU_ACME_CACHE_DIR":         "directory ACME certificates and keys are kept in",
+	"KIBUTSU_ACME_DIRECTORY_URL":     "ACME directory to use in place of Let's Encrypt's",
+}
+
+// Options are the sources read besides the environment
+type Options struct {
+	// File is a YAML config file, re-read on every Load. Empty means none.
+	File string
+
+	// Flags are the settings given on the command line, by setting key
+	Flags map[string]string
+}
+
+// ParseFlags reads the command-line flags: --config (or KIBUTSU_CONFIG)
+// names the config file and every setting has a flag of its own. It
+// returns flag.ErrHelp after printing usage for -h.
+func ParseFlags(args []string) (Options, error) {
+	fs := flag.NewFlagSet("kibutsu", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("KIBUTSU_CONFIG"), "YAML config file")
+	names := make(map[string]string, len(settings))
+	for _, name := range sortedSettings() {
+		flagName := strings.ReplaceAll(settingKey(name), "_", "-")
+		names[flagName] = name
+		fs.String(flagName, "", fmt.Sprintf("%s (%s)", settings[name], name))
+	}
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	if fs.NArg() > 0 {
+		return Options{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	opts := Options{File: *file, Flags: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := names[f.Name]; ok {
+			opts.Flags[settingKey(name)] = f.Value.String()
+		}
+	})
+	return opts, nil
+}
+
+// source looks settings up in the flags, then the environment, then the
+// config file
+type source struct {
+	flags map[string]string
+	file  map[string]string
+}
+
+func newSource(opts Options) (source, error) {
+	s := source{flags: opts.Flags}
+	if opts.File != "" {
+		file, err := readConfigFile(opts.File)
+		if err != nil {
+			return source{}, fmt.Errorf("invalid config file %s: %w", opts.File, err)
+		}
+		s.file = file
+	}
+	return s, nil
+}
+
+func (s source) get(name string) string {
+	key := settingKey(name)
+	if v, ok := s.flags[key]; ok {
+		return v
+	}
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return s.file[key]
+}
+
+// readConfigFile returns the settings in a YAML config file as the strings
+// the environment would hold: booleans become 1 or 0 and lists are comma
+// separated.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(settings))
+	for name := range settings {
+		known[settingKey(name)] = true
+	}
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+		switch v := v.(type) {
+		case nil:
+		case bool:
+			values[key] = "0"
+			if v {
+				values[key] = "1"
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("%s must not be a mapping", key)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// settingKey is the config file key of an environment variable
+func settingKey(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, "KIBUTSU_"))
+}
+
+func sortedSettings() []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ObjectStorage is an S3-compatible bucket, on AWS S3 or a server such as
+// MinIO, that backups, exports and log archives can be kept in
+type ObjectStorage struct {
+	// Endpoint is the storage server's URL, such as http://minio:9000;
+	// https://s3.{region}.amazonaws.com unless set
+	Endpoint string
+
+	Region string
+	Bucket string
+
+	// Prefix is prepended to every object key, so several installations can
+	// share a bucket
+	Prefix string
+
+	AccessKey string
+	SecretKey string
+
+	// PathStyle names the bucket in the URL's path rather than its host
+	// name, as MinIO and most self-hosted servers need. It is the default
+	// when Endpoint is set.
+	PathStyle bool
+}
+
+// loadObjectStorage reads the KIBUTSU_S3_* settings, returning nil when no
+// bucket is set. The keys fall back to the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+func loadObjectStorage(src source) (*ObjectStorage, error) {
+	bucket := src.get("KIBUTSU_S3_BUCKET")
+	if bucket == "" {
+		for _, name := range []string{"KIBUTSU_S3_ENDPOINT", "KIBUTSU_S3_PREFIX", "KIBUTSU_S3_ACCESS_KEY", "KIBUTSU_S3_SECRET_KEY"} {
+			if src.get(name) != "" {
+				return nil, fmt.Errorf("%s requires KIBUTSU_S3_BUCKET", name)
+			}
+		}
+		return nil, nil
+	}
+
+	storage := &ObjectStorage{
+		Endpoint:  src.get("KIBUTSU_S3_ENDPOINT"),
+		Region:    src.get("KIBUTSU_S3_REGION"),
+		Bucket:    bucket,
+		Prefix:    strings.Trim(src.get("KIBUTSU_S3_PREFIX"), "/"),
+		AccessKey: src.get("KIBUTSU_S3_ACCESS_KEY"),
+		SecretKey: src.get("KIBUTSU_S3_SECRET_KEY"),
+	}
+	if storage.Region == "" {
+		storage.Region = "us-east-1"
+	}
+	if storage.AccessKey == "" {
+		storage.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if storage.SecretKey == "" {
+		storage.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if storage.AccessKey == "" || storage.SecretKey == "" {
+		return nil, fmt.Errorf("KIBUTSU_S3_BUCKET needs KIBUTSU_S3_ACCESS_KEY and KIBUTSU_S3_SECRET_KEY")
+	}
+
+	if storage.Endpoint == "" {
+		storage.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", storage.Region)
+	} else {
+		u, err := url.Parse(storage.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid KIBUTSU_S3_ENDPOINT %q: must be an http or https URL without a path", storage.Endpoint)
+		}
+		storage.Endpoint = u.Scheme + "://" + u.Host
+		storage.PathStyle = true
+	}
+	switch v := src.get("KIBUTSU_S3_PATH_STYLE"); v {
+	case "":
+	case "1":
+		storage.PathStyle = true
+	case "0":
+		storage.PathStyle = false
+	default:
+		return nil, fmt.Errorf("invalid KIBUTSU_S3_PATH_STYLE %q: must be 1 or 0", v)
+	}
+	return storage, nil
+}
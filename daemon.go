@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"kibutsu/config"
+)
+
+// daemonCheckInterval is how often a reachable daemon is pinged to notice
+// it going away
+const daemonCheckInterval = 15 * time.Second
+
+// daemonRetryMin and daemonRetryMax bound the backoff between attempts to
+// reach a daemon that is down
+const (
+	daemonRetryMin = time.Second
+	daemonRetryMax = 30 * time.Second
+)
+
+// DaemonStatus reports whether a Docker endpoint's daemon can be reached
+type DaemonStatus struct {
+	Endpoint   string `json:"endpoint"`
+	Host       string `json:"host"`
+	Connected  bool   `json:"connected"`
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Since is when the daemon was last found to be reachable or
+	// unreachable, whichever it is now
+	Since     *time.Time `json:"since,omitempty"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+
+	// Attempts counts the failed pings since the daemon was last reachable
+	Attempts  int        `json:"attempts,omitempty"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+
+	// Reconnects counts the times the client was reset after losing its
+	// connection to the daemon
+	Reconnects int `json:"reconnects,omitempty"`
+
+	// Swarm is the daemon's Swarm node state, such as inactive or active,
+	// and SwarmManager whether it is a manager, as of the last ping
+	Swarm        string `json:"swarm,omitempty"`
+	SwarmManager bool   `json:"swarmManager,omitempty"`
+}
+
+// daemonMonitor keeps track of whether a daemon is reachable, so the server
+// can keep running without it and report it offline rather than exit.
+//
+// Every handler holds the endpoint's client, so it can't be swapped for a
+// new one. When the connection itself fails (the socket is gone, say, with
+// the daemon restarting) the client is reset in place instead: its pooled
+// connections are dropped so calls dial afresh, and once the daemon answers
+// again the API version is lowered to its own if it came back older.
+type daemonMonitor struct {
+	client *client.Client
+	config *config.Store
+
+	mu     sync.Mutex
+	status DaemonStatus
+	// reset is set when the connection failed and the client should
+	// renegotiate once the daemon is back
+	reset bool
+	// wake cuts the wait short when a refresh finds the daemon gone
+	wake chan struct{}
+}
+
+func newDaemonMonitor(endpoint string, cli *client.Client, cfg *config.Store) *daemonMonitor {
+	return &daemonMonitor{
+		client: cli,
+		config: cfg,
+		status: DaemonStatus{Endpoint: endpoint, Host: cli.DaemonHost()},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// run pings the daemon every daemonCheckInterval while it is reachable, and
+// with a doubling backoff while it isn't, until ctx is cancelled
+func (m *daemonMonitor) run(ctx context.Context) {
+	backoff := daemonRetryMin
+	for {
+		m.mu.Lock()
+		wait := daemonCheckInterval
+		switch {
+		case m.status.LastCheck == nil:
+			wait = 0
+		case !m.status.Connected:
+			wait = backoff
+			backoff = min(backoff*2, daemonRetryMax)
+			next := time.Now().Add(wait).UTC()
+			m.status.NextRetry = &next
+		default:
+			backoff = daemonRetryMin
+		}
+		m.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-m.wake:
+			timer.Stop()
+			continue
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, m.config.Get().DockerReadTimeout)
+		m.ping(pingCtx)
+		cancel()
+	}
+}
+
+// ping checks the daemon and records the outcome, logging when it goes
+// away or comes back
+func (m *daemonMonitor) ping(ctx context.Context) bool {
+	ping, err := m.client.Ping(ctx)
+	now := time.Now().UTC()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &m.status
+	known := s.LastCheck != nil
+	s.LastCheck = &now
+	if err != nil {
+		if s.Connected || !known {
+			s.Since = &now
+			slog.Warn("Docker daemon unreachable", "endpoint", s.Endpoint, "host", s.Host, "error", err)
+		}
+		s.Connected, s.LastError = false, err.Error()
+		s.Attempts++
+		if client.IsErrConnectionFailed(err) {
+			m.client.Close()
+			m.reset = true
+		}
+		return false
+	}
+	if m.reset {
+		m.client.NegotiateAPIVersionPing(ping)
+		m.reset = false
+		s.Reconnects++
+	}
+	if !s.Connected {
+		s.Since = &now
+		if known {
+			slog.Info("Reconnected to Docker daemon", "endpoint", s.Endpoint, "host", s.Host, "attempts", s.Attempts, "api_version", ping.APIVersion)
+		}
+	}
+	s.Connected, s.APIVersion, s.LastError, s.Attempts = true, ping.APIVersion, "", 0
+	s.Swarm, s.SwarmManager = "", false
+	if ping.SwarmStatus != nil {
+		s.Swarm, s.SwarmManager = string(ping.SwarmStatus.NodeState), ping.SwarmStatus.ControlAvailable
+	}
+	s.NextRetry = nil
+	return true
+}
+
+func (m *daemonMonitor) snapshot() DaemonStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// statusHandler reports the daemon's status as of the last ping, or pings
+// it first with refresh=true
+func (m *daemonMonitor) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("refresh") == "true" {
+		ctx, cancel := context.WithTimeout(r.Context(), m.config.Get().DockerReadTimeout)
+		was := m.snapshot().Connected
+		if !m.ping(ctx) && was {
+			// Start the backoff now rather than at the next routine check
+			select {
+			case m.wake <- struct{}{}:
+			default:
+			}
+		}
+		cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.snapshot())
+}
@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+// Entries of a project backup: the project's bundle, then one archive per
+// named volume
+const (
+	backupBundleEntry = "project.tar.gz"
+	backupVolumeDir   = "volumes/"
+)
+
+// ProjectVolumes returns the named volumes a project's services mount,
+// sorted. Bind mounts of host paths are not volumes.
+func ProjectVolumes(config *apitypes.ComposeConfig) []string {
+	names := make(map[string]bool)
+	for _, svc := range config.Services {
+		for _, volume := range svc.Volumes {
+			source, _, ok := strings.Cut(volume, ":")
+			if !ok || source == "" || strings.ContainsAny(source[:1], "/.~$") {
+				continue
+			}
+			names[source] = true
+		}
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// BackupProject writes a project's bundle (see WriteBundle) and an archive
+// of each of its named volumes that exists, as BackupVolume makes them, to
+// w as a tar. Each archive is staged in a temporary file first, since a tar
+// entry needs its size up front.
+func BackupProject(ctx context.Context, cli *client.Client, helperImage string, w io.Writer, dir, name string, files, volumes []string) error {
+	tw := tar.NewWriter(w)
+
+	err := addBackupEntry(tw, backupBundleEntry, func(w io.Writer) error {
+		return WriteBundle(w, dir, name, files)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up project files: %w", err)
+	}
+
+	for _, volume := range volumes {
+		if _, err := cli.VolumeInspect(ctx, volume); client.IsErrNotFound(err) {
+			// Not created yet, or removed with the project
+			continue
+		}
+		err := addBackupEntry(tw, backupVolumeDir+volume+".tar.gz", func(w io.Writer) error {
+			return BackupVolume(ctx, cli, volume, helperImage, w)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to back up volume %s: %w", volume, err)
+		}
+	}
+	return tw.Close()
+}
+
+// addBackupEntry adds the output of write to tw as a file called name
+func addBackupEntry(tw *tar.Writer, name string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp("", "kibutsu-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	return err
+}
+
+// RestoreProject puts back a backup made by BackupProject. Every volume in
+// it is emptied and refilled. The project's files are registered under root
+// only if the project doesn't exist any more; an existing project keeps its
+// files.
+func RestoreProject(ctx context.Context, cli *client.Client, helperImage string, r io.Reader, root, name string) (*apitypes.BackupRestoreResult, error) {
+	result := &apitypes.BackupRestoreResult{Project: name, Volumes: []string{}}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+
+		switch {
+		case hdr.Name == backupBundleEntry:
+			if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+				continue
+			}
+			if _, err := ImportBundle(tr, root, name); err != nil {
+				return result, fmt.Errorf("failed to restore project files: %w", err)
+			}
+			result.Files = true
+
+		case strings.HasPrefix(hdr.Name, backupVolumeDir) && path.Ext(hdr.Name) == ".gz":
+			volume := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, backupVolumeDir), ".tar.gz")
+			if volume == "" || strings.Contains(volume, "/") {
+				return result, fmt.Errorf("%w: unexpected entry %q", ErrInvalidBundle, hdr.Name)
+			}
+			if err := RestoreVolume(ctx, cli, volume, helperImage, tr, true); err != nil {
+				return result, fmt.Errorf("failed to restore volume %s: %w", volume, err)
+			}
+			result.Volumes = append(result.Volumes, volume)
+		}
+	}
+}
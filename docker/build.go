@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+
+	apitypes "kibutsu/api/types"
+)
+
+// BuildWithBuildKit builds an image through the docker CLI with BuildKit
+// enabled. The Engine API only accepts BuildKit secrets over an interactive
+// session, which the CLI provides. Secrets are written to private temporary
+// files that are removed when the build ends; every output line is passed to
+// emit with secret values redacted. With opts.Remote the context is fetched
+// from there and buildContext, if not nil, is the Dockerfile to use. The
+// CLI gets authConfigs as its registry logins, in a config file next to the
+// secrets.
+func BuildWithBuildKit(ctx context.Context, daemonHost string, buildContext io.Reader, opts apitypes.BuildOptions, authConfigs map[string]registry.AuthConfig, emit func(line string)) error {
+	cli, err := exec.LookPath("docker")
+	if err != nil {
+		return fmt.Errorf("BuildKit builds require the docker CLI on the server: %w", err)
+	}
+
+	secretDir, err := os.MkdirTemp("", "kibutsu-build-secrets-")
+	if err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	defer os.RemoveAll(secretDir)
+
+	if err := writeCLIConfig(secretDir, authConfigs); err != nil {
+		return fmt.Errorf("failed to stage registry logins: %w", err)
+	}
+
+	args := []string{"build", "--progress=plain"}
+	if opts.Remote != "" && buildContext != nil {
+		args = append(args, "--file", "-")
+	} else if opts.Dockerfile != "" {
+		args = append(args, "--file", opts.Dockerfile)
+	}
+	if opts.Target != "" {
+		args = append(args, "--target", opts.Target)
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if opts.Pull {
+		args = append(args, "--pull")
+	}
+	for _, tag := range opts.Tags {
+		args = append(args, "--tag", tag)
+	}
+	for _, key := range sortedKeys(opts.BuildArgs) {
+		args = append(args, "--build-arg", key+"="+opts.BuildArgs[key])
+	}
+	for i, id := range sortedKeys(opts.Secrets) {
+		path := filepath.Join(secretDir, fmt.Sprintf("secret-%d", i))
+		if err := os.WriteFile(path, []byte(opts.Secrets[id]), 0o600); err != nil {
+			return fmt.Errorf("failed to stage secret %q: %w", id, err)
+		}
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s", id, path))
+	}
+	if opts.Remote != "" {
+		args = append(args, opts.Remote)
+	} else {
+		args = append(args, "-") // read the build context tarball from stdin
+	}
+
+	cmd := exec.CommandContext(ctx, cli, args...)
+	cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1", "DOCKER_HOST="+daemonHost, "DOCKER_CONFIG="+secretDir)
+	if buildContext != nil {
+		cmd.Stdin = buildContext
+	}
+
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture build output: %w", err)
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start build: %w", err)
+	}
+
+	redact := secretRedactor(opts.Secrets)
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		emit(redact(scanner.Text()))
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("build failed: %w", err)
+	}
+	return nil
+}
+
+// writeCLIConfig writes a docker CLI config.json into dir holding the
+// registry logins
+func writeCLIConfig(dir string, authConfigs map[string]registry.AuthConfig) error {
+	type cliAuth struct {
+		Auth string `json:"auth"`
+	}
+	auths := make(map[string]cliAuth, len(authConfigs))
+	for address, config := range authConfigs {
+		auths[address] = cliAuth{Auth: base64.StdEncoding.EncodeToString([]byte(config.Username + ":" + config.Password))}
+	}
+	data, err := json.Marshal(map[string]any{"auths": auths})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600)
+}
+
+// DockerfileContext returns a build context holding only a Dockerfile
+func DockerfileContext(dockerfile string) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	header := &tar.Header{
+		Name:    "Dockerfile",
+		Mode:    0o644,
+		Size:    int64(len(dockerfile)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// ValidateRemoteContext checks that a remote build context is a URL the
+// daemon fetches itself: http(s), git or an scp-style Git address. Local
+// paths are rejected, as they would be read from the daemon's host.
+func ValidateRemoteContext(remote string) error {
+	if strings.HasPrefix(remote, "git@") {
+		return nil
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "git", "ssh":
+	default:
+		return fmt.Errorf("must be an http(s) or Git URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
+}
+
+// secretRedactor returns a function that masks every secret value in s
+func secretRedactor(secrets map[string]string) func(s string) string {
+	values := make([]string, 0, len(secrets))
+	for _, v := range secrets {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	// Replace longer values first so a secret containing another is fully masked
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	return func(s string) string {
+		for _, v := range values {
+			s = strings.ReplaceAll(s, v, "****")
+		}
+		return s
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,251 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+)
+
+// MaxBundleSize caps the uncompressed size of an imported project bundle.
+const MaxBundleSize = 256 << 20
+
+var (
+	// ErrInvalidBundle is returned when an imported bundle is malformed or
+	// contains entries that would be unsafe to extract.
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrProjectExists is returned when importing over an existing project.
+	ErrProjectExists = errors.New("project already exists")
+)
+
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// BundleFiles lists the files that make up a project: the compose file, its
+// .env and any bind-mounted sources that live inside the project directory.
+// Paths are relative to dir and use forward slashes.
+func BundleFiles(dir string, config *apitypes.ComposeConfig) ([]string, error) {
+	files := map[string]bool{"docker-compose.yml": true}
+	if info, err := os.Stat(filepath.Join(dir, ".env")); err == nil && info.Mode().IsRegular() {
+		files[".env"] = true
+	}
+
+	for _, svc := range config.Services {
+		for _, volume := range svc.Volumes {
+			source := strings.SplitN(volume, ":", 2)[0]
+			if !strings.HasPrefix(source, ".") {
+				continue // named volume or absolute host path
+			}
+			rel, err := filepath.Rel(dir, filepath.Join(dir, source))
+			if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue // outside the project, cannot be moved with it
+			}
+			err = filepath.WalkDir(filepath.Join(dir, rel), func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.Type().IsRegular() {
+					r, _ := filepath.Rel(dir, p)
+					files[filepath.ToSlash(r)] = true
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read %s: %w", source, err)
+			}
+		}
+	}
+
+	list := make([]string, 0, len(files))
+	for f := range files {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// WriteBundle writes files from dir as a tar.gz whose entries are rooted at
+// a directory named after the project.
+func WriteBundle(w io.Writer, dir, name string, files []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		if err := addBundleFile(tw, filepath.Join(dir, filepath.FromSlash(f)), path.Join(name, f)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addBundleFile(tw *tar.Writer, src, name string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// ImportBundle extracts a bundle written by WriteBundle into a new project
+// directory under root. The project is named after the bundle's top-level
+// directory unless name is set. Only regular files and directories are
+// accepted, and every entry must stay inside the project directory.
+func ImportBundle(r io.Reader, root, name string) (*apitypes.BundleImport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a gzip stream: %v", ErrInvalidBundle, err)
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(root, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	result := &apitypes.BundleImport{Files: make([]string, 0)}
+	var bundleRoot string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+
+		top, rel, err := splitBundlePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if bundleRoot == "" {
+			bundleRoot = top
+		} else if top != bundleRoot {
+			return nil, fmt.Errorf("%w: entries span several top-level directories", ErrInvalidBundle)
+		}
+		if rel == "" {
+			continue
+		}
+		target := filepath.Join(tmp, filepath.FromSlash(rel))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			result.Bytes += header.Size
+			if result.Bytes > MaxBundleSize {
+				return nil, fmt.Errorf("%w: exceeds %d bytes", ErrInvalidBundle, MaxBundleSize)
+			}
+			if err := extractBundleFile(tr, target, header); err != nil {
+				return nil, err
+			}
+			result.Files = append(result.Files, rel)
+		default:
+			return nil, fmt.Errorf("%w: %s is not a regular file or directory", ErrInvalidBundle, header.Name)
+		}
+	}
+
+	if name == "" {
+		name = bundleRoot
+	}
+	if !projectNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid project name %q", ErrInvalidBundle, name)
+	}
+
+	config, err := loadComposeFile(filepath.Join(tmp, "docker-compose.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot load docker-compose.yml: %v", ErrInvalidBundle, err)
+	}
+	if len(config.Services) == 0 {
+		return nil, fmt.Errorf("%w: docker-compose.yml defines no services", ErrInvalidBundle)
+	}
+	result.Services = make([]string, 0, len(config.Services))
+	for svc := range config.Services {
+		result.Services = append(result.Services, svc)
+	}
+	sort.Strings(result.Services)
+	sort.Strings(result.Files)
+
+	dest := filepath.Join(root, name)
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProjectExists, name)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return nil, err
+	}
+	result.Project = name
+	return result, nil
+}
+
+// splitBundlePath validates an entry name and splits it into the bundle's
+// top-level directory and the path below it.
+func splitBundlePath(name string) (string, string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", "", fmt.Errorf("%w: unsafe path %q", ErrInvalidBundle, name)
+	}
+	for _, elem := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if elem == ".." {
+			return "", "", fmt.Errorf("%w: unsafe path %q", ErrInvalidBundle, name)
+		}
+	}
+
+	clean := path.Clean(name)
+	top, rel, _ := strings.Cut(clean, "/")
+	if top == "." || !fs.ValidPath(clean) {
+		return "", "", fmt.Errorf("%w: unsafe path %q", ErrInvalidBundle, name)
+	}
+	return top, rel, nil
+}
+
+func extractBundleFile(r io.Reader, target string, header *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fs.FileMode(header.Mode)&0755|0600)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%w: duplicate entry %s", ErrInvalidBundle, header.Name)
+		}
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(file, r, header.Size); err != nil {
+		return fmt.Errorf("%w: truncated entry %s", ErrInvalidBundle, header.Name)
+	}
+	return nil
+}
@@ -2,9 +2,10 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,6 +18,7 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
@@ -27,8 +29,17 @@ type ComposeProject struct {
 	Name       string
 	ConfigPath string
 	Config     *apitypes.ComposeConfig
-	client     *client.Client
-	mu         sync.RWMutex
+	// StopTimeout is the graceful stop timeout in seconds used when
+	// removing containers
+	StopTimeout int
+	// Progress, if set, receives per-service progress during Up and Pull
+	Progress func(apitypes.ComposeProgress)
+	// RegistryMirror, if set, is used to pull Docker Hub images
+	RegistryMirror string
+	// RegistryAuth, if set, supplies logins for private registries
+	RegistryAuth RegistryAuth
+	client       *client.Client
+	mu           sync.RWMutex
 }
 
 type ProjectStatus struct {
@@ -57,31 +68,293 @@ type ContainerInfo struct {
 
 func NewComposeProject(client *client.Client, name string, config *apitypes.ComposeConfig) (*ComposeProject, error) {
 	return &ComposeProject{
-		Name:       name,
-		ConfigPath: filepath.Join("compose", name, "docker-compose.yml"),
-		Config:     config,
-		client:     client,
+		Name:        name,
+		ConfigPath:  filepath.Join("compose", name, "docker-compose.yml"),
+		Config:      config,
+		StopTimeout: 30,
+		client:      client,
 	}, nil
 }
 
-func (p *ComposeProject) Up(ctx context.Context) error {
+// Up creates and starts every service in dependency order. A service that
+// fails does not stop the others, but services depending on it are skipped.
+// The result lists what happened to each service; the error is non-nil if
+// any service failed or was skipped.
+func (p *ComposeProject) Up(ctx context.Context) (*apitypes.ComposeResult, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	result := &apitypes.ComposeResult{
+		Operation: "up",
+		Succeeded: []string{},
+		Failed:    []string{},
+		Skipped:   []string{},
+	}
+
 	// Create networks first
 	if err := p.createNetworks(ctx); err != nil {
-		return fmt.Errorf("failed to create networks: %w", err)
+		p.emit(apitypes.ComposeProgress{Status: "error", Error: err.Error()})
+		return result, fmt.Errorf("failed to create networks: %w", err)
 	}
 
 	// Create and start services in dependency order
-	services := p.getServiceOrder()
-	for _, serviceName := range services {
+	unavailable := make(map[string]bool)
+	for _, serviceName := range p.getServiceOrder() {
+		if dep := p.unavailableDependency(serviceName, unavailable); dep != "" {
+			unavailable[serviceName] = true
+			result.Skipped = append(result.Skipped, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "skipped", Error: fmt.Sprintf("dependency %s did not start", dep)})
+			continue
+		}
 		if err := p.startService(ctx, serviceName); err != nil {
-			return fmt.Errorf("failed to start service %s: %w", serviceName, err)
+			unavailable[serviceName] = true
+			result.Failed = append(result.Failed, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "error", Error: err.Error()})
+			continue
 		}
+		result.Succeeded = append(result.Succeeded, serviceName)
 	}
 
-	return nil
+	result.Success = len(result.Failed) == 0 && len(result.Skipped) == 0
+	if !result.Success {
+		return result, fmt.Errorf("services failed to start: %s", strings.Join(append(result.Failed, result.Skipped...), ", "))
+	}
+	return result, nil
+}
+
+func (p *ComposeProject) unavailableDependency(service string, unavailable map[string]bool) string {
+	for _, dep := range p.Config.Services[service].DependsOn {
+		if unavailable[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+func (p *ComposeProject) emit(progress apitypes.ComposeProgress) {
+	if p.Progress != nil {
+		p.Progress(progress)
+	}
+}
+
+// Pull pulls the image of every service, or only of the services given,
+// including ones the daemon already has. A failed pull does not stop the
+// others; the error is non-nil if any image failed to pull.
+func (p *ComposeProject) Pull(ctx context.Context, services ...string) (*apitypes.ComposeResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := &apitypes.ComposeResult{
+		Operation: "pull",
+		Succeeded: []string{},
+		Failed:    []string{},
+		Skipped:   []string{},
+	}
+
+	for _, serviceName := range p.selectServices(services) {
+		ref := p.Config.Services[serviceName].Image
+		if ref == "" {
+			result.Failed = append(result.Failed, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "error", Error: "service has no image"})
+			continue
+		}
+		if err := p.pullImage(ctx, serviceName, ref); err != nil {
+			result.Failed = append(result.Failed, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "error", Error: err.Error()})
+			continue
+		}
+		result.Succeeded = append(result.Succeeded, serviceName)
+		p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "pulled"})
+	}
+
+	result.Success = len(result.Failed) == 0
+	if !result.Success {
+		return result, fmt.Errorf("images failed to pull: %s", strings.Join(result.Failed, ", "))
+	}
+	return result, nil
+}
+
+// Start starts the stopped containers of every service, or only of the
+// services given, in dependency order. Unlike docker compose start, a
+// service without containers has them created, as Up would.
+func (p *ComposeProject) Start(ctx context.Context, services ...string) (*apitypes.ComposeResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.eachContainer(ctx, "start", p.selectServices(services), func(ctx context.Context, id string) error {
+		return p.client.ContainerStart(ctx, id, container.StartOptions{})
+	})
+}
+
+// Stop stops the containers of every service, or only of the services
+// given, in reverse dependency order. The containers are kept, so Start
+// brings them back as they were.
+func (p *ComposeProject) Stop(ctx context.Context, services ...string) (*apitypes.ComposeResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	selected := p.selectServices(services)
+	for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+		selected[i], selected[j] = selected[j], selected[i]
+	}
+	timeout := p.StopTimeout
+	return p.eachContainer(ctx, "stop", selected, func(ctx context.Context, id string) error {
+		return p.client.ContainerStop(ctx, id, container.StopOptions{Timeout: &timeout})
+	})
+}
+
+// Restart restarts the existing containers of every service, or only of the
+// services given, in dependency order. Like docker compose restart it does
+// not recreate containers, so compose file changes are not applied. Services
+// without containers are skipped.
+func (p *ComposeProject) Restart(ctx context.Context, services ...string) (*apitypes.ComposeResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	timeout := p.StopTimeout
+	return p.eachContainer(ctx, "restart", p.selectServices(services), func(ctx context.Context, id string) error {
+		return p.client.ContainerRestart(ctx, id, container.StopOptions{Timeout: &timeout})
+	})
+}
+
+// operationStatus is the progress status reported before and after an
+// operation on a container
+var operationStatus = map[string][2]string{
+	"start":   {"starting", "started"},
+	"stop":    {"stopping", "stopped"},
+	"restart": {"restarting", "restarted"},
+}
+
+// eachContainer applies op to the containers of services, in the order
+// given. A service fails if op fails on any of its containers; the others
+// are still attempted. Services without containers are skipped, except by
+// start, which creates them.
+func (p *ComposeProject) eachContainer(ctx context.Context, operation string, services []string, op func(ctx context.Context, id string) error) (*apitypes.ComposeResult, error) {
+	result := &apitypes.ComposeResult{
+		Operation: operation,
+		Succeeded: []string{},
+		Failed:    []string{},
+		Skipped:   []string{},
+	}
+	status := operationStatus[operation]
+
+	for _, serviceName := range services {
+		f := filters.NewArgs()
+		f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+		f.Add("label", fmt.Sprintf("com.docker.compose.service=%s", serviceName))
+		containers, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+		if err != nil {
+			result.Failed = append(result.Failed, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "error", Error: err.Error()})
+			continue
+		}
+		if len(containers) == 0 {
+			if operation == "start" {
+				if err := p.startService(ctx, serviceName); err != nil {
+					result.Failed = append(result.Failed, serviceName)
+					p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "error", Error: err.Error()})
+					continue
+				}
+				result.Succeeded = append(result.Succeeded, serviceName)
+				continue
+			}
+			result.Skipped = append(result.Skipped, serviceName)
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Status: "skipped", Error: "service has no containers"})
+			continue
+		}
+
+		failed := false
+		for _, c := range containers {
+			containerName := strings.TrimPrefix(c.Names[0], "/")
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Container: containerName, Status: status[0]})
+			if err := op(ctx, c.ID); err != nil {
+				failed = true
+				p.emit(apitypes.ComposeProgress{Service: serviceName, Container: containerName, Status: "error", Error: err.Error()})
+				continue
+			}
+			p.emit(apitypes.ComposeProgress{Service: serviceName, Container: containerName, Status: status[1]})
+		}
+		if failed {
+			result.Failed = append(result.Failed, serviceName)
+		} else {
+			result.Succeeded = append(result.Succeeded, serviceName)
+		}
+	}
+
+	result.Success = len(result.Failed) == 0
+	if !result.Success {
+		return result, fmt.Errorf("services failed to %s: %s", operation, strings.Join(result.Failed, ", "))
+	}
+	return result, nil
+}
+
+// selectServices returns the given services in dependency order, or every
+// service if none are given
+func (p *ComposeProject) selectServices(services []string) []string {
+	order := p.getServiceOrder()
+	if len(services) == 0 {
+		return order
+	}
+	wanted := make(map[string]bool, len(services))
+	for _, s := range services {
+		wanted[s] = true
+	}
+	selected := make([]string, 0, len(services))
+	for _, s := range order {
+		if wanted[s] {
+			selected = append(selected, s)
+		}
+	}
+	return selected
+}
+
+// ensureImage pulls the service image if the daemon does not have it yet
+func (p *ComposeProject) ensureImage(ctx context.Context, service, ref string) error {
+	if _, _, err := p.client.ImageInspectWithRaw(ctx, ref); err == nil {
+		return nil
+	} else if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+	return p.pullImage(ctx, service, ref)
+}
+
+// pullImage pulls a service image, through the registry mirror if set
+func (p *ComposeProject) pullImage(ctx context.Context, service, ref string) error {
+	pullRef, mirrored, err := MirrorReference(ref, p.RegistryMirror)
+	if err != nil {
+		return err
+	}
+
+	encodedAuth, err := EncodedRegistryAuth(p.RegistryAuth, pullRef, nil)
+	if err != nil {
+		return err
+	}
+
+	p.emit(apitypes.ComposeProgress{Service: service, Status: "pulling"})
+	reader, err := p.client.ImagePull(ctx, pullRef, image.PullOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", pullRef, err)
+	}
+	defer reader.Close()
+
+	// The pull only completes once its progress stream is drained; errors
+	// arrive in-band.
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg apitypes.PullProgress
+		if err := decoder.Decode(&msg); err != nil {
+			if err != io.EOF {
+				return fmt.Errorf("failed to pull image %s: %w", pullRef, err)
+			}
+			if mirrored {
+				return NewImageManager(p.client).retagFromMirror(ctx, pullRef, ref)
+			}
+			return nil
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("failed to pull image %s: %s", pullRef, msg.Error)
+		}
+	}
 }
 
 func (p *ComposeProject) Down(ctx context.Context) error {
@@ -223,6 +496,11 @@ func (p *ComposeProject) Logs(ctx context.Context, service string, follow bool)
 	return io.NopCloser(io.MultiReader(readers...)), nil
 }
 
+// LoadProjectConfig reads the compose file of a project registered under root
+func LoadProjectConfig(root, name string) (*apitypes.ComposeConfig, error) {
+	return loadComposeFile(filepath.Join(root, name, "docker-compose.yml"))
+}
+
 // Helper functions
 func loadComposeFile(path string) (*apitypes.ComposeConfig, error) {
 	data, err := os.ReadFile(path)
@@ -276,7 +554,7 @@ func (p *ComposeProject) getServiceOrder() []string {
 		if !visited[name] {
 			if !visit(name) {
 				// Handle circular dependencies
-				log.Printf("Warning: circular dependency detected in service %s", name)
+				slog.Warn("Circular dependency detected", "service", name)
 			}
 		}
 	}
@@ -315,7 +593,7 @@ func (p *ComposeProject) removeNetworks(ctx context.Context) error {
 
 	for _, network := range networks {
 		if err := p.client.NetworkRemove(ctx, network.ID); err != nil {
-			log.Printf("Warning: failed to remove network %s: %v", network.Name, err)
+			slog.WarnContext(ctx, "Failed to remove network", "network", network.Name, "error", err)
 		}
 	}
 	return nil
@@ -328,6 +606,9 @@ func (p *ComposeProject) startService(ctx context.Context, service string) error
 		replicas = svcConfig.Deploy.Replicas
 	}
 
+	if err := p.ensureImage(ctx, service, svcConfig.Image); err != nil {
+		return err
+	}
 	for i := 0; i < replicas; i++ {
 		if err := p.createContainer(ctx, service, svcConfig, i); err != nil {
 			return err
@@ -349,14 +630,14 @@ func (p *ComposeProject) stopService(ctx context.Context, service string) error
 		return err
 	}
 
-	timeout := 30
+	timeout := p.StopTimeout
 	for _, c := range containers {
 		if err := p.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: &timeout}); err != nil {
-			log.Printf("Warning: failed to stop container %s: %v", c.ID, err)
+			slog.WarnContext(ctx, "Failed to stop container", "container", c.ID, "error", err)
 			continue
 		}
 		if err := p.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
-			log.Printf("Warning: failed to remove container %s: %v", c.ID, err)
+			slog.WarnContext(ctx, "Failed to remove container", "container", c.ID, "error", err)
 		}
 	}
 	return nil
@@ -405,22 +686,26 @@ func (p *ComposeProject) createContainer(ctx context.Context, service string, co
 	}
 
 	// Create container
-	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, fmt.Sprintf("%s_%s_%d", p.Name, service, index))
+	name := fmt.Sprintf("%s_%s_%d", p.Name, service, index)
+	p.emit(apitypes.ComposeProgress{Service: service, Container: name, Status: "creating"})
+	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
 	if err != nil {
 		return fmt.Errorf("failed to create container: %w", err)
 	}
 
 	// Start container
+	p.emit(apitypes.ComposeProgress{Service: service, Container: name, Status: "starting"})
 	if err := p.client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
 		return fmt.Errorf("failed to start container: %w", err)
 	}
+	p.emit(apitypes.ComposeProgress{Service: service, Container: name, Status: "started"})
 
 	return nil
 }
 
 func (p *ComposeProject) removeContainer(ctx context.Context, containerID string) error {
 	// Stop container first
-	timeout := 30
+	timeout := p.StopTimeout
 	if err := p.client.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout}); err != nil {
 		return fmt.Errorf("failed to stop container %s: %w", containerID, err)
 	}
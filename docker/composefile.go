@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v3"
+
+	apitypes "kibutsu/api/types"
+)
+
+// MaxComposeFileSize caps the size of an uploaded compose file
+const MaxComposeFileSize = 1 << 20
+
+// ErrInvalidComposeFile is returned for a compose file that doesn't parse
+// or that kibutsu couldn't bring up
+var ErrInvalidComposeFile = errors.New("invalid compose file")
+
+// ValidProjectName reports whether name can be used for a new project
+func ValidProjectName(name string) bool {
+	return projectNamePattern.MatchString(name)
+}
+
+// ParseComposeFile parses a compose file and checks that every service can
+// be created: each needs an image, valid port mappings and volume targets,
+// dependencies that exist without cycles, and declared networks. The error
+// lists every problem found.
+func ParseComposeFile(data []byte) (*apitypes.ComposeConfig, error) {
+	var config apitypes.ComposeConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidComposeFile, err)
+	}
+	if len(config.Services) == 0 {
+		return nil, fmt.Errorf("%w: no services defined", ErrInvalidComposeFile)
+	}
+
+	var problems []string
+	names := make([]string, 0, len(config.Services))
+	for name := range config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	deps := make(map[string][]string, len(names))
+	for _, name := range names {
+		spec := config.Services[name]
+		if spec.Image == "" {
+			problems = append(problems, fmt.Sprintf("service %s: image is required", name))
+		}
+		for _, port := range spec.Ports {
+			if _, err := nat.ParsePortSpec(port); err != nil {
+				problems = append(problems, fmt.Sprintf("service %s: invalid port mapping %q: %v", name, port, err))
+			}
+		}
+		for _, volume := range spec.Volumes {
+			parts := strings.Split(volume, ":")
+			if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+				problems = append(problems, fmt.Sprintf("service %s: invalid volume %q: must be source:/container/path[:mode]", name, volume))
+			}
+		}
+		for _, dep := range spec.DependsOn {
+			if _, ok := config.Services[dep]; !ok {
+				problems = append(problems, fmt.Sprintf("service %s: depends on undefined service %s", name, dep))
+			}
+		}
+		for _, network := range spec.Networks {
+			if _, ok := config.Networks[network]; !ok && network != "default" {
+				problems = append(problems, fmt.Sprintf("service %s: uses undefined network %s", name, network))
+			}
+		}
+		if spec.Deploy != nil && spec.Deploy.Replicas < 0 {
+			problems = append(problems, fmt.Sprintf("service %s: replicas must not be negative", name))
+		}
+		deps[name] = spec.DependsOn
+	}
+	for _, cycle := range findCycles(names, deps) {
+		problems = append(problems, fmt.Sprintf("dependency cycle: %s -> %s", strings.Join(cycle, " -> "), cycle[0]))
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidComposeFile, strings.Join(problems, "; "))
+	}
+	return &config, nil
+}
+
+// CreateProject registers a new project under root from the contents of
+// its compose file, which must pass ParseComposeFile.
+func CreateProject(root, name string, data []byte) (*apitypes.ComposeConfig, error) {
+	if !ValidProjectName(name) {
+		return nil, fmt.Errorf("%w: invalid project name %q: use lower case letters, digits, - and _", ErrInvalidComposeFile, name)
+	}
+	config, err := ParseComposeFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%w: %s", ErrProjectExists, name)
+		}
+		return nil, err
+	}
+	if err := WriteComposeFile(dir, data); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return config, nil
+}
+
+// WriteComposeFile replaces the compose file in a project directory. The
+// new contents are written to a temporary file first, so readers never see
+// a partial file.
+func WriteComposeFile(dir string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".docker-compose-*.yml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, "docker-compose.yml"))
+}
+
+// DiffServices compares the services of two compose files
+func DiffServices(old, next *apitypes.ComposeConfig) (added, removed []string, changed []apitypes.ServiceChange) {
+	added, removed, changed = []string{}, []string{}, []apitypes.ServiceChange{}
+	for name := range next.Services {
+		if _, ok := old.Services[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name, before := range old.Services {
+		after, ok := next.Services[name]
+		if !ok {
+			removed = append(removed, name)
+			continue
+		}
+		var fields []string
+		for _, f := range []struct {
+			key           string
+			before, after any
+		}{
+			{"image", before.Image, after.Image},
+			{"command", before.Command, after.Command},
+			{"environment", before.Environment, after.Environment},
+			{"ports", before.Ports, after.Ports},
+			{"volumes", before.Volumes, after.Volumes},
+			{"depends_on", before.DependsOn, after.DependsOn},
+			{"links", before.Links, after.Links},
+			{"networks", before.Networks, after.Networks},
+			{"deploy", before.Deploy, after.Deploy},
+		} {
+			if !reflect.DeepEqual(f.before, f.after) {
+				fields = append(fields, f.key)
+			}
+		}
+		if len(fields) > 0 {
+			changed = append(changed, apitypes.ServiceChange{Service: name, Fields: fields})
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Service < changed[j].Service })
+	return added, removed, changed
+}
@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// DiscoveredDevice is a device the daemon found through CDI, such as
+// nvidia.com/gpu=0
+type DiscoveredDevice struct {
+	Source string `json:"Source"`
+	ID     string `json:"ID"`
+}
+
+// DiscoveredDevices returns the devices the daemon reports in its info. ok
+// is false for daemons that don't report them (before API 1.50), whose
+// devices can't be known without starting a container.
+//
+// The client's Info predates the field and drops it, so the info is read
+// over a connection of its own, from the unversioned path that answers in
+// the daemon's own API version.
+func DiscoveredDevices(ctx context.Context, cli *client.Client) ([]DiscoveredDevice, bool, error) {
+	conn, err := cli.Dialer()(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/info", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return nil, false, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("daemon answered %s", resp.Status)
+	}
+
+	var info struct {
+		DiscoveredDevices *[]DiscoveredDevice
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, false, err
+	}
+	if info.DiscoveredDevices == nil {
+		return nil, false, nil
+	}
+	return *info.DiscoveredDevices, true, nil
+}
+
+// NvidiaGPUs returns the names of the NVIDIA GPUs among devices, as
+// --gpus device= takes them: indexes such as 0, or UUIDs when the CDI spec
+// names them that way. The nvidia.com/gpu=all device is left out.
+func NvidiaGPUs(devices []DiscoveredDevice) []string {
+	var gpus []string
+	for _, d := range devices {
+		name, ok := strings.CutPrefix(d.ID, "nvidia.com/gpu=")
+		if ok && name != "all" {
+			gpus = append(gpus, name)
+		}
+	}
+	return gpus
+}
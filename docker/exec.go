@@ -1,14 +1,19 @@
 package docker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"path"
+	"regexp"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 // ExecManager handles container exec operations
@@ -30,6 +35,35 @@ type ExecConfig struct {
 	Privileged   bool
 }
 
+// execUserPattern matches a user or uid, optionally followed by :group or :gid
+var execUserPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+
+// ValidateExecConfig checks the user and working directory of an exec
+// before it reaches the daemon, which reports these errors only on start.
+func ValidateExecConfig(config ExecConfig) error {
+	if config.User != "" && !execUserPattern.MatchString(config.User) {
+		return fmt.Errorf("invalid user %q: must be a name or uid, optionally followed by :group or :gid", config.User)
+	}
+	if config.WorkingDir != "" && !path.IsAbs(config.WorkingDir) {
+		return fmt.Errorf("invalid working directory %q: must be an absolute path", config.WorkingDir)
+	}
+	return nil
+}
+
+// ExecInfo describes an exec instance: what it was started with and its
+// current state
+type ExecInfo struct {
+	ID          string   `json:"id"`
+	ContainerID string   `json:"containerId"`
+	Cmd         []string `json:"cmd"`
+	User        string   `json:"user"`       // empty means the container's user
+	WorkingDir  string   `json:"workingDir"` // empty means the container's working directory
+	Tty         bool     `json:"tty"`
+	Running     bool     `json:"running"`
+	ExitCode    int      `json:"exitCode"`
+	Pid         int      `json:"pid"`
+}
+
 // ExecInstance represents an active exec instance
 type ExecInstance struct {
 	ID     string
@@ -47,6 +81,10 @@ func NewExecManager(client *client.Client) *ExecManager {
 
 // Create creates a new exec instance in a container
 func (m *ExecManager) Create(ctx context.Context, containerID string, config ExecConfig) (*ExecInstance, error) {
+	if err := ValidateExecConfig(config); err != nil {
+		return nil, err
+	}
+
 	execConfig := types.ExecConfig{
 		Cmd:          config.Cmd,
 		Tty:          config.Tty,
@@ -141,6 +179,126 @@ func (m *ExecManager) GetExitCode(ctx context.Context, execID string) (int, erro
 	return inspect.ExitCode, nil
 }
 
+// Inspect reports the state of an exec instance. The daemon does not echo
+// the user and working directory back, so they come from the config the
+// instance was created with.
+func (m *ExecManager) Inspect(ctx context.Context, execID string) (*ExecInfo, error) {
+	inspect, err := m.client.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect exec: %w", err)
+	}
+
+	info := &ExecInfo{
+		ID:          inspect.ExecID,
+		ContainerID: inspect.ContainerID,
+		Running:     inspect.Running,
+		ExitCode:    inspect.ExitCode,
+		Pid:         inspect.Pid,
+	}
+	if instance, ok := m.execs.Load(execID); ok {
+		config := instance.(*ExecInstance).Config
+		info.Cmd = config.Cmd
+		info.User = config.User
+		info.WorkingDir = config.WorkingDir
+		info.Tty = config.Tty
+	}
+	return info, nil
+}
+
+// ExecResult is the outcome of a command run to completion
+type ExecResult struct {
+	ExitCode  int
+	Output    []byte // stdout and stderr interleaved, capped at the requested limit
+	Truncated bool   // output beyond the limit was discarded
+}
+
+// Run executes a command without a TTY, feeding it stdin if given, and waits
+// for it to exit. Output past limit bytes is dropped. If ctx ends first the
+// command keeps running in the container, since the daemon can't stop an
+// exec.
+func (m *ExecManager) Run(ctx context.Context, containerID string, config ExecConfig, stdin io.Reader, limit int) (*ExecResult, error) {
+	if err := ValidateExecConfig(config); err != nil {
+		return nil, err
+	}
+
+	resp, err := m.client.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          config.Cmd,
+		Env:          config.Env,
+		User:         config.User,
+		WorkingDir:   config.WorkingDir,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	attach, err := m.client.ContainerExecAttach(ctx, resp.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	defer attach.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(attach.Conn, stdin)
+			attach.CloseWrite()
+		}()
+	}
+
+	output := &cappedBuffer{limit: limit}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(output, output, attach.Reader)
+		copied <- err
+	}()
+	select {
+	case err := <-copied:
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exec output: %w", err)
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// The output stream can close a moment before the daemon records the
+	// exit code.
+	for {
+		inspect, err := m.client.ContainerExecInspect(ctx, resp.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect exec: %w", err)
+		}
+		if !inspect.Running {
+			return &ExecResult{ExitCode: inspect.ExitCode, Output: output.buf.Bytes(), Truncated: output.truncated}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest. It is only written from one goroutine at a time.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
 // Remove removes an exec instance from the manager
 func (m *ExecManager) Remove(execID string) {
 	if instance, ok := m.execs.Load(execID); ok {
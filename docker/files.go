@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+// ListContainerDir lists the entries directly inside dir in a container.
+// The daemon only hands out whole trees, as a tar archive, so the archive's
+// headers are read and everything below the first level skipped. Reading
+// stops, and the list is reported as truncated, once maxEntries entries are
+// listed or maxBytes of the archive have been read, as a large subdirectory
+// would otherwise have the daemon send all of its content.
+func ListContainerDir(ctx context.Context, cli *client.Client, id, dir string, maxEntries int, maxBytes int64) ([]apitypes.ContainerFile, bool, error) {
+	rc, _, err := cli.CopyFromContainer(ctx, id, dir)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	// The daemon names entries after the base name of dir, so /etc/hosts
+	// comes as etc/hosts; the root's entries have no prefix
+	prefix := ""
+	if dir != "/" {
+		prefix = path.Base(dir) + "/"
+	}
+	entries := make([]apitypes.ContainerFile, 0)
+	archive := &readCounter{reader: rc}
+	tr := tar.NewReader(archive)
+	for {
+		if len(entries) == maxEntries || archive.n > maxBytes {
+			return sortFiles(entries), true, nil
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		name := strings.Trim(strings.TrimPrefix(hdr.Name, "./"), "/")
+		rel := strings.TrimSuffix(strings.TrimPrefix(name+"/", prefix), "/")
+		if rel == "" || rel == "." || strings.Contains(rel, "/") {
+			// dir itself, or deeper down
+			continue
+		}
+		entries = append(entries, containerFile(path.Join(dir, rel), hdr))
+	}
+	return sortFiles(entries), false, nil
+}
+
+// readCounter counts the bytes read through it
+type readCounter struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// StatContainerPath describes a single path in a container
+func StatContainerPath(ctx context.Context, cli *client.Client, id, p string) (apitypes.ContainerFile, error) {
+	stat, err := cli.ContainerStatPath(ctx, id, p)
+	if err != nil {
+		return apitypes.ContainerFile{}, err
+	}
+	return apitypes.ContainerFile{
+		Name:       stat.Name,
+		Path:       p,
+		Type:       fileType(stat.Mode),
+		Size:       stat.Size,
+		Mode:       stat.Mode.String(),
+		ModTime:    stat.Mtime.UTC(),
+		LinkTarget: stat.LinkTarget,
+	}, nil
+}
+
+func containerFile(p string, hdr *tar.Header) apitypes.ContainerFile {
+	mode := hdr.FileInfo().Mode()
+	return apitypes.ContainerFile{
+		Name:       path.Base(p),
+		Path:       p,
+		Type:       fileType(mode),
+		Size:       hdr.Size,
+		Mode:       mode.String(),
+		ModTime:    hdr.ModTime.UTC(),
+		LinkTarget: hdr.Linkname,
+	}
+}
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	}
+	return "other"
+}
+
+// sortFiles puts directories first, then orders by name
+func sortFiles(files []apitypes.ContainerFile) []apitypes.ContainerFile {
+	sort.Slice(files, func(i, j int) bool {
+		if (files[i].Type == "dir") != (files[j].Type == "dir") {
+			return files[i].Type == "dir"
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
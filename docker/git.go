@@ -0,0 +1,396 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+// gitSourcesDir holds the clones of Git-backed projects inside the compose
+// directory. Each project directory is a symlink into its clone; the dot
+// keeps the clones from being taken for projects themselves.
+const gitSourcesDir = ".git-sources"
+
+// gitCredentialsVersion is bound into encrypted credentials so they can't
+// be opened as anything else
+const gitCredentialsVersion = "kibutsu-git-credentials-v1"
+
+var (
+	// ErrInvalidGitSource is returned for a URL, branch or path that can't
+	// be used, or credentials that can't be stored
+	ErrInvalidGitSource = errors.New("invalid git source")
+	// ErrNotGitProject is returned for a project that wasn't imported from
+	// a Git repository
+	ErrNotGitProject = errors.New("project is not synced from git")
+	// ErrGitFailed is returned when git itself fails, such as when the
+	// repository can't be reached or the credentials are refused
+	ErrGitFailed = errors.New("git failed")
+)
+
+// scpLikeURL matches the user@host:path form git accepts for SSH
+var scpLikeURL = regexp.MustCompile(`^([A-Za-z0-9._-]+@)?[A-Za-z0-9.-]+:[^/\\][^\s]*$`)
+
+// gitLocks serializes git commands on the same clone
+var gitLocks sync.Map
+
+// gitSource is kept next to a project's clone, recording what to fetch
+type gitSource struct {
+	URL      string    `json:"url"`
+	Branch   string    `json:"branch,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Commit   string    `json:"commit"`
+	SyncedAt time.Time `json:"syncedAt"`
+
+	// Credentials is "username:password" sealed with the secret key
+	Nonce       []byte `json:"nonce,omitempty"`
+	Credentials []byte `json:"credentials,omitempty"`
+}
+
+// ImportGitProject clones a repository under root and registers the
+// directory at req.Path as project req.Name. The compose file there must
+// pass ParseComposeFile. Credentials are stored encrypted with key, so they
+// need one.
+func ImportGitProject(ctx context.Context, root string, key []byte, req apitypes.ComposeGitImportRequest) (*apitypes.ComposeGitSource, *apitypes.ComposeConfig, error) {
+	if !ValidProjectName(req.Name) {
+		return nil, nil, fmt.Errorf("%w: invalid project name %q: use lower case letters, digits, - and _", ErrInvalidGitSource, req.Name)
+	}
+	repoPath, err := validateGitSource(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	source := &gitSource{URL: req.URL, Branch: req.Branch, Path: repoPath}
+	auth := ""
+	if req.Username != "" || req.Password != "" {
+		if len(key) == 0 {
+			return nil, nil, fmt.Errorf("%w: storing credentials needs KIBUTSU_SECRET_KEY", ErrInvalidGitSource)
+		}
+		username := req.Username
+		if username == "" {
+			username = "git"
+		}
+		auth = username + ":" + req.Password
+		if source.Nonce, source.Credentials, err = sealGitCredentials(key, req.Name, auth); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	dest := filepath.Join(root, req.Name)
+	sources := filepath.Join(root, gitSourcesDir)
+	for _, p := range []string{dest, filepath.Join(sources, req.Name)} {
+		if _, err := os.Lstat(p); err == nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrProjectExists, req.Name)
+		}
+	}
+	if err := os.MkdirAll(sources, 0755); err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.MkdirTemp(sources, ".clone-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	args := []string{"clone", "--depth", "1", "--single-branch"}
+	if req.Branch != "" {
+		args = append(args, "--branch", req.Branch)
+	}
+	if _, err := runGit(ctx, tmp, auth, append(args, "--", req.URL, "repo")...); err != nil {
+		return nil, nil, err
+	}
+	repo := filepath.Join(tmp, "repo")
+	config, err := parseRepoComposeFile(repo, repoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if source.Commit, err = gitHead(ctx, repo, "HEAD"); err != nil {
+		return nil, nil, err
+	}
+	source.SyncedAt = time.Now().UTC()
+	if err := writeGitSource(tmp, source); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(sources, req.Name)); err != nil {
+		return nil, nil, err
+	}
+	target := filepath.Join(gitSourcesDir, req.Name, "repo", filepath.FromSlash(repoPath))
+	if err := os.Symlink(target, dest); err != nil {
+		os.RemoveAll(filepath.Join(sources, req.Name))
+		if errors.Is(err, os.ErrExist) {
+			return nil, nil, fmt.Errorf("%w: %s", ErrProjectExists, req.Name)
+		}
+		return nil, nil, err
+	}
+	return source.view(req.Name), config, nil
+}
+
+// SyncGitProject fetches the latest commit of a Git-backed project's branch
+// and checks it out, discarding changes made to tracked files in the clone.
+// A commit whose compose file doesn't pass ParseComposeFile is not kept.
+// It returns the commit checked out before and the project's compose file.
+func SyncGitProject(ctx context.Context, root, name string, key []byte) (*apitypes.ComposeGitSource, string, *apitypes.ComposeConfig, error) {
+	dir := filepath.Join(root, gitSourcesDir, name)
+	lock, _ := gitLocks.LoadOrStore(dir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	source, err := readGitSource(dir)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	auth := ""
+	if len(source.Credentials) > 0 {
+		if auth, err = openGitCredentials(key, name, source.Nonce, source.Credentials); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	repo := filepath.Join(dir, "repo")
+	ref := source.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, err := runGit(ctx, repo, auth, "fetch", "--depth", "1", "origin", ref); err != nil {
+		return nil, "", nil, err
+	}
+	latest, err := gitHead(ctx, repo, "FETCH_HEAD")
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	previous := source.Commit
+	if latest != previous {
+		if _, err := runGit(ctx, repo, "", "reset", "--hard", latest); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	config, err := parseRepoComposeFile(repo, source.Path)
+	if err != nil {
+		if latest != previous {
+			runGit(ctx, repo, "", "reset", "--hard", previous)
+		}
+		return nil, "", nil, fmt.Errorf("commit %s: %w", shortCommit(latest), err)
+	}
+
+	source.Commit = latest
+	source.SyncedAt = time.Now().UTC()
+	if err := writeGitSource(dir, source); err != nil {
+		return nil, "", nil, err
+	}
+	return source.view(name), previous, config, nil
+}
+
+// LoadGitSource describes where a Git-backed project comes from, or returns
+// ErrNotGitProject
+func LoadGitSource(root, name string) (*apitypes.ComposeGitSource, error) {
+	if !ValidProjectName(name) {
+		return nil, ErrNotGitProject
+	}
+	source, err := readGitSource(filepath.Join(root, gitSourcesDir, name))
+	if err != nil {
+		return nil, err
+	}
+	return source.view(name), nil
+}
+
+// validateGitSource checks the URL, branch and path of an import, returning
+// the path cleaned and relative to the repository root
+func validateGitSource(req apitypes.ComposeGitImportRequest) (string, error) {
+	if strings.HasPrefix(req.URL, "-") {
+		return "", fmt.Errorf("%w: invalid url %q", ErrInvalidGitSource, req.URL)
+	}
+	httpURL := false
+	if u, err := url.Parse(req.URL); err == nil && u.Scheme != "" && u.Host != "" {
+		switch u.Scheme {
+		case "https", "http":
+			httpURL = true
+			if _, ok := u.User.Password(); ok {
+				return "", fmt.Errorf("%w: pass credentials as username and password rather than in the url", ErrInvalidGitSource)
+			}
+		case "ssh", "git":
+		default:
+			return "", fmt.Errorf("%w: unsupported url scheme %q: use https, http, ssh or git", ErrInvalidGitSource, u.Scheme)
+		}
+	} else if strings.Contains(req.URL, "://") || !scpLikeURL.MatchString(req.URL) {
+		return "", fmt.Errorf("%w: invalid url %q: use an https, http, ssh or git url, or user@host:path", ErrInvalidGitSource, req.URL)
+	}
+	if (req.Username != "" || req.Password != "") && !httpURL {
+		return "", fmt.Errorf("%w: username and password only apply to http(s) urls", ErrInvalidGitSource)
+	}
+
+	if b := req.Branch; b != "" && (strings.HasPrefix(b, "-") || strings.Contains(b, "..") || strings.ContainsAny(b, " \t\n~^:?*[\\")) {
+		return "", fmt.Errorf("%w: invalid branch %q", ErrInvalidGitSource, b)
+	}
+
+	p := path.Clean("/" + filepath.ToSlash(req.Path))
+	if req.Path != "" && (path.IsAbs(req.Path) || strings.Contains(req.Path, "..")) {
+		return "", fmt.Errorf("%w: path %q must be relative to the repository root", ErrInvalidGitSource, req.Path)
+	}
+	return strings.TrimPrefix(p, "/"), nil
+}
+
+// parseRepoComposeFile loads and validates the compose file of a project
+// directory inside a clone
+func parseRepoComposeFile(repo, repoPath string) (*apitypes.ComposeConfig, error) {
+	data, err := os.ReadFile(filepath.Join(repo, filepath.FromSlash(repoPath), "docker-compose.yml"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			where := "the repository root"
+			if repoPath != "" {
+				where = repoPath
+			}
+			return nil, fmt.Errorf("%w: no docker-compose.yml in %s", ErrInvalidComposeFile, where)
+		}
+		return nil, err
+	}
+	return ParseComposeFile(data)
+}
+
+// runGit runs git in dir without prompting for anything. auth, as
+// "username:password", is sent as a basic auth header set through the
+// environment, so it never lands in the clone's config or the process list.
+func runGit(ctx context.Context, dir, auth string, args ...string) ([]byte, error) {
+	cli, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("%w: git is not installed: %v", ErrGitFailed, err)
+	}
+	cmd := exec.CommandContext(ctx, cli, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	if auth != "" {
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte(auth)),
+		)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(strings.TrimPrefix(stderr.String(), "Cloning into 'repo'...\n"))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("%w: git %s: %s", ErrGitFailed, args[0], msg)
+	}
+	return output, nil
+}
+
+// gitHead resolves ref in a clone to a commit id
+func gitHead(ctx context.Context, repo, ref string) (string, error) {
+	output, err := runGit(ctx, repo, "", "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+func readGitSource(dir string) (*gitSource, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "source.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotGitProject
+		}
+		return nil, err
+	}
+	var source gitSource
+	if err := json.Unmarshal(data, &source); err != nil {
+		return nil, fmt.Errorf("invalid git source: %w", err)
+	}
+	return &source, nil
+}
+
+// writeGitSource replaces source.json in dir atomically
+func writeGitSource(dir string, source *gitSource) error {
+	data, err := json.MarshalIndent(source, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".source-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, "source.json"))
+}
+
+func (s *gitSource) view(name string) *apitypes.ComposeGitSource {
+	return &apitypes.ComposeGitSource{
+		Project:        name,
+		URL:            s.URL,
+		Branch:         s.Branch,
+		Path:           s.Path,
+		HasCredentials: len(s.Credentials) > 0,
+		Commit:         s.Commit,
+		SyncedAt:       s.SyncedAt,
+	}
+}
+
+// sealGitCredentials encrypts credentials with AES-256-GCM, bound to the
+// project they belong to
+func sealGitCredentials(key []byte, name, auth string) ([]byte, []byte, error) {
+	aead, err := gitCredentialsAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, []byte(auth), []byte(gitCredentialsVersion+":"+name)), nil
+}
+
+func openGitCredentials(key []byte, name string, nonce, sealed []byte) (string, error) {
+	if len(key) == 0 {
+		return "", fmt.Errorf("%w: the stored credentials need KIBUTSU_SECRET_KEY", ErrInvalidGitSource)
+	}
+	aead, err := gitCredentialsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	plain, err := aead.Open(nil, nonce, sealed, []byte(gitCredentialsVersion+":"+name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt git credentials (wrong KIBUTSU_SECRET_KEY?): %w", err)
+	}
+	return string(plain), nil
+}
+
+func gitCredentialsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
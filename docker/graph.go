@@ -0,0 +1,179 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+
+	apitypes "kibutsu/api/types"
+)
+
+// Graph builds the service dependency graph of the project, annotated with
+// the current state of each service's containers.
+func (p *ComposeProject) Graph(ctx context.Context) (*apitypes.ServiceGraph, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: f,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	running := make(map[string]int)
+	existing := make(map[string]int)
+	for _, c := range containers {
+		service := c.Labels["com.docker.compose.service"]
+		existing[service]++
+		if c.State == "running" {
+			running[service]++
+		}
+	}
+
+	names := make([]string, 0, len(p.Config.Services))
+	for name := range p.Config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	graph := &apitypes.ServiceGraph{
+		Project: p.Name,
+		Nodes:   make([]apitypes.GraphNode, 0, len(names)),
+		Edges:   make([]apitypes.GraphEdge, 0),
+	}
+
+	for _, name := range names {
+		svc := p.Config.Services[name]
+		replicas := 1
+		if svc.Deploy != nil && svc.Deploy.Replicas > 0 {
+			replicas = svc.Deploy.Replicas
+		}
+
+		state := "not_created"
+		switch {
+		case existing[name] == 0:
+		case running[name] == existing[name]:
+			state = "running"
+		case running[name] == 0:
+			state = "stopped"
+		default:
+			state = "partial"
+		}
+
+		graph.Nodes = append(graph.Nodes, apitypes.GraphNode{
+			ID:       name,
+			Image:    svc.Image,
+			Replicas: replicas,
+			Running:  running[name],
+			State:    state,
+		})
+	}
+
+	// Directed edges: depends_on and links both imply start ordering
+	deps := make(map[string][]string)
+	for _, name := range names {
+		svc := p.Config.Services[name]
+		for _, dep := range svc.DependsOn {
+			graph.Edges = append(graph.Edges, apitypes.GraphEdge{From: name, To: dep, Type: "depends_on"})
+			deps[name] = append(deps[name], dep)
+		}
+		for _, link := range svc.Links {
+			target := strings.SplitN(link, ":", 2)[0]
+			graph.Edges = append(graph.Edges, apitypes.GraphEdge{From: name, To: target, Type: "link"})
+			deps[name] = append(deps[name], target)
+		}
+	}
+
+	// Undirected edges between services attached to the same named network
+	members := make(map[string][]string)
+	for _, name := range names {
+		for _, net := range p.Config.Services[name].Networks {
+			members[net] = append(members[net], name)
+		}
+	}
+	networks := make([]string, 0, len(members))
+	for net := range members {
+		networks = append(networks, net)
+	}
+	sort.Strings(networks)
+	for _, net := range networks {
+		services := members[net]
+		for i := 0; i < len(services); i++ {
+			for j := i + 1; j < len(services); j++ {
+				graph.Edges = append(graph.Edges, apitypes.GraphEdge{
+					From:    services[i],
+					To:      services[j],
+					Type:    "network",
+					Network: net,
+				})
+			}
+		}
+	}
+
+	graph.Cycles = findCycles(names, deps)
+	inCycle := make(map[[2]string]bool)
+	for _, cycle := range graph.Cycles {
+		for i, from := range cycle {
+			inCycle[[2]string{from, cycle[(i+1)%len(cycle)]}] = true
+		}
+	}
+	for i, edge := range graph.Edges {
+		if edge.Type != "network" && inCycle[[2]string{edge.From, edge.To}] {
+			graph.Edges[i].Cyclic = true
+		}
+	}
+
+	return graph, nil
+}
+
+// findCycles returns each dependency cycle reachable in deps, listed in
+// dependency order starting from the first service encountered.
+func findCycles(names []string, deps map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	cycles := make([][]string, 0)
+
+	var visit func(node string)
+	visit = func(node string) {
+		state[node] = inProgress
+		stack = append(stack, node)
+
+		for _, dep := range deps[node] {
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case inProgress:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						cycles = append(cycles, append([]string(nil), stack[i:]...))
+						break
+					}
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[node] = done
+	}
+
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+	return cycles
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
@@ -18,7 +20,10 @@ import (
 
 // ImageManager handles Docker image operations
 type ImageManager struct {
-	client *client.Client
+	// RegistryAuth, if set, supplies the login for pulls from private
+	// registries
+	RegistryAuth RegistryAuth
+	client       *client.Client
 }
 
 // NewImageManager creates a new image manager
@@ -99,6 +104,86 @@ func (m *ImageManager) Tag(ctx context.Context, source, target string) error {
 	return nil
 }
 
+// Push pushes ref to its registry, authenticating with encodedAuth (an
+// X-Registry-Auth value), and passes the progress to send. A reference
+// without a tag pushes latest, unless all is set to push every tag. It
+// returns the digest of the pushed manifest; errors the registry reports
+// in the progress stream are returned too.
+func (m *ImageManager) Push(ctx context.Context, ref, encodedAuth string, all bool, send func(apitypes.PushProgress)) (string, error) {
+	reader, err := m.client.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: encodedAuth, All: all})
+	if err != nil {
+		return "", fmt.Errorf("failed to push image: %w", err)
+	}
+	defer reader.Close()
+
+	var digest string
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg struct {
+			apitypes.PushProgress
+			Aux *struct {
+				Digest string `json:"Digest"`
+			} `json:"aux"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return digest, nil
+			}
+			return digest, fmt.Errorf("error reading push progress: %w", err)
+		}
+		if msg.Error != "" {
+			return digest, fmt.Errorf("failed to push image: %s", msg.Error)
+		}
+		if msg.Aux != nil {
+			digest = msg.Aux.Digest
+			msg.Digest = digest
+		}
+		send(msg.PushProgress)
+	}
+}
+
+// Load loads the images in a tarball made by docker save, passing the
+// daemon's progress to send. It returns the tags, or the IDs of untagged
+// images, that were loaded.
+func (m *ImageManager) Load(ctx context.Context, input io.Reader, send func(apitypes.ImageLoadProgress)) ([]string, error) {
+	resp, err := m.client.ImageLoad(ctx, input, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load images: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var loaded []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			apitypes.ImageLoadProgress
+			Stream string `json:"stream"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return loaded, nil
+			}
+			return loaded, fmt.Errorf("error reading load progress: %w", err)
+		}
+		if msg.Error != "" {
+			return loaded, fmt.Errorf("failed to load images: %s", msg.Error)
+		}
+		if msg.Stream != "" {
+			line := strings.TrimSpace(msg.Stream)
+			ref, ok := strings.CutPrefix(line, "Loaded image: ")
+			if !ok {
+				ref, ok = strings.CutPrefix(line, "Loaded image ID: ")
+			}
+			if !ok {
+				continue
+			}
+			loaded = append(loaded, ref)
+			msg.Status, msg.Image = "loaded", ref
+		}
+		send(msg.ImageLoadProgress)
+	}
+}
+
 // GetHistory returns the history of an image
 func (m *ImageManager) GetHistory(ctx context.Context, id string) ([]apitypes.ImageHistory, error) {
 	history, err := m.client.ImageHistory(ctx, id)
@@ -202,3 +287,61 @@ func convertVolumeDiskUsage(volumes []*volume.Volume) []apitypes.VolumeDiskUsage
 	}
 	return result
 }
+
+// CheckUpdate compares the digest the local image was pulled with against the
+// registry's current manifest digest for ref's tag, using the login from
+// RegistryAuth if there is one. Problems reaching the registry are reported
+// as a warning rather than an error.
+func (m *ImageManager) CheckUpdate(ctx context.Context, ref, imageID string) apitypes.ImageUpdateCheck {
+	check := apitypes.ImageUpdateCheck{Image: ref, LocalDigests: []string{}}
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		check.Warning = "Container was created from an image ID, so there is no tag to check"
+		return check
+	}
+	if _, ok := named.(reference.Digested); ok {
+		check.Warning = "Image is pinned by digest, so it cannot change"
+		return check
+	}
+	tagged := reference.TagNameOnly(named)
+
+	local, _, err := m.client.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		check.Warning = fmt.Sprintf("Failed to inspect local image: %v", err)
+		return check
+	}
+	for _, repoDigest := range local.RepoDigests {
+		canonical, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || canonical.Name() != named.Name() {
+			continue
+		}
+		if digested, ok := canonical.(reference.Digested); ok {
+			check.LocalDigests = append(check.LocalDigests, digested.Digest().String())
+		}
+	}
+	if len(check.LocalDigests) == 0 {
+		check.Warning = "Local image has no registry digest (it was built or loaded locally), so it cannot be compared"
+		return check
+	}
+
+	encodedAuth, err := EncodedRegistryAuth(m.RegistryAuth, tagged.String(), nil)
+	if err != nil {
+		check.Warning = fmt.Sprintf("Failed to look up registry credentials: %v", err)
+		return check
+	}
+	remote, err := m.client.DistributionInspect(ctx, tagged.String(), encodedAuth)
+	if err != nil {
+		check.Warning = fmt.Sprintf("Could not reach registry to check for updates: %v", err)
+		return check
+	}
+	check.RemoteDigest = remote.Descriptor.Digest.String()
+	check.Checked = true
+	check.UpdateAvailable = true
+	for _, d := range check.LocalDigests {
+		if d == check.RemoteDigest {
+			check.UpdateAvailable = false
+		}
+	}
+	return check
+}
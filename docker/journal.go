@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// journalEntry holds the fields of a journalctl JSON record written by the
+// journald logging driver
+type journalEntry struct {
+	Message  json.RawMessage `json:"MESSAGE"`
+	Priority string          `json:"PRIORITY"`
+	Realtime string          `json:"__REALTIME_TIMESTAMP"`
+	Partial  string          `json:"CONTAINER_PARTIAL_MESSAGE"`
+}
+
+// JournalAvailable reports whether journalctl can be run on this host
+func JournalAvailable() bool {
+	_, err := exec.LookPath("journalctl")
+	return err == nil
+}
+
+// LocalDaemon reports whether cli talks to a daemon on this host over its
+// socket, whose journald logs are in this host's journal. Daemons reached
+// over TCP or SSH write theirs to their own host's journal.
+func LocalDaemon(cli *client.Client) bool {
+	host := cli.DaemonHost()
+	return strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://")
+}
+
+// JournalLogs reads the logs of a container using the journald logging
+// driver from the host journal. The stream has the same shape as
+// ContainerLogs: multiplexed stdout/stderr unless the container has a TTY,
+// with RFC 3339 timestamps when options.Timestamps is set.
+func JournalLogs(ctx context.Context, containerID string, tty bool, options container.LogsOptions) (io.ReadCloser, error) {
+	cli, err := exec.LookPath("journalctl")
+	if err != nil {
+		return nil, fmt.Errorf("journalctl is not available on the server: %w", err)
+	}
+
+	args := []string{"--output=json", "--no-pager", "--all", "CONTAINER_ID_FULL=" + containerID}
+	if options.Tail != "" && options.Tail != "all" {
+		if _, err := strconv.Atoi(options.Tail); err != nil {
+			return nil, fmt.Errorf("invalid tail %q", options.Tail)
+		}
+		args = append(args, "--lines="+options.Tail)
+	}
+	if options.Since != "" {
+		args = append(args, "--since=@"+options.Since)
+	}
+	if options.Follow {
+		args = append(args, "--follow")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, cli, args...)
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to capture journal output: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	reader, writer := io.Pipe()
+	stdout, stderr := io.Writer(writer), io.Writer(writer)
+	if !tty {
+		stdout = stdcopy.NewStdWriter(writer, stdcopy.Stdout)
+		stderr = stdcopy.NewStdWriter(writer, stdcopy.Stderr)
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(output)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var werr error
+		for werr == nil && scanner.Scan() {
+			var entry journalEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			line := entry.message()
+			if entry.Partial != "true" {
+				line += "\n"
+			}
+			if options.Timestamps {
+				line = entry.time().Format(time.RFC3339Nano) + " " + line
+			}
+			// The journald driver logs stderr at priority 3 (err) and stdout
+			// at 6 (info).
+			if entry.Priority == "3" {
+				_, werr = io.WriteString(stderr, line)
+			} else {
+				_, werr = io.WriteString(stdout, line)
+			}
+		}
+		cancel()
+		if err := cmd.Wait(); werr == nil && err != nil && ctx.Err() == nil {
+			werr = fmt.Errorf("journalctl failed: %w", err)
+		}
+		writer.CloseWithError(werr)
+	}()
+
+	return &journalReader{PipeReader: reader, cancel: cancel}, nil
+}
+
+// message decodes MESSAGE, which journalctl writes as a byte array when the
+// text isn't valid UTF-8
+func (e journalEntry) message() string {
+	var text string
+	if json.Unmarshal(e.Message, &text) == nil {
+		return text
+	}
+	var raw []byte
+	var values []int
+	if json.Unmarshal(e.Message, &values) == nil {
+		for _, v := range values {
+			raw = append(raw, byte(v))
+		}
+	}
+	return string(raw)
+}
+
+func (e journalEntry) time() time.Time {
+	usec, err := strconv.ParseInt(e.Realtime, 10, 64)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return time.UnixMicro(usec).UTC()
+}
+
+// journalReader stops journalctl when the log stream is closed
+type journalReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *journalReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
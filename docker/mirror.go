@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+
+	apitypes "kibutsu/api/types"
+)
+
+// dockerHubDomain is the registry domain of unqualified references
+const dockerHubDomain = "docker.io"
+
+// MirrorReference rewrites a Docker Hub reference to pull from mirror, e.g.
+// nginx:1.27 becomes mirror.example.com/library/nginx:1.27. References to
+// other registries, or an empty mirror, are returned unchanged with mirrored
+// set to false.
+func MirrorReference(ref, mirror string) (pullRef string, mirrored bool, err error) {
+	if mirror == "" {
+		return ref, false, nil
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	if reference.Domain(named) != dockerHubDomain {
+		return ref, false, nil
+	}
+
+	pullRef = strings.TrimSuffix(mirror, "/") + "/" + reference.Path(named)
+	if digested, ok := named.(reference.Digested); ok {
+		return pullRef + "@" + digested.Digest().String(), true, nil
+	}
+	return pullRef + ":" + reference.TagNameOnly(named).(reference.Tagged).Tag(), true, nil
+}
+
+// PullThroughMirror pulls ref like PullWithRetry, fetching Docker Hub images
+// from mirror when one is given. The pulled image is retagged with the
+// original reference so it shows up under the name that was asked for.
+func (m *ImageManager) PullThroughMirror(ctx context.Context, ref, mirror string, policy RetryPolicy, send func(apitypes.PullProgress)) error {
+	pullRef, mirrored, err := MirrorReference(ref, mirror)
+	if err != nil {
+		return err
+	}
+	if !mirrored {
+		return m.PullWithRetry(ctx, ref, policy, send)
+	}
+
+	send(apitypes.PullProgress{Status: fmt.Sprintf("Pulling %s through mirror %s", ref, pullRef)})
+	if err := m.PullWithRetry(ctx, pullRef, policy, send); err != nil {
+		return err
+	}
+	return m.retagFromMirror(ctx, pullRef, ref)
+}
+
+// retagFromMirror tags an image pulled from a mirror with its original
+// reference and drops the mirror tag. Digest references can't be tags, so
+// those images keep only their mirror name.
+func (m *ImageManager) retagFromMirror(ctx context.Context, pullRef, ref string) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return nil
+	}
+
+	target := reference.FamiliarString(reference.TagNameOnly(named))
+	if err := m.client.ImageTag(ctx, pullRef, target); err != nil {
+		return fmt.Errorf("failed to tag %s as %s: %w", pullRef, target, err)
+	}
+	if _, err := m.client.ImageRemove(ctx, pullRef, image.RemoveOptions{}); err != nil {
+		return fmt.Errorf("failed to remove mirror tag %s: %w", pullRef, err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+
+	apitypes "kibutsu/api/types"
+)
+
+// layerStatuses are the pull progress statuses that refer to a single layer
+var layerStatuses = map[string]bool{
+	"Pulling fs layer":   true,
+	"Waiting":            true,
+	"Downloading":        true,
+	"Verifying Checksum": true,
+	"Download complete":  true,
+	"Extracting":         true,
+	"Pull complete":      true,
+	"Already exists":     true,
+}
+
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// pullTracker follows layer progress across pull attempts so totals keep
+// counting layers that finished before a retry.
+type pullTracker struct {
+	layers map[string]*layerProgress
+}
+
+// update records event and fills in its aggregate fields. It reports false
+// for messages that only repeat progress of a layer that already finished.
+func (t *pullTracker) update(event *apitypes.PullProgress) bool {
+	if layerStatuses[event.Status] && event.ID != "" {
+		layer, ok := t.layers[event.ID]
+		if !ok {
+			layer = &layerProgress{}
+			t.layers[event.ID] = layer
+		}
+
+		switch event.Status {
+		case "Pull complete", "Already exists":
+			if layer.done {
+				return false
+			}
+			layer.done = true
+			layer.current = layer.total
+		case "Download complete":
+			layer.current = layer.total
+		case "Downloading":
+			if layer.done {
+				return false
+			}
+			if event.ProgressDetail.Total > 0 {
+				layer.total = event.ProgressDetail.Total
+			}
+			layer.current = event.ProgressDetail.Current
+		default:
+			if layer.done {
+				return false
+			}
+		}
+	}
+
+	event.LayersTotal = len(t.layers)
+	for _, layer := range t.layers {
+		if layer.done {
+			event.LayersDone++
+		}
+		event.BytesDone += layer.current
+		event.BytesTotal += layer.total
+	}
+	return true
+}
+
+// PullWithRetry pulls ref, passing progress to send. When the pull fails
+// with a transient network error it is started again; the daemon keeps the
+// layers that already completed, and progress totals carry over so clients
+// don't see the pull start from zero.
+func (m *ImageManager) PullWithRetry(ctx context.Context, ref string, policy RetryPolicy, send func(apitypes.PullProgress)) error {
+	tracker := &pullTracker{layers: make(map[string]*layerProgress)}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := m.pullOnce(ctx, ref, attempt, tracker, send)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !isTransientPull(err) || attempt >= policy.Attempts {
+			if attempt > 1 {
+				return fmt.Errorf("pull failed after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		send(apitypes.PullProgress{
+			Status:  fmt.Sprintf("Retrying in %s after error: %v", backoff, err),
+			Attempt: attempt + 1,
+		})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (m *ImageManager) pullOnce(ctx context.Context, ref string, attempt int, tracker *pullTracker, send func(apitypes.PullProgress)) error {
+	encodedAuth, err := EncodedRegistryAuth(m.RegistryAuth, ref, nil)
+	if err != nil {
+		return err
+	}
+	reader, err := m.client.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: encodedAuth})
+	if err != nil {
+		return fmt.Errorf("failed to pull image: %w", err)
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var event apitypes.PullProgress
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error reading pull progress: %w", err)
+		}
+		if event.Error != "" {
+			return errors.New(event.Error)
+		}
+		if !tracker.update(&event) {
+			continue
+		}
+		event.Attempt = attempt
+		send(event)
+	}
+}
+
+// isTransientPull reports whether a pull error is worth retrying. Besides
+// daemon hiccups this covers registry timeouts and gateway errors, which the
+// daemon reports as plain messages in the progress stream.
+func isTransientPull(err error) bool {
+	if IsTransient(err) {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"TLS handshake timeout", "i/o timeout", "502 Bad Gateway", "503 Service Unavailable", "504 Gateway Timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// rollbackTimeout bounds putting the old container back after a failed
+// recreate. It runs even if the request was cancelled.
+const rollbackTimeout = time.Minute
+
+// Recreated describes the container that replaced an old one
+type Recreated struct {
+	ID       string
+	Started  bool
+	Warnings []string
+}
+
+// RecreateContainer replaces the container described by old with a new one
+// from the same image reference and configuration, for picking up a newly
+// pulled image. imageConfig is the config of the image old was created
+// from, if it still exists; settings old merely inherited from it are left
+// for the new image to supply. The old container is stopped and renamed out
+// of the way, and only removed once the new one has started; if any step
+// fails it is renamed back and restarted. Anonymous volumes are carried
+// over so their data isn't lost.
+func RecreateContainer(ctx context.Context, cli *client.Client, old types.ContainerJSON, imageConfig *container.Config, stopTimeout int) (Recreated, error) {
+	config, hostConfig, primary, extra := replacementConfig(old, imageConfig)
+	name := strings.TrimPrefix(old.Name, "/")
+	wasRunning := old.State != nil && (old.State.Running || old.State.Restarting)
+
+	var result Recreated
+	rollback := func(cause error) (Recreated, error) {
+		rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		if result.ID != "" {
+			if err := cli.ContainerRemove(rctx, result.ID, container.RemoveOptions{Force: true}); err != nil {
+				slog.Error("Failed to remove replacement container", "container", result.ID, "error", err)
+			}
+		}
+		if err := cli.ContainerRename(rctx, old.ID, name); err != nil {
+			slog.Error("Failed to restore container name", "container", old.ID, "name", name, "error", err)
+		}
+		if wasRunning {
+			if err := cli.ContainerStart(rctx, old.ID, container.StartOptions{}); err != nil {
+				slog.Error("Failed to restart container", "container", old.ID, "error", err)
+			}
+		}
+		return Recreated{}, cause
+	}
+
+	if err := cli.ContainerRename(ctx, old.ID, fmt.Sprintf("%s-old-%s", name, old.ID[:12])); err != nil {
+		return Recreated{}, fmt.Errorf("failed to rename container: %w", err)
+	}
+	if wasRunning {
+		if err := cli.ContainerStop(ctx, old.ID, container.StopOptions{Timeout: &stopTimeout}); err != nil {
+			return rollback(fmt.Errorf("failed to stop container: %w", err))
+		}
+	}
+
+	created, err := cli.ContainerCreate(ctx, config, hostConfig, primary, nil, name)
+	if err != nil {
+		return rollback(fmt.Errorf("failed to create container: %w", err))
+	}
+	result.ID, result.Warnings = created.ID, created.Warnings
+	for _, netName := range sortedNetworks(extra) {
+		if err := cli.NetworkConnect(ctx, netName, created.ID, extra[netName]); err != nil {
+			return rollback(fmt.Errorf("failed to connect network %s: %w", netName, err))
+		}
+	}
+	if wasRunning {
+		if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			return rollback(fmt.Errorf("failed to start container: %w", err))
+		}
+		result.Started = true
+	}
+
+	// The replacement is up; failing to clean up the old container leaves
+	// it stopped under its -old- name rather than undoing the recreate
+	if err := cli.ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("old container %s was not removed: %v", old.ID[:12], err))
+	}
+	return result, nil
+}
+
+// replacementConfig derives the create options for a replacement of old.
+// Networks are split into the one the container is created on and the
+// others, which are connected afterwards since older daemons accept only a
+// single network at create.
+func replacementConfig(old types.ContainerJSON, imageConfig *container.Config) (*container.Config, *container.HostConfig, *network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	config := *old.Config
+	if config.Hostname == old.ID[:12] {
+		config.Hostname = ""
+	}
+	if imageConfig != nil {
+		if slices.Equal(config.Cmd, imageConfig.Cmd) {
+			config.Cmd = nil
+		}
+		if slices.Equal(config.Entrypoint, imageConfig.Entrypoint) {
+			config.Entrypoint = nil
+		}
+		if config.WorkingDir == imageConfig.WorkingDir {
+			config.WorkingDir = ""
+		}
+		if config.User == imageConfig.User {
+			config.User = ""
+		}
+		if config.StopSignal == imageConfig.StopSignal {
+			config.StopSignal = ""
+		}
+		if reflect.DeepEqual(config.Healthcheck, imageConfig.Healthcheck) {
+			config.Healthcheck = nil
+		}
+		config.Env = slices.DeleteFunc(slices.Clone(config.Env), func(env string) bool {
+			return slices.Contains(imageConfig.Env, env)
+		})
+		config.Labels = maps.Clone(config.Labels)
+		maps.DeleteFunc(config.Labels, func(k, v string) bool {
+			inherited, ok := imageConfig.Labels[k]
+			return ok && inherited == v
+		})
+		config.ExposedPorts = maps.Clone(config.ExposedPorts)
+		for port := range imageConfig.ExposedPorts {
+			delete(config.ExposedPorts, port)
+		}
+		config.Volumes = maps.Clone(config.Volumes)
+		for target := range imageConfig.Volumes {
+			delete(config.Volumes, target)
+		}
+	}
+
+	hostConfig := *old.HostConfig
+	anonymous := anonymousVolumes(old)
+	hostConfig.Mounts = append(slices.Clone(hostConfig.Mounts), anonymous...)
+	if len(anonymous) > 0 {
+		config.Volumes = maps.Clone(config.Volumes)
+		for _, m := range anonymous {
+			delete(config.Volumes, m.Target)
+		}
+	}
+
+	mode := hostConfig.NetworkMode
+	if mode.IsHost() || mode.IsNone() || mode.IsContainer() || old.NetworkSettings == nil {
+		return &config, &hostConfig, nil, nil
+	}
+	// The default network mode is the bridge network
+	primaryName := mode.NetworkName()
+	if mode.IsDefault() {
+		primaryName = network.NetworkBridge
+	}
+	primary := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	extra := map[string]*network.EndpointSettings{}
+	for name, ep := range old.NetworkSettings.Networks {
+		settings := &network.EndpointSettings{
+			IPAMConfig: ep.IPAMConfig,
+			Links:      ep.Links,
+			DriverOpts: ep.DriverOpts,
+			Aliases: slices.DeleteFunc(slices.Clone(ep.Aliases), func(alias string) bool {
+				return alias == old.ID[:12]
+			}),
+		}
+		if name == primaryName {
+			primary.EndpointsConfig[name] = settings
+		} else {
+			extra[name] = settings
+		}
+	}
+	return &config, &hostConfig, primary, extra
+}
+
+// anonymousVolumes returns mounts of the volumes old uses that it wasn't
+// explicitly given, which the daemon would otherwise replace with new,
+// empty ones
+func anonymousVolumes(old types.ContainerJSON) []mount.Mount {
+	declared := map[string]bool{}
+	for _, bind := range old.HostConfig.Binds {
+		if parts := strings.Split(bind, ":"); len(parts) >= 2 {
+			declared[parts[1]] = true
+		}
+	}
+	for _, m := range old.HostConfig.Mounts {
+		declared[m.Target] = true
+	}
+
+	var mounts []mount.Mount
+	for _, m := range old.Mounts {
+		if m.Type != mount.TypeVolume || declared[m.Destination] {
+			continue
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeVolume,
+			Source:   m.Name,
+			Target:   m.Destination,
+			ReadOnly: !m.RW,
+		})
+	}
+	return mounts
+}
+
+func sortedNetworks(networks map[string]*network.EndpointSettings) []string {
+	return slices.Sorted(maps.Keys(networks))
+}
@@ -0,0 +1,219 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"gopkg.in/yaml.v3"
+
+	apitypes "kibutsu/api/types"
+)
+
+// dockerHubAuthAddress is the server address Docker Hub credentials are
+// stored under by the docker CLI, and the one the daemon expects
+const dockerHubAuthAddress = "https://index.docker.io/v1/"
+
+// RegistryAuth looks up the credentials for a registry host. Lookup returns
+// nil, without an error, when there are none.
+type RegistryAuth interface {
+	Lookup(host string) (*apitypes.RegistryCredential, error)
+	All() ([]apitypes.RegistryCredential, error)
+}
+
+// RegistryAuthChain looks credentials up in each RegistryAuth in turn
+type RegistryAuthChain []RegistryAuth
+
+func (c RegistryAuthChain) Lookup(host string) (*apitypes.RegistryCredential, error) {
+	for _, auth := range c {
+		cred, err := auth.Lookup(host)
+		if err != nil || cred != nil {
+			return cred, err
+		}
+	}
+	return nil, nil
+}
+
+// All returns every login, taking the first for a registry held by more
+// than one
+func (c RegistryAuthChain) All() ([]apitypes.RegistryCredential, error) {
+	seen := make(map[string]bool)
+	var all []apitypes.RegistryCredential
+	for _, auth := range c {
+		list, err := auth.All()
+		if err != nil {
+			return nil, err
+		}
+		for _, cred := range list {
+			if !seen[cred.Registry] {
+				seen[cred.Registry] = true
+				all = append(all, cred)
+			}
+		}
+	}
+	return all, nil
+}
+
+// RegistryAuthFile reads registry credentials from a YAML file holding a
+// list of registry, username and password entries. The file is re-read
+// when its modification time changes.
+type RegistryAuthFile struct {
+	path string
+
+	mu          sync.Mutex
+	modTime     time.Time
+	credentials map[string]apitypes.RegistryCredential
+}
+
+// NewRegistryAuthFile loads the registry credentials file at path
+func NewRegistryAuthFile(path string) (*RegistryAuthFile, error) {
+	f := &RegistryAuthFile{path: path}
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RegistryAuthFile) Lookup(host string) (*apitypes.RegistryCredential, error) {
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cred, ok := f.credentials[NormalizeRegistryHost(host)]
+	if !ok {
+		return nil, nil
+	}
+	return &cred, nil
+}
+
+func (f *RegistryAuthFile) All() ([]apitypes.RegistryCredential, error) {
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := make([]apitypes.RegistryCredential, 0, len(f.credentials))
+	for _, cred := range f.credentials {
+		all = append(all, cred)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Registry < all[j].Registry })
+	return all, nil
+}
+
+// refresh reloads the file if it changed since it was last read
+func (f *RegistryAuthFile) refresh() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.credentials != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var list []apitypes.RegistryCredential
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	credentials := make(map[string]apitypes.RegistryCredential, len(list))
+	for _, cred := range list {
+		if cred.Registry == "" || cred.Username == "" {
+			return fmt.Errorf("registry credentials need a registry and a username")
+		}
+		host := NormalizeRegistryHost(cred.Registry)
+		if _, ok := credentials[host]; ok {
+			return fmt.Errorf("registry %s is defined twice", host)
+		}
+		cred.Registry = host
+		credentials[host] = cred
+	}
+	f.credentials = credentials
+	f.modTime = info.ModTime()
+	return nil
+}
+
+// RegistryHost returns the registry an image reference belongs to, with
+// Docker Hub as docker.io
+func RegistryHost(ref string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	return reference.Domain(named), nil
+}
+
+// NormalizeRegistryHost reduces the ways a registry is written, with or
+// without a scheme or path and the several names of Docker Hub, to the
+// host RegistryHost returns
+func NormalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return strings.ToLower(host)
+}
+
+// EncodedRegistryAuth returns the X-Registry-Auth value for pulling or
+// pushing ref: cred if given, else what auth holds for ref's registry, else
+// anonymous access. auth may be nil.
+func EncodedRegistryAuth(auth RegistryAuth, ref string, cred *apitypes.RegistryCredential) (string, error) {
+	host, err := RegistryHost(ref)
+	if err != nil {
+		return "", err
+	}
+	if cred == nil && auth != nil {
+		if cred, err = auth.Lookup(host); err != nil {
+			return "", fmt.Errorf("failed to look up credentials for %s: %w", host, err)
+		}
+	}
+	if cred == nil {
+		return registry.EncodeAuthConfig(registry.AuthConfig{})
+	}
+	cred.Registry = host
+	return registry.EncodeAuthConfig(authConfig(*cred))
+}
+
+// BuildAuthConfigs returns every login auth holds, keyed by server address
+// as image builds expect them, so base images can be pulled from private
+// registries. auth may be nil.
+func BuildAuthConfigs(auth RegistryAuth) (map[string]registry.AuthConfig, error) {
+	configs := make(map[string]registry.AuthConfig)
+	if auth == nil {
+		return configs, nil
+	}
+	all, err := auth.All()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry credentials: %w", err)
+	}
+	for _, cred := range all {
+		config := authConfig(cred)
+		configs[config.ServerAddress] = config
+	}
+	return configs, nil
+}
+
+func authConfig(cred apitypes.RegistryCredential) registry.AuthConfig {
+	address := NormalizeRegistryHost(cred.Registry)
+	if address == "docker.io" {
+		address = dockerHubAuthAddress
+	}
+	return registry.AuthConfig{
+		Username:      cred.Username,
+		Password:      cred.Password,
+		ServerAddress: address,
+	}
+}
@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	apitypes "kibutsu/api/types"
+)
+
+// registryStoreVersion is bound into the ciphertext so a file can't be
+// decrypted as some other format
+const registryStoreVersion = "kibutsu-registry-store-v1"
+
+// registryStoreFile is the on-disk form of a RegistryStore
+type registryStoreFile struct {
+	Version    string `json:"version"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// RegistryStore keeps registry logins managed through the API in a file
+// encrypted with AES-256-GCM. The whole list is re-encrypted with a fresh
+// nonce on every change.
+type RegistryStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu          sync.Mutex
+	credentials map[string]apitypes.RegistryCredential
+}
+
+// NewRegistryStore opens the store at path with a 32-byte key, creating it
+// on the first change if it doesn't exist yet
+func NewRegistryStore(path string, key []byte) (*RegistryStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &RegistryStore{path: path, aead: aead, credentials: make(map[string]apitypes.RegistryCredential)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file registryStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid registry store: %w", err)
+	}
+	if file.Version != registryStoreVersion {
+		return nil, fmt.Errorf("unsupported registry store version %q", file.Version)
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Ciphertext, []byte(file.Version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt registry store (wrong KIBUTSU_SECRET_KEY?): %w", err)
+	}
+	var list []apitypes.RegistryCredential
+	if err := json.Unmarshal(plain, &list); err != nil {
+		return nil, fmt.Errorf("invalid registry store: %w", err)
+	}
+	for _, cred := range list {
+		s.credentials[cred.Registry] = cred
+	}
+	return s, nil
+}
+
+func (s *RegistryStore) Lookup(host string) (*apitypes.RegistryCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cred, ok := s.credentials[NormalizeRegistryHost(host)]
+	if !ok {
+		return nil, nil
+	}
+	return &cred, nil
+}
+
+func (s *RegistryStore) All() ([]apitypes.RegistryCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(), nil
+}
+
+// Set adds a login, replacing any for the same registry
+func (s *RegistryStore) Set(cred apitypes.RegistryCredential) error {
+	cred.Registry = NormalizeRegistryHost(cred.Registry)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.credentials[cred.Registry]
+	s.credentials[cred.Registry] = cred
+	if err := s.save(); err != nil {
+		if existed {
+			s.credentials[cred.Registry] = prev
+		} else {
+			delete(s.credentials, cred.Registry)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the login for a registry, reporting whether there was one
+func (s *RegistryStore) Delete(host string) (bool, error) {
+	host = NormalizeRegistryHost(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.credentials[host]
+	if !ok {
+		return false, nil
+	}
+	delete(s.credentials, host)
+	if err := s.save(); err != nil {
+		s.credentials[host] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *RegistryStore) list() []apitypes.RegistryCredential {
+	list := make([]apitypes.RegistryCredential, 0, len(s.credentials))
+	for _, cred := range s.credentials {
+		list = append(list, cred)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Registry < list[j].Registry })
+	return list
+}
+
+// save encrypts the logins and replaces the file, readable only by its
+// owner
+func (s *RegistryStore) save() error {
+	plain, err := json.Marshal(s.list())
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(registryStoreFile{
+		Version:    registryStoreVersion,
+		Nonce:      nonce,
+		Ciphertext: s.aead.Seal(nil, nonce, plain, []byte(registryStoreVersion)),
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".registries-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
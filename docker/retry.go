@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// RetryPolicy bounds retries of idempotent Docker calls. The delay doubles
+// after each failed attempt, starting at Backoff.
+type RetryPolicy struct {
+	Attempts int // total attempts, including the first
+	Backoff  time.Duration
+}
+
+// RetryCounters reports how often retries happened since startup
+type RetryCounters struct {
+	Retries   uint64 `json:"retries"`   // attempts made after a transient failure
+	Recovered uint64 `json:"recovered"` // calls that succeeded after retrying
+	Exhausted uint64 `json:"exhausted"` // calls that still failed after the last attempt
+}
+
+var retryRetries, retryRecovered, retryExhausted atomic.Uint64
+
+// RetryStats returns the retry counters
+func RetryStats() RetryCounters {
+	return RetryCounters{
+		Retries:   retryRetries.Load(),
+		Recovered: retryRecovered.Load(),
+		Exhausted: retryExhausted.Load(),
+	}
+}
+
+// Retry runs op until it succeeds, fails with a non-transient error, or the
+// policy's attempts are used up. Only use it for idempotent reads such as
+// list, inspect and info; writes must never be retried blindly.
+func Retry[T any](ctx context.Context, policy RetryPolicy, op func(context.Context) (T, error)) (T, error) {
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		result, err := op(ctx)
+		if err == nil {
+			if attempt > 1 {
+				retryRecovered.Add(1)
+			}
+			return result, nil
+		}
+		if !IsTransient(err) || ctx.Err() != nil {
+			return result, err
+		}
+		if attempt >= policy.Attempts {
+			retryExhausted.Add(1)
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		retryRetries.Add(1)
+	}
+}
+
+// IsTransient reports whether err looks like a passing daemon hiccup, such as
+// a dropped connection while the daemon restarts, rather than a real failure.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if client.IsErrConnectionFailed(err) || errdefs.IsUnavailable(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// The client wraps some transport errors as plain strings.
+	msg := err.Error()
+	for _, s := range []string{"connection reset", "broken pipe", "connection refused", "context deadline exceeded", "unexpected EOF"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
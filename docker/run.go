@@ -0,0 +1,96 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+
+	apitypes "kibutsu/api/types"
+)
+
+// CreateOneOff creates, but does not start, a standalone container from a
+// service definition, like `docker compose run`. The container gets the
+// service's volumes and networks but none of its published ports, so it
+// cannot conflict with the running stack.
+func (p *ComposeProject) CreateOneOff(ctx context.Context, service string, req apitypes.ComposeRunRequest) (string, string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	svc, ok := p.Config.Services[service]
+	if !ok {
+		return "", "", fmt.Errorf("service %s not found in project %s", service, p.Name)
+	}
+
+	env := make(map[string]string, len(svc.Environment)+len(req.Env))
+	for k, v := range svc.Environment {
+		env[k] = v
+	}
+	for k, v := range req.Env {
+		env[k] = v
+	}
+
+	cmd := svc.Command
+	if len(req.Command) > 0 {
+		cmd = req.Command
+	}
+
+	exposedPorts := nat.PortSet{}
+	for _, portStr := range svc.Ports {
+		mappings, err := nat.ParsePortSpec(portStr)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid port mapping %s: %w", portStr, err)
+		}
+		for _, pm := range mappings {
+			exposedPorts[pm.Port] = struct{}{}
+		}
+	}
+
+	containerConfig := &container.Config{
+		Image:        svc.Image,
+		Cmd:          cmd,
+		Env:          mapToEnvSlice(env),
+		ExposedPorts: exposedPorts,
+		AttachStdout: !req.Detach,
+		AttachStderr: !req.Detach,
+		Labels: map[string]string{
+			"com.docker.compose.project": p.Name,
+			"com.docker.compose.service": service,
+			"com.docker.compose.oneoff":  "True",
+		},
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds: svc.Volumes,
+		// Attached runs are removed by the caller after the exit code is
+		// read; auto-removal would race with waiting on the container.
+		AutoRemove: req.Remove && req.Detach,
+	}
+
+	networkConfig := &network.NetworkingConfig{
+		EndpointsConfig: make(map[string]*network.EndpointSettings),
+	}
+	networks := []string(svc.Networks)
+	if len(networks) == 0 {
+		for name := range p.Config.Networks {
+			networks = append(networks, name)
+		}
+	}
+	for _, name := range networks {
+		if spec, ok := p.Config.Networks[name]; ok && spec.External {
+			networkConfig.EndpointsConfig[name] = &network.EndpointSettings{}
+			continue
+		}
+		networkConfig.EndpointsConfig[fmt.Sprintf("%s_%s", p.Name, name)] = &network.EndpointSettings{}
+	}
+
+	name := fmt.Sprintf("%s_%s_run_%s", p.Name, service, uuid.New().String()[:8])
+	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create container: %w", err)
+	}
+	return resp.ID, name, nil
+}
@@ -0,0 +1,174 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// SSHClientOpts returns the client options that reach the daemon at an
+// ssh://[user@]host[:port] address. Each connection runs
+// "docker system dial-stdio" on the remote host through the ssh command,
+// which uses the usual keys, agent and ~/.ssh/config. The client keeps host
+// as its DaemonHost, so the docker CLI run for BuildKit builds dials it too.
+func SSHClientOpts(host string) ([]client.Opt, error) {
+	args, err := sshArgs(host)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSSH(ctx, args)
+		},
+		MaxIdleConns:    6,
+		IdleConnTimeout: 30 * time.Second,
+	}
+	// The HTTP client goes after WithHost, which would set up a TCP
+	// transport for the host
+	return []client.Opt{
+		client.WithHost(host),
+		client.WithHTTPClient(&http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}),
+	}, nil
+}
+
+// sshArgs returns the ssh command's arguments for an ssh:// address
+func sshArgs(host string) ([]string, error) {
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("must be of the form ssh://[user@]host[:port]")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("ssh:// hosts can't have a path or query")
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("ssh:// hosts can't carry a password; use a key or the SSH agent")
+	}
+	if strings.HasPrefix(u.Hostname(), "-") || strings.HasPrefix(u.User.Username(), "-") {
+		return nil, fmt.Errorf("invalid ssh host %q", host)
+	}
+
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=30"}
+	if user := u.User.Username(); user != "" {
+		args = append(args, "-l", user)
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	return append(args, "--", u.Hostname(), "docker", "system", "dial-stdio"), nil
+}
+
+// dialSSH starts ssh with args and returns a connection over its stdin and
+// stdout. The command isn't tied to ctx, since the client keeps connections
+// open for later requests; closing the connection ends it.
+func dialSSH(ctx context.Context, args []string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("ssh", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	conn := &sshConn{cmd: cmd, stdin: stdin, stdout: stdout}
+	cmd.Stderr = &conn.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run ssh: %w", err)
+	}
+	return conn, nil
+}
+
+// sshConn is a connection to the daemon over an ssh process's stdin and
+// stdout. Deadlines are ignored, as the HTTP client bounds calls with
+// contexts and closes the connection when they end.
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr lockedBuffer
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *sshConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+			return n, fmt.Errorf("ssh: %s: %w", msg, io.ErrUnexpectedEOF)
+		}
+	}
+	return n, err
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite ends the remote side's input, which hijacked connections such
+// as exec attaches use to signal the end of stdin
+func (c *sshConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *sshConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stdout.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		var exitErr *exec.ExitError
+		if err := c.cmd.Wait(); err != nil && !errors.As(err, &exitErr) {
+			c.closeErr = err
+		}
+	})
+	return c.closeErr
+}
+
+func (c *sshConn) LocalAddr() net.Addr                { return sshAddr("local") }
+func (c *sshConn) RemoteAddr() net.Addr               { return sshAddr(strings.Join(c.cmd.Args, " ")) }
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
+
+// lockedBuffer collects the ssh command's stderr, which is written while
+// Read may be looking at it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf.Len() > 4<<10 {
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
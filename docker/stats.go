@@ -0,0 +1,192 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+// ContainerSample is a single decoded stats reading for a container
+type ContainerSample struct {
+	ID    string                  `json:"id"`
+	Name  string                  `json:"name"`
+	Image string                  `json:"image"`
+	Stats apitypes.ContainerStats `json:"stats"`
+}
+
+// SampleStats takes a single stats reading for a container. The daemon waits
+// for a second reading before answering so CPU usage can be computed.
+func SampleStats(ctx context.Context, cli *client.Client, id string) (apitypes.ContainerStats, error) {
+	resp, err := cli.ContainerStats(ctx, id, false)
+	if err != nil {
+		return apitypes.ContainerStats{}, fmt.Errorf("failed to get stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var raw container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return apitypes.ContainerStats{}, fmt.Errorf("failed to decode stats: %w", err)
+	}
+	return DecodeStats(raw), nil
+}
+
+// StreamStats follows a container's stats, passing a decoded sample to send
+// at most once per interval. The daemon produces a reading about every
+// second, so shorter intervals get every reading. It returns nil when the
+// daemon ends the stream, as it does when the container stops, and the
+// error from send if that fails.
+func StreamStats(ctx context.Context, cli *client.Client, id string, interval time.Duration, send func(apitypes.ContainerStats) error) error {
+	resp, err := cli.ContainerStats(ctx, id, true)
+	if err != nil {
+		return fmt.Errorf("failed to get stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var last time.Time
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var raw container.StatsResponse
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to decode stats: %w", err)
+		}
+		// The first reading has no previous one to compute CPU usage from
+		if raw.PreCPUStats.SystemUsage == 0 {
+			continue
+		}
+		// Allow for jitter in the daemon's one-second readings
+		if !last.IsZero() && raw.Read.Sub(last) < interval-interval/10 {
+			continue
+		}
+		last = raw.Read
+		if err := send(DecodeStats(raw)); err != nil {
+			return err
+		}
+	}
+}
+
+// SampleRunning samples every running container, keeping at most concurrency
+// stats requests in flight. Containers that fail to sample are skipped.
+func SampleRunning(ctx context.Context, cli *client.Client, concurrency int) ([]ContainerSample, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+		samples = make([]ContainerSample, 0, len(containers))
+	)
+	for _, c := range containers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return samples, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(c types.Container) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			stats, err := SampleStats(ctx, cli, c.ID)
+			if err != nil {
+				return
+			}
+
+			name := c.ID
+			if len(c.Names) > 0 {
+				name = strings.TrimPrefix(c.Names[0], "/")
+			}
+
+			mu.Lock()
+			samples = append(samples, ContainerSample{ID: c.ID, Name: name, Image: c.Image, Stats: stats})
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	return samples, nil
+}
+
+// DecodeStats converts a raw Docker stats payload into API stats, turning the
+// cgroup counters into the percentages `docker stats` reports.
+func DecodeStats(raw container.StatsResponse) apitypes.ContainerStats {
+	var stats apitypes.ContainerStats
+
+	cpuDelta := float64(raw.CPUStats.CPUUsage.TotalUsage) - float64(raw.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(raw.CPUStats.SystemUsage) - float64(raw.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(raw.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(raw.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPU.UsagePercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+	stats.CPU.SystemUsage = raw.CPUStats.CPUUsage.UsageInKernelmode
+	stats.CPU.UserUsage = raw.CPUStats.CPUUsage.UsageInUsermode
+
+	// Match the docker CLI by excluding reclaimable page cache from usage.
+	cache := raw.MemoryStats.Stats["cache"]
+	inactive, ok := raw.MemoryStats.Stats["inactive_file"]
+	if !ok {
+		inactive = raw.MemoryStats.Stats["total_inactive_file"]
+	}
+	usage := raw.MemoryStats.Usage
+	if inactive < usage {
+		usage -= inactive
+	}
+	if cache == 0 {
+		cache = raw.MemoryStats.Stats["file"]
+	}
+	rss, ok := raw.MemoryStats.Stats["rss"]
+	if !ok {
+		rss = raw.MemoryStats.Stats["anon"]
+	}
+	stats.Memory.Usage = usage
+	stats.Memory.Limit = raw.MemoryStats.Limit
+	stats.Memory.RSS = rss
+	stats.Memory.Cache = cache
+	if raw.MemoryStats.Limit > 0 {
+		stats.Memory.Percent = float64(usage) / float64(raw.MemoryStats.Limit) * 100
+	}
+
+	for _, n := range raw.Networks {
+		stats.Network.RxBytes += n.RxBytes
+		stats.Network.TxBytes += n.TxBytes
+		stats.Network.RxPackets += n.RxPackets
+		stats.Network.TxPackets += n.TxPackets
+	}
+
+	for _, entry := range raw.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockIO.Read += entry.Value
+		case "write":
+			stats.BlockIO.Write += entry.Value
+		}
+	}
+
+	stats.PIDs = int(raw.PidsStats.Current)
+	stats.ReadTime = raw.Read
+
+	return stats
+}
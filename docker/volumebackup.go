@@ -0,0 +1,215 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// VolumeHelperLabel marks the short-lived containers that volume backups
+// and restores mount the volume in
+const VolumeHelperLabel = "kibutsu.volume-helper"
+
+// volumeMountPath is where helper containers mount the volume
+const volumeMountPath = "/volume"
+
+// helperCleanupTimeout bounds removing a helper container once the request
+// that created it has ended
+const helperCleanupTimeout = 30 * time.Second
+
+// BackupVolume writes the contents of a volume to w as a gzip compressed
+// tar, with paths relative to the volume's root. The volume is mounted
+// read-only in a helper container made from helperImage, which is never
+// started: the daemon copies out of the mount directly.
+func BackupVolume(ctx context.Context, cli *client.Client, name, helperImage string, w io.Writer) error {
+	// Mounting a volume that doesn't exist would create it
+	if _, err := cli.VolumeInspect(ctx, name); err != nil {
+		return err
+	}
+
+	id, err := createVolumeHelper(ctx, cli, name, helperImage, true, nil)
+	if err != nil {
+		return err
+	}
+	defer removeVolumeHelper(ctx, cli, id)
+
+	rc, _, err := cli.CopyFromContainer(ctx, id, volumeMountPath)
+	if err != nil {
+		return fmt.Errorf("failed to read volume: %w", err)
+	}
+	defer rc.Close()
+
+	gz := gzip.NewWriter(w)
+	if err := rebaseVolumeArchive(rc, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// RestoreVolume extracts a tar archive, optionally compressed, into a
+// volume, creating the volume if it doesn't exist. Paths in the archive are
+// taken as relative to the volume's root, as BackupVolume writes them.
+// With replace, the volume is emptied first, which runs a shell in the
+// helper container; otherwise the archive is extracted over the volume's
+// existing contents.
+func RestoreVolume(ctx context.Context, cli *client.Client, name, helperImage string, archive io.Reader, replace bool) error {
+	var cmd []string
+	if replace {
+		cmd = []string{"sh", "-c", "rm -rf " + volumeMountPath + "/..?* " + volumeMountPath + "/.[!.]* " + volumeMountPath + "/*"}
+	}
+	id, err := createVolumeHelper(ctx, cli, name, helperImage, false, cmd)
+	if err != nil {
+		return err
+	}
+	defer removeVolumeHelper(ctx, cli, id)
+
+	if replace {
+		if err := runVolumeHelper(ctx, cli, id); err != nil {
+			return fmt.Errorf("failed to empty volume: %w", err)
+		}
+	}
+
+	// The daemon detects and decompresses gzip, bzip2 and xz archives
+	if err := cli.CopyToContainer(ctx, id, volumeMountPath, archive, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("failed to restore volume: %w", err)
+	}
+	return nil
+}
+
+// createVolumeHelper creates a container from helperImage, pulling it if
+// needed, with the volume mounted at volumeMountPath. It has no network
+// and is labelled so leftovers can be found.
+func createVolumeHelper(ctx context.Context, cli *client.Client, volume, helperImage string, readOnly bool, cmd []string) (string, error) {
+	if err := ensureHelperImage(ctx, cli, helperImage); err != nil {
+		return "", err
+	}
+
+	created, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Image:  helperImage,
+			Cmd:    cmd,
+			Labels: map[string]string{VolumeHelperLabel: volume},
+		},
+		&container.HostConfig{
+			NetworkMode: "none",
+			Mounts: []mount.Mount{{
+				Type:     mount.TypeVolume,
+				Source:   volume,
+				Target:   volumeMountPath,
+				ReadOnly: readOnly,
+			}},
+		},
+		nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create helper container: %w", err)
+	}
+	return created.ID, nil
+}
+
+// runVolumeHelper starts the helper container and waits for its command to
+// exit successfully
+func runVolumeHelper(ctx context.Context, cli *client.Client, id string) error {
+	waitCh, errCh := cli.ContainerWait(ctx, id, container.WaitConditionNextExit)
+	if err := cli.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		return err
+	}
+	select {
+	case result := <-waitCh:
+		if result.Error != nil {
+			return errors.New(result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return fmt.Errorf("helper exited with status %d", result.StatusCode)
+		}
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
+// removeVolumeHelper removes a helper container, even once ctx is done
+func removeVolumeHelper(ctx context.Context, cli *client.Client, id string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), helperCleanupTimeout)
+	defer cancel()
+	cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+}
+
+// ensureHelperImage pulls the helper image if the daemon does not have it
+// yet
+func ensureHelperImage(ctx context.Context, cli *client.Client, ref string) error {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, ref); err == nil {
+		return nil
+	} else if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+
+	// Not wrapped, so a missing image isn't mistaken for a missing volume
+	reader, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %v", ref, err)
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to pull image %s: %w", ref, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("failed to pull image %s: %s", ref, msg.Error)
+		}
+	}
+}
+
+// rebaseVolumeArchive copies the daemon's archive of volumeMountPath, whose
+// entries are named volume/..., to w with the entries named relative to
+// the volume's root instead
+func rebaseVolumeArchive(r io.Reader, w io.Writer) error {
+	prefix := strings.TrimPrefix(volumeMountPath, "/")
+	rebase := func(name string) string {
+		name = strings.TrimPrefix(name, prefix)
+		if name = strings.TrimPrefix(name, "/"); name == "" {
+			return "./"
+		}
+		return name
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read volume archive: %w", err)
+		}
+		hdr.Name = rebase(hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rebase(hdr.Linkname)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// EndpointStatus reports whether a Docker endpoint can be reached
+type EndpointStatus struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Reachable  bool   `json:"reachable"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newEndpointClient creates the client for an endpoint from the endpoints
+// file, with any extra options. It doesn't connect, so an unreachable daemon
+// doesn't stop startup.
+func newEndpointClient(e config.Endpoint, extra ...client.Opt) (*client.Client, error) {
+	opts, err := hostClientOpts(e.Host)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, client.WithAPIVersionNegotiation())
+	if e.TLS() {
+		// After WithHost, which replaces the transport TLS is applied to
+		opts = append(opts, client.WithTLSClientConfig(e.TLSCA, e.TLSCert, e.TLSKey))
+	}
+	return client.NewClientWithOpts(append(opts, extra...)...)
+}
+
+// hostClientOpts returns the options that point a client at host. ssh://
+// hosts are dialed through the ssh command; WithHost sets up the transport
+// for the rest, including named pipes on Windows.
+func hostClientOpts(host string) ([]client.Opt, error) {
+	if strings.HasPrefix(host, "ssh://") {
+		return docker.SSHClientOpts(host)
+	}
+	return []client.Opt{client.WithHost(host)}, nil
+}
+
+// selectEndpoint routes a request to the router of the Docker endpoint it
+// names, either with an /endpoints/{name} path prefix or the endpoint query
+// parameter. Requests naming neither go to the local endpoint.
+func (app *App) selectEndpoint(routers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/endpoints/"); ok {
+			name, _, _ := strings.Cut(rest, "/")
+			router, ok := routers[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown Docker endpoint %q", name), http.StatusNotFound)
+				return
+			}
+			http.StripPrefix("/endpoints/"+name, router).ServeHTTP(w, r)
+			return
+		}
+
+		name := r.URL.Query().Get("endpoint")
+		if name == "" {
+			name = config.LocalEndpoint
+		}
+		router, ok := routers[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown Docker endpoint %q", name), http.StatusNotFound)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// listEndpoints pings every Docker endpoint and reports which are
+// reachable, the local endpoint first
+func (app *App) listEndpoints(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(app.endpoints))
+	for name := range app.endpoints {
+		if name != config.LocalEndpoint {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{config.LocalEndpoint}, names...)
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.config.Get().DockerReadTimeout)
+	defer cancel()
+
+	statuses := make([]EndpointStatus, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			cli := app.endpoints[name]
+			status := EndpointStatus{Name: name, Host: cli.DaemonHost()}
+			ping, err := cli.Ping(ctx)
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Reachable = true
+				status.APIVersion = ping.APIVersion
+			}
+			statuses[i] = status
+		}(i, name)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -1,6 +1,8 @@
-import type { Container, Image, ComposeProject, SystemInfo, DiskUsage } from '../types/docker';
+import type { Container, Image, ComposeProject, ComposeProjectConfig, SystemInfo, SystemMetrics, DiskUsage, ListResponse, ExecInfo, AuthSession, RegistryLogin, AuditEntry, AuditFilter, ContainerFilter, ImageInfo, ImageFilter, ContainerBatchRequest, ContainerBatchResult, ImageBatchDeleteRequest, ImageBatchDeleteResult, ContainerFileList, ContainerChange, ContainerCommitRequest, UpdateContainerRequest, RecreateResult, UpdateReport, Job, JobRequest, JobRun, JobWebhookRequest, JobWebhookCreated, PruneScope, SystemPruneResult, DaemonStatus, ComposeGitImportRequest, ComposeGitSource, ComposeProjectCreated, ComposeSyncResult, ContainerHealth, ContainerExport, ContainerDefinition, CreateContainerResponse, LogSearch, LogSearchResult, LogFrame, AggregateLogsOptions, StoredLogs, StoredLogSearch, ImageLoadProgress, Backup, BackupKind, BackupRestoreResult, StorageObject, StoredLogsImport, SwarmInfo, SwarmService, SwarmServiceUpdateRequest, SwarmServiceUpdateResult, SwarmNode, SwarmTask, SwarmSecret, SwarmConfig, SwarmDataKind, NotificationSettings, NotificationResult } from '../types/docker';
 
-const API_BASE = '/api';
+// Resolve against the <base> tag the server injects when served under a subpath.
+const API_BASE =
+  typeof document !== 'undefined' ? new URL('api', document.baseURI).pathname : '/api';
 const getWsUrl = () => {
   if (typeof window !== 'undefined') {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
@@ -44,12 +46,151 @@ export class DockerClient {
   }
 
   // Authentication methods
-  async login(username: string, password: string): Promise<void> {
+  // The server also sets a session cookie, which is what the browser's
+  // WebSocket and EventSource connections authenticate with.
+  async login(username: string, password: string): Promise<AuthSession> {
     const response = await this.fetch('/auth/login', {
       method: 'POST',
       body: JSON.stringify({ username, password })
     });
-    this.token = await response.text();
+    const session: AuthSession = await response.json();
+    this.token = session.token;
+    return session;
+  }
+
+  async logout(): Promise<void> {
+    await this.fetch('/auth/logout', { method: 'POST' });
+    this.token = undefined;
+  }
+
+  async getSession(): Promise<AuthSession> {
+    return this.fetch('/auth/session').then(r => r.json());
+  }
+
+  // Registry logins
+  async getAuditLog(filter: AuditFilter = {}): Promise<ListResponse<AuditEntry>> {
+    const params = new URLSearchParams();
+    for (const [key, value] of Object.entries(filter)) {
+      if (value !== undefined && value !== '') params.set(key, String(value));
+    }
+    const query = params.toString();
+    return this.fetch(`/audit${query ? `?${query}` : ''}`).then(r => r.json());
+  }
+
+  async getRegistries(): Promise<RegistryLogin[]> {
+    return this.fetch('/registries').then(r => r.json());
+  }
+
+  async addRegistry(login: RegistryLogin & { password: string }): Promise<RegistryLogin> {
+    const response = await this.fetch('/registries', {
+      method: 'POST',
+      body: JSON.stringify(login)
+    });
+    return response.json();
+  }
+
+  async removeRegistry(registry: string): Promise<void> {
+    await this.fetch(`/registries/${encodeURIComponent(registry)}`, { method: 'DELETE' });
+  }
+
+  // Scheduled jobs
+  async getJobs(): Promise<Job[]> {
+    return this.fetchList('/jobs');
+  }
+
+  async createJob(job: JobRequest): Promise<Job> {
+    const response = await this.fetch('/jobs', {
+      method: 'POST',
+      body: JSON.stringify(job)
+    });
+    return response.json();
+  }
+
+  async updateJob(id: string, job: JobRequest): Promise<Job> {
+    const response = await this.fetch(`/jobs/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(job)
+    });
+    return response.json();
+  }
+
+  async deleteJob(id: string): Promise<void> {
+    await this.fetch(`/jobs/${id}`, { method: 'DELETE' });
+  }
+
+  async runJob(id: string): Promise<void> {
+    await this.fetch(`/jobs/${id}/run`, { method: 'POST' });
+  }
+
+  async getJobRuns(id: string): Promise<JobRun[]> {
+    return this.fetchList(`/jobs/${id}/runs`);
+  }
+
+  async createJobWebhook(id: string, request: JobWebhookRequest = {}): Promise<JobWebhookCreated> {
+    return this.fetch(`/jobs/${id}/webhook`, {
+      method: 'POST',
+      body: JSON.stringify(request)
+    }).then(r => r.json());
+  }
+
+  async deleteJobWebhook(id: string): Promise<void> {
+    await this.fetch(`/jobs/${id}/webhook`, { method: 'DELETE' });
+  }
+
+  // Backups kept on the server, newest first
+  async getBackups(kind?: BackupKind, name?: string): Promise<Backup[]> {
+    const params = new URLSearchParams();
+    if (kind) params.set('kind', kind);
+    if (name) params.set('name', name);
+    const query = params.toString();
+    return this.fetchList(`/backups${query ? `?${query}` : ''}`);
+  }
+
+  async createBackup(kind: BackupKind, name: string): Promise<Backup> {
+    return this.fetch('/backups', {
+      method: 'POST',
+      body: JSON.stringify({ kind, name })
+    }).then(r => r.json());
+  }
+
+  // Fetched rather than linked so the Authorization header is sent
+  async downloadBackup(id: string): Promise<Blob> {
+    return this.fetch(`/backups/${id}`).then(r => r.blob());
+  }
+
+  async deleteBackup(id: string): Promise<void> {
+    await this.fetch(`/backups/${id}`, { method: 'DELETE' });
+  }
+
+  // volume restores a volume backup into another volume
+  async restoreBackup(id: string, volume?: string): Promise<BackupRestoreResult> {
+    const query = volume ? `?volume=${encodeURIComponent(volume)}` : '';
+    return this.fetch(`/backups/${id}/restore${query}`, { method: 'POST' }).then(r => r.json());
+  }
+
+  // Objects in the bucket shared by every endpoint, in key order
+  async getStorageObjects(prefix = ''): Promise<StorageObject[]> {
+    const query = prefix ? `?prefix=${encodeURIComponent(prefix)}` : '';
+    return this.fetchList(`/storage/objects${query}`);
+  }
+
+  async downloadStorageObject(key: string): Promise<Blob> {
+    return this.fetch(`/storage/objects/${this.objectPath(key)}`).then(r => r.blob());
+  }
+
+  async deleteStorageObject(key: string): Promise<void> {
+    await this.fetch(`/storage/objects/${this.objectPath(key)}`, { method: 'DELETE' });
+  }
+
+  async getNotificationSettings(): Promise<NotificationSettings> {
+    return this.fetch('/notifications').then(r => r.json());
+  }
+
+  async testNotification(channel = ''): Promise<NotificationResult[]> {
+    return this.fetch('/notifications/test', {
+      method: 'POST',
+      body: JSON.stringify({ channel })
+    }).then(r => r.json());
   }
 
   // WebSocket handling
@@ -67,7 +208,11 @@ export class DockerClient {
 
   // Container operations
   async getContainers(): Promise<Container[]> {
-    return this.fetch('/containers').then(r => r.json());
+    return this.fetchList('/containers');
+  }
+
+  async queryContainers(filter: ContainerFilter = {}): Promise<ListResponse<Container>> {
+    return this.fetch(`/containers${this.listQuery(filter)}`).then(r => r.json());
   }
 
   async startContainer(id: string): Promise<void> {
@@ -82,9 +227,158 @@ export class DockerClient {
     await this.fetch(`/containers/${id}/restart`, { method: 'POST' });
   }
 
+  async pauseContainer(id: string): Promise<void> {
+    await this.fetch(`/containers/${id}/pause`, { method: 'POST' });
+  }
+
+  async unpauseContainer(id: string): Promise<void> {
+    await this.fetch(`/containers/${id}/unpause`, { method: 'POST' });
+  }
+
+  async killContainer(id: string, signal = 'SIGKILL'): Promise<void> {
+    await this.fetch(`/containers/${id}/kill?signal=${encodeURIComponent(signal)}`, { method: 'POST' });
+  }
+
+  async renameContainer(id: string, name: string): Promise<void> {
+    await this.fetch(`/containers/${id}/rename?name=${encodeURIComponent(name)}`, { method: 'POST' });
+  }
+
+  async updateContainer(id: string, update: UpdateContainerRequest): Promise<{ warnings?: string[] }> {
+    const response = await this.fetch(`/containers/${id}/update`, {
+      method: 'POST',
+      body: JSON.stringify(update)
+    });
+    return response.json();
+  }
+
+  async recreateContainer(id: string, force = false): Promise<RecreateResult> {
+    const response = await this.fetch(`/containers/${id}/recreate${force ? '?force=true' : ''}`, { method: 'POST' });
+    return response.json();
+  }
+
+  async commitContainer(id: string, options: ContainerCommitRequest = {}): Promise<{ id: string; reference?: string }> {
+    const response = await this.fetch(`/containers/${id}/commit`, {
+      method: 'POST',
+      body: JSON.stringify(options)
+    });
+    return response.json();
+  }
+
+  async getContainerHealth(id: string): Promise<ContainerHealth> {
+    return this.fetch(`/containers/${id}/health`).then(r => r.json());
+  }
+
+  async exportContainerConfig(id: string, reveal = false): Promise<ContainerExport> {
+    return this.fetch(`/containers/${id}/export-config${reveal ? '?reveal=true' : ''}`).then(r => r.json());
+  }
+
+  // Creates a container from an export, its definition or a compose file
+  async importContainer(definition: ContainerExport | ContainerDefinition | string, options: { name?: string; service?: string; start?: boolean } = {}): Promise<CreateContainerResponse> {
+    const params = new URLSearchParams();
+    if (options.name) params.set('name', options.name);
+    if (options.service) params.set('service', options.service);
+    if (options.start) params.set('start', 'true');
+    const compose = typeof definition === 'string';
+    const response = await this.fetch(`/containers/import?${params}`, {
+      method: 'POST',
+      headers: compose ? { 'Content-Type': 'application/yaml' } : undefined,
+      body: compose ? definition : JSON.stringify(definition)
+    });
+    return response.json();
+  }
+
+  async searchLogs(id: string, search: LogSearch = {}): Promise<LogSearchResult> {
+    const params = new URLSearchParams({ format: 'json' });
+    for (const [key, value] of Object.entries(search)) {
+      if (value === undefined || value === '') continue;
+      params.set(key, Array.isArray(value) ? value.join(',') : String(value));
+    }
+    return this.fetch(`/containers/${id}/logs?${params}`).then(r => r.json());
+  }
+
+  async getStoredLogs(): Promise<StoredLogs> {
+    return this.fetch('/logs/stored').then(r => r.json());
+  }
+
+  // Searches collected logs, which outlive their container; ref is an ID,
+  // ID prefix or name
+  async searchStoredLogs(ref: string, search: StoredLogSearch = {}): Promise<LogSearchResult> {
+    const params = new URLSearchParams();
+    for (const [key, value] of Object.entries(search)) {
+      if (value === undefined || value === '') continue;
+      params.set(key, Array.isArray(value) ? value.join(',') : String(value));
+    }
+    return this.fetch(`/logs/stored/${encodeURIComponent(ref)}?${params}`).then(r => r.json());
+  }
+
+  async deleteStoredLogs(ref: string): Promise<void> {
+    await this.fetch(`/logs/stored/${encodeURIComponent(ref)}`, { method: 'DELETE' });
+  }
+
+  // Stores the collected logs in the bucket
+  async archiveStoredLogs(ref: string): Promise<StorageObject> {
+    return this.fetch(`/logs/stored/${encodeURIComponent(ref)}/archive`, { method: 'POST' }).then(r => r.json());
+  }
+
+  async importStoredLogs(key: string): Promise<StoredLogsImport> {
+    return this.fetch(`/logs/stored/import?key=${encodeURIComponent(key)}`, { method: 'POST' }).then(r => r.json());
+  }
+
+  async batchContainers(request: ContainerBatchRequest, timeout?: number): Promise<ContainerBatchResult> {
+    const query = timeout !== undefined ? `?timeout=${timeout}` : '';
+    const response = await this.fetch(`/containers/batch${query}`, {
+      method: 'POST',
+      body: JSON.stringify(request)
+    });
+    return response.json();
+  }
+
+  async getContainerChanges(id: string): Promise<ContainerChange[]> {
+    return this.fetchList(`/containers/${id}/changes`);
+  }
+
+  async listContainerFiles(id: string, path = '/'): Promise<ContainerFileList> {
+    return this.fetch(`/containers/${id}/files?path=${encodeURIComponent(path)}`).then(r => r.json());
+  }
+
+  // Fetched rather than linked so the Authorization header is sent
+  async downloadContainerFiles(id: string, path: string): Promise<Blob> {
+    return this.fetch(`/containers/${id}/files/archive?path=${encodeURIComponent(path)}`).then(r => r.blob());
+  }
+
+  // The whole filesystem, as docker export makes it
+  async exportContainer(id: string): Promise<Blob> {
+    return this.fetch(`/containers/${id}/export`).then(r => r.blob());
+  }
+
+  async exportContainerToStorage(id: string): Promise<StorageObject> {
+    return this.fetch(`/containers/${id}/export?target=s3`, { method: 'POST' }).then(r => r.json());
+  }
+
+  // Creates an exec to attach to with wsManager.connectToExec within a minute
+  async createExec(id: string, cmd: string[] = ['/bin/sh'], tty = true): Promise<ExecInfo> {
+    const response = await this.fetch(`/containers/${id}/exec`, {
+      method: 'POST',
+      body: JSON.stringify({ cmd, tty })
+    });
+    return response.json();
+  }
+
   // Image operations
   async getImages(): Promise<Image[]> {
-    return this.fetch('/images').then(r => r.json());
+    return this.fetchList('/images');
+  }
+
+  async queryImages(filter: ImageFilter = {}): Promise<ListResponse<ImageInfo>> {
+    return this.fetch(`/images${this.listQuery(filter)}`).then(r => r.json());
+  }
+
+  async batchDeleteImages(request: ImageBatchDeleteRequest): Promise<ImageBatchDeleteResult> {
+    const response = await this.fetch('/images/batch-delete', {
+      method: 'POST',
+      body: JSON.stringify(request)
+    });
+    return response.json();
   }
 
   async pullImage(name: string): Promise<ReadableStream> {
@@ -94,9 +388,57 @@ export class DockerClient {
     return response.body!;
   }
 
+  // Fetched rather than linked so the Authorization header is sent
+  async exportImage(ref: string): Promise<Blob> {
+    return this.fetch(`/images/${ref}/export`).then(r => r.blob());
+  }
+
+  async exportImageToStorage(ref: string): Promise<StorageObject> {
+    return this.fetch(`/images/${ref}/export?target=s3`, { method: 'POST' }).then(r => r.json());
+  }
+
+  // Uploads a docker save tarball, passing each progress line to
+  // onProgress, and resolves with the last one
+  async importImage(file: Blob, onProgress?: (progress: ImageLoadProgress) => void): Promise<ImageLoadProgress> {
+    const response = await this.fetch('/images/import', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/x-tar' },
+      body: file
+    });
+    return this.readLoadProgress(response, onProgress);
+  }
+
+  // Loads a docker save tarball kept in the bucket
+  async importImageFromStorage(key: string, onProgress?: (progress: ImageLoadProgress) => void): Promise<ImageLoadProgress> {
+    const response = await this.fetch(`/images/import?key=${encodeURIComponent(key)}`, { method: 'POST' });
+    return this.readLoadProgress(response, onProgress);
+  }
+
+  private async readLoadProgress(response: Response, onProgress?: (progress: ImageLoadProgress) => void): Promise<ImageLoadProgress> {
+    const reader = response.body!.pipeThrough(new TextDecoderStream()).getReader();
+    let buffered = '';
+    let last: ImageLoadProgress = { status: 'error', error: 'No response', progressDetail: { current: 0, total: 0 }, bytesDone: 0 };
+    while (true) {
+      const { done, value } = await reader.read();
+      if (done) break;
+      buffered += value;
+      const lines = buffered.split('\n');
+      buffered = lines.pop()!;
+      for (const line of lines.filter(Boolean)) {
+        last = JSON.parse(line);
+        onProgress?.(last);
+      }
+    }
+    return last;
+  }
+
   // Compose operations
   async getComposeProjects(): Promise<ComposeProject[]> {
-    return this.fetch('/compose/projects').then(r => r.json());
+    return this.fetchList('/compose/projects');
+  }
+
+  async getComposeProject(project: string): Promise<ComposeProjectConfig> {
+    return this.fetch(`/compose/projects/${project}`).then(r => r.json());
   }
 
   async composeUp(project: string): Promise<ReadableStream> {
@@ -120,21 +462,141 @@ export class DockerClient {
     });
   }
 
+  async importGitProject(request: ComposeGitImportRequest): Promise<ComposeProjectCreated> {
+    return this.fetch('/compose/projects/import-git', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(request)
+    }).then(r => r.json());
+  }
+
+  async getGitSource(project: string): Promise<ComposeGitSource> {
+    return this.fetch(`/compose/projects/${project}/git`).then(r => r.json());
+  }
+
+  async syncProject(project: string, options: { force?: boolean; deploy?: boolean } = {}): Promise<ComposeSyncResult> {
+    return this.fetch(`/compose/projects/${project}/sync${this.listQuery(options)}`, {
+      method: 'POST'
+    }).then(r => r.json());
+  }
+
   // System operations
+  async getDaemonStatus(refresh = false): Promise<DaemonStatus> {
+    return this.fetch(`/docker/status${refresh ? '?refresh=true' : ''}`).then(r => r.json());
+  }
+
+  // Swarm operations; all but getSwarm need the endpoint to be a manager
+  async getSwarm(): Promise<SwarmInfo> {
+    return this.fetch('/swarm').then(r => r.json());
+  }
+
+  async getSwarmServices(): Promise<SwarmService[]> {
+    return this.fetchList('/swarm/services');
+  }
+
+  async scaleSwarmService(id: string, replicas: number): Promise<SwarmServiceUpdateResult> {
+    return this.fetch(`/swarm/services/${id}/scale`, {
+      method: 'POST',
+      body: JSON.stringify({ replicas })
+    }).then(r => r.json());
+  }
+
+  async updateSwarmService(id: string, request: SwarmServiceUpdateRequest): Promise<SwarmServiceUpdateResult> {
+    return this.fetch(`/swarm/services/${id}/update`, {
+      method: 'POST',
+      body: JSON.stringify(request)
+    }).then(r => r.json());
+  }
+
+  async getSwarmNodes(): Promise<SwarmNode[]> {
+    return this.fetchList('/swarm/nodes');
+  }
+
+  // service narrows the tasks to one service, by ID or name
+  async getSwarmTasks(service?: string): Promise<SwarmTask[]> {
+    return this.fetchList(service ? `/swarm/services/${encodeURIComponent(service)}/tasks` : '/swarm/tasks');
+  }
+
+  async getSwarmSecrets(): Promise<SwarmSecret[]> {
+    return this.fetchList('/swarm/secrets');
+  }
+
+  async getSwarmConfigs(): Promise<SwarmConfig[]> {
+    return this.fetchList('/swarm/configs');
+  }
+
+  // Creates a secret or config from text content, such as a file's
+  async createSwarmData(kind: 'secrets', name: string, data: string, labels?: Record<string, string>): Promise<SwarmSecret>;
+  async createSwarmData(kind: 'configs', name: string, data: string, labels?: Record<string, string>): Promise<SwarmConfig>;
+  async createSwarmData(kind: SwarmDataKind, name: string, data: string, labels?: Record<string, string>): Promise<SwarmSecret | SwarmConfig> {
+    return this.fetch(`/swarm/${kind}`, {
+      method: 'POST',
+      body: JSON.stringify({ name, data, labels })
+    }).then(r => r.json());
+  }
+
+  async removeSwarmData(kind: SwarmDataKind, id: string): Promise<void> {
+    await this.fetch(`/swarm/${kind}/${encodeURIComponent(id)}`, { method: 'DELETE' });
+  }
+
   async getSystemInfo(): Promise<SystemInfo> {
     return this.fetch('/system/info').then(r => r.json());
   }
 
+  async getSystemMetrics(): Promise<SystemMetrics> {
+    return this.fetch('/system/metrics').then(r => r.json());
+  }
+
+  async getUpdates(all = false): Promise<UpdateReport> {
+    return this.fetch(`/updates${all ? '?all=true' : ''}`).then(r => r.json());
+  }
+
+  async checkForUpdates(): Promise<void> {
+    await this.fetch('/updates/check', { method: 'POST' });
+  }
+
+  async pruneSystem(options: { scopes?: PruneScope[]; all?: boolean; dryRun?: boolean } = {}): Promise<SystemPruneResult> {
+    const params = new URLSearchParams();
+    if (options.scopes?.length) params.set('scope', options.scopes.join(','));
+    if (options.all) params.set('all', 'true');
+    if (options.dryRun) params.set('dry_run', 'true');
+    const query = params.toString();
+    const response = await this.fetch(`/system/prune${query ? `?${query}` : ''}`, { method: 'POST' });
+    return response.json();
+  }
+
   async getDiskUsage(): Promise<DiskUsage> {
     return this.fetch('/system/disk').then(r => r.json());
   }
 
   // Base fetch method with error handling
+  private async fetchList<T>(path: string): Promise<T[]> {
+    const list: ListResponse<T> = await this.fetch(path).then(r => r.json());
+    return list.items;
+  }
+
+  // Keeps the slashes of an object key, which the server reads as a path
+  private objectPath(key: string): string {
+    return key.split('/').map(encodeURIComponent).join('/');
+  }
+
+  private listQuery(filter: object): string {
+    const params = new URLSearchParams();
+    for (const [key, value] of Object.entries(filter)) {
+      for (const v of Array.isArray(value) ? value : [value]) {
+        if (v !== undefined && v !== '') params.append(key, String(v));
+      }
+    }
+    const query = params.toString();
+    return query ? `?${query}` : '';
+  }
+
   private async fetch(path: string, options: RequestInit = {}): Promise<Response> {
     const response = await fetch(`${this.baseUrl}${path}`, {
       ...options,
       headers: {
         'Content-Type': 'application/json',
+        ...(this.token ? { Authorization: `Bearer ${this.token}` } : {}),
         ...options.headers,
       },
     });
@@ -160,6 +622,20 @@ export class DockerClient {
     }
   }
 
+  // Merged logs of several containers or a compose project, sorted by
+  // timestamp. Returns a function that closes the stream.
+  aggregateLogs(options: AggregateLogsOptions, onFrame: (frame: LogFrame) => void, onBacklogEnd?: () => void): () => void {
+    const params = new URLSearchParams();
+    for (const [key, value] of Object.entries(options)) {
+      if (value === undefined || value === '') continue;
+      params.set(key, Array.isArray(value) ? value.join(',') : String(value));
+    }
+    const source = new EventSource(`${this.baseUrl}/logs/aggregate?${params}`);
+    source.addEventListener('log', (event) => onFrame(JSON.parse((event as MessageEvent).data)));
+    source.addEventListener('backlog_end', () => onBacklogEnd?.());
+    return () => source.close();
+  }
+
   // WebSocket event subscription
   onDockerEvent(callback: (event: any) => void): () => void {
     const handler = (event: MessageEvent) => {
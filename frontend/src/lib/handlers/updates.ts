@@ -53,7 +53,7 @@ export async function handleContainerUpdate(containerId: string, newState: Parti
 
 // Log streaming management
 export function setupLogStreaming(containerId: string) {
-  return wsManager.subscribe(`/containers/${containerId}/logs`, (data) => {
+  return wsManager.subscribe(`/containers/${containerId}/logs/ws`, (data) => {
     // Handle incoming log data
     const logUpdate = new CustomEvent('docker:log', {
       detail: { containerId, log: data }
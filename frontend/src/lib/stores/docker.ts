@@ -66,6 +66,12 @@ export const errorStore = (() => {
   };
 })();
 
+// Epoch and sequence number of the last event received, sent on reconnect so
+// the server only replays events we have not seen yet. The epoch changes when
+// the server restarts, which starts the sequence over.
+let lastEventEpoch = '';
+let lastEventSeq = 0;
+
 // WebSocket connection management
 function createWebSocketConnection() {
   if (typeof window === 'undefined') {
@@ -79,7 +85,7 @@ function createWebSocketConnection() {
   }
 
   try {
-    const ws = new WebSocket(wsUrl);
+    const ws = new WebSocket(lastEventSeq > 0 ? `${wsUrl}?since=${lastEventEpoch}-${lastEventSeq}` : wsUrl);
     
     ws.onmessage = (event) => {
       try {
@@ -107,6 +113,27 @@ function createWebSocketConnection() {
 
 // WebSocket message handler
 function handleWebSocketMessage(data: any) {
+  if (data.type === 'replay_end') {
+    // The server restarted or dropped events we missed; resync everything
+    if (data.truncated || data.reset || data.seq < lastEventSeq) {
+      refreshAll();
+    }
+    lastEventEpoch = data.epoch;
+    lastEventSeq = data.seq;
+    return;
+  }
+  if (typeof data.seq === 'number') {
+    // Events from a restarted server number from 1 again
+    if (data.epoch === lastEventEpoch && data.seq <= lastEventSeq) {
+      return;
+    }
+    lastEventEpoch = data.epoch;
+    lastEventSeq = data.seq;
+  }
+  if (data.project) {
+    composeStore.refresh(() => client.getComposeProjects());
+  }
+
   switch (data.type) {
     case 'container':
       containersStore.refresh(() => client.getContainers());
@@ -123,22 +150,22 @@ function handleWebSocketMessage(data: any) {
   }
 }
 
+const refreshAll = async () => {
+  await Promise.all([
+    containersStore.refresh(() => client.getContainers()),
+    imagesStore.refresh(() => client.getImages()),
+    composeStore.refresh(() => client.getComposeProjects()),
+    systemStore.refresh(() => client.getSystemInfo()),
+    diskUsageStore.refresh(() => client.getDiskUsage())
+  ]);
+};
+
 // Auto-refresh functionality
 const setupAutoRefresh = () => {
   const refreshInterval = 30000; // 30 seconds
 
-  const refresh = async () => {
-    await Promise.all([
-      containersStore.refresh(() => client.getContainers()),
-      imagesStore.refresh(() => client.getImages()),
-      composeStore.refresh(() => client.getComposeProjects()),
-      systemStore.refresh(() => client.getSystemInfo()),
-      diskUsageStore.refresh(() => client.getDiskUsage())
-    ]);
-  };
-
   // Initial load
-  refresh();
+  refreshAll();
 
   // Set up interval for system metrics
   const interval = setInterval(() => {
@@ -26,6 +26,64 @@ export interface Image {
   VirtualSize: number;
 }
 
+export interface ImageInfo {
+  id: string;
+  parent_id?: string;
+  repo_tags?: string[];
+  repo_digests?: string[];
+  created: string;
+  size: number;
+  shared_size: number;
+  virtual_size: number;
+  labels?: Record<string, string>;
+  dangling: boolean;
+  in_use: boolean;
+  containers: number;
+}
+
+export interface ImageBatchDeleteRequest {
+  images: string[];
+  force?: boolean;
+  prune_children?: boolean;
+}
+
+export interface ImageDeleteResult {
+  image: string;
+  success: boolean;
+  status: number;
+  error?: string;
+  untagged?: string[];
+  deleted?: string[];
+}
+
+export interface ImageBatchDeleteResult {
+  success: boolean;
+  removed: number;
+  failed: number;
+  images: ImageDeleteResult[];
+}
+
+export interface ImageFilter {
+  dangling?: boolean;
+  reference?: string;
+  label?: string[];
+  in_use?: boolean;
+  minSize?: string;
+  maxSize?: string;
+  sort?: 'size' | 'created';
+  order?: 'asc' | 'desc';
+  limit?: number;
+  offset?: number;
+}
+
+export interface ListResponse<T> {
+  items: T[];
+  total: number;
+  limit: number;
+  offset: number;
+  generatedAt: string;
+}
+
 export interface ComposeProject {
   name: string;
   path: string;
@@ -33,6 +91,59 @@ export interface ComposeProject {
   services: string[];
 }
 
+// The parsed compose file of a project
+export interface ComposeProjectConfig {
+  services: Record<string, {
+    image: string;
+    deploy?: {
+      replicas: number;
+    };
+  }>;
+}
+
+export interface ComposeResult {
+  operation: string;
+  success: boolean;
+  succeeded: string[];
+  failed: string[];
+  skipped: string[];
+}
+
+export interface ComposeGitImportRequest {
+  name: string;
+  url: string;
+  branch?: string;
+  path?: string;
+  username?: string;
+  password?: string;
+}
+
+export interface ComposeGitSource {
+  project: string;
+  url: string;
+  branch?: string;
+  path?: string;
+  hasCredentials: boolean;
+  commit: string;
+  syncedAt: string;
+}
+
+export interface ComposeProjectCreated {
+  project: string;
+  services: string[];
+  git?: ComposeGitSource;
+}
+
+export interface ComposeSyncResult {
+  project: string;
+  previousCommit: string;
+  commit: string;
+  changed: boolean;
+  deployed: boolean;
+  result?: ComposeResult;
+  error?: string;
+}
+
 export interface SystemInfo {
   containers: number;
   images: number;
@@ -45,6 +156,34 @@ export interface SystemInfo {
   architecture: string;
 }
 
+export interface SystemMetrics {
+  time: string;
+  containers: number;
+  cpu_percent: number;
+  host_cpus: number;
+  host_cpu_percent: number;
+  memory_usage: number;
+  host_memory: number;
+  memory_percent: number;
+  network_rx_bytes: number;
+  network_tx_bytes: number;
+  block_read_bytes: number;
+  block_write_bytes: number;
+  pids: number;
+  host: {
+    name: string;
+    operating_system: string;
+    kernel_version: string;
+    architecture: string;
+    docker_version: string;
+    containers: number;
+    containers_running: number;
+    containers_paused: number;
+    containers_stopped: number;
+    images: number;
+  };
+}
+
 export interface DockerError {
   message: string;
   code: string;
@@ -73,4 +212,589 @@ export interface ContainerDiskUsage {
 export interface VolumeDiskUsage {
   name: string;
   size: number;
-} 
\ No newline at end of file
+} 
+
+export type PruneScope = 'containers' | 'networks' | 'volumes' | 'images' | 'build-cache';
+
+export interface PruneItem {
+  id?: string;
+  name?: string;
+  size: number;
+}
+
+export interface PruneScopeResult {
+  items: PruneItem[];
+  space_reclaimed: number;
+  error?: string;
+}
+
+export interface SystemPruneResult {
+  dry_run: boolean;
+  containers?: PruneScopeResult;
+  images?: PruneScopeResult;
+  volumes?: PruneScopeResult;
+  networks?: PruneScopeResult;
+  build_cache?: PruneScopeResult;
+  space_reclaimed: number;
+}
+
+export interface ContainerFile {
+  name: string;
+  path: string;
+  type: 'file' | 'dir' | 'symlink' | 'other';
+  size: number;
+  mode: string;
+  modTime: string;
+  linkTarget?: string;
+}
+
+export interface ContainerFileList {
+  path: string;
+  entries: ContainerFile[];
+  truncated: boolean;
+}
+
+export interface ContainerChange {
+  path: string;
+  kind: 'added' | 'modified' | 'deleted';
+}
+
+export interface UpdateContainerRequest {
+  preset?: string;
+  cpus?: number;
+  memory?: number;
+  memorySwap?: number;
+  restartPolicy?: { name: 'no' | 'always' | 'unless-stopped' | 'on-failure'; maximumRetryCount?: number };
+}
+
+export interface ContainerBatchRequest {
+  action: 'start' | 'stop' | 'restart' | 'remove';
+  ids: string[];
+  force?: boolean;
+  volumes?: boolean;
+  tokens?: Record<string, string>;
+  concurrency?: number;
+}
+
+export interface ContainerBatchItemResult {
+  id: string;
+  name?: string;
+  success: boolean;
+  status: number;
+  error?: string;
+}
+
+export interface ContainerBatchResult {
+  action: string;
+  success: boolean;
+  succeeded: number;
+  failed: number;
+  containers: ContainerBatchItemResult[];
+}
+
+export type LogLevel = 'debug' | 'info' | 'warn' | 'error' | 'fatal';
+
+export interface LogSearch {
+  q?: string;
+  regex?: string;
+  level?: (LogLevel | 'unknown')[];
+  stream?: 'stdout' | 'stderr';
+  since?: string;
+  until?: string;
+  tail?: number | 'all';
+  limit?: number;
+}
+
+export interface LogEntry {
+  timestamp: string;
+  stream: 'stdout' | 'stderr';
+  level?: LogLevel;
+  message: string;
+}
+
+export interface LogSearchResult {
+  container: string;
+  entries: LogEntry[];
+  scanned: number;
+  matched: number;
+  truncated: boolean;
+}
+
+export interface LogFrame {
+  service: string;
+  container: string;
+  index: number;
+  colorIndex: number;
+  stream: 'stdout' | 'stderr' | 'error';
+  timestamp: string;
+  level?: LogLevel;
+  message: string;
+}
+
+export interface AggregateLogsOptions extends Omit<LogSearch, 'limit'> {
+  containers?: string[];
+  project?: string;
+  follow?: boolean;
+}
+
+export type StoredLogSearch = Omit<LogSearch, 'tail'>;
+
+export interface StoredContainer {
+  id: string;
+  name: string;
+  image: string;
+  project?: string;
+  service?: string;
+  firstLog?: string;
+  lastLog?: string;
+  size: number;
+  removedAt?: string;
+  collecting: boolean;
+}
+
+export interface StoredLogs {
+  enabled: boolean;
+  collect: string[];
+  retention?: string;
+  maxSize: number;
+  containers: StoredContainer[];
+}
+
+// The create request that makes a container again, as exported
+export interface ContainerDefinition {
+  image: string;
+  name?: string;
+  entrypoint?: string[];
+  cmd?: string[];
+  workingDir?: string;
+  user?: string;
+  hostname?: string;
+  network?: string;
+  env?: string[];
+  labels?: Record<string, string>;
+  ports?: { hostIp: string; hostPort: number; containerPort: number; protocol: string }[];
+  mounts?: { type: 'bind' | 'volume' | 'tmpfs'; source?: string; target: string; readOnly?: boolean }[];
+  restartPolicy?: { name: string; maximumRetryCount?: number };
+  init?: boolean;
+  cpus?: number;
+  memory?: number;
+  capAdd?: string[];
+  capDrop?: string[];
+  sysctls?: Record<string, string>;
+  ulimits?: { name: string; soft: number; hard?: number }[];
+  devices?: { pathOnHost: string; pathInContainer?: string; cgroupPermissions?: string }[];
+  deviceRequests?: { driver?: string; count?: number; deviceIds?: string[]; capabilities?: string[][]; options?: Record<string, string> }[];
+  start?: boolean;
+}
+
+export interface ContainerExport {
+  definition: ContainerDefinition;
+  compose: string;
+  run: string;
+  omitted?: string[];
+  redacted?: string[];
+}
+
+export interface CreateContainerResponse {
+  id: string;
+  warnings?: string[];
+  started: boolean;
+}
+
+export interface ImageLoadProgress {
+  status: string; // uploading, the daemon's message while loading, loaded, done or error
+  id?: string;
+  progressDetail: { current: number; total: number };
+  bytesDone: number;
+  bytesTotal?: number;
+  image?: string;
+  images?: string[];
+  error?: string;
+}
+
+export interface ContainerHealth {
+  status: 'healthy' | 'unhealthy' | 'starting' | 'none';
+  failingStreak: number;
+  check?: {
+    test: string[];
+    interval?: string;
+    timeout?: string;
+    startPeriod?: string;
+    startInterval?: string;
+    retries?: number;
+  };
+  log: HealthProbe[];
+}
+
+export interface HealthProbe {
+  start: string;
+  end: string;
+  exitCode: number;
+  output: string;
+}
+
+export interface RecreateResult {
+  oldId: string;
+  id: string;
+  name: string;
+  image: string;
+  previousImageId: string;
+  imageId: string;
+  recreated: boolean;
+  started: boolean;
+  warnings?: string[];
+}
+
+export interface ImageUpdateCheck {
+  image: string;
+  checked: boolean;
+  updateAvailable: boolean;
+  localDigests: string[];
+  remoteDigest?: string;
+  warning?: string;
+}
+
+export interface ContainerUpdate {
+  containerId: string;
+  name: string;
+  imageId: string;
+  check: ImageUpdateCheck;
+  checkedAt: string;
+  autoUpdate: boolean;
+  recreated?: RecreateResult;
+  recreateError?: string;
+}
+
+export interface UpdateReport {
+  enabled: boolean;
+  interval?: string;
+  checking: boolean;
+  lastCheck?: string;
+  nextCheck?: string;
+  lastError?: string;
+  containers: ContainerUpdate[];
+}
+
+export type JobAction = 'prune-images' | 'prune-containers' | 'restart-container' | 'recreate-container' | 'compose-update' | 'backup-volume' | 'backup-compose';
+
+export interface JobRun {
+  started: string;
+  durationMs: number;
+  trigger: 'schedule' | 'manual' | 'webhook';
+  user?: string;
+  success: boolean;
+  result?: string;
+  error?: string;
+}
+
+export interface Job {
+  id: string;
+  name: string;
+  schedule: string;
+  endpoint?: string;
+  action: JobAction;
+  target?: string;
+  all?: boolean;
+  keep?: number; // backups a backup job keeps; 0 keeps them all
+  enabled: boolean;
+  createdAt: string;
+  updatedAt: string;
+  running: boolean;
+  nextRun?: string;
+  lastRun?: JobRun;
+  lastError?: string;
+  webhook?: JobWebhook;
+}
+
+export interface JobWebhook {
+  signed: boolean;
+  createdAt: string;
+  lastTriggered?: string;
+}
+
+export interface JobWebhookRequest {
+  signed?: boolean;
+  secret?: string;
+}
+
+export interface JobWebhookCreated extends JobWebhook {
+  token: string;
+  path: string;
+  secret?: string;
+}
+
+export interface JobRequest {
+  name?: string;
+  schedule: string;
+  endpoint?: string;
+  action: JobAction;
+  target?: string;
+  all?: boolean;
+  keep?: number;
+  enabled?: boolean;
+}
+
+export type BackupKind = 'volume' | 'compose';
+
+export interface Backup {
+  id: string; // kind/name/timestamp
+  kind: BackupKind;
+  name: string;
+  created: string;
+  size: number;
+}
+
+// An object in the S3-compatible bucket; keys are relative to the
+// configured prefix
+export interface StorageObject {
+  key: string;
+  size: number;
+  modified: string;
+}
+
+export interface StoredLogsImport {
+  container: StoredContainer;
+  entries: number;
+}
+
+export interface BackupRestoreResult {
+  backup: string;
+  volumes: string[];
+  project?: string;
+  files: boolean; // the project's files were registered again
+}
+
+export type NotificationEvent = 'container-exited' | 'health-failing' | 'image-update' | 'job-failed';
+
+export interface Notification {
+  event: NotificationEvent | 'test';
+  endpoint: string;
+  title: string;
+  message: string;
+  container?: string;
+  containerId?: string;
+  project?: string;
+  job?: string;
+  time: string;
+}
+
+export interface NotificationChannel {
+  name: string;
+  type: 'slack' | 'discord' | 'email' | 'webhook';
+}
+
+export interface NotificationRoute {
+  events: NotificationEvent[] | null;
+  channels: string[];
+  endpoints: string[] | null;
+  containers: string[] | null;
+}
+
+export interface NotificationSettings {
+  enabled: boolean;
+  events: NotificationEvent[];
+  channels: NotificationChannel[];
+  routes: NotificationRoute[];
+}
+
+export interface NotificationResult {
+  channel: string;
+  type: NotificationChannel['type'];
+  success: boolean;
+  error?: string;
+}
+
+export interface ContainerCommitRequest {
+  repo?: string;
+  tag?: string;
+  comment?: string;
+  author?: string;
+  pause?: boolean;
+}
+
+export interface DaemonStatus {
+  endpoint: string;
+  host: string;
+  connected: boolean;
+  apiVersion?: string;
+  since?: string;
+  lastCheck?: string;
+  lastError?: string;
+  attempts?: number;
+  nextRetry?: string;
+  reconnects?: number;
+  swarm?: string; // the Swarm node state, such as inactive or active
+  swarmManager?: boolean;
+}
+
+export interface SwarmInfo {
+  state: 'inactive' | 'pending' | 'active' | 'error' | 'locked';
+  manager: boolean;
+  nodeId?: string;
+  nodeAddr?: string;
+  clusterId?: string;
+  nodes?: number;
+  managers?: number;
+  error?: string;
+}
+
+export interface SwarmPort {
+  protocol: string;
+  targetPort: number;
+  publishedPort?: number;
+  publishMode?: 'ingress' | 'host';
+}
+
+export interface SwarmService {
+  id: string;
+  name: string;
+  image: string;
+  mode: 'replicated' | 'global' | 'replicated-job' | 'global-job';
+  replicas?: number;
+  running: number;
+  desired: number;
+  ports?: SwarmPort[];
+  labels?: Record<string, string>;
+  created: string;
+  updated: string;
+  updateState?: string;
+  updateMessage?: string;
+}
+
+// Unset fields are left alone; rollback can't be combined with the others
+export interface SwarmServiceUpdateRequest {
+  image?: string;
+  env?: string[];
+  labels?: Record<string, string>;
+  force?: boolean;
+  rollback?: boolean;
+}
+
+export interface SwarmServiceUpdateResult {
+  id: string;
+  name: string;
+  warnings?: string[];
+}
+
+export interface SwarmNode {
+  id: string;
+  hostname: string;
+  role: 'manager' | 'worker';
+  availability: 'active' | 'pause' | 'drain';
+  state: string;
+  message?: string;
+  addr?: string;
+  leader?: boolean;
+  reachability?: string;
+  engineVersion?: string;
+  os?: string;
+  architecture?: string;
+  nanoCpus?: number;
+  memoryBytes?: number;
+  labels?: Record<string, string>;
+}
+
+// A secret's value can't be read back
+export interface SwarmSecret {
+  id: string;
+  name: string;
+  labels?: Record<string, string>;
+  driver?: string;
+  created: string;
+  updated: string;
+  services: string[]; // the services using it
+}
+
+export interface SwarmConfig {
+  id: string;
+  name: string;
+  labels?: Record<string, string>;
+  size: number;
+  created: string;
+  updated: string;
+  services: string[];
+}
+
+export type SwarmDataKind = 'secrets' | 'configs';
+
+export interface SwarmTask {
+  id: string;
+  serviceId: string;
+  serviceName?: string;
+  slot?: number;
+  nodeId?: string;
+  nodeName?: string;
+  image: string;
+  desiredState: string;
+  state: string;
+  message?: string;
+  error?: string;
+  exitCode?: number;
+  containerId?: string;
+  created: string;
+  updated: string;
+}
+
+export interface ExecInfo {
+  id: string;
+  containerId: string;
+  cmd: string[];
+  user: string;
+  workingDir: string;
+  tty: boolean;
+  running: boolean;
+  exitCode: number;
+  pid: number;
+}
+
+export interface AuthSession {
+  enabled: boolean;
+  username?: string;
+  expiresAt?: string;
+  token?: string;
+}
+
+export interface AuditEntry {
+  time: string;
+  user: string;
+  endpoint: string;
+  resource: string;
+  target?: string;
+  action: string;
+  method: string;
+  path: string;
+  query?: string;
+  status: number;
+  success: boolean;
+  error?: string;
+  durationMs: number;
+  requestId?: string;
+}
+
+export interface AuditFilter {
+  since?: string;
+  until?: string;
+  user?: string;
+  resource?: string;
+  target?: string;
+  action?: string;
+  success?: boolean;
+  limit?: number;
+  offset?: number;
+}
+
+export interface ContainerFilter {
+  status?: string;
+  name?: string;
+  label?: string[];
+  health?: 'healthy' | 'unhealthy' | 'starting' | 'none';
+  sort?: 'name' | 'image' | 'state' | 'created';
+  order?: 'asc' | 'desc';
+  limit?: number;
+  offset?: number;
+}
+
+export interface RegistryLogin {
+  registry: string;
+  username: string;
+}
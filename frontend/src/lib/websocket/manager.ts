@@ -112,8 +112,8 @@ export class WebSocketManager {
   }
 
   connectToContainerLogs(containerId: string): WebSocket {
-    return this.connect(`/containers/${containerId}/logs`, {
-      url: `${this.baseUrl}/containers/${containerId}/logs`
+    return this.connect(`/containers/${containerId}/logs/ws`, {
+      url: `${this.baseUrl}/containers/${containerId}/logs/ws`
     });
   }
 
@@ -124,6 +124,12 @@ export class WebSocketManager {
     });
   }
 
+  connectToExec(containerId: string, execId: string): WebSocket {
+    return this.connect(`/containers/${containerId}/exec/${execId}`, {
+      url: `${this.baseUrl}/containers/${containerId}/exec/${execId}`
+    });
+  }
+
   connectToComposeLogs(projectName: string): WebSocket {
     return this.connect(`/compose/${projectName}/logs`, {
       url: `${this.baseUrl}/compose/${projectName}/logs`
@@ -0,0 +1,250 @@
+package jobs
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+// maxRuns is how many runs of each job are kept, newest first
+const maxRuns = 20
+
+// storedJob is a job with its run history as kept on disk
+type storedJob struct {
+	apitypes.Job
+	Runs []apitypes.JobRun `json:"runs"`
+
+	// WebhookToken is the SHA-256 of the job's webhook token, and
+	// WebhookSecret the key its deliveries are signed with, if any
+	WebhookToken  string `json:"webhookToken,omitempty"`
+	WebhookSecret string `json:"webhookSecret,omitempty"`
+}
+
+// Store keeps jobs and their recent runs in a JSON file, rewritten on every
+// change
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	jobs map[string]storedJob
+}
+
+// NewStore opens the store at path, creating it on the first change if it
+// doesn't exist yet
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, jobs: make(map[string]storedJob)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []storedJob
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid jobs file: %w", err)
+	}
+	for _, job := range list {
+		s.jobs[job.ID] = job
+	}
+	return s, nil
+}
+
+// List returns every job sorted by name
+func (s *Store) List() []apitypes.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]apitypes.Job, 0, len(s.jobs))
+	for _, job := range s.list() {
+		list = append(list, job.Job)
+	}
+	return list
+}
+
+func (s *Store) Get(id string) (apitypes.Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job.Job, ok
+}
+
+// Put adds a job, or replaces the one with the same ID keeping its runs and
+// webhook
+func (s *Store) Put(job apitypes.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.jobs[job.ID]
+	job.Webhook = prev.Webhook
+	s.jobs[job.ID] = storedJob{Job: job, Runs: prev.Runs, WebhookToken: prev.WebhookToken, WebhookSecret: prev.WebhookSecret}
+	if err := s.save(); err != nil {
+		if existed {
+			s.jobs[job.ID] = prev
+		} else {
+			delete(s.jobs, job.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a job and its runs, reporting whether there was one
+func (s *Store) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.jobs[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.jobs, id)
+	if err := s.save(); err != nil {
+		s.jobs[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// AddRun records a finished run of a job. A job deleted while it was
+// running is left deleted.
+func (s *Store) AddRun(id string, run apitypes.JobRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	job := prev
+	job.LastRun = &run
+	if run.Trigger == "webhook" && job.Webhook != nil {
+		webhook := *job.Webhook
+		webhook.LastTriggered = &run.Started
+		job.Webhook = &webhook
+	}
+	if run.Success {
+		job.LastError = ""
+	} else {
+		job.LastError = run.Error
+	}
+	job.Runs = append([]apitypes.JobRun{run}, prev.Runs...)
+	if len(job.Runs) > maxRuns {
+		job.Runs = job.Runs[:maxRuns]
+	}
+	s.jobs[id] = job
+	if err := s.save(); err != nil {
+		s.jobs[id] = prev
+		return err
+	}
+	return nil
+}
+
+// SetWebhook gives a job a webhook reached by the token with the given
+// SHA-256, replacing any it had. A non-empty secret makes deliveries need
+// a signature. It reports false if there is no such job.
+func (s *Store) SetWebhook(id, tokenHash, secret string) (*apitypes.JobWebhook, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.jobs[id]
+	if !ok {
+		return nil, false, nil
+	}
+	job := prev
+	job.Webhook = &apitypes.JobWebhook{Signed: secret != "", CreatedAt: time.Now().UTC()}
+	job.WebhookToken, job.WebhookSecret = tokenHash, secret
+	s.jobs[id] = job
+	if err := s.save(); err != nil {
+		s.jobs[id] = prev
+		return nil, false, err
+	}
+	return job.Webhook, true, nil
+}
+
+// RemoveWebhook removes a job's webhook, reporting whether it had one
+func (s *Store) RemoveWebhook(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.jobs[id]
+	if !ok || prev.Webhook == nil {
+		return false, nil
+	}
+	job := prev
+	job.Webhook, job.WebhookToken, job.WebhookSecret = nil, "", ""
+	s.jobs[id] = job
+	if err := s.save(); err != nil {
+		s.jobs[id] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// WebhookJob finds the job whose webhook token has the given SHA-256,
+// returning it with the webhook's secret
+func (s *Store) WebhookJob(tokenHash string) (apitypes.Job, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.WebhookToken != "" && subtle.ConstantTimeCompare([]byte(job.WebhookToken), []byte(tokenHash)) == 1 {
+			return job.Job, job.WebhookSecret, true
+		}
+	}
+	return apitypes.Job{}, "", false
+}
+
+// Runs returns the recent runs of a job, newest first
+func (s *Store) Runs(id string) ([]apitypes.JobRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(job.Runs), true
+}
+
+func (s *Store) list() []storedJob {
+	list := make([]storedJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, job)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// save replaces the file with the current jobs
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".jobs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
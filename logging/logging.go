@@ -0,0 +1,117 @@
+// Package logging sets up the structured logger the whole service writes
+// through, and carries the request ID so handler logs can be tied to the
+// request that caused them.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options select where logs go and how they look
+type Options struct {
+	Level      string // debug, info, warn or error
+	Format     string // text or json
+	File       string // stdout, stderr or a file path
+	MaxSize    int    // megabytes at which File is rotated; zero never rotates
+	MaxBackups int    // rotated files to keep
+}
+
+type contextKey struct{}
+
+// level is shared by every logger Setup creates so SetLevel applies at once
+var level slog.LevelVar
+
+// Setup makes a logger from opts the default for both slog and the log
+// package. Close the returned writer on exit to flush a log file.
+func Setup(opts Options) (io.Closer, error) {
+	var out io.WriteCloser
+	switch opts.File {
+	case "", "stdout":
+		out = nopCloser{os.Stdout}
+	case "stderr":
+		out = nopCloser{os.Stderr}
+	default:
+		f, err := NewRotatingFile(opts.File, int64(opts.MaxSize)<<20, opts.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file %s: %w", opts.File, err)
+		}
+		out = f
+	}
+	if err := SetLevel(opts.Level); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	if opts.Format == "json" {
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(out, handlerOpts)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	// Anything still using the log package comes through at info
+	log.SetFlags(0)
+	return out, nil
+}
+
+// SetLevel changes the level of the default logger
+func SetLevel(name string) error {
+	switch strings.ToLower(name) {
+	case "debug":
+		level.Set(slog.LevelDebug)
+	case "", "info":
+		level.Set(slog.LevelInfo)
+	case "warn":
+		level.Set(slog.LevelWarn)
+	case "error":
+		level.Set(slog.LevelError)
+	default:
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	return nil
+}
+
+// WithRequestID returns ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "" if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID to records logged with a context
+// that carries one, as slog.InfoContext(r.Context(), ...) does
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,549 @@
+// Package logstore keeps copies of container logs on disk, so they can be
+// searched after the container is gone. Each container has a directory of
+// JSON Lines segments named after the time of their first line, which
+// retention removes oldest first.
+package logstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+const (
+	// segmentSize is the size at which a new segment is started
+	segmentSize = 8 << 20
+
+	// maxLine bounds a single entry when reading segments back
+	maxLine = 1 << 20
+
+	metaFile      = "container.json"
+	segmentSuffix = ".jsonl"
+)
+
+// ErrNotFound is returned for a container the store has no logs of
+var ErrNotFound = errors.New("no stored logs")
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Store appends log entries to per-container segment files under dir.
+// Writes are buffered until Flush.
+type Store struct {
+	dir string
+
+	mu   sync.Mutex
+	open map[string]*segment // by endpoint/ID
+}
+
+type segment struct {
+	path string
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// NewStore creates dir if needed, readable only by its owner
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, open: make(map[string]*segment)}, nil
+}
+
+func (s *Store) containerDir(endpoint, id string) (string, error) {
+	if !validName.MatchString(endpoint) || !validName.MatchString(id) {
+		return "", fmt.Errorf("invalid endpoint %q or container %q", endpoint, id)
+	}
+	return filepath.Join(s.dir, endpoint, id), nil
+}
+
+// Track records what a container is, so its logs can be listed and found by
+// name once it is gone
+func (s *Store) Track(endpoint string, c apitypes.StoredContainer) error {
+	dir, err := s.containerDir(endpoint, c.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	prev, _ := readMeta(dir)
+	c.RemovedAt = nil
+	if prev.ID == c.ID && prev.Name == c.Name && prev.Image == c.Image && prev.RemovedAt == nil {
+		return nil
+	}
+	return writeMeta(dir, c)
+}
+
+// MarkRemoved records that the container no longer exists
+func (s *Store) MarkRemoved(endpoint, id string, at time.Time) error {
+	dir, err := s.containerDir(endpoint, id)
+	if err != nil {
+		return err
+	}
+	meta, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	meta.RemovedAt = &at
+	s.mu.Lock()
+	s.closeSegment(endpoint + "/" + id)
+	s.mu.Unlock()
+	return writeMeta(dir, meta)
+}
+
+// Append adds entries to the container's newest segment, starting a new one
+// when it is full
+func (s *Store) Append(endpoint, id string, entries ...apitypes.LogEntry) error {
+	dir, err := s.containerDir(endpoint, id)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := endpoint + "/" + id
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		seg := s.open[key]
+		if seg != nil && seg.size >= segmentSize {
+			s.closeSegment(key)
+			seg = nil
+		}
+		if seg == nil {
+			if seg, err = openSegment(dir, entry.Timestamp); err != nil {
+				return err
+			}
+			s.open[key] = seg
+		}
+		n, err := seg.buf.Write(append(line, '\n'))
+		seg.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSegment opens the newest segment in dir if it has room, or starts one
+// named after first
+func openSegment(dir string, first time.Time) (*segment, error) {
+	path := ""
+	if segments, err := listSegments(dir); err == nil && len(segments) > 0 {
+		if last := segments[len(segments)-1]; last.size < segmentSize {
+			path = last.path
+		}
+	}
+	if path == "" {
+		if first.IsZero() {
+			first = time.Now()
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%019d%s", first.UnixNano(), segmentSuffix))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &segment{path: path, file: file, buf: bufio.NewWriter(file), size: info.Size()}, nil
+}
+
+// closeSegment flushes and closes the open segment of key, if any. The
+// caller holds s.mu.
+func (s *Store) closeSegment(key string) {
+	if seg := s.open[key]; seg != nil {
+		seg.buf.Flush()
+		seg.file.Close()
+		delete(s.open, key)
+	}
+}
+
+// Flush writes the buffered entries of every container to disk
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, seg := range s.open {
+		errs = append(errs, seg.buf.Flush())
+	}
+	return errors.Join(errs...)
+}
+
+// Close flushes and closes every open segment
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.open {
+		s.closeSegment(key)
+	}
+	return nil
+}
+
+// Last returns the timestamp of the newest stored entry of a container, or
+// the zero time if there is none
+func (s *Store) Last(endpoint, id string) (time.Time, error) {
+	dir, err := s.containerDir(endpoint, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := s.Flush(); err != nil {
+		return time.Time{}, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) == 0 {
+		return time.Time{}, nil
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		if ts, ok := lastTimestamp(segments[i].path); ok {
+			return ts, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// lastTimestamp reads the timestamp of the last complete line of a segment
+func lastTimestamp(path string) (time.Time, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, false
+	}
+	offset := max(info.Size()-64<<10, 0)
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return time.Time{}, false
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		var entry apitypes.LogEntry
+		if json.Unmarshal(lines[i], &entry) == nil && !entry.Timestamp.IsZero() {
+			return entry.Timestamp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Containers lists the containers with stored logs on endpoint, most
+// recently logged first
+func (s *Store) Containers(endpoint string) ([]apitypes.StoredContainer, error) {
+	if !validName.MatchString(endpoint) {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(filepath.Join(s.dir, endpoint))
+	if errors.Is(err, os.ErrNotExist) {
+		return []apitypes.StoredContainer{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []apitypes.StoredContainer{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		c, err := s.describe(filepath.Join(s.dir, endpoint, d.Name()))
+		if err != nil {
+			continue
+		}
+		result = append(result, c)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].LastLog, result[j].LastLog
+		return a != nil && (b == nil || a.After(*b))
+	})
+	return result, nil
+}
+
+// describe reads a container's metadata and the extent of its segments
+func (s *Store) describe(dir string) (apitypes.StoredContainer, error) {
+	c, err := readMeta(dir)
+	if err != nil {
+		return c, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return c, err
+	}
+	for _, seg := range segments {
+		c.Size += seg.size
+	}
+	if len(segments) > 0 {
+		first := segments[0].start
+		c.FirstLog = &first
+		for i := len(segments) - 1; i >= 0; i-- {
+			if last, ok := lastTimestamp(segments[i].path); ok {
+				c.LastLog = &last
+				break
+			}
+		}
+	}
+	return c, nil
+}
+
+// Find looks a container up by ID, ID prefix or name. A name that several
+// stored containers had picks the most recently logged one.
+func (s *Store) Find(endpoint, ref string) (apitypes.StoredContainer, error) {
+	containers, err := s.Containers(endpoint)
+	if err != nil {
+		return apitypes.StoredContainer{}, err
+	}
+	for _, c := range containers {
+		if c.ID == ref {
+			return c, nil
+		}
+	}
+	for _, c := range containers {
+		if c.Name == strings.TrimPrefix(ref, "/") {
+			return c, nil
+		}
+	}
+	var found []apitypes.StoredContainer
+	for _, c := range containers {
+		if strings.HasPrefix(c.ID, ref) {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	if len(found) > 1 {
+		return apitypes.StoredContainer{}, fmt.Errorf("%q matches %d containers", ref, len(found))
+	}
+	return apitypes.StoredContainer{}, fmt.Errorf("%w of container %s", ErrNotFound, ref)
+}
+
+// Read passes the stored entries of a container between since and until
+// (zero for no bound) to each, oldest first. Lines that can't be parsed,
+// such as one cut short by a crash, are skipped.
+func (s *Store) Read(endpoint, id string, since, until time.Time, each func(apitypes.LogEntry)) error {
+	dir, err := s.containerDir(endpoint, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for i, seg := range segments {
+		// A segment ends where the next one starts
+		if !since.IsZero() && i+1 < len(segments) && segments[i+1].start.Before(since) {
+			continue
+		}
+		if !until.IsZero() && seg.start.After(until) {
+			break
+		}
+		if err := readSegment(seg.path, func(entry apitypes.LogEntry) {
+			if (since.IsZero() || !entry.Timestamp.Before(since)) && (until.IsZero() || !entry.Timestamp.After(until)) {
+				each(entry)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, each func(apitypes.LogEntry)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		var entry apitypes.LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			each(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// Delete removes everything stored about a container
+func (s *Store) Delete(endpoint, id string) error {
+	dir, err := s.containerDir(endpoint, id)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.closeSegment(endpoint + "/" + id)
+	s.mu.Unlock()
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w of container %s", ErrNotFound, id)
+	}
+	return os.RemoveAll(dir)
+}
+
+// Prune removes the segments of endpoint's containers that ended before
+// retention ago, then the oldest segments of containers over maxSize bytes
+// (zero disables either). Removed containers left without logs are
+// forgotten. It returns how many bytes were freed.
+func (s *Store) Prune(endpoint string, retention time.Duration, maxSize int64) (int64, error) {
+	if !validName.MatchString(endpoint) {
+		return 0, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if err := s.Flush(); err != nil {
+		return 0, err
+	}
+	dirs, err := os.ReadDir(filepath.Join(s.dir, endpoint))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	var errs []error
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		key := endpoint + "/" + d.Name()
+		dir := filepath.Join(s.dir, endpoint, d.Name())
+		segments, err := listSegments(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var total int64
+		for _, seg := range segments {
+			total += seg.size
+		}
+		cutoff := time.Now().Add(-retention)
+		kept := segments[:0]
+		for i, seg := range segments {
+			end := seg.modified
+			if i+1 < len(segments) {
+				end = segments[i+1].start
+			}
+			expired := retention > 0 && end.Before(cutoff)
+			oversize := maxSize > 0 && total > maxSize && i < len(segments)-1
+			if !expired && !oversize {
+				kept = append(kept, seg)
+				continue
+			}
+			s.mu.Lock()
+			if open := s.open[key]; open != nil && open.path == seg.path {
+				s.closeSegment(key)
+			}
+			s.mu.Unlock()
+			if err := os.Remove(seg.path); err != nil {
+				errs = append(errs, err)
+				kept = append(kept, seg)
+				continue
+			}
+			total -= seg.size
+			freed += seg.size
+		}
+
+		if len(kept) == 0 {
+			if meta, err := readMeta(dir); err == nil && meta.RemovedAt != nil {
+				errs = append(errs, os.RemoveAll(dir))
+			}
+		}
+	}
+	return freed, errors.Join(errs...)
+}
+
+type segmentInfo struct {
+	path     string
+	start    time.Time
+	size     int64
+	modified time.Time
+}
+
+// listSegments returns a container's segments, oldest first
+func listSegments(dir string) ([]segmentInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segmentInfo
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		nanos, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentInfo{
+			path:     filepath.Join(dir, e.Name()),
+			start:    time.Unix(0, nanos).UTC(),
+			size:     info.Size(),
+			modified: info.ModTime(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments, nil
+}
+
+func readMeta(dir string) (apitypes.StoredContainer, error) {
+	var c apitypes.StoredContainer
+	data, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// writeMeta replaces the metadata file atomically
+func writeMeta(dir string, c apitypes.StoredContainer) error {
+	c.FirstLog, c.LastLog, c.Size, c.Collecting = nil, nil, 0, false
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, metaFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, metaFile))
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +28,14 @@ import (
 	"github.com/google/uuid"
 
 	"kibutsu/api/handlers"
+	"kibutsu/audit"
+	"kibutsu/auth"
+	"kibutsu/config"
+	"kibutsu/docker"
+	"kibutsu/jobs"
+	"kibutsu/logging"
+	"kibutsu/logstore"
+	"kibutsu/notify"
 )
 
 //go:embed frontend/build/*
@@ -31,13 +49,35 @@ func GetFileSystem() http.FileSystem {
 	return http.FS(fsys)
 }
 
+// loadIndex reads the SPA entry point and injects a <base> tag so relative
+// asset and API URLs resolve under the configured base path.
+func loadIndex(basePath string) ([]byte, error) {
+	index, err := fs.ReadFile(staticFiles, "frontend/build/index.html")
+	if err != nil {
+		return nil, err
+	}
+	base := fmt.Sprintf(`<base href="%s/">`, html.EscapeString(basePath))
+	return bytes.Replace(index, []byte("<head>"), []byte("<head>"+base), 1), nil
+}
+
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp string `json:"timestamp"`
+	Status        string               `json:"status"` // healthy, or unhealthy while the local daemon is unreachable
+	Timestamp     string               `json:"timestamp"`
+	Docker        DaemonStatus         `json:"docker"`
+	Streams       StreamStats          `json:"streams"`
+	DockerRetries docker.RetryCounters `json:"dockerRetries"`
 }
 
 type App struct {
-	dockerClient *client.Client
+	config       *config.Store
+	streams      *streamRegistry
+	endpoints    map[string]*client.Client // by endpoint name
+	daemons      map[string]*daemonMonitor // by endpoint name
+	registryAuth docker.RegistryAuth       // nil without any registry logins
+	metrics      *metricsRegistry
+	jobs         *handlers.JobScheduler
+	notifier     *notify.Notifier
+	logStore     *logstore.Store // nil unless logs are collected
 }
 
 type responseWriter struct {
@@ -47,20 +87,40 @@ type responseWriter struct {
 
 type contextKey string
 
-const requestIDKey contextKey = "requestID"
-
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.status = code
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush and Hijack pass through so streaming responses and WebSocket
+// upgrades keep working behind the logging middleware.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	rw.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func requestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestID := r.Header.Get("X-Request-ID")
 		if requestID == "" {
 			requestID = uuid.New().String()
 		}
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		ctx := logging.WithRequestID(r.Context(), requestID)
 		w.Header().Set("X-Request-ID", requestID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -73,22 +133,29 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(rw, r)
 
-		log.Printf(
-			"[%s] %s %s %d %s",
-			r.Context().Value(requestIDKey),
-			r.Method,
-			r.URL.Path,
-			rw.status,
-			time.Since(start),
+		slog.InfoContext(r.Context(), "Request",
+			"method", r.Method,
+			"path", redactWebhookToken(r.URL.Path),
+			"status", rw.status,
+			"duration", time.Since(start),
 		)
 	})
 }
 
+// redactWebhookToken hides the token of a webhook delivery's path, which
+// is all it takes to trigger the webhook's job
+func redactWebhookToken(path string) string {
+	if i := strings.Index(path, "/api/webhooks/"); i >= 0 {
+		return path[:i] + "/api/webhooks/[redacted]"
+	}
+	return path
+}
+
 func recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Printf("[PANIC] %v\n%s", err, debug.Stack())
+				slog.ErrorContext(r.Context(), "Panic serving request", "panic", err, "stack", string(debug.Stack()))
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			}
 		}()
@@ -96,123 +163,427 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+func timeoutMiddleware(cfg *config.Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			ctx, cancel := handlers.WithRequestTimeout(r.Context(), cfg.Get().RequestTimeout)
 			defer cancel()
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID")
+func corsMiddleware(cfg *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			for _, allowed := range cfg.Get().CORSOrigins {
+				if allowed == "*" || allowed == origin {
+					w.Header().Set("Access-Control-Allow-Origin", allowed)
+					break
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID, Authorization")
+			w.Header().Add("Vary", "Origin")
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
+// healthHandler reports the server's health, with a 503 while the local
+// daemon is unreachable. The body still describes the daemon's state, and
+// the server keeps serving and reconnecting meanwhile.
 func (app *App) healthHandler(w http.ResponseWriter, r *http.Request) {
 	response := HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Status:        "healthy",
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+		Docker:        app.daemons[config.LocalEndpoint].snapshot(),
+		Streams:       app.streams.snapshot(app.config.Get()),
+		DockerRetries: docker.RetryStats(),
 	}
 	w.Header().Set("Content-Type", "application/json")
+	if !response.Docker.Connected {
+		response.Status = "unhealthy"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
-func (app *App) dockerInfoHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+func dockerInfoHandler(dockerClient *client.Client, cfg *config.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.Get().DockerReadTimeout)
+		defer cancel()
 
-	info, err := app.dockerClient.Info(ctx)
-	if err != nil {
-		http.Error(w, "Failed to get Docker info: "+err.Error(), http.StatusInternalServerError)
-		return
+		c := cfg.Get()
+		info, err := docker.Retry(ctx, docker.RetryPolicy{Attempts: c.DockerRetries, Backoff: c.DockerRetryBackoff}, dockerClient.Info)
+		if err != nil {
+			http.Error(w, "Failed to get Docker info: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(info)
+// requireAdmin wraps a handler so it only runs for requests carrying the
+// KIBUTSU_ADMIN_TOKEN bearer token. Without a token configured the wrapped
+// endpoint is disabled.
+func (app *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := app.config.Get().AdminToken
+		if adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled; set KIBUTSU_ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
 }
 
-func main() {
-	log.Println("Starting Docker management service...")
+// publicAPIPaths are reachable without a session
+var publicAPIPaths = map[string]bool{
+	"/auth/login":   true,
+	"/auth/logout":  true,
+	"/auth/session": true,
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// requireAuth rejects API requests without a valid session with a 401 and
+// records the user of those with one. Requests carrying the admin token are
+// let through for requireAdmin to check. A nil authenticator leaves the API
+// open.
+func (app *App) requireAuth(authenticator *auth.Authenticator, next http.Handler) http.Handler {
+	if authenticator == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicAPIPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if adminToken := app.config.Get().AdminToken; adminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+				next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), "admin")))
+				return
+			}
+		}
+		session, ok := authenticator.Authenticate(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), session.Username)))
+	})
+}
+
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
 
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// hashPassword implements "kibutsu hash-password": it reads a password from
+// the first line of stdin and prints the hash to put in the users file.
+func hashPassword() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fatal("No password given on stdin", "error", err)
+	}
+	hash, err := auth.HashPassword(password)
 	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+		fatal("Failed to hash password", "error", err)
 	}
-	defer dockerClient.Close()
+	fmt.Println(hash)
+}
 
-	if _, err := dockerClient.Ping(ctx); err != nil {
-		log.Fatalf("Failed to connect to Docker daemon: %v", err)
+// generateKey implements "kibutsu generate-key": it prints a random key to
+// use as KIBUTSU_SECRET_KEY.
+func generateKey() {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatal("Failed to generate key", "error", err)
 	}
-	log.Println("Successfully connected to Docker daemon")
+	fmt.Println(hex.EncodeToString(key))
+}
 
-	app := &App{dockerClient: dockerClient}
-	containerHandler := handlers.NewContainerHandler(dockerClient)
-	imageHandler := handlers.NewImageHandler(dockerClient)
-	composeHandler := handlers.NewComposeHandler(dockerClient)
+// reloadHandler re-reads the configuration and applies the live-tunable
+// settings. It requires the KIBUTSU_ADMIN_TOKEN bearer token.
+func (app *App) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	mux := http.NewServeMux()
+	result, err := app.config.Reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := logging.SetLevel(app.config.Get().LogLevel); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to apply log level", "error", err)
+	}
+	slog.InfoContext(r.Context(), "Configuration reloaded", "applied", result.Applied, "restart_required", result.RestartRequired)
 
-	// Health check endpoint
-	mux.HandleFunc("/health", app.healthHandler)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	// API routes
-	apiRouter := http.NewServeMux()
-	apiRouter.HandleFunc("/docker/info", app.dockerInfoHandler)
+// endpointRouter builds the API routes served by one Docker endpoint and
+// starts relaying its events until ctx is cancelled.
+func (app *App) endpointRouter(ctx context.Context, name string, dockerClient *client.Client) http.Handler {
+	containerHandler := handlers.NewContainerHandler(dockerClient, app.config)
+	containerHandler.RequireRemoveConfirmation(app.config.Get().ConfirmDestructive)
+	containerHandler.UseRegistryAuth(app.registryAuth)
+	imageHandler := handlers.NewImageHandler(dockerClient, app.config, app.registryAuth)
+	composeHandler := handlers.NewComposeHandler(dockerClient, app.config, app.registryAuth)
+	swarmHandler := handlers.NewSwarmHandler(dockerClient, app.config, app.registryAuth)
+	systemHandler := handlers.NewSystemHandler(dockerClient, app.config)
+	passthroughHandler := handlers.NewPassthroughHandler(dockerClient, app.config)
+	terminalHandler := handlers.NewTerminalHandler(dockerClient)
+	volumeHandler := handlers.NewVolumeHandler(dockerClient, app.config)
+	networkHandler := handlers.NewNetworkHandler(dockerClient, app.config)
+
+	eventHub := handlers.NewEventHub(dockerClient, app.config)
+	eventHub.UseNotifier(app.notifier, name)
+	go eventHub.Run(ctx)
+	updateChecker := handlers.NewUpdateChecker(dockerClient, app.config, containerHandler)
+	updateChecker.UseNotifier(app.notifier, name)
+	go updateChecker.Run(ctx)
+	logCollector := handlers.NewLogCollector(dockerClient, app.config, app.logStore, name)
+	go logCollector.Run(ctx)
+	backupHandler := handlers.NewBackupHandler(dockerClient, app.config, name, composeHandler)
+	app.jobs.AddEndpoint(name, handlers.NewJobRunner(dockerClient, app.config, containerHandler, composeHandler, backupHandler))
+
+	router := http.NewServeMux()
+	daemon := app.daemons[name]
+	go daemon.run(ctx)
+
+	router.HandleFunc("/docker/info", dockerInfoHandler(dockerClient, app.config))
+	router.HandleFunc("/docker/status", daemon.statusHandler)
+	router.HandleFunc("/docker/raw", app.requireAdmin(passthroughHandler.Forward))
+	router.HandleFunc("/docker", app.limitStream("events", eventHub.HandleWebSocket))
+	router.HandleFunc("/events", app.limitStream("events", eventHub.HandleSSE))
 
 	// Container endpoints
-	apiRouter.HandleFunc("/containers", containerHandler.ListContainers)
-	apiRouter.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/containers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			containerHandler.CreateContainer(w, r)
+			return
+		}
+		containerHandler.ListContainers(w, r)
+	})
+	router.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/containers/")
 		parts := strings.Split(path, "/")
 
 		if len(parts) < 2 {
+			if parts[0] == "top" && r.Method == http.MethodGet {
+				containerHandler.TopContainers(w, r)
+				return
+			}
+			if parts[0] == "crash-looping" && r.Method == http.MethodGet {
+				containerHandler.ListCrashLooping(w, r)
+				return
+			}
+			if parts[0] == "prune" && r.Method == http.MethodPost {
+				containerHandler.PruneContainers(w, r)
+				return
+			}
+			if parts[0] == "batch" && r.Method == http.MethodPost {
+				containerHandler.BatchContainers(w, r)
+				return
+			}
+			if parts[0] == "import" && r.Method == http.MethodPost {
+				containerHandler.ImportContainer(w, r)
+				return
+			}
+			if !containerHandler.AllowContainer(w, r, parts[0]) {
+				return
+			}
+			if r.Method == http.MethodDelete {
+				containerHandler.RemoveContainer(w, r)
+				return
+			}
 			containerHandler.GetContainer(w, r)
 			return
 		}
 
+		if !containerHandler.AllowContainer(w, r, parts[0]) {
+			return
+		}
 		switch parts[1] {
-		case "start":
-			containerHandler.StartContainer(w, r)
-		case "stop":
-			containerHandler.StopContainer(w, r)
-		case "restart":
-			containerHandler.RestartContainer(w, r)
+		case "remove-preview":
+			containerHandler.RemoveContainerPreview(w, r)
+		case "remove-running":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			containerHandler.StopAndRemove(w, r)
+		case "start", "stop", "restart", "pause", "unpause", "kill", "rename", "update", "commit", "recreate":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			switch parts[1] {
+			case "start":
+				containerHandler.StartContainer(w, r)
+			case "stop":
+				containerHandler.StopContainer(w, r)
+			case "restart":
+				containerHandler.RestartContainer(w, r)
+			case "pause":
+				containerHandler.PauseContainer(w, r)
+			case "unpause":
+				containerHandler.UnpauseContainer(w, r)
+			case "kill":
+				containerHandler.KillContainer(w, r)
+			case "rename":
+				containerHandler.RenameContainer(w, r)
+			case "update":
+				containerHandler.UpdateContainer(w, r)
+			case "commit":
+				containerHandler.CommitContainer(w, r)
+			case "recreate":
+				containerHandler.RecreateContainer(w, r)
+			}
+		case "mounts":
+			containerHandler.GetContainerMounts(w, r)
 		case "logs":
-			containerHandler.GetContainerLogs(w, r)
+			if len(parts) == 3 && parts[2] == "ws" {
+				app.limitStream("logs", containerHandler.StreamContainerLogs)(w, r)
+				return
+			}
+			app.limitStream("logs", containerHandler.GetContainerLogs)(w, r)
+		case "log-config":
+			containerHandler.GetLogConfig(w, r)
+		case "command":
+			containerHandler.GetContainerCommand(w, r)
+		case "export-config":
+			containerHandler.ExportContainerConfig(w, r)
+		case "export":
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			app.limitStream("export", containerHandler.ExportContainer)(w, r)
+		case "env":
+			containerHandler.GetContainerEnv(w, r)
+		case "health":
+			containerHandler.GetContainerHealth(w, r)
+		case "exec":
+			switch {
+			case len(parts) == 3 && parts[2] == "run" && r.Method == http.MethodPost:
+				containerHandler.RunExec(w, r)
+			case len(parts) == 2 && r.Method == http.MethodPost:
+				terminalHandler.CreateExec(w, r)
+			case len(parts) == 2 && r.Method == http.MethodGet:
+				// Open a shell directly: /containers/{id}/exec
+				app.limitStream("exec", terminalHandler.HandleTerminal)(w, r)
+			case len(parts) == 3 && r.Method == http.MethodGet:
+				// Attach to a created exec: /containers/{id}/exec/{execId}
+				app.limitStream("exec", terminalHandler.AttachExec)(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		case "config-drift":
+			containerHandler.GetConfigDrift(w, r)
+		case "size":
+			containerHandler.GetContainerSize(w, r)
+		case "break-loop":
+			containerHandler.BreakRestartLoop(w, r)
 		case "stats":
-			containerHandler.GetContainerStats(w, r)
+			app.limitStream("stats", containerHandler.GetContainerStats)(w, r)
+		case "changes":
+			containerHandler.GetContainerChanges(w, r)
+		case "files":
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			switch {
+			case len(parts) == 2:
+				containerHandler.ListContainerFiles(w, r)
+			case len(parts) == 3 && parts[2] == "archive":
+				app.limitStream("archive", containerHandler.DownloadContainerArchive)(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// Log endpoints
+	router.HandleFunc("/logs/aggregate", app.limitStream("logs", containerHandler.AggregateLogs))
+	router.HandleFunc("/logs/stored", logCollector.ListStored)
+	router.HandleFunc("/logs/stored/", func(w http.ResponseWriter, r *http.Request) {
+		// Expected URLs: /logs/stored/{ref}, /logs/stored/{ref}/archive and
+		// /logs/stored/import
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/logs/stored/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost:
+			app.limitStream("import", logCollector.ImportStored)(w, r)
+		case len(parts) == 2 && parts[1] == "archive" && r.Method == http.MethodPost:
+			app.limitStream("export", logCollector.ArchiveStored)(w, r)
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			logCollector.SearchStored(w, r)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			logCollector.DeleteStored(w, r)
 		default:
 			http.NotFound(w, r)
 		}
 	})
 
 	// Image endpoints
-	apiRouter.HandleFunc("/images", imageHandler.ListImages)
-	apiRouter.HandleFunc("/images/pull", imageHandler.PullImage)
-	apiRouter.HandleFunc("/system/info", imageHandler.GetSystemInfo)
-	apiRouter.HandleFunc("/system/version", imageHandler.GetSystemVersion)
-	apiRouter.HandleFunc("/system/disk", imageHandler.GetDiskUsage)
-	apiRouter.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/presets/resources", containerHandler.ListResourcePresets)
+	router.HandleFunc("/images", imageHandler.ListImages)
+	router.HandleFunc("/images/pull", app.limitStream("pull", imageHandler.PullImage))
+	router.HandleFunc("/images/build", app.limitStream("build", imageHandler.BuildImage))
+	router.HandleFunc("/images/import", app.limitStream("import", imageHandler.ImportImage))
+	router.HandleFunc("/images/batch-delete", imageHandler.BatchDeleteImages)
+	router.HandleFunc("/system/info", imageHandler.GetSystemInfo)
+	router.HandleFunc("/system/version", imageHandler.GetSystemVersion)
+	router.HandleFunc("/system/disk", imageHandler.GetDiskUsage)
+	router.HandleFunc("/system/metrics", systemHandler.GetMetrics)
+	router.HandleFunc("/system/prune", systemHandler.PruneSystem)
+	router.HandleFunc("/updates", updateChecker.ListUpdates)
+	router.HandleFunc("/updates/check", updateChecker.CheckNow)
+	router.HandleFunc("/system/usage-audit", systemHandler.GetUsageAudit)
+	router.HandleFunc("/system/usage/stream", app.limitStream("usage", systemHandler.StreamUsage))
+	router.HandleFunc("/diagnostics/docker", systemHandler.GetDockerDiagnostics)
+	router.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/history") {
 			imageHandler.GetImageHistory(w, r)
 			return
 		}
+		// Expected URLs: /images/{id}/tag, /images/{ref}/push and
+		// /images/{ref}/export
+		if strings.HasSuffix(r.URL.Path, "/tag") && r.Method == http.MethodPost {
+			imageHandler.TagImage(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/push") && r.Method == http.MethodPost {
+			app.limitStream("push", imageHandler.PushImage)(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/export") && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+			app.limitStream("export", imageHandler.ExportImage)(w, r)
+			return
+		}
 
 		switch r.Method {
 		case http.MethodGet:
@@ -224,8 +595,230 @@ func main() {
 		}
 	})
 
+	// Swarm endpoints
+	router.HandleFunc("/swarm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		swarmHandler.GetSwarm(w, r)
+	})
+	router.HandleFunc("/swarm/services", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		swarmHandler.ListServices(w, r)
+	})
+	router.HandleFunc("/swarm/services/", func(w http.ResponseWriter, r *http.Request) {
+		// Expected URLs: /swarm/services/{id}, /swarm/services/{id}/scale,
+		// /swarm/services/{id}/update and /swarm/services/{id}/tasks
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/swarm/services/"), "/")
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			swarmHandler.GetService(w, r)
+		case len(parts) == 2 && parts[1] == "scale" && r.Method == http.MethodPost:
+			swarmHandler.ScaleService(w, r)
+		case len(parts) == 2 && parts[1] == "update" && r.Method == http.MethodPost:
+			swarmHandler.UpdateService(w, r)
+		case len(parts) == 2 && parts[1] == "tasks" && r.Method == http.MethodGet:
+			swarmHandler.ListTasks(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	router.HandleFunc("/swarm/nodes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		swarmHandler.ListNodes(w, r)
+	})
+	router.HandleFunc("/swarm/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		swarmHandler.GetNode(w, r)
+	})
+	router.HandleFunc("/swarm/secrets", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			swarmHandler.ListSecrets(w, r)
+		case http.MethodPost:
+			swarmHandler.CreateSecret(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/swarm/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			swarmHandler.GetSecret(w, r)
+		case http.MethodDelete:
+			swarmHandler.RemoveSecret(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/swarm/configs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			swarmHandler.ListConfigs(w, r)
+		case http.MethodPost:
+			swarmHandler.CreateConfig(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/swarm/configs/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			swarmHandler.GetConfig(w, r)
+		case http.MethodDelete:
+			swarmHandler.RemoveConfig(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/swarm/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		swarmHandler.ListTasks(w, r)
+	})
+
+	// Volume endpoints
+	router.HandleFunc("/volumes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			volumeHandler.ListVolumes(w, r)
+		case http.MethodPost:
+			volumeHandler.CreateVolume(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	router.HandleFunc("/volumes/prune", volumeHandler.PruneVolumes)
+	router.HandleFunc("/volumes/", func(w http.ResponseWriter, r *http.Request) {
+		// Expected URLs: /volumes/{name}/backup and /volumes/{name}/restore
+		if parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/"); len(parts) == 2 {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			switch parts[1] {
+			case "backup":
+				app.limitStream("backup", volumeHandler.BackupVolume)(w, r)
+			case "restore":
+				app.limitStream("restore", volumeHandler.RestoreVolume)(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			volumeHandler.GetVolume(w, r)
+		case http.MethodDelete:
+			volumeHandler.RemoveVolume(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// Backup endpoints
+	router.HandleFunc("/backups", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			backupHandler.ListBackups(w, r)
+		case http.MethodPost:
+			// Not a stream: nothing is written until the backup is done,
+			// so the idle sweeper would cancel it. longContext bounds it.
+			backupHandler.CreateBackup(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/backups/", func(w http.ResponseWriter, r *http.Request) {
+		// Expected URLs: /backups/{kind}/{name}/{timestamp} and
+		// /backups/{kind}/{name}/{timestamp}/restore
+		switch parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/backups/"), "/"); {
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			app.limitStream("backup", backupHandler.DownloadBackup)(w, r)
+		case len(parts) == 3 && r.Method == http.MethodDelete:
+			backupHandler.DeleteBackup(w, r)
+		case len(parts) == 4 && parts[3] == "restore" && r.Method == http.MethodPost:
+			// Cancelling a restore partway would leave the target half
+			// replaced, so it isn't idle-sweepable either
+			backupHandler.RestoreBackup(w, r)
+		case len(parts) == 3 || len(parts) == 4 && parts[3] == "restore":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// Network endpoints
+	router.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			networkHandler.ListNetworks(w, r)
+		case http.MethodPost:
+			networkHandler.CreateNetwork(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	router.HandleFunc("/networks/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/networks/"), "/")
+		if len(parts) == 2 && r.Method == http.MethodPost {
+			switch parts[1] {
+			case "connect":
+				networkHandler.ConnectContainer(w, r)
+				return
+			case "disconnect":
+				networkHandler.DisconnectContainer(w, r)
+				return
+			}
+		}
+		if len(parts) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			networkHandler.GetNetwork(w, r)
+		case http.MethodDelete:
+			networkHandler.RemoveNetwork(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
 	// Compose endpoints
-	apiRouter.HandleFunc("/compose/projects/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/compose/projects", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			composeHandler.CreateProject(w, r)
+		case http.MethodGet:
+			composeHandler.ListProjects(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	router.HandleFunc("/compose/batch", func(w http.ResponseWriter, r *http.Request) {
+		// Without streamed progress nothing is written until every project
+		// is done, which the idle sweeper would take for a dead stream
+		if handlers.WantsProgress(r) {
+			app.limitStream("batch", composeHandler.BatchProjects)(w, r)
+			return
+		}
+		composeHandler.BatchProjects(w, r)
+	})
+	router.HandleFunc("/compose/projects/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/compose/projects/")
 		parts := strings.Split(path, "/")
 
@@ -237,18 +830,29 @@ func main() {
 			}
 		}
 
+		if len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost {
+			composeHandler.ImportProject(w, r)
+			return
+		}
+		if len(parts) == 1 && parts[0] == "import-git" && r.Method == http.MethodPost {
+			composeHandler.ImportGitProject(w, r)
+			return
+		}
+
 		// If only the project name is provided, return project details.
 		if len(parts) == 1 {
 			if r.Method == http.MethodGet {
 				composeHandler.GetProject(w, r)
 				return
 			}
+			http.NotFound(w, r)
+			return
 		}
 
 		// Otherwise route based on an action provided in the URL.
 		projectName := parts[0]
 		action := parts[1]
-		log.Printf("Project: %s, Action: %s", projectName, action)
+		slog.DebugContext(r.Context(), "Compose project action", "project", projectName, "action", action)
 		switch action {
 		case "up":
 			if r.Method == http.MethodPost {
@@ -260,9 +864,53 @@ func main() {
 				composeHandler.ProjectDown(w, r)
 				return
 			}
+		case "pull":
+			if r.Method == http.MethodPost {
+				composeHandler.ProjectPull(w, r)
+				return
+			}
+		case "restart":
+			if r.Method == http.MethodPost {
+				composeHandler.ProjectRestart(w, r)
+				return
+			}
 		case "logs":
 			if r.Method == http.MethodGet {
-				composeHandler.GetProjectLogs(w, r)
+				app.limitStream("logs", composeHandler.GetProjectLogs)(w, r)
+				return
+			}
+		case "export":
+			if r.Method == http.MethodGet {
+				composeHandler.ExportProject(w, r)
+				return
+			}
+		case "file":
+			switch r.Method {
+			case http.MethodGet:
+				composeHandler.GetComposeFile(w, r)
+				return
+			case http.MethodPut:
+				composeHandler.PutComposeFile(w, r)
+				return
+			}
+		case "graph":
+			if r.Method == http.MethodGet {
+				composeHandler.GetProjectGraph(w, r)
+				return
+			}
+		case "history":
+			if r.Method == http.MethodGet {
+				composeHandler.GetProjectHistory(w, r)
+				return
+			}
+		case "git":
+			if r.Method == http.MethodGet {
+				composeHandler.GetGitSource(w, r)
+				return
+			}
+		case "sync":
+			if r.Method == http.MethodPost {
+				composeHandler.SyncProject(w, r)
 				return
 			}
 		case "services":
@@ -274,61 +922,393 @@ func main() {
 				// Expected URL: /compose/projects/{project}/services/{service}/scale
 				composeHandler.ScaleService(w, r)
 				return
+			} else if len(parts) == 4 && (parts[3] == "start" || parts[3] == "stop" || parts[3] == "restart") && r.Method == http.MethodPost {
+				// Expected URL: /compose/projects/{project}/services/{service}/start|stop|restart
+				composeHandler.ServiceAction(w, r)
+				return
+			} else if len(parts) == 4 && parts[3] == "run" && r.Method == http.MethodPost {
+				// Expected URL: /compose/projects/{project}/services/{service}/run
+				app.limitStream("run", composeHandler.RunService)(w, r)
+				return
 			}
 		}
 		http.NotFound(w, r)
 	})
 
+	return recordRoute("/api", router)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPassword()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate-key" {
+		generateKey()
+		return
+	}
+
+	opts, err := config.ParseFlags(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fatal("Invalid arguments", "error", err)
+	}
+	cfg, err := config.Load(opts)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	cfgStore := config.NewStore(cfg, opts)
+
+	logOutput, err := logging.Setup(logging.Options{
+		Level:      cfg.LogLevel,
+		Format:     cfg.LogFormat,
+		File:       cfg.LogFile,
+		MaxSize:    cfg.LogMaxSize,
+		MaxBackups: cfg.LogMaxBackups,
+	})
+	if err != nil {
+		fatal("Failed to set up logging", "error", err)
+	}
+	defer logOutput.Close()
+	slog.Info("Starting Docker management service")
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.StartupTimeout)
+	defer cancel()
+
+	metrics := newMetricsRegistry()
+	clientOpts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation(), metrics.instrumentDocker(config.LocalEndpoint)}
+	dockerHost := cfg.DockerHost
+	if dockerHost == "" && strings.HasPrefix(os.Getenv("DOCKER_HOST"), "ssh://") {
+		// FromEnv can't dial ssh:// itself
+		dockerHost = os.Getenv("DOCKER_HOST")
+	}
+	if dockerHost != "" {
+		hostOpts, err := hostClientOpts(dockerHost)
+		if err != nil {
+			fatal("Invalid Docker host", "host", dockerHost, "error", err)
+		}
+		clientOpts = append(clientOpts, hostOpts...)
+	}
+	dockerClient, err := client.NewClientWithOpts(clientOpts...)
+	if err != nil {
+		fatal("Failed to create Docker client", "error", err)
+	}
+	defer dockerClient.Close()
+	slog.Info("Connecting to Docker daemon", "host", dockerClient.DaemonHost())
+
+	// Without the daemon the server still starts, so the UI can report it
+	// offline; the monitor keeps trying to reach it
+	localDaemon := newDaemonMonitor(config.LocalEndpoint, dockerClient, cfgStore)
+	if localDaemon.ping(ctx) {
+		slog.Info("Successfully connected to Docker daemon")
+	} else {
+		slog.Warn("Starting in degraded mode until the Docker daemon is reachable")
+	}
+
+	var authenticator *auth.Authenticator
+	if cfg.UsersFile != "" {
+		users, err := auth.NewFileStore(cfg.UsersFile)
+		if err != nil {
+			fatal("Failed to load users file", "path", cfg.UsersFile, "error", err)
+		}
+		authenticator, err = auth.NewAuthenticator(users, cfgStore)
+		if err != nil {
+			fatal("Failed to set up authentication", "error", err)
+		}
+		slog.Info("Authentication enabled", "users_file", cfg.UsersFile)
+	} else {
+		slog.Warn("KIBUTSU_USERS_FILE is not set; the API is open to anyone who can reach it")
+	}
+
+	app := &App{
+		config:    cfgStore,
+		streams:   newStreamRegistry(),
+		endpoints: map[string]*client.Client{config.LocalEndpoint: dockerClient},
+		daemons:   map[string]*daemonMonitor{config.LocalEndpoint: localDaemon},
+		metrics:   metrics,
+		notifier:  notify.New(cfgStore),
+	}
+	// Logins added through the API take precedence over the file
+	var registryStore *docker.RegistryStore
+	var registryAuth docker.RegistryAuthChain
+	if cfg.SecretKey != nil {
+		registryStore, err = docker.NewRegistryStore(cfg.RegistryStoreFile, cfg.SecretKey)
+		if err != nil {
+			fatal("Failed to open registry store", "path", cfg.RegistryStoreFile, "error", err)
+		}
+		registryAuth = append(registryAuth, registryStore)
+	}
+	if cfg.RegistryAuthFile != "" {
+		authFile, err := docker.NewRegistryAuthFile(cfg.RegistryAuthFile)
+		if err != nil {
+			fatal("Failed to load registry credentials", "path", cfg.RegistryAuthFile, "error", err)
+		}
+		registryAuth = append(registryAuth, authFile)
+	}
+	if len(registryAuth) > 0 {
+		app.registryAuth = registryAuth
+	}
+	registryHandler := handlers.NewRegistryHandler(registryStore, dockerClient, cfgStore)
+	auditStore, err := audit.NewStore(cfg.AuditFile)
+	if err != nil {
+		fatal("Failed to open audit log", "path", cfg.AuditFile, "error", err)
+	}
+	defer auditStore.Close()
+	auditHandler := handlers.NewAuditHandler(auditStore)
+	jobStore, err := jobs.NewStore(cfg.JobsFile)
+	if err != nil {
+		fatal("Failed to open jobs file", "path", cfg.JobsFile, "error", err)
+	}
+	app.jobs = handlers.NewJobScheduler(jobStore, cfgStore)
+	app.jobs.UseNotifier(app.notifier)
+	if cfg.LogStoreDir != "" {
+		app.logStore, err = logstore.NewStore(cfg.LogStoreDir)
+		if err != nil {
+			fatal("Failed to open log store", "path", cfg.LogStoreDir, "error", err)
+		}
+		defer app.logStore.Close()
+	}
+	notificationHandler := handlers.NewNotificationHandler(app.notifier, cfgStore)
+	storageHandler := handlers.NewStorageHandler(cfgStore)
+	basePath := cfg.BasePath
+	authHandler := handlers.NewAuthHandler(authenticator)
+
+	hubCtx, stopHub := context.WithCancel(context.Background())
+	defer stopHub()
+	go app.streams.runSweeper(hubCtx, cfgStore)
+	go app.notifier.Run(hubCtx)
+
+	routers := map[string]http.Handler{config.LocalEndpoint: app.endpointRouter(hubCtx, config.LocalEndpoint, dockerClient)}
+	for _, e := range cfg.Endpoints {
+		remote, err := newEndpointClient(e, metrics.instrumentDocker(e.Name))
+		if err != nil {
+			fatal("Failed to create Docker client for endpoint", "endpoint", e.Name, "error", err)
+		}
+		defer remote.Close()
+		app.endpoints[e.Name] = remote
+		app.daemons[e.Name] = newDaemonMonitor(e.Name, remote, cfgStore)
+		routers[e.Name] = app.endpointRouter(hubCtx, e.Name, remote)
+		slog.Info("Managing endpoint", "endpoint", e.Name, "host", e.Host)
+	}
+	go app.jobs.Run(hubCtx)
+
+	mux := http.NewServeMux()
+
+	// Health check endpoint
+	mux.HandleFunc("/health", app.healthHandler)
+
+	// Prometheus metrics
+	mux.HandleFunc("/metrics", app.metricsHandler)
+
+	// API routes
+	apiRouter := http.NewServeMux()
+	apiRouter.HandleFunc("/auth/login", authHandler.Login)
+	apiRouter.HandleFunc("/auth/logout", authHandler.Logout)
+	apiRouter.HandleFunc("/auth/session", authHandler.GetSession)
+	apiRouter.HandleFunc("/admin/reload", app.requireAdmin(app.reloadHandler))
+	apiRouter.HandleFunc("/endpoints", app.listEndpoints)
+	apiRouter.HandleFunc("/audit", auditHandler.ListAudit)
+	apiRouter.HandleFunc("/registries", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			registryHandler.ListRegistries(w, r)
+		case http.MethodPost:
+			registryHandler.AddRegistry(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	apiRouter.HandleFunc("/registries/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		registryHandler.RemoveRegistry(w, r)
+	})
+	apiRouter.HandleFunc("/notifications", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		notificationHandler.GetSettings(w, r)
+	})
+	apiRouter.HandleFunc("/notifications/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		notificationHandler.TestNotification(w, r)
+	})
+	apiRouter.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			app.jobs.ListJobs(w, r)
+		case http.MethodPost:
+			app.jobs.CreateJob(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	apiRouter.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			app.jobs.GetJob(w, r)
+		case len(parts) == 1 && r.Method == http.MethodPut:
+			app.jobs.UpdateJob(w, r)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			app.jobs.DeleteJob(w, r)
+		case len(parts) == 2 && parts[1] == "run" && r.Method == http.MethodPost:
+			app.jobs.RunJob(w, r)
+		case len(parts) == 2 && parts[1] == "runs" && r.Method == http.MethodGet:
+			app.jobs.ListJobRuns(w, r)
+		case len(parts) == 2 && parts[1] == "webhook" && r.Method == http.MethodPost:
+			app.jobs.CreateWebhook(w, r)
+		case len(parts) == 2 && parts[1] == "webhook" && r.Method == http.MethodDelete:
+			app.jobs.DeleteWebhook(w, r)
+		case len(parts) <= 2:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	apiRouter.HandleFunc("/storage/objects", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		storageHandler.ListObjects(w, r)
+	})
+	apiRouter.HandleFunc("/storage/objects/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			app.limitStream("download", storageHandler.DownloadObject)(w, r)
+		case http.MethodDelete:
+			storageHandler.DeleteObject(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	// Everything else is served by the selected Docker endpoint
+	apiRouter.Handle("/", app.selectEndpoint(routers))
+
+	// Webhook deliveries authenticate with their token and signature rather
+	// than a session, and stay out of the audit log, which would keep the
+	// token; their runs are recorded with the job
+	mux.HandleFunc("/api/webhooks/", app.jobs.ReceiveWebhook)
+
 	// Mount API router under /api
-	mux.Handle("/api/", http.StripPrefix("/api", apiRouter))
+	mux.Handle("/api/", http.StripPrefix("/api", app.requireAuth(authenticator, auditHandler.Record(recordRoute("/api", apiRouter)))))
 
 	// Serve static files
 	fileServer := http.FileServer(GetFileSystem())
+	index, err := loadIndex(basePath)
+	if err != nil {
+		slog.Warn("Failed to load index.html, serving it unmodified", "error", err)
+	}
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" && !strings.HasPrefix(r.URL.Path, "/assets/") {
 			r.URL.Path = "/"
 		}
+		if r.URL.Path == "/" && index != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(index)
+			return
+		}
 		fileServer.ServeHTTP(w, r)
 	}))
 
+	// Mount everything under the base path when deployed behind a proxy subpath
+	var root http.Handler = recordRoute("", mux)
+	if basePath != "" {
+		prefixed := http.NewServeMux()
+		prefixed.Handle(basePath+"/", http.StripPrefix(basePath, root))
+		prefixed.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+		root = prefixed
+		slog.Info("Serving under base path", "base_path", basePath)
+	}
+
 	// Apply middleware chain
-	handler := corsMiddleware(
+	handler := corsMiddleware(cfgStore)(
 		requestIDMiddleware(
-			recoveryMiddleware(
-				loggingMiddleware(
-					timeoutMiddleware(30 * time.Second)(mux),
+			metricsMiddleware(metrics)(
+				recoveryMiddleware(
+					loggingMiddleware(
+						rateLimitMiddleware(cfgStore)(
+							timeoutMiddleware(cfgStore)(root),
+						),
+					),
 				),
 			),
 		),
 	)
 
+	serverTLS, acmeCerts, err := tlsConfig(cfg)
+	if err != nil {
+		fatal("Invalid TLS configuration", "error", err)
+	}
 	server := &http.Server{
-		Addr:         ":8080",
+		Addr:         cfg.ListenAddr,
 		Handler:      handler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		TLSConfig:    serverTLS,
+		ReadTimeout:  cfg.ServerReadTimeout,
+		WriteTimeout: cfg.ServerWriteTimeout,
+		IdleTimeout:  cfg.ServerIdleTimeout,
 	}
 
 	go func() {
-		log.Printf("Server listening on %s", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
+		var err error
+		if serverTLS != nil {
+			slog.Info("Server listening", "addr", server.Addr, "tls", true, "acmeDomains", cfg.ACMEDomains)
+			// The certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Server listening", "addr", server.Addr, "tls", false)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Server failed to start", "error", err)
 		}
 	}()
 
+	var redirectServer *http.Server
+	if cfg.HTTPRedirectAddr != "" {
+		redirect := httpsRedirect(cfg.ListenAddr)
+		if acmeCerts != nil {
+			// Answers the ACME HTTP-01 challenge and redirects the rest
+			redirect = acmeCerts.HTTPHandler(redirect)
+		}
+		redirectServer = &http.Server{
+			Addr:         cfg.HTTPRedirectAddr,
+			Handler:      redirect,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		}
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("HTTP redirect server failed to start", "error", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfgStore.Get().ShutdownTimeout)
 	defer shutdownCancel()
 
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
 	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		fatal("Server forced to shutdown", "error", err)
 	}
 
-	log.Println("Server exited properly")
+	slog.Info("Server exited properly")
 }
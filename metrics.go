@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"kibutsu/config"
+	"kibutsu/docker"
+)
+
+// latencyBuckets are the histogram upper bounds in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricsConcurrency caps the stats requests in flight while a scrape
+// samples containers
+const metricsConcurrency = 16
+
+const routeKey contextKey = "route"
+
+// histogram counts observations into latencyBuckets
+type histogram struct {
+	buckets []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricsRegistry holds the counters and histograms /metrics exports, keyed
+// by their rendered label set. Container gauges are sampled at scrape time.
+type metricsRegistry struct {
+	mu               sync.Mutex
+	requests         map[string]uint64
+	requestDurations map[string]*histogram
+	dockerDurations  map[string]*histogram
+	dockerErrors     map[string]uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:         make(map[string]uint64),
+		requestDurations: make(map[string]*histogram),
+		dockerDurations:  make(map[string]*histogram),
+		dockerErrors:     make(map[string]uint64),
+	}
+}
+
+func (m *metricsRegistry) observeRequest(method, route string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[labels("method", method, "route", route, "code", strconv.Itoa(status))]++
+	observe(m.requestDurations, labels("method", method, "route", route), d)
+}
+
+func (m *metricsRegistry) observeDocker(endpoint, operation string, failed bool, d time.Duration) {
+	key := labels("endpoint", endpoint, "operation", operation)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.dockerDurations, key, d)
+	if failed {
+		m.dockerErrors[key]++
+	}
+}
+
+func observe(histograms map[string]*histogram, key string, d time.Duration) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{}
+		histograms[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// metricsMiddleware counts requests and their durations by method, route and
+// status. The route is the ServeMux pattern that matched, as recorded by
+// recordRoute, so ids in paths don't become labels.
+func metricsMiddleware(m *metricsRegistry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := new(string)
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), routeKey, route)))
+
+			if *route == "" {
+				*route = "unmatched"
+			}
+			m.observeRequest(metricMethod(r.Method), *route, rw.status, time.Since(start))
+		})
+	}
+}
+
+// metricMethod is the method label of a request. Anything outside the
+// standard methods is OTHER, since clients can send any method before
+// they are authenticated and each label value adds a series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete,
+		http.MethodPatch, http.MethodHead, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// recordRoute notes the pattern of mux that matches the request, under
+// prefix, as the request's route. Nested muxes overwrite it with their more
+// specific pattern.
+func recordRoute(prefix string, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(routeKey).(*string); ok {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				*route = prefix + pattern
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// dockerTracer records the latency of every Docker API call a client makes.
+// The Docker client wraps its transport in otelhttp with the tracer provider
+// it is given, which is the only hook that leaves its own transport, and so
+// TLS and hijacked connections, untouched. A call's latency is the time until
+// its response headers arrive, when otelhttp sets the span status.
+type dockerTracer struct {
+	noop.Tracer
+	endpoint string
+	metrics  *metricsRegistry
+}
+
+type dockerTracerProvider struct {
+	noop.TracerProvider
+	tracer *dockerTracer
+}
+
+// instrumentDocker returns the client option recording the Docker API calls
+// made to endpoint
+func (m *metricsRegistry) instrumentDocker(endpoint string) client.Opt {
+	return client.WithTraceProvider(dockerTracerProvider{tracer: &dockerTracer{endpoint: endpoint, metrics: m}})
+}
+
+func (p dockerTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return p.tracer
+}
+
+func (t *dockerTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	method, path, _ := strings.Cut(name, " ")
+	return ctx, &dockerSpan{tracer: t, operation: dockerOperation(method, path), start: time.Now()}
+}
+
+type dockerSpan struct {
+	noop.Span
+	tracer    *dockerTracer
+	operation string
+	start     time.Time
+	once      sync.Once
+}
+
+func (s *dockerSpan) SetStatus(code codes.Code, _ string) {
+	s.once.Do(func() {
+		s.tracer.metrics.observeDocker(s.tracer.endpoint, s.operation, code == codes.Error, time.Since(s.start))
+	})
+}
+
+// dockerCollectionActions are the second path segments that act on a whole
+// collection, as in /containers/json, rather than name an object
+var dockerCollectionActions = map[string]bool{
+	"json": true, "create": true, "prune": true, "search": true, "get": true,
+	"load": true, "df": true, "privileges": true, "pull": true,
+}
+
+// dockerObjectActions are the last path segments that act on an object, as
+// in /containers/{id}/logs. Image names may contain slashes, so anything
+// else after the collection is taken to be part of the name.
+var dockerObjectActions = map[string]bool{
+	"json": true, "logs": true, "stats": true, "start": true, "stop": true,
+	"restart": true, "kill": true, "pause": true, "unpause": true, "wait": true,
+	"attach": true, "exec": true, "resize": true, "top": true, "changes": true,
+	"export": true, "archive": true, "update": true, "rename": true,
+	"history": true, "push": true, "tag": true, "get": true, "connect": true,
+	"disconnect": true, "enable": true, "disable": true, "upgrade": true,
+	"set": true,
+}
+
+// dockerOperation reduces a Docker API request to a label without object
+// ids or the API version, e.g. "GET /containers/{id}/json"
+func dockerOperation(method, path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 1 && strings.HasPrefix(parts[0], "v") {
+		if _, err := strconv.ParseFloat(parts[0][1:], 64); err == nil {
+			parts = parts[1:]
+		}
+	}
+	switch {
+	case len(parts) == 1, parts[0] == "swarm":
+	case len(parts) == 2 && dockerCollectionActions[parts[1]]:
+	default:
+		op := []string{parts[0], "{id}"}
+		if last := parts[len(parts)-1]; len(parts) > 2 && dockerObjectActions[last] {
+			op = append(op, last)
+		}
+		parts = op
+	}
+	return method + " /" + strings.Join(parts, "/")
+}
+
+// metricsHandler serves the metrics in the Prometheus text format. When
+// KIBUTSU_METRICS_TOKEN is set, scrapes must send it as a bearer token.
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := app.config.Get().MetricsToken; token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ctx, cancel := scrapeContext(r, app.config.Get())
+	defer cancel()
+	containers := app.sampleContainers(ctx)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	app.metrics.write(w)
+	writeStreamMetrics(w, app.streams.snapshot(app.config.Get()))
+	writeContainerMetrics(w, containers)
+}
+
+// scrapeContext bounds container sampling by the write timeout, and by the
+// scrape timeout Prometheus sends, less a margin to write the response
+func scrapeContext(r *http.Request, cfg *config.Config) (context.Context, context.CancelFunc) {
+	timeout := cfg.DockerWriteTimeout
+	if v, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil && v > 1 {
+		timeout = min(timeout, time.Duration((v-0.5)*float64(time.Second)))
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// endpointSamples are the running containers sampled on one endpoint
+type endpointSamples struct {
+	endpoint string
+	samples  []docker.ContainerSample
+	err      error
+}
+
+// sampleContainers samples the running containers of every endpoint at once
+func (app *App) sampleContainers(ctx context.Context) []endpointSamples {
+	names := make([]string, 0, len(app.endpoints))
+	for name := range app.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]endpointSamples, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			samples, err := docker.SampleRunning(ctx, app.endpoints[name], metricsConcurrency)
+			results[i] = endpointSamples{endpoint: name, samples: samples, err: err}
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "kibutsu_http_requests_total", "counter", "HTTP requests served, by method, route and status code.")
+	for _, key := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "kibutsu_http_requests_total{%s} %d\n", key, m.requests[key])
+	}
+	writeHistograms(w, "kibutsu_http_request_duration_seconds", "Time taken to serve HTTP requests, including streams, by method and route.", m.requestDurations)
+	writeHistograms(w, "kibutsu_docker_request_duration_seconds", "Time until the Docker daemon responded to API calls, by endpoint and operation.", m.dockerDurations)
+	writeHeader(w, "kibutsu_docker_request_errors_total", "counter", "Docker API calls that failed or got an error response, by endpoint and operation.")
+	for _, key := range sortedKeys(m.dockerErrors) {
+		fmt.Fprintf(w, "kibutsu_docker_request_errors_total{%s} %d\n", key, m.dockerErrors[key])
+	}
+
+	retries := docker.RetryStats()
+	writeHeader(w, "kibutsu_docker_retries_total", "counter", "Docker reads retried after a transient failure.")
+	fmt.Fprintf(w, "kibutsu_docker_retries_total %d\n", retries.Retries)
+	writeHeader(w, "kibutsu_docker_retries_exhausted_total", "counter", "Docker reads that still failed after the last retry.")
+	fmt.Fprintf(w, "kibutsu_docker_retries_exhausted_total %d\n", retries.Exhausted)
+}
+
+func writeHistograms(w io.Writer, name, help string, histograms map[string]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	for _, key := range sortedKeys(histograms) {
+		h := histograms[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, key, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, key, h.count)
+	}
+}
+
+func writeStreamMetrics(w io.Writer, streams StreamStats) {
+	writeHeader(w, "kibutsu_streams_active", "gauge", "Open streaming connections, by kind.")
+	for _, kind := range sortedKeys(streams.ByKind) {
+		fmt.Fprintf(w, "kibutsu_streams_active{%s} %d\n", labels("kind", kind), streams.ByKind[kind])
+	}
+	writeHeader(w, "kibutsu_streams_rejected_total", "counter", "Streams refused for exceeding a limit.")
+	fmt.Fprintf(w, "kibutsu_streams_rejected_total %d\n", streams.Rejected)
+}
+
+// containerMetrics are the per-container series, read from a sample
+var containerMetrics = []struct {
+	name, kind, help string
+	value            func(docker.ContainerSample) float64
+}{
+	{"kibutsu_container_cpu_percent", "gauge", "CPU usage, where 100 is one full CPU.",
+		func(s docker.ContainerSample) float64 { return s.Stats.CPU.UsagePercent }},
+	{"kibutsu_container_memory_usage_bytes", "gauge", "Memory usage in bytes.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.Memory.Usage) }},
+	{"kibutsu_container_memory_limit_bytes", "gauge", "Memory limit, or the host memory when unlimited.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.Memory.Limit) }},
+	{"kibutsu_container_network_receive_bytes_total", "counter", "Bytes received on all interfaces.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.Network.RxBytes) }},
+	{"kibutsu_container_network_transmit_bytes_total", "counter", "Bytes sent on all interfaces.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.Network.TxBytes) }},
+	{"kibutsu_container_block_read_bytes_total", "counter", "Bytes read from block devices.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.BlockIO.Read) }},
+	{"kibutsu_container_block_write_bytes_total", "counter", "Bytes written to block devices.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.BlockIO.Write) }},
+	{"kibutsu_container_pids", "gauge", "Processes running in the container.",
+		func(s docker.ContainerSample) float64 { return float64(s.Stats.PIDs) }},
+}
+
+func writeContainerMetrics(w io.Writer, results []endpointSamples) {
+	writeHeader(w, "kibutsu_endpoint_up", "gauge", "Whether the endpoint's running containers could be listed during this scrape.")
+	for _, res := range results {
+		up := 1
+		if res.err != nil && len(res.samples) == 0 {
+			up = 0
+		}
+		fmt.Fprintf(w, "kibutsu_endpoint_up{%s} %d\n", labels("endpoint", res.endpoint), up)
+	}
+
+	for _, metric := range containerMetrics {
+		writeHeader(w, metric.name, metric.kind, metric.help)
+		for _, res := range results {
+			for _, s := range res.samples {
+				key := labels("endpoint", res.endpoint, "id", shortID(s.ID), "name", s.Name, "image", s.Image)
+				fmt.Fprintf(w, "%s{%s} %s\n", metric.name, key, formatFloat(metric.value(s)))
+			}
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels renders name/value pairs as a Prometheus label set, without braces
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,290 @@
+// Package notify sends notifications about containers, images and jobs to
+// Slack, Discord, email and webhook channels, as routed by the
+// KIBUTSU_NOTIFICATIONS_FILE rules.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+// queueSize is how many notifications may wait for delivery before new
+// ones are dropped
+const queueSize = 100
+
+// cooldown is how long repeats of an event about the same container or job
+// are held back, so a crash-looping container doesn't flood the channels
+const cooldown = 10 * time.Minute
+
+// sendTimeout bounds delivery to a single channel
+const sendTimeout = 15 * time.Second
+
+var (
+	// ErrNotConfigured is returned when no notifications file is set
+	ErrNotConfigured = errors.New("no notification channels configured")
+	// ErrUnknownChannel is returned for a channel name that isn't configured
+	ErrUnknownChannel = errors.New("unknown channel")
+)
+
+// Notifier queues notifications and delivers them in the background to the
+// channels their routes pick. The channels and routes are read from the
+// live configuration on every delivery.
+type Notifier struct {
+	config *config.Store
+	client *http.Client
+	queue  chan apitypes.Notification
+
+	mu   sync.Mutex
+	sent map[string]time.Time // by event, endpoint and subject
+}
+
+func New(cfg *config.Store) *Notifier {
+	return &Notifier{
+		config: cfg,
+		client: &http.Client{Timeout: sendTimeout},
+		queue:  make(chan apitypes.Notification, queueSize),
+		sent:   make(map[string]time.Time),
+	}
+}
+
+// Notify queues msg for delivery. Repeats of the same event about the same
+// subject within the cooldown are dropped, as is everything while the queue
+// is full. A nil Notifier drops every notification.
+func (n *Notifier) Notify(msg apitypes.Notification) {
+	if n == nil || n.config.Get().Notifications == nil {
+		return
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now().UTC()
+	}
+
+	key := strings.Join([]string{msg.Event, msg.Endpoint, msg.ContainerID, msg.Job}, "\x00")
+	n.mu.Lock()
+	for k, sent := range n.sent {
+		if time.Since(sent) > cooldown {
+			delete(n.sent, k)
+		}
+	}
+	if _, recent := n.sent[key]; recent {
+		n.mu.Unlock()
+		return
+	}
+	n.sent[key] = time.Now()
+	n.mu.Unlock()
+
+	select {
+	case n.queue <- msg:
+	default:
+		slog.Warn("Notification queue is full, dropping notification", "event", msg.Event, "title", msg.Title)
+	}
+}
+
+// Run delivers queued notifications until ctx is cancelled
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-n.queue:
+			n.deliver(ctx, msg)
+		}
+	}
+}
+
+// deliver sends msg to every channel a matching route names, once each
+func (n *Notifier) deliver(ctx context.Context, msg apitypes.Notification) {
+	settings := n.config.Get().Notifications
+	if settings == nil {
+		return
+	}
+	picked := make(map[string]bool)
+	for _, route := range settings.Routes {
+		if route.Matches(msg.Event, msg.Endpoint, msg.Container) {
+			for _, name := range route.Channels {
+				picked[name] = true
+			}
+		}
+	}
+	for _, channel := range settings.Channels {
+		if !picked[channel.Name] {
+			continue
+		}
+		if err := n.send(ctx, channel, msg); err != nil {
+			slog.WarnContext(ctx, "Failed to send notification", "channel", channel.Name, "type", channel.Type, "event", msg.Event, "error", err)
+		} else {
+			slog.DebugContext(ctx, "Notification sent", "channel", channel.Name, "event", msg.Event)
+		}
+	}
+}
+
+// Test sends a test notification to the named channel, or to every channel
+// if name is empty, bypassing the routes, and reports how each went
+func (n *Notifier) Test(ctx context.Context, name, endpoint string) ([]apitypes.NotificationResult, error) {
+	settings := n.config.Get().Notifications
+	if settings == nil {
+		return nil, ErrNotConfigured
+	}
+	msg := apitypes.Notification{
+		Event:    "test",
+		Endpoint: endpoint,
+		Title:    "Test notification",
+		Message:  "Notifications from kibutsu reach this channel.",
+		Time:     time.Now().UTC(),
+	}
+
+	results := []apitypes.NotificationResult{}
+	for _, channel := range settings.Channels {
+		if name != "" && channel.Name != name {
+			continue
+		}
+		result := apitypes.NotificationResult{Channel: channel.Name, Type: channel.Type, Success: true}
+		if err := n.send(ctx, channel, msg); err != nil {
+			result.Success, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	if name != "" && len(results) == 0 {
+		return nil, fmt.Errorf("%w %q", ErrUnknownChannel, name)
+	}
+	return results, nil
+}
+
+func (n *Notifier) send(ctx context.Context, channel config.NotifyChannel, msg apitypes.Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	switch channel.Type {
+	case "slack":
+		return n.post(ctx, channel.URL, map[string]string{"text": "*" + msg.Title + "*\n" + body(msg)}, nil)
+	case "discord":
+		return n.post(ctx, channel.URL, map[string]string{"content": "**" + msg.Title + "**\n" + body(msg)}, nil)
+	case "webhook":
+		return n.post(ctx, channel.URL, msg, func(req *http.Request, data []byte) {
+			req.Header.Set("X-Kibutsu-Event", msg.Event)
+			if channel.Secret != "" {
+				mac := hmac.New(sha256.New, []byte(channel.Secret))
+				mac.Write(data)
+				req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+		})
+	case "email":
+		return sendEmail(ctx, channel, msg)
+	}
+	return fmt.Errorf("unknown channel type %q", channel.Type)
+}
+
+// post sends payload as JSON, failing on any non-2xx answer
+func (n *Notifier) post(ctx context.Context, url string, payload any, prepare func(*http.Request, []byte)) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kibutsu")
+	if prepare != nil {
+		prepare(req, data)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// sendEmail delivers msg over SMTP, with STARTTLS when the server offers it
+func sendEmail(ctx context.Context, channel config.NotifyChannel, msg apitypes.Notification) error {
+	host, _, _ := net.SplitHostPort(channel.SMTPHost)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", channel.SMTPHost)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if channel.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", channel.Username, channel.Password, host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(channel.From); err != nil {
+		return err
+	}
+	for _, to := range channel.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\n", channel.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(channel.To, ", "))
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[kibutsu] "+msg.Title))
+	fmt.Fprintf(w, "Date: %s\r\n", msg.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(w, "%s\r\n", strings.ReplaceAll(body(msg), "\n", "\r\n"))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// body is the text of a notification below its title: the message and
+// what it is about
+func body(msg apitypes.Notification) string {
+	lines := []string{msg.Message}
+	for _, detail := range [][2]string{
+		{"Endpoint", msg.Endpoint},
+		{"Container", msg.Container},
+		{"Project", msg.Project},
+		{"Job", msg.Job},
+	} {
+		if detail[1] != "" {
+			lines = append(lines, detail[0]+": "+detail[1])
+		}
+	}
+	lines = append(lines, "Time: "+msg.Time.Format(time.RFC3339))
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,270 @@
+// Package objectstore is a small client for S3-compatible buckets, enough to
+// keep backups, exports and log archives in one. Requests are signed with
+// AWS Signature Version 4.
+package objectstore
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/config"
+)
+
+// ErrNotFound is returned for an object that doesn't exist
+var ErrNotFound = errors.New("object not found")
+
+// Bucket is an S3-compatible bucket. It holds no state besides its
+// configuration, so one may be made per request.
+type Bucket struct {
+	config *config.ObjectStorage
+	client *http.Client
+}
+
+func New(cfg *config.ObjectStorage) *Bucket {
+	return &Bucket{config: cfg, client: http.DefaultClient}
+}
+
+// Put stores size bytes read from r under key, replacing any object there.
+// The payload isn't hashed, so r is read once and may be a stream.
+func (b *Bucket) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := b.request(ctx, http.MethodPut, key, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns the contents of the object under key
+func (b *Bucket) Get(ctx context.Context, key string) (io.ReadCloser, apitypes.StorageObject, error) {
+	req, err := b.request(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, apitypes.StorageObject{}, err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, apitypes.StorageObject{}, err
+	}
+	return resp.Body, describe(key, resp), nil
+}
+
+// Stat describes the object under key
+func (b *Bucket) Stat(ctx context.Context, key string) (apitypes.StorageObject, error) {
+	req, err := b.request(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return apitypes.StorageObject{}, err
+	}
+	resp.Body.Close()
+	return describe(key, resp), nil
+}
+
+// Delete removes the object under key. Removing a missing object succeeds,
+// as it does on S3.
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	req, err := b.request(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is the part of a ListObjectsV2 response that List reads
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the objects whose keys start with prefix, in key order
+func (b *Bucket) List(ctx context.Context, prefix string) ([]apitypes.StorageObject, error) {
+	list := make([]apitypes.StorageObject, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {b.key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := b.request(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			key := c.Key
+			if b.config.Prefix != "" {
+				key = strings.TrimPrefix(key, b.config.Prefix+"/")
+			}
+			list = append(list, apitypes.StorageObject{Key: key, Size: c.Size, Modified: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return list, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// key returns the full key of an object, under the configured prefix
+func (b *Bucket) key(key string) string {
+	if b.config.Prefix == "" {
+		return key
+	}
+	return b.config.Prefix + "/" + key
+}
+
+// request builds a signed request for the object under key, or for the
+// bucket itself when key is empty
+func (b *Bucket) request(ctx context.Context, method, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u, err := url.Parse(b.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	objectPath := ""
+	if key != "" {
+		objectPath = "/" + b.key(key)
+	}
+	if b.config.PathStyle {
+		u.Path = "/" + b.config.Bucket + objectPath
+	} else {
+		u.Host = b.config.Bucket + "." + u.Host
+		u.Path = objectPath
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	sign(req, b.config, time.Now().UTC())
+	return req, nil
+}
+
+// errorResponse is the body of an S3 error
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends req, turning error statuses into errors
+func (b *Bucket) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e errorResponse
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if resp.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" {
+		return nil, ErrNotFound
+	}
+	if e.Code == "" {
+		return nil, fmt.Errorf("object storage returned %s", resp.Status)
+	}
+	return nil, fmt.Errorf("object storage returned %s: %s", e.Code, e.Message)
+}
+
+// describe reads an object's size and modification time from the headers
+// of a GET or HEAD response
+func describe(key string, resp *http.Response) apitypes.StorageObject {
+	obj := apitypes.StorageObject{Key: key, Size: resp.ContentLength}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		obj.Size = size
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.Modified = modified
+	}
+	return obj
+}
+
+// escapePath percent-encodes a path as SigV4 expects, leaving slashes
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape percent-encodes everything but the unreserved characters
+func escape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// canonicalQuery encodes query sorted by name, as SigV4 expects
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kibutsu/api/handlers"
+	"kibutsu/config"
+)
+
+// streamSweepInterval is how often idle streams are looked for
+const streamSweepInterval = 30 * time.Second
+
+// streamRegistry tracks long-lived streaming connections. Each one holds a
+// goroutine and a Docker connection, so they are capped globally and per
+// client to keep a single client from exhausting the daemon.
+type streamRegistry struct {
+	mu         sync.Mutex
+	total      int
+	byClient   map[string]int
+	byKind     map[string]int
+	rejected   uint64
+	active     map[*activeStream]struct{}
+	idleClosed uint64
+}
+
+// activeStream is one registered stream. lastActive is bumped on each
+// successful write to an HTTP stream or read from its request body, or on
+// each frame read from a WebSocket client (including pongs to the server's
+// pings).
+type activeStream struct {
+	kind       string
+	client     string
+	lastActive atomic.Int64 // unix nanoseconds
+	cancel     context.CancelFunc
+
+	mu   sync.Mutex
+	conn net.Conn // set once the connection is hijacked
+}
+
+func (s *activeStream) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *activeStream) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, s.lastActive.Load()))
+}
+
+// close ends the request context, which stops the Docker stream behind it,
+// and closes a hijacked connection outright.
+func (s *activeStream) close() {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// StreamStats is a snapshot of the active streams
+type StreamStats struct {
+	Active         int            `json:"active"`
+	ByKind         map[string]int `json:"byKind"`
+	Clients        int            `json:"clients"`
+	Rejected       uint64         `json:"rejected"`
+	IdleClosed     uint64         `json:"idleClosed"`     // streams force-closed after going idle
+	IdleTimeout    string         `json:"idleTimeout"`    // "0s" means idle streams are kept
+	Limit          int            `json:"limit"`          // 0 means unlimited
+	PerClientLimit int            `json:"perClientLimit"` // 0 means unlimited
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		byClient: make(map[string]int),
+		byKind:   make(map[string]int),
+		active:   make(map[*activeStream]struct{}),
+	}
+}
+
+// acquire registers a stream for client; cancel ends it if it goes idle. It
+// returns the stream and a release func, or an error describing which limit
+// was hit.
+func (s *streamRegistry) acquire(client, kind string, limit, perClient int, cancel context.CancelFunc) (*activeStream, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit > 0 && s.total >= limit {
+		s.rejected++
+		return nil, nil, fmt.Errorf("Too many open streams: the server allows %d concurrent streams", limit)
+	}
+	if perClient > 0 && s.byClient[client] >= perClient {
+		s.rejected++
+		return nil, nil, fmt.Errorf("Too many open streams: each client may hold %d concurrent streams; close some before opening more", perClient)
+	}
+
+	s.total++
+	s.byClient[client]++
+	s.byKind[kind]++
+	stream := &activeStream{kind: kind, client: client, cancel: cancel}
+	stream.touch()
+	s.active[stream] = struct{}{}
+
+	var once sync.Once
+	return stream, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.active, stream)
+			s.total--
+			if s.byClient[client]--; s.byClient[client] == 0 {
+				delete(s.byClient, client)
+			}
+			if s.byKind[kind]--; s.byKind[kind] == 0 {
+				delete(s.byKind, kind)
+			}
+		})
+	}, nil
+}
+
+// snapshot returns the current stream counts
+func (s *streamRegistry) snapshot(cfg *config.Config) StreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byKind := make(map[string]int, len(s.byKind))
+	for k, v := range s.byKind {
+		byKind[k] = v
+	}
+	return StreamStats{
+		Active:         s.total,
+		ByKind:         byKind,
+		Clients:        len(s.byClient),
+		Rejected:       s.rejected,
+		IdleClosed:     s.idleClosed,
+		IdleTimeout:    cfg.StreamIdleTimeout.String(),
+		Limit:          cfg.MaxStreams,
+		PerClientLimit: cfg.MaxStreamsPerClient,
+	}
+}
+
+// sweep force-closes streams with no activity for longer than idle and
+// returns how many it closed.
+func (s *streamRegistry) sweep(idle time.Duration) int {
+	now := time.Now()
+	var stale []*activeStream
+
+	s.mu.Lock()
+	for stream := range s.active {
+		if stream.idleFor(now) > idle {
+			stale = append(stale, stream)
+			delete(s.active, stream) // closed once, even if the handler is slow to return
+		}
+	}
+	s.idleClosed += uint64(len(stale))
+	s.mu.Unlock()
+
+	for _, stream := range stale {
+		slog.Info("Closing idle stream", "kind", stream.kind, "client", stream.client, "idle", stream.idleFor(now).Round(time.Second))
+		stream.close()
+	}
+	return len(stale)
+}
+
+// runSweeper periodically closes streams idle for longer than the
+// configured KIBUTSU_STREAM_IDLE_TIMEOUT until ctx ends.
+func (s *streamRegistry) runSweeper(ctx context.Context, cfg *config.Store) {
+	ticker := time.NewTicker(streamSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if idle := cfg.Get().StreamIdleTimeout; idle > 0 {
+				s.sweep(idle)
+			}
+		}
+	}
+}
+
+// limitStream wraps a streaming handler so it counts against the stream
+// limits, answering 429 when they are exceeded, and can be closed by the
+// sweeper once it goes idle. Streams outlive the request timeout and the
+// server's write timeout: they end when the client goes away, the handler
+// returns or the sweeper closes them.
+func (app *App) limitStream(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.config.Get()
+		ctx, cancel := context.WithCancel(handlers.AsStream(handlers.WithoutRequestTimeout(r.Context())))
+		defer cancel()
+		stream, release, err := app.streams.acquire(clientIP(r), kind, cfg.MaxStreams, cfg.MaxStreamsPerClient, cancel)
+		if err != nil {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		// The deadline carries over to a hijacked connection, so it is
+		// cleared before WebSocket handlers get it too
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.WarnContext(r.Context(), "Failed to clear stream write deadline", "kind", kind, "error", err)
+		}
+
+		// Reading an upload counts too, so a slow one isn't taken for idle
+		r = r.WithContext(ctx)
+		r.Body = &activityBody{ReadCloser: r.Body, stream: stream}
+		next(&activityWriter{ResponseWriter: w, stream: stream}, r)
+	}
+}
+
+// activityWriter records successful writes as stream activity. A hijacked
+// connection is handed to the stream so the sweeper can close it, and only
+// reads from it count: a dead WebSocket peer still accepts writes until the
+// socket buffer fills.
+type activityWriter struct {
+	http.ResponseWriter
+	stream *activeStream
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err == nil {
+		w.stream.touch()
+	}
+	return n, err
+}
+
+func (w *activityWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *activityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.stream.mu.Lock()
+	w.stream.conn = conn
+	w.stream.mu.Unlock()
+
+	// Reads go through brw, which may already hold buffered client data
+	reader := bufio.NewReader(&activityReader{Reader: brw.Reader, stream: w.stream})
+	return conn, bufio.NewReadWriter(reader, brw.Writer), nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection
+func (w *activityWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type activityReader struct {
+	io.Reader
+	stream *activeStream
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.stream.touch()
+	}
+	return n, err
+}
+
+// activityBody records reads from a request body as stream activity
+type activityBody struct {
+	io.ReadCloser
+	stream *activeStream
+}
+
+func (b *activityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.stream.touch()
+	}
+	return n, err
+}
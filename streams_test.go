@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"kibutsu/config"
+)
+
+// An SSE stream must outlive both the request timeout and the server's
+// write timeout, which only bound ordinary requests.
+func TestLimitStreamOutlivesRequestTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:      100 * time.Millisecond,
+		MaxStreams:          10,
+		MaxStreamsPerClient: 10,
+	}, config.Options{})
+	app := &App{config: cfg, streams: newStreamRegistry()}
+
+	sse := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	srv := httptest.NewUnstartedServer(timeoutMiddleware(cfg)(app.limitStream("events", sse)))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	events := 0
+	for time.Now().Before(deadline) {
+		if !scanner.Scan() {
+			t.Fatalf("stream closed after %d events: %v", events, scanner.Err())
+		}
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			events++
+		}
+	}
+}
+
+// Closing the client's connection still ends the stream
+func TestLimitStreamEndsWithClient(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:      time.Minute,
+		MaxStreams:          10,
+		MaxStreamsPerClient: 10,
+	}, config.Options{})
+	app := &App{config: cfg, streams: newStreamRegistry()}
+
+	done := make(chan struct{})
+	sse := func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+
+	srv := httptest.NewServer(timeoutMiddleware(cfg)(app.limitStream("events", sse)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream still open after the client went away")
+	}
+}
+
+// A slow upload is activity, so the sweeper leaves it open even though
+// nothing is written back until it is done
+func TestLimitStreamUploadIsActivity(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:      time.Minute,
+		MaxStreams:          10,
+		MaxStreamsPerClient: 10,
+	}, config.Options{})
+	app := &App{config: cfg, streams: newStreamRegistry()}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				app.streams.sweep(50 * time.Millisecond)
+			}
+		}
+	}()
+
+	upload := func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil || r.Context().Err() != nil {
+			http.Error(w, "upload cut short", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, len(data))
+	}
+	srv := httptest.NewServer(timeoutMiddleware(cfg)(app.limitStream("restore", upload)))
+	defer srv.Close()
+
+	body, bodyWriter := io.Pipe()
+	go func() {
+		for i := 0; i < 15; i++ {
+			bodyWriter.Write([]byte("chunk"))
+			time.Sleep(20 * time.Millisecond)
+		}
+		bodyWriter.Close()
+	}()
+	resp, err := http.Post(srv.URL, "application/octet-stream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "75" {
+		t.Fatalf("status = %d, body %q; want the whole upload read", resp.StatusCode, got)
+	}
+}
+
+// A WebSocket stream hijacks its connection, which must not keep the
+// server's write deadline or the request timeout
+func TestLimitStreamWebSocketOutlivesRequestTimeout(t *testing.T) {
+	cfg := config.NewStore(&config.Config{
+		RequestTimeout:      100 * time.Millisecond,
+		MaxStreams:          10,
+		MaxStreamsPerClient: 10,
+	}, config.Options{})
+	app := &App{config: cfg, streams: newStreamRegistry()}
+
+	ws := func(w http.ResponseWriter, r *http.Request) {
+		websocket.Handler(func(ws *websocket.Conn) {
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			for i := 0; ; i++ {
+				if err := websocket.Message.Send(ws, fmt.Sprint(i)); err != nil {
+					return
+				}
+				select {
+				case <-ticker.C:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}).ServeHTTP(w, r)
+	}
+
+	srv := httptest.NewUnstartedServer(timeoutMiddleware(cfg)(app.limitStream("events", ws)))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	frames := 0
+	for time.Now().Before(deadline) {
+		var msg string
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			t.Fatalf("stream closed after %d frames: %v", frames, err)
+		}
+		frames++
+	}
+}
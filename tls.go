@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"kibutsu/config"
+)
+
+// certLoader serves the configured certificate, reloading it when the
+// certificate or key file changes so renewed certificates are picked up
+// without a restart
+type certLoader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *certLoader) load() (*tls.Certificate, error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cert != nil && modTimes == l.modTimes {
+		return l.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	if l.cert != nil {
+		slog.Info("Reloaded TLS certificate", "path", l.certFile)
+	}
+	l.cert = &cert
+	l.modTimes = modTimes
+	return l.cert, nil
+}
+
+// getCertificate keeps serving the previous certificate if a reload fails,
+// as happens when a renewal has replaced only one of the two files so far
+func (l *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := l.load()
+	if err != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	return cert, nil
+}
+
+// tlsConfig builds the server TLS configuration, or returns nil when TLS
+// is not configured. With ACME domains it also returns the manager that
+// obtains their certificates, whose HTTP handler answers the HTTP-01
+// challenge.
+func tlsConfig(cfg *config.Config) (*tls.Config, *autocert.Manager, error) {
+	if len(cfg.ACMEDomains) > 0 {
+		manager := acmeManager(cfg)
+		serverTLS := manager.TLSConfig()
+		serverTLS.MinVersion = tls.VersionTLS12
+		return serverTLS, manager, nil
+	}
+	if cfg.TLSCertFile == "" {
+		return nil, nil, nil
+	}
+	loader, err := newCertLoader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.getCertificate,
+	}, nil, nil
+}
+
+// acmeManager obtains and renews certificates for the configured domains
+// only, keeping them and the account key in the cache directory so restarts
+// don't request new ones
+func acmeManager(cfg *config.Config) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+	return manager
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over HTTPS on
+// the server's listen port
+func httpsRedirect(listenAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}